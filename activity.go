@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+const (
+	activityCommit = "commit"
+	activityBuild  = "build"
+	activityRun    = "run"
+	activityEdit   = "edit"
+	activityPull   = "pull"
+
+	defaultActivityLimit = 50
+)
+
+// ActivityItem is an entry of a repository's activity feed. Data is the
+// commit or build itself, or the data of the event that was recorded.
+type ActivityItem struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+var activityMu sync.Mutex
+
+func activityLogPath(repo string) string {
+	return filepath.Join(dataDir, "activity", repo+".log")
+}
+
+// recordActivity keeps the events that leave no record of their own, like
+// runs, edits and pulls, in a log per repository. Commits and builds are
+// read from git and the build records instead.
+func recordActivity(e *Event) {
+	var typ string
+	switch e.Type {
+	case eventRunStarted, eventRunFinished, eventRunFailed:
+		typ = activityRun
+	case eventRepoEdited:
+		typ = activityEdit
+	case eventRepoPulled:
+		typ = activityPull
+	default:
+		return
+	}
+	if e.Repo == "" {
+		return
+	}
+	data := map[string]interface{}{"event": e.Type}
+	for k, v := range e.Data {
+		data[k] = v
+	}
+	b, err := json.Marshal(&ActivityItem{Type: typ, Time: e.Time, Data: data})
+	if err != nil {
+		return
+	}
+
+	activityMu.Lock()
+	defer activityMu.Unlock()
+	p := activityLogPath(e.Repo)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		log.Printf("activity: %v", err)
+		return
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("activity: %v", err)
+		return
+	}
+	defer f.Close()
+	f.Write(append(b, '\n'))
+}
+
+// loggedActivity reads the recorded activity of a repository.
+func loggedActivity(repo string) ([]*ActivityItem, error) {
+	activityMu.Lock()
+	defer activityMu.Unlock()
+	f, err := os.Open(activityLogPath(repo))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var items []*ActivityItem
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		var item ActivityItem
+		if json.Unmarshal(s.Bytes(), &item) == nil {
+			items = append(items, &item)
+		}
+	}
+	return items, s.Err()
+}
+
+// getActivity merges the commits, builds, runs, edits and pulls of a
+// repository into one feed, newest first. Pass the time of the last item
+// as before to get older ones.
+func getActivity(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	q := r.URL.Query()
+	limit := defaultActivityLimit
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				errors.New("limit must be a positive integer")}
+		}
+		limit = n
+	}
+	before := time.Now().Add(time.Minute)
+	if s := q.Get("before"); s != "" {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				errors.New("before must be an RFC 3339 time")}
+		}
+		before = t
+	}
+
+	items, err := loggedActivity(id)
+	if err != nil {
+		return err
+	}
+	// A repository without commits has no log; that's not an error here.
+	commits, _ := gitLog(id, "-n", strconv.Itoa(limit),
+		"--before="+before.Format(time.RFC3339))
+	for _, c := range commits {
+		items = append(items, &ActivityItem{Type: activityCommit, Time: c.Date, Data: c})
+	}
+	builds, err := repoBuilds(id)
+	if err != nil {
+		return err
+	}
+	for _, b := range builds {
+		items = append(items, &ActivityItem{Type: activityBuild, Time: b.Started, Data: b})
+	}
+
+	feed := []*ActivityItem{}
+	for _, item := range items {
+		if item.Time.Before(before) {
+			feed = append(feed, item)
+		}
+	}
+	sort.SliceStable(feed, func(i, j int) bool {
+		return feed[i].Time.After(feed[j].Time)
+	})
+	if len(feed) > limit {
+		feed = feed[:limit]
+	}
+	return renderJSON(w, http.StatusOK, feed)
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/launchmango/backend/httputil"
+)
+
+// Log formats, chosen with the format query parameter of the log
+// endpoints. Logs are served as written by default.
+const (
+	logFormatRaw   = ""
+	logFormatPlain = "plain" // ANSI escapes removed
+	logFormatHTML  = "html"  // colors as <span> elements
+	logFormatJSON  = "json"  // lines of styled segments
+)
+
+var ansiColors = []string{"black", "red", "green", "yellow", "blue",
+	"magenta", "cyan", "white"}
+
+// ANSIStyle is the text style set by SGR escape sequences. Colors are a
+// name, "bright-" and a name, or a #rrggbb value.
+type ANSIStyle struct {
+	Bold      bool   `json:"bold,omitempty"`
+	Dim       bool   `json:"dim,omitempty"`
+	Italic    bool   `json:"italic,omitempty"`
+	Underline bool   `json:"underline,omitempty"`
+	FG        string `json:"fg,omitempty"`
+	BG        string `json:"bg,omitempty"`
+}
+
+type ANSISegment struct {
+	Text string `json:"text"`
+	ANSIStyle
+}
+
+type ANSILine struct {
+	N        int            `json:"n"`
+	Segments []*ANSISegment `json:"segments"`
+}
+
+// ansi256 returns the color for an index into the xterm 256 color palette.
+func ansi256(n int) string {
+	switch {
+	case n < 8:
+		return ansiColors[n]
+	case n < 16:
+		return "bright-" + ansiColors[n-8]
+	case n < 232:
+		n -= 16
+		level := func(c int) int {
+			if c == 0 {
+				return 0
+			}
+			return 55 + c*40
+		}
+		return fmt.Sprintf("#%02x%02x%02x", level(n/36), level(n/6%6), level(n%6))
+	default:
+		g := 8 + (n-232)*10
+		return fmt.Sprintf("#%02x%02x%02x", g, g, g)
+	}
+}
+
+// apply updates the style with the parameters of an SGR sequence.
+func (s *ANSIStyle) apply(params string) {
+	var p []int
+	for _, f := range strings.Split(params, ";") {
+		n, _ := strconv.Atoi(f)
+		p = append(p, n)
+	}
+	for i := 0; i < len(p); i++ {
+		switch n := p[i]; {
+		case n == 0:
+			*s = ANSIStyle{}
+		case n == 1:
+			s.Bold = true
+		case n == 2:
+			s.Dim = true
+		case n == 3:
+			s.Italic = true
+		case n == 4:
+			s.Underline = true
+		case n == 22:
+			s.Bold, s.Dim = false, false
+		case n == 23:
+			s.Italic = false
+		case n == 24:
+			s.Underline = false
+		case n >= 30 && n <= 37:
+			s.FG = ansiColors[n-30]
+		case n == 39:
+			s.FG = ""
+		case n >= 40 && n <= 47:
+			s.BG = ansiColors[n-40]
+		case n == 49:
+			s.BG = ""
+		case n >= 90 && n <= 97:
+			s.FG = "bright-" + ansiColors[n-90]
+		case n >= 100 && n <= 107:
+			s.BG = "bright-" + ansiColors[n-100]
+		case n == 38 || n == 48:
+			var c string
+			if i+2 < len(p) && p[i+1] == 5 {
+				c = ansi256(p[i+2] & 255)
+				i += 2
+			} else if i+4 < len(p) && p[i+1] == 2 {
+				c = fmt.Sprintf("#%02x%02x%02x", p[i+2]&255, p[i+3]&255, p[i+4]&255)
+				i += 4
+			} else {
+				i = len(p)
+				continue
+			}
+			if n == 38 {
+				s.FG = c
+			} else {
+				s.BG = c
+			}
+		}
+	}
+}
+
+// ansiParse splits a line into segments of uniformly styled text, starting
+// from and updating style. Escape sequences other than SGR, like cursor
+// movement, are dropped.
+func ansiParse(line string, style *ANSIStyle) []*ANSISegment {
+	segs := []*ANSISegment{}
+	var text strings.Builder
+	emit := func() {
+		if text.Len() > 0 {
+			segs = append(segs, &ANSISegment{Text: text.String(), ANSIStyle: *style})
+			text.Reset()
+		}
+	}
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if c != 0x1b {
+			if c != '\r' {
+				text.WriteByte(c)
+			}
+			continue
+		}
+		if i+1 >= len(line) {
+			break
+		}
+		switch line[i+1] {
+		case '[':
+			// CSI: parameters, then a final byte in 0x40-0x7e.
+			j := i + 2
+			for j < len(line) && (line[j] < 0x40 || line[j] > 0x7e) {
+				j++
+			}
+			if j >= len(line) {
+				i = len(line)
+				continue
+			}
+			if line[j] == 'm' {
+				emit()
+				style.apply(line[i+2 : j])
+			}
+			i = j
+		case ']':
+			// OSC: terminated by BEL or ESC \.
+			j := i + 2
+			for j < len(line) && line[j] != 0x07 &&
+				!(line[j] == 0x1b && j+1 < len(line) && line[j+1] == '\\') {
+				j++
+			}
+			if j < len(line) && line[j] == 0x1b {
+				j++
+			}
+			i = j
+		default:
+			i++
+		}
+	}
+	emit()
+	return segs
+}
+
+func stripANSI(line string) string {
+	if !strings.Contains(line, "\x1b") {
+		return line
+	}
+	var style ANSIStyle
+	var b strings.Builder
+	for _, s := range ansiParse(line, &style) {
+		b.WriteString(s.Text)
+	}
+	return b.String()
+}
+
+func (s *ANSIStyle) classes() (classes []string, css []string) {
+	if s.Bold {
+		classes = append(classes, "ansi-bold")
+	}
+	if s.Dim {
+		classes = append(classes, "ansi-dim")
+	}
+	if s.Italic {
+		classes = append(classes, "ansi-italic")
+	}
+	if s.Underline {
+		classes = append(classes, "ansi-underline")
+	}
+	for _, c := range []struct{ prefix, prop, color string }{
+		{"ansi-fg-", "color", s.FG}, {"ansi-bg-", "background-color", s.BG},
+	} {
+		switch {
+		case c.color == "":
+		case strings.HasPrefix(c.color, "#"):
+			css = append(css, c.prop+":"+c.color)
+		default:
+			classes = append(classes, c.prefix+c.color)
+		}
+	}
+	return classes, css
+}
+
+func ansiHTML(segs []*ANSISegment) string {
+	var b strings.Builder
+	for _, s := range segs {
+		classes, css := s.classes()
+		if len(classes) == 0 && len(css) == 0 {
+			b.WriteString(html.EscapeString(s.Text))
+			continue
+		}
+		b.WriteString("<span")
+		if len(classes) > 0 {
+			b.WriteString(` class="` + strings.Join(classes, " ") + `"`)
+		}
+		if len(css) > 0 {
+			b.WriteString(` style="` + strings.Join(css, ";") + `"`)
+		}
+		b.WriteString(">" + html.EscapeString(s.Text) + "</span>")
+	}
+	return b.String()
+}
+
+// logLine is a line of a log file with its number and, when a format
+// needs them, its styled segments.
+type logLine struct {
+	n    int
+	text string
+	segs []*ANSISegment
+}
+
+// serveLog serves the log file at p in the format asked for, or only its
+// last lines with tail. Styles carry over from one line to the next, as
+// they do in a terminal.
+func serveLog(w http.ResponseWriter, r *http.Request, p string) error {
+	q := r.URL.Query()
+	format := q.Get("format")
+	switch format {
+	case logFormatRaw, logFormatPlain, logFormatHTML, logFormatJSON:
+	default:
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("format must be plain, html or json")}
+	}
+	tail := 0
+	if t := q.Get("tail"); t != "" {
+		n, err := strconv.Atoi(t)
+		if err != nil || n <= 0 {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				errors.New("tail must be a positive integer")}
+		}
+		tail = n
+	}
+	if format == logFormatRaw && tail == 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeFile(w, r, p)
+		return nil
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errNotFound
+		}
+		return err
+	}
+	defer f.Close()
+
+	var style ANSIStyle
+	var ring []*logLine
+	var lines []*ANSILine
+	bw := bufio.NewWriter(w)
+	switch format {
+	case logFormatRaw, logFormatPlain:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	case logFormatHTML:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		bw.WriteString("<pre class=\"ansi\">")
+	case logFormatJSON:
+		lines = []*ANSILine{}
+	}
+	write := func(l *logLine) {
+		switch format {
+		case logFormatRaw:
+			bw.WriteString(l.text + "\n")
+		case logFormatPlain:
+			for _, seg := range l.segs {
+				bw.WriteString(seg.Text)
+			}
+			bw.WriteByte('\n')
+		case logFormatHTML:
+			bw.WriteString(ansiHTML(l.segs) + "\n")
+		case logFormatJSON:
+			lines = append(lines, &ANSILine{N: l.n, Segments: l.segs})
+		}
+	}
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; s.Scan(); n++ {
+		l := &logLine{n: n, text: s.Text()}
+		if format != logFormatRaw {
+			l.segs = ansiParse(l.text, &style)
+		}
+		if tail == 0 {
+			write(l)
+			continue
+		}
+		if len(ring) == tail {
+			ring = ring[1:]
+		}
+		ring = append(ring, l)
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	for _, l := range ring {
+		write(l)
+	}
+	switch format {
+	case logFormatHTML:
+		bw.WriteString("</pre>\n")
+	case logFormatJSON:
+		return renderJSON(w, http.StatusOK, lines)
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+var (
+	regexpBundleID   = regexp.MustCompile(`^[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)+$`)
+	regexpAppVersion = regexp.MustCompile(`^[0-9]+(\.[0-9]+){0,2}$`)
+	regexpPBXBare    = regexp.MustCompile(`^[A-Za-z0-9_./]+$`)
+
+	errNoXcodeProject = &httputil.HTTPError{http.StatusNotFound,
+		errors.New("repository has no Xcode project")}
+)
+
+// appSettings pairs the build settings of an Xcode project with the
+// Info.plist keys that hold the same values in older projects.
+var appSettings = []struct {
+	setting, plistKey string
+}{
+	{"PRODUCT_BUNDLE_IDENTIFIER", "CFBundleIdentifier"},
+	{"MARKETING_VERSION", "CFBundleShortVersionString"},
+	{"CURRENT_PROJECT_VERSION", "CFBundleVersion"},
+}
+
+// AppInfo is the identity and version of the app a repository builds.
+// Files lists where they were read from, relative to the repository.
+type AppInfo struct {
+	BundleID string   `json:"bundleID"`
+	Version  string   `json:"version"`
+	Build    string   `json:"build"`
+	Files    []string `json:"files"`
+}
+
+func pbxSettingRegexp(setting string) *regexp.Regexp {
+	return regexp.MustCompile(`(\b` + setting + ` = )("[^"]*"|[^;\s]*);`)
+}
+
+func pbxUnquote(v string) string {
+	return strings.Trim(v, `"`)
+}
+
+func pbxQuote(v string) string {
+	if regexpPBXBare.MatchString(v) {
+		return v
+	}
+	return `"` + v + `"`
+}
+
+// isVariable reports whether a value refers to a build setting, like
+// $(MARKETING_VERSION), rather than being a value itself.
+func isVariable(v string) bool {
+	return strings.Contains(v, "$(") || strings.Contains(v, "${")
+}
+
+// appProject returns the pbxproj of the repository's first Xcode project
+// and the Info.plist files its targets use.
+func appProject(id string) (string, []string, error) {
+	projects, _ := filepath.Glob(filepath.Join(id, "*.xcodeproj", "project.pbxproj"))
+	if len(projects) == 0 {
+		return "", nil, errNoXcodeProject
+	}
+	b, err := ioutil.ReadFile(projects[0])
+	if err != nil {
+		return "", nil, err
+	}
+	seen := make(map[string]bool)
+	var plists []string
+	for _, m := range pbxSettingRegexp("INFOPLIST_FILE").FindAllStringSubmatch(string(b), -1) {
+		v := pbxUnquote(m[2])
+		if v == "" || isVariable(v) || seen[v] {
+			continue
+		}
+		seen[v] = true
+		p, err := repoPath(id, v)
+		if err == nil && fileExists(p) {
+			plists = append(plists, p)
+		}
+	}
+	sort.Strings(plists)
+	return projects[0], plists, nil
+}
+
+// appFiles returns the files, relative to the repository, that setAppInfo
+// may change.
+func appFiles(id string) []string {
+	pbxproj, plists, err := appProject(id)
+	if err != nil {
+		return nil
+	}
+	files := []string{repoRel(id, pbxproj)}
+	for _, p := range plists {
+		files = append(files, repoRel(id, p))
+	}
+	return files
+}
+
+// appValues returns the values a project gives setting, and those of the
+// corresponding key in its Info.plist files that aren't variables.
+func appValues(pbxproj string, plists []string, setting, plistKey string) []string {
+	var values []string
+	if b, err := ioutil.ReadFile(pbxproj); err == nil {
+		for _, m := range pbxSettingRegexp(setting).FindAllStringSubmatch(string(b), -1) {
+			if v := pbxUnquote(m[2]); v != "" && !isVariable(v) {
+				values = append(values, v)
+			}
+		}
+	}
+	for _, p := range plists {
+		if v, err := plistValue(p, plistKey); err == nil && v != "" && !isVariable(v) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// appValue picks the app's value among those of every target. For bundle
+// IDs that is the shortest, since tests and extensions extend the app's;
+// for versions, the most common.
+func appValue(values []string, shortest bool) string {
+	best := ""
+	counts := make(map[string]int)
+	for _, v := range values {
+		counts[v]++
+	}
+	for _, v := range values {
+		switch {
+		case best == "":
+			best = v
+		case shortest && len(v) < len(best):
+			best = v
+		case !shortest && counts[v] > counts[best]:
+			best = v
+		}
+	}
+	return best
+}
+
+func readAppInfo(id string) (*AppInfo, error) {
+	pbxproj, plists, err := appProject(id)
+	if err != nil {
+		return nil, err
+	}
+	info := &AppInfo{Files: []string{repoRel(id, pbxproj)}}
+	for _, p := range plists {
+		info.Files = append(info.Files, repoRel(id, p))
+	}
+	for i, field := range []*string{&info.BundleID, &info.Version, &info.Build} {
+		s := appSettings[i]
+		*field = appValue(appValues(pbxproj, plists, s.setting, s.plistKey), i == 0)
+	}
+	return info, nil
+}
+
+func getAppInfo(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	defer rlockRepo(id)()
+	info, err := readAppInfo(id)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, info)
+}
+
+// updateAppInfo changes the bundle ID, version or build number of the app
+// everywhere the project sets them: the build settings of every target and
+// configuration, and Info.plist files holding values rather than variables.
+// Bundle IDs of tests and extensions that extend the app's follow it.
+func updateAppInfo(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	var req struct {
+		BundleID *string `json:"bundleID"`
+		Version  *string `json:"version"`
+		Build    *string `json:"build"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	if req.BundleID != nil && !regexpBundleID.MatchString(*req.BundleID) {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("invalid bundle ID")}
+	}
+	if req.Version != nil && !regexpAppVersion.MatchString(*req.Version) {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("version must be up to three numbers separated by periods")}
+	}
+	if req.Build != nil && !regexpAppVersion.MatchString(*req.Build) {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("build must be up to three numbers separated by periods")}
+	}
+
+	defer rlockRepo(id)()
+	if err := checkOwners(r, id, appFiles(id)...); err != nil {
+		return err
+	}
+	changed, err := setAppInfo(id, req.BundleID, req.Version, req.Build)
+	if err != nil {
+		return err
+	}
+	if len(changed) > 0 {
+		invalidateTreeCache(id)
+		publish(&Event{Type: eventRepoEdited, Repo: id,
+			Data: map[string]interface{}{"action": "appinfo", "paths": changed}})
+	}
+	info, err := readAppInfo(id)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, info)
+}
+
+// setAppInfo changes the values that aren't nil, returning the files it
+// changed. The caller holds the repository lock.
+func setAppInfo(id string, bundleID, version, build *string) ([]string, error) {
+	info, err := readAppInfo(id)
+	if err != nil {
+		return nil, err
+	}
+	pbxproj, plists, err := appProject(id)
+	if err != nil {
+		return nil, err
+	}
+	// Each replacer returns the new value of a setting given its old one,
+	// or "" to leave it.
+	replacers := make([]func(old string) string, len(appSettings))
+	if bundleID != nil && info.BundleID != "" {
+		from, to := info.BundleID, *bundleID
+		replacers[0] = func(old string) string {
+			if old == from || strings.HasPrefix(old, from+".") {
+				return to + old[len(from):]
+			}
+			return ""
+		}
+	}
+	for i, v := range []*string{nil, version, build} {
+		if v != nil {
+			to := *v
+			replacers[i] = func(string) string { return to }
+		}
+	}
+
+	b, err := ioutil.ReadFile(pbxproj)
+	if err != nil {
+		return nil, err
+	}
+	src := string(b)
+	for i, s := range appSettings {
+		replace := replacers[i]
+		if replace == nil {
+			continue
+		}
+		re := pbxSettingRegexp(s.setting)
+		src = re.ReplaceAllStringFunc(src, func(m string) string {
+			sub := re.FindStringSubmatch(m)
+			old := pbxUnquote(sub[2])
+			if isVariable(old) {
+				return m
+			}
+			if v := replace(old); v != "" {
+				return sub[1] + pbxQuote(v) + ";"
+			}
+			return m
+		})
+	}
+	changed := []string{}
+	if src != string(b) {
+		fi, err := os.Stat(pbxproj)
+		if err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(pbxproj, []byte(src), fi.Mode()); err != nil {
+			return nil, err
+		}
+		changed = append(changed, repoRel(id, pbxproj))
+	}
+	for _, p := range plists {
+		edited := false
+		for i, s := range appSettings {
+			if replacers[i] == nil {
+				continue
+			}
+			old, err := plistValue(p, s.plistKey)
+			if err != nil || isVariable(old) {
+				continue
+			}
+			if v := replacers[i](old); v != "" && v != old {
+				if err := runCmd("plutil", "-replace", s.plistKey, "-string", v, p); err != nil {
+					return nil, err
+				}
+				edited = true
+			}
+		}
+		if edited {
+			changed = append(changed, repoRel(id, p))
+		}
+	}
+
+	return changed, nil
+}
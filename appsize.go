@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+var (
+	regexpLinkMapFile   = regexp.MustCompile(`^\[\s*(\d+)\]\s+(.+)$`)
+	regexpLinkMapSymbol = regexp.MustCompile(`^0x[0-9A-Fa-f]+\s+0x([0-9A-Fa-f]+)\s+\[\s*(\d+)\]`)
+	regexpThinningSize  = regexp.MustCompile(`App size: (.+) compressed, (.+) uncompressed`)
+)
+
+// SizeReport breaks down the size of an archived app. Deltas are relative
+// to the previous report for the repository.
+type SizeReport struct {
+	ID         string             `json:"id"`
+	Created    time.Time          `json:"created"`
+	Scheme     string             `json:"scheme"`
+	Total      int64              `json:"total"`
+	Delta      int64              `json:"delta"`
+	Frameworks []*SizeItem        `json:"frameworks"`
+	Assets     []*SizeItem        `json:"assets"`
+	Modules    []*SizeItem        `json:"modules"`
+	Variants   []*ThinningVariant `json:"variants,omitempty"`
+}
+
+type SizeItem struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	Delta int64  `json:"delta"`
+}
+
+type ThinningVariant struct {
+	Name         string `json:"name"`
+	Compressed   string `json:"compressed"`
+	Uncompressed string `json:"uncompressed"`
+}
+
+func sizeReportName(id, reportID string) string {
+	return filepath.Join("sizes", id, reportID+".json")
+}
+
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err == nil && !f.IsDir() {
+			size += f.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+func sortSizeItems(m map[string]int64) []*SizeItem {
+	items := []*SizeItem{}
+	for name, size := range m {
+		items = append(items, &SizeItem{Name: name, Size: size})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Size != items[j].Size {
+			return items[i].Size > items[j].Size
+		}
+		return items[i].Name < items[j].Name
+	})
+	return items
+}
+
+// bundleSizes returns the size of the app's executable and of each embedded
+// framework and extension.
+func bundleSizes(app string) map[string]int64 {
+	sizes := make(map[string]int64)
+	var embedded int64
+	for _, sub := range []string{"Frameworks", "PlugIns", "Watch"} {
+		entries, _ := ioutil.ReadDir(filepath.Join(app, sub))
+		for _, e := range entries {
+			size := dirSize(filepath.Join(app, sub, e.Name()))
+			sizes[e.Name()] = size
+			embedded += size
+		}
+	}
+	if exe, err := plistValue(filepath.Join(app, "Info.plist"), "CFBundleExecutable"); err == nil {
+		if fi, err := os.Stat(filepath.Join(app, exe)); err == nil {
+			sizes[exe] = fi.Size()
+			embedded += fi.Size()
+		}
+	}
+	if rest := dirSize(app) - embedded; rest > 0 {
+		sizes["Resources"] = rest
+	}
+	return sizes
+}
+
+// assetSizes groups the renditions in a compiled asset catalog by name.
+func assetSizes(car string) (map[string]int64, error) {
+	out, err := exec.Command("xcrun", "assetutil", "--info", car).Output()
+	if err != nil {
+		return nil, fmt.Errorf("assetutil: %v", err)
+	}
+	var renditions []struct {
+		Name       string
+		SizeOnDisk int64
+	}
+	if err := json.Unmarshal(out, &renditions); err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64)
+	for _, r := range renditions {
+		if r.Name != "" {
+			sizes[r.Name] += r.SizeOnDisk
+		}
+	}
+	return sizes, nil
+}
+
+// linkMapModule names the library an object file in a link map came from,
+// e.g. "libPods.a" for ".../libPods.a(Foo.o)".
+func linkMapModule(file string) string {
+	if i := strings.LastIndex(file, "("); i > 0 && strings.HasSuffix(file, ")") {
+		return filepath.Base(file[:i])
+	}
+	return filepath.Base(file)
+}
+
+// linkMapSizes sums the symbol sizes in an ld link map per module.
+func linkMapSizes(path string) (map[string]int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	files := make(map[string]string)
+	sizes := make(map[string]int64)
+	section := ""
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "# ") {
+			switch {
+			case strings.HasPrefix(line, "# Object files:"):
+				section = "files"
+			case strings.HasPrefix(line, "# Symbols:"):
+				section = "symbols"
+			case strings.HasPrefix(line, "# Dead Stripped Symbols:"):
+				section = ""
+			}
+			continue
+		}
+		switch section {
+		case "files":
+			if m := regexpLinkMapFile.FindStringSubmatch(line); m != nil {
+				files[m[1]] = linkMapModule(m[2])
+			}
+		case "symbols":
+			m := regexpLinkMapSymbol.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			size, _ := strconv.ParseInt(m[1], 16, 64)
+			if name, ok := files[m[2]]; ok {
+				sizes[name] += size
+			}
+		}
+	}
+	return sizes, s.Err()
+}
+
+// thinningVariants parses the "App Thinning Size Report.txt" written when
+// an archive is exported with thinning enabled.
+func thinningVariants(path string) ([]*ThinningVariant, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var variants []*ThinningVariant
+	var cur *ThinningVariant
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "Variant: ") {
+			cur = &ThinningVariant{Name: strings.TrimPrefix(line, "Variant: ")}
+			variants = append(variants, cur)
+		} else if m := regexpThinningSize.FindStringSubmatch(line); m != nil && cur != nil {
+			cur.Compressed, cur.Uncompressed = m[1], m[2]
+		}
+	}
+	return variants, s.Err()
+}
+
+func applyDeltas(items, prev []*SizeItem) {
+	old := make(map[string]int64)
+	for _, item := range prev {
+		old[item.Name] = item.Size
+	}
+	for _, item := range items {
+		item.Delta = item.Size - old[item.Name]
+	}
+}
+
+func latestSizeReport(id string) (*SizeReport, error) {
+	reports, err := sizeReports(id)
+	if err != nil || len(reports) == 0 {
+		return nil, err
+	}
+	return reports[len(reports)-1], nil
+}
+
+// sizeReports returns the repository's size reports, oldest first.
+func sizeReports(id string) ([]*SizeReport, error) {
+	files, err := filepath.Glob(filepath.Join(dataDir, "sizes", id, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	var reports []*SizeReport
+	for _, f := range files {
+		var report SizeReport
+		if err := readJSON(sizeReportName(id, strings.TrimSuffix(filepath.Base(f), ".json")),
+			&report); err != nil {
+			return nil, err
+		}
+		reports = append(reports, &report)
+	}
+	return reports, nil
+}
+
+// analyzeSize archives scheme with a link map and measures the result. When
+// exportOptions is set the archive is also exported to get the App Thinning
+// size report.
+func analyzeSize(id, scheme, exportOptions string, opts *BuildOptions,
+	out io.Writer) (*SizeReport, error) {
+	report := &SizeReport{
+		ID:      time.Now().UTC().Format("20060102T150405"),
+		Created: time.Now(),
+		Scheme:  scheme,
+	}
+	dir, err := filepath.Abs(filepath.Join(id, "build", "size", report.ID))
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	archive := filepath.Join(dir, scheme+".xcarchive")
+	err = xcodebuild(id, opts, out, "archive", "-scheme", scheme,
+		"-destination", "generic/platform=iOS", "-archivePath", archive,
+		"LD_GENERATE_MAP_FILE=YES",
+		"LD_MAP_FILE_PATH="+filepath.Join(dir, "$(PRODUCT_NAME)-LinkMap.txt"))
+	if err != nil {
+		return nil, err
+	}
+
+	apps, _ := filepath.Glob(filepath.Join(archive, "Products", "Applications", "*.app"))
+	if len(apps) == 0 {
+		return nil, errors.New("archive contains no application")
+	}
+	app := apps[0]
+	report.Total = dirSize(app)
+	report.Frameworks = sortSizeItems(bundleSizes(app))
+
+	assets := make(map[string]int64)
+	if car := filepath.Join(app, "Assets.car"); fileExists(car) {
+		if assets, err = assetSizes(car); err != nil {
+			fmt.Fprintf(out, "warning: %v\n", err)
+		}
+	}
+	report.Assets = sortSizeItems(assets)
+
+	modules := make(map[string]int64)
+	maps, _ := filepath.Glob(filepath.Join(dir, "*-LinkMap.txt"))
+	for _, m := range maps {
+		sizes, err := linkMapSizes(m)
+		if err != nil {
+			return nil, err
+		}
+		for name, size := range sizes {
+			modules[name] += size
+		}
+	}
+	report.Modules = sortSizeItems(modules)
+
+	if exportOptions != "" {
+		export := filepath.Join(dir, "export")
+		err := xcodebuild(id, opts, out, "-exportArchive", "-archivePath", archive,
+			"-exportPath", export, "-exportOptionsPlist", exportOptions)
+		if err != nil {
+			return nil, err
+		}
+		report.Variants, err = thinningVariants(
+			filepath.Join(export, "App Thinning Size Report.txt"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	prev, err := latestSizeReport(id)
+	if err != nil {
+		return nil, err
+	}
+	if prev != nil {
+		report.Delta = report.Total - prev.Total
+		applyDeltas(report.Frameworks, prev.Frameworks)
+		applyDeltas(report.Assets, prev.Assets)
+		applyDeltas(report.Modules, prev.Modules)
+	}
+	return report, writeJSON(sizeReportName(id, report.ID), report)
+}
+
+func analyzeRepoSize(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	var req struct {
+		Scheme        string `json:"scheme"`
+		ExportOptions string `json:"exportOptions"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	if req.Scheme == "" || strings.HasPrefix(req.Scheme, "-") ||
+		strings.ContainsAny(req.Scheme, "/$") {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("scheme is required")}
+	}
+	exportOptions := ""
+	if req.ExportOptions != "" {
+		p, err := repoPath(id, req.ExportOptions)
+		if err != nil {
+			return err
+		}
+		if !fileExists(p) {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				fmt.Errorf("%s does not exist", req.ExportOptions)}
+		}
+		if exportOptions, err = filepath.Abs(p); err != nil {
+			return err
+		}
+	}
+	xcode, err := resolveXcode(id, "")
+	if err != nil {
+		return err
+	}
+
+	j := startResultJob(id, "size", func(out io.Writer) (interface{}, error) {
+		return analyzeSize(id, req.Scheme, exportOptions,
+			&BuildOptions{xcode: xcode}, out)
+	})
+	return renderJSON(w, http.StatusAccepted, j)
+}
+
+func listSizeReports(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	reports, err := sizeReports(id)
+	if err != nil {
+		return err
+	}
+	type summary struct {
+		ID      string    `json:"id"`
+		Created time.Time `json:"created"`
+		Scheme  string    `json:"scheme"`
+		Total   int64     `json:"total"`
+		Delta   int64     `json:"delta"`
+	}
+	list := []summary{}
+	for i := len(reports) - 1; i >= 0; i-- {
+		rep := reports[i]
+		list = append(list, summary{rep.ID, rep.Created, rep.Scheme, rep.Total, rep.Delta})
+	}
+	return renderJSON(w, http.StatusOK, list)
+}
+
+func getSizeReport(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	reportID := mux.Vars(r)["report"]
+	if !repoExists(id) || strings.ContainsAny(reportID, `/\.`) {
+		return errNotFound
+	}
+
+	var report SizeReport
+	if err := readJSON(sizeReportName(id, reportID), &report); err != nil {
+		return err
+	}
+	if report.ID == "" {
+		return errNotFound
+	}
+	return renderJSON(w, http.StatusOK, &report)
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+const ascAPI = "https://api.appstoreconnect.apple.com/v1"
+
+type ASCApp struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	BundleID string `json:"bundleID"`
+	SKU      string `json:"sku"`
+}
+
+type ASCBundleID struct {
+	ID         string `json:"id"`
+	Identifier string `json:"identifier"`
+	Name       string `json:"name"`
+	Platform   string `json:"platform"`
+}
+
+type ASCBuild struct {
+	ID              string    `json:"id"`
+	Version         string    `json:"version"`
+	ProcessingState string    `json:"processingState"`
+	UploadedDate    time.Time `json:"uploadedDate"`
+	Expired         bool      `json:"expired"`
+}
+
+type ascClient struct {
+	creds *ASCCredentials
+	key   *ecdsa.PrivateKey
+}
+
+type ascResource struct {
+	ID         string          `json:"id"`
+	Attributes json.RawMessage `json:"attributes"`
+}
+
+func newASCClient() (*ascClient, error) {
+	creds, err := loadASCCredentials()
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return nil, errors.New("appstoreconnect: invalid private key")
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := k.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("appstoreconnect: private key is not ECDSA")
+	}
+	return &ascClient{creds: creds, key: key}, nil
+}
+
+// token returns a short-lived ES256 JWT as required by the App Store
+// Connect API.
+func (c *ascClient) token() (string, error) {
+	enc := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{
+		"alg": "ES256",
+		"kid": c.creds.KeyID,
+		"typ": "JWT",
+	})
+	now := time.Now()
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss": c.creds.IssuerID,
+		"iat": now.Unix(),
+		"exp": now.Add(15 * time.Minute).Unix(),
+		"aud": "appstoreconnect-v1",
+	})
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signed + "." + enc.EncodeToString(sig), nil
+}
+
+func (c *ascClient) do(method, path string, body interface{}, v interface{}) error {
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, ascAPI+path, rd)
+	if err != nil {
+		return err
+	}
+	token, err := c.token()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Errors []struct {
+				Detail string `json:"detail"`
+			} `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		msg := http.StatusText(resp.StatusCode)
+		if len(e.Errors) > 0 {
+			msg = e.Errors[0].Detail
+		}
+		status := resp.StatusCode
+		if status >= 500 {
+			status = http.StatusBadGateway
+		}
+		return &httputil.HTTPError{status, fmt.Errorf("appstoreconnect: %s", msg)}
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *ascClient) list(path string) ([]ascResource, error) {
+	var page struct {
+		Data []ascResource `json:"data"`
+	}
+	if err := c.do("GET", path, nil, &page); err != nil {
+		return nil, err
+	}
+	return page.Data, nil
+}
+
+func (c *ascClient) Apps() ([]*ASCApp, error) {
+	data, err := c.list("/apps?limit=200")
+	if err != nil {
+		return nil, err
+	}
+	apps := []*ASCApp{}
+	for _, d := range data {
+		app := &ASCApp{ID: d.ID}
+		json.Unmarshal(d.Attributes, app)
+		apps = append(apps, app)
+	}
+	return apps, nil
+}
+
+func (c *ascClient) BundleIDs(identifier string) ([]*ASCBundleID, error) {
+	path := "/bundleIds?limit=200"
+	if identifier != "" {
+		path += "&filter[identifier]=" + url.QueryEscape(identifier)
+	}
+	data, err := c.list(path)
+	if err != nil {
+		return nil, err
+	}
+	ids := []*ASCBundleID{}
+	for _, d := range data {
+		b := &ASCBundleID{ID: d.ID}
+		json.Unmarshal(d.Attributes, b)
+		ids = append(ids, b)
+	}
+	return ids, nil
+}
+
+// RegisterBundleID creates the bundle ID unless one with the same
+// identifier is already registered.
+func (c *ascClient) RegisterBundleID(identifier, name, platform string) (*ASCBundleID, error) {
+	existing, err := c.BundleIDs(identifier)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range existing {
+		if b.Identifier == identifier {
+			return b, nil
+		}
+	}
+
+	var body struct {
+		Data struct {
+			Type       string      `json:"type"`
+			Attributes ASCBundleID `json:"attributes"`
+		} `json:"data"`
+	}
+	body.Data.Type = "bundleIds"
+	body.Data.Attributes = ASCBundleID{
+		Identifier: identifier,
+		Name:       name,
+		Platform:   platform,
+	}
+	var created struct {
+		Data ascResource `json:"data"`
+	}
+	if err := c.do("POST", "/bundleIds", &body, &created); err != nil {
+		return nil, err
+	}
+	b := &ASCBundleID{ID: created.Data.ID}
+	json.Unmarshal(created.Data.Attributes, b)
+	return b, nil
+}
+
+func (c *ascClient) Builds(appID string) ([]*ASCBuild, error) {
+	data, err := c.list("/builds?limit=50&sort=-uploadedDate&filter[app]=" +
+		url.QueryEscape(appID))
+	if err != nil {
+		return nil, err
+	}
+	builds := []*ASCBuild{}
+	for _, d := range data {
+		b := &ASCBuild{ID: d.ID}
+		json.Unmarshal(d.Attributes, b)
+		builds = append(builds, b)
+	}
+	return builds, nil
+}
+
+// UploadedBuild finds the most recently uploaded build of the app with
+// bundle ID bundleID whose build number is build. It returns nil if App
+// Store Connect doesn't list one, as for a while after uploading.
+func (c *ascClient) UploadedBuild(bundleID, build string) (*ASCBuild, error) {
+	apps, err := c.list("/apps?limit=1&filter[bundleId]=" + url.QueryEscape(bundleID))
+	if err != nil || len(apps) == 0 {
+		return nil, err
+	}
+	data, err := c.list("/builds?limit=1&sort=-uploadedDate&filter[app]=" +
+		url.QueryEscape(apps[0].ID) + "&filter[version]=" + url.QueryEscape(build))
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	b := &ASCBuild{ID: data[0].ID}
+	json.Unmarshal(data[0].Attributes, b)
+	return b, nil
+}
+
+func listASCApps(w http.ResponseWriter, r *http.Request) error {
+	c, err := newASCClient()
+	if err != nil {
+		return err
+	}
+	apps, err := c.Apps()
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, apps)
+}
+
+func listASCBundleIDs(w http.ResponseWriter, r *http.Request) error {
+	c, err := newASCClient()
+	if err != nil {
+		return err
+	}
+	ids, err := c.BundleIDs(r.URL.Query().Get("identifier"))
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, ids)
+}
+
+func createASCBundleID(w http.ResponseWriter, r *http.Request) error {
+	var req ASCBundleID
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	if req.Identifier == "" || req.Name == "" {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("identifier and name are required")}
+	}
+	if req.Platform == "" {
+		req.Platform = "IOS"
+	}
+
+	c, err := newASCClient()
+	if err != nil {
+		return err
+	}
+	b, err := c.RegisterBundleID(req.Identifier, req.Name, req.Platform)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, b)
+}
+
+func listASCBuilds(w http.ResponseWriter, r *http.Request) error {
+	c, err := newASCClient()
+	if err != nil {
+		return err
+	}
+	builds, err := c.Builds(mux.Vars(r)["appID"])
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, builds)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+const (
+	archiveZip   = "zip"
+	archiveTarGz = "tar.gz"
+)
+
+var archiveTypes = map[string]string{
+	archiveZip:   "application/zip",
+	archiveTarGz: "application/gzip",
+}
+
+// getRepoArchive streams the repository, or the directory named by path,
+// as a zip or gzipped tarball. With ref, the files are those committed at
+// ref, read by git archive. Without, they are the working tree, edits
+// included, leaving out .git and the directories excluded from the tree,
+// like build outputs and installed dependencies.
+func getRepoArchive(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = archiveZip
+	}
+	if _, ok := archiveTypes[format]; !ok {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("format must be zip or tar.gz")}
+	}
+	rel := ""
+	if p := q.Get("path"); strings.Trim(p, "/") != "" {
+		var err error
+		if rel, err = cleanRel(p); err != nil {
+			return err
+		}
+		if hasGitDir(rel) {
+			return errNotFound
+		}
+	}
+	ref := q.Get("ref")
+	if strings.HasPrefix(ref, "-") {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("invalid ref")}
+	}
+
+	name, err := repoName(id)
+	if err != nil {
+		return err
+	}
+	if rel != "" {
+		name = path.Base(rel)
+	}
+
+	defer rlockRepo(id)()
+	if ref != "" {
+		if _, err := gitCmd(id, "rev-parse", "--verify", "--quiet", ref+"^{commit}"); err != nil {
+			return errNotFound
+		}
+		if rel != "" {
+			if out, _ := gitCmd(id, "ls-tree", ref, "--", rel); out == "" {
+				return errNotFound
+			}
+		}
+	} else {
+		dir := id
+		if rel != "" {
+			if dir, err = repoPath(id, rel); err != nil {
+				return err
+			}
+		}
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			return errNotFound
+		}
+	}
+
+	w.Header().Set("Content-Type", archiveTypes[format])
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=%q", name+"."+format))
+	if ref != "" {
+		return gitArchive(w, id, ref, rel, name, format)
+	}
+	return treeArchive(w, id, rel, name, format)
+}
+
+// gitArchive writes the files committed at ref under rel, in a directory
+// called name.
+func gitArchive(w io.Writer, id, ref, rel, name, format string) error {
+	treeish := ref
+	if rel != "" {
+		// Archiving the subtree itself leaves out the directories above it.
+		treeish += ":" + rel
+	}
+	args := []string{"archive", "--format=" + format, "--prefix=" + name + "/", treeish}
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Dir = id
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git archive: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func skipArchivePath(rel string) bool {
+	return hasGitDir(rel) || skipTreePath(rel)
+}
+
+// treeArchive writes the working tree under rel, in a directory called
+// name.
+func treeArchive(w io.Writer, id, rel, name, format string) error {
+	dir := filepath.Join(id, filepath.FromSlash(rel))
+	if format == archiveTarGz {
+		gw := gzip.NewWriter(w)
+		tw := tar.NewWriter(gw)
+		if err := tarPath(tw, dir, name, skipArchivePath); err != nil {
+			return err
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		return gw.Close()
+	}
+
+	zw := zip.NewWriter(w)
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel != "." && skipArchivePath(rel) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		h, err := zip.FileInfoHeader(fi)
+		if err != nil {
+			return err
+		}
+		h.Name = path.Join(name, rel)
+		if fi.IsDir() {
+			h.Name += "/"
+		} else {
+			h.Method = zip.Deflate
+		}
+		hw, err := zw.CreateHeader(h)
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(hw, target)
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(hw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
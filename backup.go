@@ -0,0 +1,223 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// backupSkip lists the parts of the data directory left out of backups:
+// caches that are rebuilt on demand, and artifacts unless asked for.
+var backupSkip = map[string]bool{
+	"treecache": true,
+	"artifacts": true,
+}
+
+// createBackup streams a gzipped tarball of the server's state: the data
+// directory, with the repository metadata, settings, users, credentials,
+// secrets and logs, and with ?repos=1 the repository working trees too.
+// ?artifacts=1 includes the stored build artifacts. The secrets key is
+// included unless it comes from SECRETS_KEY, so keep backups safe.
+func createBackup(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	withRepos, withArtifacts := q.Get("repos") == "1", q.Get("artifacts") == "1"
+	var ids []string
+	if withRepos {
+		var err error
+		if ids, err = repoIDs(); err != nil {
+			return err
+		}
+	}
+
+	name := "launchmango-" + time.Now().UTC().Format("20060102T150405Z") + ".tar.gz"
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	audit("backup", "", fmt.Sprintf("repos=%t artifacts=%t", withRepos, withArtifacts))
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	err := tarPath(tw, dataDir, dataDir, func(rel string) bool {
+		top := strings.SplitN(rel, "/", 2)[0]
+		if top == "artifacts" && withArtifacts {
+			return false
+		}
+		return backupSkip[top] || strings.HasSuffix(rel, ".tmp")
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		unlock := rlockRepo(id)
+		err := tarPath(tw, id, id, nil)
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// tarPath adds the tree at dir to tw, named prefix followed by their path
+// relative to dir. skip is given those relative paths and leaves out the
+// ones it returns true for, with everything under them. Symlinks are
+// stored as links.
+func tarPath(tw *tar.Writer, dir, prefix string, skip func(rel string) bool) error {
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel != "." && skip != nil && skip(rel) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		} else if !fi.IsDir() && !fi.Mode().IsRegular() {
+			return nil
+		}
+		h, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		h.Name = path.Join(prefix, rel)
+		if fi.IsDir() {
+			h.Name += "/"
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		// Copy only the size in the header, in case the file grew.
+		_, err = io.CopyN(tw, f, h.Size)
+		return err
+	})
+}
+
+// restoreBackup unpacks a backup made by createBackup into the workspace,
+// before the server starts. Files of the data directory replace those
+// there; repositories that already exist in the workspace are kept as they
+// are. Entries that don't belong to the data directory or a repository, or
+// that would be written outside the workspace, are refused.
+func restoreBackup(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gr)
+	skipped := make(map[string]bool)
+	var files int
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := cleanRel(h.Name)
+		if err != nil {
+			return fmt.Errorf("%s: %v", h.Name, err)
+		}
+		top := strings.SplitN(rel, "/", 2)[0]
+		if top != dataDir && !validRepoID(top) {
+			return fmt.Errorf("%s: not part of a backup", h.Name)
+		}
+		if top != dataDir {
+			if _, ok := skipped[top]; !ok {
+				_, err := os.Lstat(top)
+				skipped[top] = err == nil
+				if err == nil {
+					log.Printf("restore: keeping existing repository %s", top)
+				}
+			}
+			if skipped[top] {
+				continue
+			}
+		}
+		p := filepath.FromSlash(rel)
+		// Files and links replace what is at p, so it is where they go
+		// that has to be checked; directories may be followed.
+		check := filepath.Dir(p)
+		if h.Typeflag == tar.TypeDir {
+			check = p
+		}
+		if err := confined(workspace, filepath.Join(workspace, check)); err != nil {
+			return fmt.Errorf("%s: %v", h.Name, err)
+		}
+		if err := restoreEntry(tr, h, p); err != nil {
+			return err
+		}
+		files++
+	}
+	log.Printf("restore: restored %d files from %s", files, name)
+	return nil
+}
+
+func restoreEntry(tr *tar.Reader, h *tar.Header, p string) error {
+	mode := os.FileMode(h.Mode).Perm()
+	switch h.Typeflag {
+	case tar.TypeDir:
+		return os.MkdirAll(p, mode|0700)
+	case tar.TypeSymlink:
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		os.Remove(p)
+		return os.Symlink(h.Linkname, p)
+	case tar.TypeReg:
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		// Remove what is there first, so a symlink isn't written through.
+		os.Remove(p)
+		out, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, tr); err != nil {
+			out.Close()
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+		return os.Chtimes(p, h.ModTime, h.ModTime)
+	}
+	return nil
+}
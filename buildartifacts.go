@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+var errNoAppArtifact = &httputil.HTTPError{http.StatusBadRequest,
+	errors.New("no app built; build the repository first")}
+
+// BuildArtifact is a bundle a build produced, kept zipped after the build
+// so it can be downloaded or run once the working tree has moved on.
+type BuildArtifact struct {
+	Name    string    `json:"name"`
+	Product string    `json:"product"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+func buildArtifactsDir(repo, id string) string {
+	return filepath.Join(dataDir, "builds", repo, id, "artifacts")
+}
+
+// recordArtifacts zips the apps and debug symbols among the products of a
+// successful build into its artifacts. They are named after the bundle;
+// when products of several configurations share a name, the newest is
+// kept. The caller holds the repository lock.
+func recordArtifacts(b *Build, products map[string]int64) error {
+	newest := make(map[string]string)
+	mtimes := make(map[string]time.Time)
+	for p := range products {
+		name := path.Base(p)
+		if path.Ext(name) != ".app" && path.Ext(name) != ".dSYM" {
+			continue
+		}
+		fi, err := os.Stat(filepath.Join(b.Repo, filepath.FromSlash(p)))
+		if err != nil {
+			continue
+		}
+		if _, ok := newest[name]; !ok || fi.ModTime().After(mtimes[name]) {
+			newest[name], mtimes[name] = p, fi.ModTime()
+		}
+	}
+	if len(newest) == 0 {
+		return nil
+	}
+	dir := buildArtifactsDir(b.Repo, b.ID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for name, p := range newest {
+		src := filepath.Join(b.Repo, filepath.FromSlash(p))
+		zp := filepath.Join(dir, name+".zip")
+		f, err := os.Create(zp + ".tmp")
+		if err != nil {
+			return err
+		}
+		err = zipPaths(f, filepath.Dir(src), src)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = writeJSON(artifactRecordName(b.Repo, b.ID, name),
+				&BuildArtifact{Name: name, Product: p, Created: time.Now()})
+		}
+		if err == nil {
+			err = os.Rename(zp+".tmp", zp)
+		}
+		if err != nil {
+			os.Remove(zp + ".tmp")
+			return err
+		}
+	}
+	return nil
+}
+
+func artifactRecordName(repo, id, name string) string {
+	return filepath.Join("builds", repo, id, "artifacts", name+".json")
+}
+
+// buildArtifacts returns the artifacts kept for a build, by name.
+func buildArtifacts(repo, id string) ([]*BuildArtifact, error) {
+	matches, err := filepath.Glob(filepath.Join(buildArtifactsDir(repo, id), "*.zip"))
+	if err != nil {
+		return nil, err
+	}
+	artifacts := []*BuildArtifact{}
+	for _, m := range matches {
+		name := strings.TrimSuffix(filepath.Base(m), ".zip")
+		a := &BuildArtifact{Name: name}
+		if err := readJSON(artifactRecordName(repo, id, name), a); err != nil {
+			return nil, err
+		}
+		if fi, err := os.Stat(m); err == nil {
+			a.Size = fi.Size()
+		}
+		artifacts = append(artifacts, a)
+	}
+	sort.Slice(artifacts, func(i, j int) bool {
+		return artifacts[i].Name < artifacts[j].Name
+	})
+	return artifacts, nil
+}
+
+// artifactPath returns the zip of the named artifact of a build, or "" if
+// it has none by that name.
+func artifactPath(repo, id, name string) string {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return ""
+	}
+	p := filepath.Join(buildArtifactsDir(repo, id), name+".zip")
+	if !fileExists(p) {
+		return ""
+	}
+	return p
+}
+
+func listBuildArtifacts(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	b, err := repoBuild(vars["id"], vars["build"])
+	if err != nil {
+		return err
+	}
+	if b == nil {
+		return errNotFound
+	}
+	artifacts, err := buildArtifacts(b.Repo, b.ID)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, artifacts)
+}
+
+// downloadBuildArtifact serves an artifact of a build as a zip holding the
+// bundle.
+func downloadBuildArtifact(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	b, err := repoBuild(vars["id"], vars["build"])
+	if err != nil {
+		return err
+	}
+	if b == nil {
+		return errNotFound
+	}
+	p := artifactPath(b.Repo, b.ID, vars["name"])
+	if p == "" {
+		return errNotFound
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=%q", vars["name"]+".zip"))
+	http.ServeFile(w, r, p)
+	return nil
+}
+
+// findAppArtifact returns the zip of the app a run launches: the artifact
+// named name of build, or of the newest successful build that has one.
+// Without a name, it is the app named after the project built, if any, or
+// else the only app the build produced.
+func findAppArtifact(repo, build, name, projectName string) (string, error) {
+	if name != "" && path.Ext(name) != ".app" {
+		return "", &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("artifact must be an app")}
+	}
+	var builds []*Build
+	if build != "" {
+		b, err := repoBuild(repo, build)
+		if err != nil {
+			return "", err
+		}
+		if b == nil {
+			return "", errNotFound
+		}
+		builds = []*Build{b}
+	} else {
+		var err error
+		if builds, err = repoBuilds(repo); err != nil {
+			return "", err
+		}
+	}
+	for _, b := range builds {
+		if b.State != buildSucceeded {
+			continue
+		}
+		if name != "" {
+			if p := artifactPath(repo, b.ID, name); p != "" {
+				return p, nil
+			}
+			continue
+		}
+		if p := artifactPath(repo, b.ID, projectName+".app"); p != "" {
+			return p, nil
+		}
+		apps, _ := filepath.Glob(filepath.Join(buildArtifactsDir(repo, b.ID), "*.app.zip"))
+		if len(apps) == 1 {
+			return apps[0], nil
+		}
+	}
+	if name != "" {
+		return "", &httputil.HTTPError{http.StatusNotFound,
+			fmt.Errorf("no artifact %q", name)}
+	}
+	return "", errNoAppArtifact
+}
+
+// extractApp unzips the app artifact at p into a temporary directory,
+// returning the app's path and a function removing it.
+func extractApp(p string) (string, func(), error) {
+	dir, err := ioutil.TempDir("", "launchmango-run")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	if err := unzipTo(dir, p); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return filepath.Join(dir, strings.TrimSuffix(filepath.Base(p), ".zip")), cleanup, nil
+}
+
+// useArtifact has a run launch the app artifact findAppArtifact finds,
+// returning a function removing its copy once the run is over.
+func (o *RunOptions) useArtifact(id, build, name, projectName string) (func(), error) {
+	p, err := findAppArtifact(id, build, name, projectName)
+	if err != nil {
+		return nil, err
+	}
+	app, cleanup, err := extractApp(p)
+	if err != nil {
+		return nil, err
+	}
+	o.app = app
+	return cleanup, nil
+}
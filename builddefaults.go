@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/launchmango/backend/httputil"
+)
+
+var regexpSDK = regexp.MustCompile(
+	`^(iphoneos|iphonesimulator|macosx|watchos|watchsimulator|appletvos|appletvsimulator|xros|xrsimulator)([0-9]+(\.[0-9]+)*)?$`)
+
+// xcodebuildFlags are the options that may be passed on to xcodebuild,
+// with the number of values each takes. Others, like those choosing
+// output paths or actions, would escape the build's directory.
+var xcodebuildFlags = map[string]int{
+	"-quiet":                             0,
+	"-verbose":                           0,
+	"-parallelizeTargets":                0,
+	"-jobs":                              1,
+	"-arch":                              1,
+	"-enableCodeCoverage":                1,
+	"-showBuildTimingSummary":            0,
+	"-allowProvisioningUpdates":          0,
+	"-skipPackagePluginValidation":       0,
+	"-skipMacroValidation":               0,
+	"-disableAutomaticPackageResolution": 0,
+	"-onlyUsePackageVersionsFromResolvedFile": 0,
+}
+
+// BuildDefaults are the xcodebuild choices builds make when their request
+// doesn't: the scheme and configuration, the SDK, the destination device,
+// and Flags, extra options and NAME=value build settings.
+type BuildDefaults struct {
+	Scheme        string   `json:"scheme,omitempty"`
+	Configuration string   `json:"configuration,omitempty"`
+	SDK           string   `json:"sdk,omitempty"`
+	Destination   string   `json:"destination,omitempty"`
+	Flags         []string `json:"flags,omitempty"`
+}
+
+func (d *BuildDefaults) validate() error {
+	if strings.HasPrefix(d.Scheme, "-") || strings.HasPrefix(d.Configuration, "-") {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("invalid scheme or configuration")}
+	}
+	if d.SDK != "" && !regexpSDK.MatchString(d.SDK) {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			fmt.Errorf("unknown SDK %q", d.SDK)}
+	}
+	if strings.Contains(d.Destination, ",") {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("destination must be a simulator name or UDID")}
+	}
+	for i := 0; i < len(d.Flags); i++ {
+		flag := d.Flags[i]
+		if eq := strings.Index(flag, "="); eq > 0 && regexpEnvName.MatchString(flag[:eq]) {
+			continue
+		}
+		n, ok := xcodebuildFlags[flag]
+		if !ok {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				fmt.Errorf("unsupported xcodebuild flag %q", flag)}
+		}
+		if i += n; i >= len(d.Flags) {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				fmt.Errorf("xcodebuild flag %s needs a value", flag)}
+		}
+	}
+	return nil
+}
+
+// buildDefaults returns the build defaults of project, or of the
+// repository when project is nil.
+func buildDefaults(settings *RepoSettings, project *Project) *BuildDefaults {
+	if project != nil {
+		return &BuildDefaults{Scheme: project.Scheme,
+			Configuration: project.Configuration, SDK: project.SDK,
+			Destination: project.Destination, Flags: project.Flags}
+	}
+	if settings.BuildDefaults != nil {
+		return settings.BuildDefaults
+	}
+	return &BuildDefaults{}
+}
+
+// useDefaults fills in the choices o doesn't make from d.
+func (o *BuildOptions) useDefaults(d *BuildDefaults) {
+	if o.Destination == "" {
+		o.Destination = d.Destination
+	}
+	if o.Scheme == "" {
+		o.Scheme = d.Scheme
+	}
+	if o.Configuration == "" {
+		o.Configuration = d.Configuration
+	}
+	if o.SDK == "" {
+		o.SDK = d.SDK
+	}
+	if o.Flags == nil {
+		o.Flags = d.Flags
+	}
+}
+
+// saveBuildDefaults makes d the build defaults of the project named
+// project, or of the repository.
+func saveBuildDefaults(id, project string, d *BuildDefaults) error {
+	settings, err := loadRepoSettings(id)
+	if err != nil {
+		return err
+	}
+	if project == "" {
+		settings.BuildDefaults = d
+		return saveRepoSettings(id, settings)
+	}
+	for _, p := range settings.Projects {
+		if p.Name == project {
+			p.Scheme, p.Configuration, p.SDK = d.Scheme, d.Configuration, d.SDK
+			p.Destination, p.Flags = d.Destination, d.Flags
+			return saveRepoSettings(id, settings)
+		}
+	}
+	return errNotFound
+}
+
+// readBuildBody reads the JSON body of a build request, if it has one.
+func readBuildBody(r *http.Request) (*BuildDefaults, error) {
+	var d BuildDefaults
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	return &d, d.validate()
+}
+
+// checkScheme checks the scheme and configuration chosen exist in the
+// Xcode project built in opts.
+func checkScheme(id string, opts *BuildOptions) error {
+	if opts.Scheme == "" && opts.Configuration == "" {
+		return nil
+	}
+	unlock := rlockRepo(id)
+	info, err := readXcodeProject(opts.dir(id), opts.xcode)
+	unlock()
+	if err != nil {
+		return err
+	}
+	if opts.Scheme != "" && !containsString(info.Schemes, opts.Scheme) {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			fmt.Errorf("no scheme %q (have %s)", opts.Scheme, strings.Join(info.Schemes, ", "))}
+	}
+	if opts.Configuration != "" && !containsString(info.Configurations, opts.Configuration) {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			fmt.Errorf("no configuration %q (have %s)", opts.Configuration,
+				strings.Join(info.Configurations, ", "))}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
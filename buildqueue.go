@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+const (
+	defaultBuildWorkers = 2
+	buildQueueSize      = 256
+
+	// defaultBuildTimeout is how many minutes a build may run before it is
+	// stopped.
+	defaultBuildTimeout = 60
+
+	// cancelWait is how long cancelling a running build waits for it to
+	// stop, to return its final log.
+	cancelWait = killGrace + 5*time.Second
+
+	// buildRetryAfter is when a build refused for want of a free slot is
+	// suggested to be tried again.
+	buildRetryAfter = 30 * time.Second
+
+	// buildLogTail is how much of the end of a build's log is included
+	// when polling it.
+	buildLogTail = 64 << 10
+)
+
+// A queuedBuild is a build waiting for or running on a build slot, or
+// running straight away for a request. done is closed once it is over.
+type queuedBuild struct {
+	b      *Build
+	p      buildProvider
+	opts   *BuildOptions
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// errBuildBusy refuses a build that can't start straight away, because
+// the repository is already building or every build slot is taken.
+type errBuildBusy struct {
+	*httputil.HTTPError
+	retryAfter time.Duration
+}
+
+func buildBusy(msg string) error {
+	return &errBuildBusy{&httputil.HTTPError{http.StatusTooManyRequests, errors.New(msg)},
+		buildRetryAfter}
+}
+
+var (
+	// maxBuilds is how many builds run at once, across repositories, set
+	// with -max-concurrent-builds.
+	maxBuilds      int
+	buildSlotsOnce sync.Once
+	buildSlots     chan struct{}
+
+	// repoBuildLocks holds a lock per repository building, so that builds
+	// of a repository, which share its working tree, run one at a time.
+	repoBuildLocksMu sync.Mutex
+	repoBuildLocks   = make(map[string]chan struct{})
+
+	queuedBuildsMu sync.Mutex
+	queuedBuilds   int
+
+	activeBuildsMu sync.Mutex
+	activeBuilds   = make(map[string]*queuedBuild)
+)
+
+// buildWorkers is how many builds run at once unless
+// -max-concurrent-builds says otherwise, set with BUILD_WORKERS.
+func buildWorkers() int {
+	if n, err := strconv.Atoi(os.Getenv("BUILD_WORKERS")); err == nil && n > 0 {
+		return n
+	}
+	return defaultBuildWorkers
+}
+
+// buildTimeout is how long the repository's builds may run: the minutes
+// its settings give, else those set with BUILD_TIMEOUT.
+func buildTimeout(settings *RepoSettings) time.Duration {
+	minutes := defaultBuildTimeout
+	if n, err := strconv.Atoi(os.Getenv("BUILD_TIMEOUT")); err == nil && n > 0 {
+		minutes = n
+	}
+	if settings.BuildTimeout > 0 {
+		minutes = settings.BuildTimeout
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+func slots() chan struct{} {
+	buildSlotsOnce.Do(func() {
+		n := maxBuilds
+		if n <= 0 {
+			n = buildWorkers()
+		}
+		buildSlots = make(chan struct{}, n)
+	})
+	return buildSlots
+}
+
+func repoBuildLock(repo string) chan struct{} {
+	repoBuildLocksMu.Lock()
+	defer repoBuildLocksMu.Unlock()
+	l := repoBuildLocks[repo]
+	if l == nil {
+		l = make(chan struct{}, 1)
+		repoBuildLocks[repo] = l
+	}
+	return l
+}
+
+// tryRepoBuildLock takes the repository's build lock if no build holds it,
+// keeping builds off the repository's outputs while they are cleaned up.
+func tryRepoBuildLock(repo string) (func(), bool) {
+	lock := repoBuildLock(repo)
+	select {
+	case lock <- struct{}{}:
+		return func() { <-lock }, true
+	default:
+		return nil, false
+	}
+}
+
+// acquireBuild takes the repository's build lock and then a build slot,
+// returning the function that releases them. When wait is set, it waits
+// for them until ctx is done; otherwise it fails with errBuildBusy if
+// either is taken.
+func acquireBuild(ctx context.Context, repo string, wait bool) (func(), error) {
+	lock := repoBuildLock(repo)
+	if wait {
+		select {
+		case lock <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	} else {
+		select {
+		case lock <- struct{}{}:
+		default:
+			return nil, buildBusy("the repository is already building")
+		}
+	}
+	slots := slots()
+	if wait {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			<-lock
+			return nil, ctx.Err()
+		}
+	} else {
+		select {
+		case slots <- struct{}{}:
+		default:
+			<-lock
+			return nil, buildBusy("too many builds are running; try again later")
+		}
+	}
+	return func() {
+		<-slots
+		<-lock
+	}, nil
+}
+
+// trackBuild makes b one of the active builds, which can be cancelled.
+func trackBuild(b *Build, p buildProvider, opts *BuildOptions) *queuedBuild {
+	ctx, cancel := context.WithCancel(opts.context())
+	opts.ctx = ctx
+	q := &queuedBuild{b: b, p: p, opts: opts, cancel: cancel,
+		done: make(chan struct{})}
+	activeBuildsMu.Lock()
+	activeBuilds[b.ID] = q
+	activeBuildsMu.Unlock()
+	return q
+}
+
+// untrack removes q from the active builds once it is over.
+func (q *queuedBuild) untrack() {
+	q.cancel()
+	activeBuildsMu.Lock()
+	delete(activeBuilds, q.b.ID)
+	activeBuildsMu.Unlock()
+	close(q.done)
+}
+
+// runBuild builds b straight away rather than queued, but like queued
+// builds, it can be cancelled while it runs. release, from acquireBuild,
+// is called once it is over.
+func runBuild(b *Build, p buildProvider, opts *BuildOptions, out io.Writer, release func()) error {
+	defer release()
+	q := trackBuild(b, p, opts)
+	defer q.untrack()
+	return build(b, p, opts, out)
+}
+
+// enqueueBuild queues b to be built once the repository has no other build
+// running and a build slot is free, in the order builds were queued.
+func enqueueBuild(b *Build, p buildProvider, opts *BuildOptions) error {
+	queuedBuildsMu.Lock()
+	full := queuedBuilds >= buildQueueSize
+	if !full {
+		queuedBuilds++
+	}
+	queuedBuildsMu.Unlock()
+	if full {
+		b.finish(errors.New("build queue is full"))
+		return &httputil.HTTPError{http.StatusServiceUnavailable,
+			errors.New("too many builds are queued; try again later")}
+	}
+	b.State = buildQueued
+	if err := b.save(); err != nil {
+		queuedBuildsMu.Lock()
+		queuedBuilds--
+		queuedBuildsMu.Unlock()
+		return err
+	}
+	q := trackBuild(b, p, opts)
+	go q.run()
+	return nil
+}
+
+// run waits for q's turn to build, then builds it, unless it is cancelled
+// first.
+func (q *queuedBuild) run() {
+	defer q.untrack()
+	release, err := acquireBuild(q.opts.context(), q.b.Repo, true)
+	queuedBuildsMu.Lock()
+	queuedBuilds--
+	queuedBuildsMu.Unlock()
+	if err != nil {
+		return
+	}
+	defer release()
+	q.b.start()
+	if err := build(q.b, q.p, q.opts, ioutil.Discard); err != nil {
+		log.Printf("build %s: %v", q.b.ID, err)
+	}
+}
+
+// repoBuild looks up one of a repository's builds, preferring the live
+// record of a queued or running build.
+func repoBuild(repo, id string) (*Build, error) {
+	// IDs are 16 hex digits, so shorter numbers are build numbers.
+	if n, err := strconv.Atoi(id); err == nil && len(id) < 16 {
+		return numberedBuild(repo, n)
+	}
+	activeBuildsMu.Lock()
+	q := activeBuilds[id]
+	activeBuildsMu.Unlock()
+	if q != nil && q.b.Repo == repo {
+		return q.b, nil
+	}
+	b, err := findBuild(id)
+	if err != nil || b == nil || b.Repo != repo {
+		return nil, err
+	}
+	return b, nil
+}
+
+// numberedBuild returns the repository's build numbered n, if it is still
+// in its history.
+func numberedBuild(repo string, n int) (*Build, error) {
+	activeBuildsMu.Lock()
+	for _, q := range activeBuilds {
+		if q.b.Repo == repo && q.b.Number == n {
+			activeBuildsMu.Unlock()
+			return q.b, nil
+		}
+	}
+	activeBuildsMu.Unlock()
+	builds, err := repoBuilds(repo)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range builds {
+		if b.Number == n {
+			return b, nil
+		}
+	}
+	return nil, nil
+}
+
+// buildLogTailString returns the end of the build's log.
+func buildLogTailString(b *Build) string {
+	f, err := os.Open(buildLogPath(b.Repo, b.ID))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err == nil && fi.Size() > buildLogTail {
+		f.Seek(-buildLogTail, io.SeekEnd)
+	}
+	out, _ := ioutil.ReadAll(f)
+	return string(out)
+}
+
+func queueBuild(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	p, opts, err := buildRequest(r, id)
+	if err != nil {
+		return err
+	}
+	b := newBuild(id, p.Name(), opts.project)
+	if err := enqueueBuild(b, p, opts); err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusAccepted, b)
+}
+
+func getRepoBuild(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	b, err := repoBuild(vars["id"], vars["build"])
+	if err != nil {
+		return err
+	}
+	if b == nil {
+		return errNotFound
+	}
+	return renderBuildLog(w, http.StatusOK, b)
+}
+
+// renderBuildLog renders b with the end of its log.
+func renderBuildLog(w http.ResponseWriter, status int, b *Build) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return renderJSON(w, status, &struct {
+		*Build
+		Log string `json:"log"`
+	}{b, buildLogTailString(b)})
+}
+
+// cancelBuild cancels a queued or running build, returning it with the end
+// of its log. Queued builds are marked cancelled straight away; running
+// ones once their processes exit, which the response waits for up to
+// cancelWait, answering 202 Accepted if they haven't yet.
+func cancelBuild(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	b, err := repoBuild(vars["id"], vars["build"])
+	if err != nil {
+		return err
+	}
+	if b == nil {
+		return errNotFound
+	}
+	activeBuildsMu.Lock()
+	q := activeBuilds[b.ID]
+	activeBuildsMu.Unlock()
+	if q == nil {
+		return &httputil.HTTPError{http.StatusConflict,
+			errors.New("build has already finished")}
+	}
+	q.b.mu.Lock()
+	queued := q.b.State == buildQueued
+	q.b.mu.Unlock()
+	q.cancel()
+	if queued {
+		if err := q.b.finish(errBuildCancelled); err != nil {
+			return err
+		}
+		return renderBuildLog(w, http.StatusOK, q.b)
+	}
+	select {
+	case <-q.done:
+		return renderBuildLog(w, http.StatusOK, q.b)
+	case <-time.After(cancelWait):
+		return renderBuildLog(w, http.StatusAccepted, q.b)
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+const (
+	buildQueued    = "queued"
+	buildRunning   = "running"
+	buildSucceeded = "succeeded"
+	buildFailed    = "failed"
+	buildCancelled = "cancelled"
+
+	levelError   = "error"
+	levelWarning = "warning"
+	levelNote    = "note"
+
+	defaultLogMatches = 1000
+
+	defaultBuildHistory = 100
+)
+
+var errBuildCancelled = errors.New("build cancelled")
+
+var regexpLogLevel = regexp.MustCompile(`(?:^|\s|:)(error|warning|note): `)
+
+// Build records one build of a repository. Its output is kept as a plain
+// text log next to the record so it can be searched after the fact.
+// Number counts the repository's builds, from 1. Commit is HEAD when the
+// build started, and Duration is in seconds.
+type Build struct {
+	ID       string     `json:"id"`
+	Number   int        `json:"number,omitempty"`
+	Repo     string     `json:"repo"`
+	Provider string     `json:"provider"`
+	Project  string     `json:"project,omitempty"`
+	Scheme   string     `json:"scheme,omitempty"`
+	Commit   string     `json:"commit,omitempty"`
+	State    string     `json:"state"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Duration float64    `json:"duration,omitempty"`
+	ExitCode *int       `json:"exitCode,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Lines    int        `json:"lines"`
+	Errors   int        `json:"errors"`
+	Warnings int        `json:"warnings"`
+	Cached   bool       `json:"cached,omitempty"`
+
+	// Environment is the toolchain the build ran with.
+	Environment *BuildEnvironment `json:"environment,omitempty"`
+
+	// Artifacts maps build products to their size in bytes.
+	Artifacts map[string]int64 `json:"artifacts,omitempty"`
+
+	dir string // the project's path, or "" for the repository
+	mu  sync.Mutex
+}
+
+type LogLine struct {
+	N     int    `json:"n"`
+	Level string `json:"level,omitempty"`
+	Text  string `json:"text"`
+}
+
+func buildRecordName(repo, id string) string {
+	return filepath.Join("builds", repo, id+".json")
+}
+
+func buildLogPath(repo, id string) string {
+	return filepath.Join(dataDir, "builds", repo, id+".log")
+}
+
+func logLevel(line string) string {
+	if strings.HasPrefix(line, "** ") && strings.Contains(line, "FAILED") {
+		return levelError
+	}
+	if m := regexpLogLevel.FindStringSubmatch(line); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// buildHistory is how many finished builds are kept per repository, set
+// with BUILD_HISTORY.
+func buildHistory() int {
+	if n, err := strconv.Atoi(os.Getenv("BUILD_HISTORY")); err == nil && n > 0 {
+		return n
+	}
+	return defaultBuildHistory
+}
+
+func newBuild(repo, provider string, project *Project) *Build {
+	b := &Build{
+		ID:       newID(),
+		Repo:     repo,
+		Provider: provider,
+		State:    buildRunning,
+		Started:  time.Now(),
+	}
+	if project != nil {
+		b.Project, b.dir = project.Name, project.Path
+	}
+	if _, err := updateRepoMeta(repo, func(m *RepoMeta) {
+		m.Builds++
+		b.Number = m.Builds
+	}); err != nil {
+		log.Printf("build %s: numbering: %v", b.ID, err)
+	}
+	return b
+}
+
+// start marks a queued build as running.
+func (b *Build) start() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.State = buildRunning
+	b.Started = time.Now()
+}
+
+// begin records what a build builds: the scheme, the commit checked out,
+// and the toolchain building it.
+func (b *Build) begin(scheme, commit string, env *BuildEnvironment) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.Scheme, b.Commit, b.Environment = scheme, commit, env
+}
+
+// line counts a line of output by level.
+func (b *Build) line(line string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.Lines++
+	switch logLevel(line) {
+	case levelError:
+		b.Errors++
+	case levelWarning:
+		b.Warnings++
+	}
+}
+
+func (b *Build) finish(err error) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.Finished = &now
+	b.Duration = now.Sub(b.Started).Seconds()
+	b.State = buildSucceeded
+	if exit, ok := err.(*exec.ExitError); ok {
+		code := exit.ExitCode()
+		b.ExitCode = &code
+	} else if err == nil {
+		code := 0
+		b.ExitCode = &code
+	}
+	if err == errBuildCancelled {
+		b.State = buildCancelled
+	} else if err != nil {
+		b.State = buildFailed
+		b.Error = redact(err.Error())
+	} else {
+		b.Artifacts = buildProducts(b.Repo, b.dir)
+	}
+	products := b.Artifacts
+	b.mu.Unlock()
+	if err == nil {
+		if aerr := recordArtifacts(b, products); aerr != nil {
+			log.Printf("build %s: recording artifacts: %v", b.ID, aerr)
+		}
+	}
+	if err := b.save(); err != nil {
+		return err
+	}
+	return pruneBuilds(b.Repo)
+}
+
+// pruneBuilds removes the records, logs and artifacts of the repository's
+// oldest finished builds beyond the history kept.
+func pruneBuilds(repo string) error {
+	builds, err := repoBuilds(repo)
+	if err != nil {
+		return err
+	}
+	kept := 0
+	for _, b := range builds {
+		if b.State == buildQueued || b.State == buildRunning {
+			continue
+		}
+		if kept++; kept <= buildHistory() {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Dir(buildArtifactsDir(repo, b.ID))); err != nil {
+			return err
+		}
+		if err := os.Remove(buildLogPath(repo, b.ID)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Remove(filepath.Join(dataDir, buildRecordName(repo, b.ID))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildProducts returns the sizes of the bundles and libraries in the
+// build products directories of the repository, or of the project at dir
+// within it. They are named relative to the repository.
+func buildProducts(repo, dir string) map[string]int64 {
+	products := make(map[string]int64)
+	matches, _ := filepath.Glob(filepath.Join(repo, filepath.FromSlash(dir), "build", "*", "*"))
+	for _, m := range matches {
+		switch filepath.Ext(m) {
+		case ".app", ".appex", ".framework", ".ipa", ".a", ".dylib", ".dSYM":
+			rel, err := filepath.Rel(repo, m)
+			if err == nil {
+				products[filepath.ToSlash(rel)] = dirSize(m)
+			}
+		}
+	}
+	return products
+}
+
+func (b *Build) save() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return writeJSON(buildRecordName(b.Repo, b.ID), b)
+}
+
+func (b *Build) createLog() (*os.File, error) {
+	p := buildLogPath(b.Repo, b.ID)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return nil, err
+	}
+	return os.Create(p)
+}
+
+// findBuild looks up a build by ID across repositories.
+func findBuild(id string) (*Build, error) {
+	if strings.ContainsAny(id, `/\.`) || id == "" {
+		return nil, nil
+	}
+	matches, err := filepath.Glob(filepath.Join(dataDir, "builds", "*", id+".json"))
+	if err != nil || len(matches) == 0 {
+		return nil, err
+	}
+	var b Build
+	repo := filepath.Base(filepath.Dir(matches[0]))
+	if err := readJSON(buildRecordName(repo, id), &b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// repoBuilds returns the builds of a repository, newest first.
+func repoBuilds(repo string) ([]*Build, error) {
+	matches, err := filepath.Glob(filepath.Join(dataDir, "builds", repo, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	builds := []*Build{}
+	for _, m := range matches {
+		var b Build
+		id := strings.TrimSuffix(filepath.Base(m), ".json")
+		if err := readJSON(buildRecordName(repo, id), &b); err != nil {
+			return nil, err
+		}
+		builds = append(builds, &b)
+	}
+	sort.Slice(builds, func(i, j int) bool {
+		return builds[i].Started.After(builds[j].Started)
+	})
+	return builds, nil
+}
+
+func listBuilds(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	builds, err := repoBuilds(id)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, builds)
+}
+
+func getBuild(w http.ResponseWriter, r *http.Request) error {
+	b, err := findBuild(mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+	if b == nil {
+		return errNotFound
+	}
+	return renderJSON(w, http.StatusOK, b)
+}
+
+func getBuildLog(w http.ResponseWriter, r *http.Request) error {
+	b, err := findBuild(mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+	if b == nil {
+		return errNotFound
+	}
+	return serveBuildLog(w, r, b)
+}
+
+// getRepoBuildLog serves the log of a repository's build, given by ID or
+// number.
+func getRepoBuildLog(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	b, err := repoBuild(vars["id"], vars["build"])
+	if err != nil {
+		return err
+	}
+	if b == nil {
+		return errNotFound
+	}
+	return serveBuildLog(w, r, b)
+}
+
+// serveBuildLog serves a build's log. With grep or level set, only
+// matching lines are returned, along with their line numbers, without ANSI
+// escapes.
+func serveBuildLog(w http.ResponseWriter, r *http.Request, b *Build) error {
+	p := buildLogPath(b.Repo, b.ID)
+	var err error
+
+	q := r.URL.Query()
+	grep := strings.ToLower(q.Get("grep"))
+	level := q.Get("level")
+	if grep == "" && level == "" {
+		return serveLog(w, r, p)
+	}
+	switch level {
+	case "", levelError, levelWarning, levelNote:
+	default:
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("level must be error, warning or note")}
+	}
+	limit := defaultLogMatches
+	if s := q.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				errors.New("invalid limit")}
+		}
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	matches := []*LogLine{}
+	truncated := false
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; s.Scan(); n++ {
+		line := stripANSI(s.Text())
+		lvl := logLevel(line)
+		if level != "" && lvl != level {
+			continue
+		}
+		if grep != "" && !strings.Contains(strings.ToLower(line), grep) {
+			continue
+		}
+		if len(matches) == limit {
+			truncated = true
+			break
+		}
+		matches = append(matches, &LogLine{N: n, Level: lvl, Text: line})
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, map[string]interface{}{
+		"build":     b.ID,
+		"lines":     matches,
+		"truncated": truncated,
+	})
+}
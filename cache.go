@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	artifactCacheIndex   = "cache/index.json"
+	defaultArtifactCache = 5 << 30
+)
+
+// CacheEntry describes the build products cached for one commit and build
+// configuration.
+type CacheEntry struct {
+	Repo     string    `json:"repo"`
+	Commit   string    `json:"commit"`
+	Products []string  `json:"products"`
+	Size     int64     `json:"size"`
+	Created  time.Time `json:"created"`
+	Used     time.Time `json:"used"`
+}
+
+var artifactCacheMu sync.Mutex
+
+func artifactCachePath(key string) string {
+	return filepath.Join(dataDir, "cache", key+".zip")
+}
+
+// artifactCacheLimit is the most the cache may hold, in bytes, set with
+// ARTIFACT_CACHE_SIZE.
+func artifactCacheLimit() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("ARTIFACT_CACHE_SIZE"), 10, 64); err == nil {
+		return n
+	}
+	return defaultArtifactCache
+}
+
+// artifactCacheKey returns the cache key for building the repository's
+// checked out commit with p and opts. There is none if the working tree
+// has changes, since the commit doesn't describe what would be built.
+func artifactCacheKey(id string, p buildProvider, opts *BuildOptions) (key, commit string, ok bool) {
+	commit, err := gitCmd(id, "rev-parse", "HEAD")
+	if err != nil {
+		return "", "", false
+	}
+	status, err := gitCmd(id, "status", "--porcelain", "--untracked-files=no")
+	if err != nil || status != "" {
+		return "", "", false
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n", commit, p.Name(), opts.Platform, opts.Destination)
+	if opts.Scheme != "" || opts.Configuration != "" {
+		fmt.Fprintf(h, "%s\n%s\n", opts.Scheme, opts.Configuration)
+	}
+	if opts.SDK != "" || len(opts.Flags) > 0 {
+		fmt.Fprintf(h, "%s\n%q\n", opts.SDK, opts.Flags)
+	}
+	if opts.project != nil {
+		fmt.Fprintf(h, "%s\n", opts.project.Path)
+	}
+	if opts.xcconfig != "" {
+		// The build depends on the xcconfig's contents, which needn't be
+		// committed.
+		b, err := ioutil.ReadFile(opts.xcconfig)
+		if err != nil {
+			return "", "", false
+		}
+		fmt.Fprintf(h, "%s\n%x\n", opts.xcconfig, sha256.Sum256(b))
+	}
+	if opts.xcode != nil {
+		fmt.Fprintf(h, "%s\n%s\n", opts.xcode.Version, opts.xcode.Build)
+	}
+	return hex.EncodeToString(h.Sum(nil)), commit, true
+}
+
+func loadCacheIndex() (map[string]*CacheEntry, error) {
+	index := make(map[string]*CacheEntry)
+	if err := readJSON(artifactCacheIndex, &index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// restoreArtifacts extracts the products cached under key into the
+// repository. It reports false if there is nothing cached.
+func restoreArtifacts(id, key string, out io.Writer) (bool, error) {
+	artifactCacheMu.Lock()
+	defer artifactCacheMu.Unlock()
+	index, err := loadCacheIndex()
+	if err != nil {
+		return false, err
+	}
+	e := index[key]
+	if e == nil || !fileExists(artifactCachePath(key)) {
+		return false, nil
+	}
+	for _, p := range e.Products {
+		os.RemoveAll(filepath.Join(id, filepath.FromSlash(p)))
+	}
+	if err := unzipTo(id, artifactCachePath(key)); err != nil {
+		return false, err
+	}
+	for _, p := range e.Products {
+		fmt.Fprintf(out, "Restored %s from cache\n", p)
+	}
+	e.Used = time.Now()
+	return true, writeJSON(artifactCacheIndex, index)
+}
+
+// cacheArtifacts stores the build products of the repository, or of the
+// project at dir, under key and evicts the least recently used entries
+// over the cache limit.
+func cacheArtifacts(id, dir, key, commit string) error {
+	products := buildProducts(id, dir)
+	if len(products) == 0 {
+		return nil
+	}
+	var paths []string
+	e := &CacheEntry{Repo: id, Commit: commit, Created: time.Now(), Used: time.Now()}
+	for p := range products {
+		e.Products = append(e.Products, p)
+		paths = append(paths, filepath.Join(id, filepath.FromSlash(p)))
+	}
+	sort.Strings(e.Products)
+
+	artifactCacheMu.Lock()
+	defer artifactCacheMu.Unlock()
+	p := artifactCachePath(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	f, err := os.Create(p + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = zipPaths(f, id, paths...)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(p+".tmp", p)
+	}
+	if err != nil {
+		os.Remove(p + ".tmp")
+		return err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	e.Size = fi.Size()
+
+	index, err := loadCacheIndex()
+	if err != nil {
+		return err
+	}
+	index[key] = e
+	evictArtifacts(index, artifactCacheLimit())
+	return writeJSON(artifactCacheIndex, index)
+}
+
+func evictArtifacts(index map[string]*CacheEntry, limit int64) {
+	var total int64
+	keys := make([]string, 0, len(index))
+	for k, e := range index {
+		total += e.Size
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return index[keys[i]].Used.Before(index[keys[j]].Used)
+	})
+	for _, k := range keys {
+		if total <= limit {
+			break
+		}
+		if err := os.Remove(artifactCachePath(k)); err != nil && !os.IsNotExist(err) {
+			log.Printf("cache: evicting %s: %v", k, err)
+			continue
+		}
+		total -= index[k].Size
+		delete(index, k)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+// regexpConventional matches the subject of a conventional commit, e.g.
+// "feat(login)!: add passkeys".
+var regexpConventional = regexp.MustCompile(`^([A-Za-z]+)(?:\(([^)]*)\))?(!)?:\s*(.+)$`)
+
+// changelogSections orders the sections of a changelog and titles them by
+// conventional commit type. Commits of other types, or that don't follow
+// the convention, are listed under "Other Changes".
+var changelogSections = []struct {
+	typ, title string
+}{
+	{"breaking", "Breaking Changes"},
+	{"feat", "Features"},
+	{"fix", "Bug Fixes"},
+	{"perf", "Performance"},
+	{"revert", "Reverts"},
+	{"", "Other Changes"},
+}
+
+// hiddenCommitTypes are left out of changelogs, being of no interest to
+// the app's users.
+var hiddenCommitTypes = map[string]bool{
+	"chore": true, "ci": true, "build": true, "test": true, "style": true,
+	"docs": true, "refactor": true,
+}
+
+// ChangelogEntry is a commit as listed in a changelog.
+type ChangelogEntry struct {
+	SHA      string      `json:"sha"`
+	Scope    string      `json:"scope,omitempty"`
+	Subject  string      `json:"subject"`
+	Breaking bool        `json:"breaking,omitempty"`
+	Issues   []*IssueRef `json:"issues,omitempty"`
+}
+
+type ChangelogSection struct {
+	Title   string            `json:"title"`
+	Entries []*ChangelogEntry `json:"entries"`
+}
+
+// Changelog lists the commits after From up to To by section. From is
+// empty when the changelog covers all of To's history.
+type Changelog struct {
+	From     string              `json:"from,omitempty"`
+	To       string              `json:"to"`
+	Sections []*ChangelogSection `json:"sections"`
+	Markdown string              `json:"markdown"`
+}
+
+// ChangelogRange selects the commits of a changelog, as the from and to
+// parameters of the changelog endpoint do.
+type ChangelogRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// previousTag returns the most recent tag reachable from ref, or "".
+func previousTag(id, ref string) string {
+	tag, err := gitCmd(id, "describe", "--tags", "--abbrev=0", ref)
+	if err != nil {
+		return ""
+	}
+	return tag
+}
+
+// buildChangelog groups the commits after from up to to, leaving out merges
+// and housekeeping. from defaults to the last tag before to, and to to
+// HEAD.
+func buildChangelog(id, from, to string) (*Changelog, error) {
+	if to == "" {
+		to = "HEAD"
+	}
+	for _, ref := range []string{from, to} {
+		if strings.HasPrefix(ref, "-") {
+			return nil, &httputil.HTTPError{http.StatusBadRequest,
+				errors.New("invalid ref")}
+		}
+		if ref == "" {
+			continue
+		}
+		if _, err := gitCmd(id, "rev-parse", "--verify", "--quiet", ref+"^{commit}"); err != nil {
+			return nil, &httputil.HTTPError{http.StatusNotFound,
+				fmt.Errorf("unknown ref %s", ref)}
+		}
+	}
+	if from == "" {
+		// The tag on to itself is the release the changelog is for.
+		from = previousTag(id, to+"^")
+	}
+	rng := to
+	if from != "" {
+		rng = from + ".." + to
+	}
+	commits, err := gitLog(id, "--no-merges", rng)
+	if err != nil {
+		return nil, err
+	}
+
+	linker := newIssueLinker(id)
+	byType := make(map[string][]*ChangelogEntry)
+	for _, c := range commits {
+		e := &ChangelogEntry{SHA: c.SHA, Subject: c.Subject,
+			Issues: linker.find(c.Subject, c.Body)}
+		typ := ""
+		if m := regexpConventional.FindStringSubmatch(c.Subject); m != nil {
+			typ = strings.ToLower(m[1])
+			e.Scope, e.Subject, e.Breaking = m[2], m[4], m[3] == "!"
+		}
+		if strings.Contains(c.Body, "BREAKING CHANGE:") ||
+			strings.Contains(c.Body, "BREAKING-CHANGE:") {
+			e.Breaking = true
+		}
+		switch {
+		case e.Breaking:
+			typ = "breaking"
+		case hiddenCommitTypes[typ]:
+			continue
+		}
+		known := false
+		for _, s := range changelogSections {
+			known = known || s.typ == typ
+		}
+		if !known {
+			typ = ""
+		}
+		byType[typ] = append(byType[typ], e)
+	}
+
+	cl := &Changelog{From: from, To: to, Sections: []*ChangelogSection{}}
+	for _, s := range changelogSections {
+		if entries := byType[s.typ]; len(entries) > 0 {
+			cl.Sections = append(cl.Sections, &ChangelogSection{Title: s.title, Entries: entries})
+		}
+	}
+	cl.Markdown = cl.markdown()
+	return cl, nil
+}
+
+func (cl *Changelog) markdown() string {
+	var b strings.Builder
+	for i, s := range cl.Sections {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "### %s\n\n", s.Title)
+		for _, e := range s.Entries {
+			b.WriteString("- ")
+			if e.Scope != "" {
+				fmt.Fprintf(&b, "**%s:** ", e.Scope)
+			}
+			b.WriteString(e.Subject)
+			for _, ref := range e.Issues {
+				if ref.URL != "" {
+					fmt.Fprintf(&b, " ([%s](%s))", ref.Key, ref.URL)
+				} else {
+					fmt.Fprintf(&b, " (%s)", ref.Key)
+				}
+			}
+			fmt.Fprintf(&b, " (%s)\n", e.SHA[:7])
+		}
+	}
+	return b.String()
+}
+
+// getChangelog renders the changelog between two refs, as JSON or, with
+// format=md, as Markdown alone.
+func getChangelog(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	q := r.URL.Query()
+	defer rlockRepo(id)()
+	cl, err := buildChangelog(id, q.Get("from"), q.Get("to"))
+	if err != nil {
+		return err
+	}
+	if q.Get("format") == "md" {
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		_, err := w.Write([]byte(cl.Markdown))
+		return err
+	}
+	return renderJSON(w, http.StatusOK, cl)
+}
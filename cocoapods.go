@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+const (
+	cocoapodsIndexURL = "https://cdn.cocoapods.org/all_pods.txt"
+	cocoapodsIndexTTL = 6 * time.Hour
+	podSearchLimit    = 50
+)
+
+var (
+	regexpPodName    = regexp.MustCompile(`^[A-Za-z0-9_.+-]+(/[A-Za-z0-9_.+-]+)?$`)
+	regexpPodVersion = regexp.MustCompile(`^[~<>=! ]*[0-9A-Za-z.+-]+$`)
+	regexpPodLine    = regexp.MustCompile(
+		`^\s*pod\s+['"]([^'"]+)['"](?:\s*,\s*['"]([^'"]+)['"])?`)
+	regexpPodTarget = regexp.MustCompile(`^\s*target\s+['"]([^'"]+)['"]\s+do`)
+
+	errNoPodfile = &httputil.HTTPError{http.StatusNotFound,
+		errors.New("repository has no Podfile")}
+
+	podIndexMu      sync.Mutex
+	podIndex        []string
+	podIndexFetched time.Time
+)
+
+type Pod struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	Target  string `json:"target,omitempty"`
+}
+
+func cocoapodsIndex() ([]string, error) {
+	podIndexMu.Lock()
+	defer podIndexMu.Unlock()
+	if podIndex != nil && time.Since(podIndexFetched) < cocoapodsIndexTTL {
+		return podIndex, nil
+	}
+
+	resp, err := http.Get(cocoapodsIndexURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &httputil.HTTPError{http.StatusBadGateway,
+			fmt.Errorf("cocoapods index: %s", resp.Status)}
+	}
+	var names []string
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		if name := strings.TrimSpace(sc.Text()); name != "" {
+			names = append(names, name)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	podIndex, podIndexFetched = names, time.Now()
+	return podIndex, nil
+}
+
+func searchPods(w http.ResponseWriter, r *http.Request) error {
+	q := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
+	if q == "" {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("q is required")}
+	}
+	index, err := cocoapodsIndex()
+	if err != nil {
+		return err
+	}
+
+	// Prefix matches rank ahead of substring matches.
+	var prefix, other []string
+	for _, name := range index {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, q) {
+			prefix = append(prefix, name)
+		} else if strings.Contains(lower, q) {
+			other = append(other, name)
+		}
+		if len(prefix) >= podSearchLimit {
+			break
+		}
+	}
+	results := append(prefix, other...)
+	if len(results) > podSearchLimit {
+		results = results[:podSearchLimit]
+	}
+	if results == nil {
+		results = []string{}
+	}
+	return renderJSON(w, http.StatusOK, results)
+}
+
+func readPodfile(id string) ([]string, os.FileMode, error) {
+	path := filepath.Join(id, "Podfile")
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, errNoPodfile
+		}
+		return nil, 0, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	return strings.Split(string(b), "\n"), fi.Mode(), nil
+}
+
+func writePodfile(id string, lines []string, mode os.FileMode) error {
+	return ioutil.WriteFile(filepath.Join(id, "Podfile"),
+		[]byte(strings.Join(lines, "\n")), mode)
+}
+
+func parsePods(lines []string) []*Pod {
+	pods := []*Pod{}
+	var target string
+	for _, line := range lines {
+		if m := regexpPodTarget.FindStringSubmatch(line); m != nil {
+			target = m[1]
+			continue
+		}
+		if m := regexpPodLine.FindStringSubmatch(line); m != nil {
+			pods = append(pods, &Pod{Name: m[1], Version: m[2], Target: target})
+		}
+	}
+	return pods
+}
+
+func podInstall(id string) *Job {
+	return startJob(id, "pod-install", func(out io.Writer) error {
+		return runCmdIn(id, out, "pod", "install")
+	})
+}
+
+func listPods(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	lines, _, err := readPodfile(id)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, parsePods(lines))
+}
+
+func addPod(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	var pod Pod
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&pod); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	if !regexpPodName.MatchString(pod.Name) {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("invalid pod name")}
+	}
+	if pod.Version != "" && !regexpPodVersion.MatchString(pod.Version) {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("invalid pod version requirement")}
+	}
+
+	if err := checkOwners(r, id, "Podfile"); err != nil {
+		return err
+	}
+	defer rlockRepo(id)()
+	lines, mode, err := readPodfile(id)
+	if err != nil {
+		return err
+	}
+	for _, p := range parsePods(lines) {
+		if p.Name == pod.Name {
+			return &httputil.HTTPError{http.StatusConflict,
+				fmt.Errorf("%s is already in the Podfile", pod.Name)}
+		}
+	}
+
+	// Insert after the opening line of the requested target, or of the
+	// first target when none was given.
+	at := -1
+	for i, line := range lines {
+		m := regexpPodTarget.FindStringSubmatch(line)
+		if m != nil && (pod.Target == "" || m[1] == pod.Target) {
+			at, pod.Target = i+1, m[1]
+			break
+		}
+	}
+	if at < 0 {
+		if pod.Target != "" {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				fmt.Errorf("target %s not found in Podfile", pod.Target)}
+		}
+		at = len(lines)
+	}
+	line := fmt.Sprintf("  pod '%s'", pod.Name)
+	if pod.Version != "" {
+		line += fmt.Sprintf(", '%s'", pod.Version)
+	}
+	lines = append(lines[:at], append([]string{line}, lines[at:]...)...)
+
+	if err := writePodfile(id, lines, mode); err != nil {
+		return err
+	}
+	invalidateTreeCache(id)
+	return renderJSON(w, http.StatusAccepted, podInstall(id))
+}
+
+func removePod(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	name := mux.Vars(r)["name"]
+	if err := checkOwners(r, id, "Podfile"); err != nil {
+		return err
+	}
+	defer rlockRepo(id)()
+
+	lines, mode, err := readPodfile(id)
+	if err != nil {
+		return err
+	}
+	kept := lines[:0]
+	removed := false
+	for _, line := range lines {
+		if m := regexpPodLine.FindStringSubmatch(line); m != nil && m[1] == name {
+			removed = true
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if !removed {
+		return errNotFound
+	}
+
+	if err := writePodfile(id, kept, mode); err != nil {
+		return err
+	}
+	invalidateTreeCache(id)
+	return renderJSON(w, http.StatusAccepted, podInstall(id))
+}
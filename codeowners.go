@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/launchmango/backend/httputil"
+)
+
+// An OwnerRule gives the files matching Pattern to Owners, user names. As
+// in CODEOWNERS files, the last rule matching a file wins, a pattern
+// matching a directory covers everything in it, a pattern with no slash
+// but a trailing one matches at any depth, and a rule without owners
+// leaves the files it matches unowned.
+type OwnerRule struct {
+	Pattern string   `json:"pattern"`
+	Owners  []string `json:"owners"`
+}
+
+// CodeOwners protects a repository's files from changes by users who
+// don't own them. Without Approval, their writes and commits are refused.
+// With it, they may edit files in the working tree, but committing the
+// changes waits until an owner approves.
+type CodeOwners struct {
+	Rules    []*OwnerRule `json:"rules"`
+	Approval bool         `json:"approval,omitempty"`
+}
+
+func validateCodeOwners(co *CodeOwners) error {
+	if co == nil {
+		return nil
+	}
+	for _, rule := range co.Rules {
+		if rule == nil || strings.Trim(rule.Pattern, "/") == "" {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				errors.New("code owner rules need a pattern")}
+		}
+		for _, owner := range rule.Owners {
+			if !regexpUserName.MatchString(owner) {
+				return &httputil.HTTPError{http.StatusBadRequest,
+					fmt.Errorf("invalid owner %q", owner)}
+			}
+		}
+	}
+	return nil
+}
+
+// owners returns the owners of the file at rel, or nil if it has none.
+func (co *CodeOwners) owners(rel string) []string {
+	var owners []string
+	for _, rule := range co.Rules {
+		anchored := strings.Contains(strings.TrimSuffix(rule.Pattern, "/"), "/")
+		pattern := strings.Trim(rule.Pattern, "/")
+		if !anchored {
+			pattern = "**/" + pattern
+		}
+		if matchPathGlob(pattern+"/**", rel) {
+			owners = rule.Owners
+		}
+	}
+	return owners
+}
+
+// requestUser returns the name of the user making a request.
+func requestUser(r *http.Request) string {
+	return r.URL.Query().Get("user")
+}
+
+func loadCodeOwners(id string) (*CodeOwners, error) {
+	settings, err := loadRepoSettings(id)
+	if err != nil {
+		return nil, err
+	}
+	if settings.CodeOwners == nil || len(settings.CodeOwners.Rules) == 0 {
+		return nil, nil
+	}
+	return settings.CodeOwners, nil
+}
+
+// ownedByOthers returns the paths, and the files under those that are
+// directories, that user doesn't own, with their owners.
+func ownedByOthers(id string, co *CodeOwners, user string, paths []string) map[string][]string {
+	owned := make(map[string][]string)
+	check := func(rel string) {
+		if owners := co.owners(rel); len(owners) > 0 && !containsString(owners, user) {
+			owned[rel] = owners
+		}
+	}
+	for _, rel := range paths {
+		check(rel)
+		dir := filepath.Join(id, filepath.FromSlash(rel))
+		if fi, err := os.Lstat(dir); err != nil || !fi.IsDir() {
+			continue
+		}
+		filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			rel := repoRel(id, p)
+			if hasGitDir(rel) {
+				return filepath.SkipDir
+			}
+			if !fi.IsDir() {
+				check(rel)
+			}
+			return nil
+		})
+	}
+	return owned
+}
+
+// treePaths returns rel, and were the file or directory at p moved there,
+// the paths of the files under it.
+func treePaths(p, rel string) []string {
+	paths := []string{rel}
+	filepath.Walk(p, func(sub string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() && sub != p {
+			paths = append(paths, path.Join(rel, filepath.ToSlash(sub[len(p)+1:])))
+		}
+		return nil
+	})
+	return paths
+}
+
+func ownedError(owned map[string][]string) error {
+	var paths []string
+	for p := range owned {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return &httputil.HTTPError{http.StatusForbidden,
+		fmt.Errorf("%s is owned by %s", paths[0], strings.Join(owned[paths[0]], ", "))}
+}
+
+// checkOwners refuses a change to the working tree touching paths,
+// relative to the repository, that the requesting user doesn't own,
+// unless owners approve commits instead.
+func checkOwners(r *http.Request, id string, paths ...string) error {
+	co, err := loadCodeOwners(id)
+	if err != nil || co == nil || co.Approval {
+		return err
+	}
+	if owned := ownedByOthers(id, co, requestUser(r), paths); len(owned) > 0 {
+		return ownedError(owned)
+	}
+	return nil
+}
+
+// checkCodeOwnersChange refuses to replace the code owners co with to
+// unless the requesting user is one of the owners co names, so the users
+// the rules protect files from can't lift them.
+func checkCodeOwnersChange(r *http.Request, co, to *CodeOwners) error {
+	if co == nil || reflect.DeepEqual(co, to) {
+		return nil
+	}
+	user := requestUser(r)
+	owned := false
+	for _, rule := range co.Rules {
+		if user != "" && containsString(rule.Owners, user) {
+			return nil
+		}
+		owned = owned || len(rule.Owners) > 0
+	}
+	if !owned {
+		return nil
+	}
+	return &httputil.HTTPError{http.StatusForbidden,
+		errors.New("only code owners may change the code owners")}
+}
+
+// checkCommitOwners checks a commit of the changed files. It returns the
+// files that need approval, or an error if they may not be committed.
+func checkCommitOwners(r *http.Request, id string, changed []string) (map[string][]string, error) {
+	co, err := loadCodeOwners(id)
+	if err != nil || co == nil {
+		return nil, err
+	}
+	user := requestUser(r)
+	owned := ownedByOthers(id, co, user, changed)
+	switch {
+	case len(owned) == 0:
+		return nil, nil
+	case !co.Approval:
+		return nil, ownedError(owned)
+	case user == "":
+		return nil, &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("user is required to request approval")}
+	}
+	return owned, nil
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+const defaultCommitLimit = 50
+
+type Commit struct {
+	SHA     string      `json:"sha"`
+	Author  string      `json:"author"`
+	Email   string      `json:"email"`
+	Date    time.Time   `json:"date"`
+	Subject string      `json:"subject"`
+	Body    string      `json:"body,omitempty"`
+	Issues  []*IssueRef `json:"issues,omitempty"`
+}
+
+// gitLog returns commits reachable from HEAD, newest first. Fields are
+// separated with ASCII unit/record separators so any message parses.
+func gitLog(id string, arg ...string) ([]*Commit, error) {
+	args := append([]string{"log",
+		"--format=%H%x1f%an%x1f%ae%x1f%aI%x1f%s%x1f%b%x1e"}, arg...)
+	out, err := gitCmd(id, args...)
+	if err != nil {
+		return nil, err
+	}
+	commits := []*Commit{}
+	for _, rec := range strings.Split(out, "\x1e") {
+		f := strings.Split(strings.TrimSpace(rec), "\x1f")
+		if len(f) != 6 {
+			continue
+		}
+		date, _ := time.Parse(time.RFC3339, f[3])
+		commits = append(commits, &Commit{
+			SHA:     f[0],
+			Author:  f[1],
+			Email:   f[2],
+			Date:    date,
+			Subject: f[4],
+			Body:    strings.TrimSpace(f[5]),
+		})
+	}
+	return commits, nil
+}
+
+// listCommits pages through the history of HEAD, newest first, or with
+// path that of a file, across renames, or directory.
+func listCommits(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	q := r.URL.Query()
+	limit := defaultCommitLimit
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				errors.New("limit must be a positive integer")}
+		}
+		limit = n
+	}
+	skip := 0
+	if s := q.Get("skip"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				errors.New("skip must be a non-negative integer")}
+		}
+		skip = n
+	}
+	args := []string{"-n", strconv.Itoa(limit), "--skip", strconv.Itoa(skip)}
+	if p := q.Get("path"); strings.Trim(p, "/") != "" {
+		rel, err := cleanRel(p)
+		if err != nil {
+			return err
+		}
+		if hasGitDir(rel) {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				errors.New("invalid path " + p)}
+		}
+		// Following renames takes a single file.
+		if fi, err := os.Stat(filepath.Join(id, filepath.FromSlash(rel))); err == nil && !fi.IsDir() {
+			args = append(args, "--follow")
+		}
+		args = append(args, "--", rel)
+	}
+
+	defer rlockRepo(id)()
+	commits, err := gitLog(id, args...)
+	if err != nil {
+		return err
+	}
+	linker := newIssueLinker(id)
+	for _, c := range commits {
+		c.Issues = linker.find(c.Subject, c.Body)
+	}
+	return renderJSON(w, http.StatusOK, commits)
+}
+
+// CommitFile is a file a commit changed, and how. Additions and
+// deletions are counted in lines and are zero for binary files. From is
+// the path of a renamed or copied file before the commit.
+type CommitFile struct {
+	Path      string `json:"path"`
+	From      string `json:"from,omitempty"`
+	Status    string `json:"status"`
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+	Binary    bool   `json:"binary,omitempty"`
+}
+
+// CommitDetail is a commit with its parents and the files it changed,
+// compared with its first parent.
+type CommitDetail struct {
+	*Commit
+	Parents   []string      `json:"parents"`
+	Files     []*CommitFile `json:"files"`
+	Additions int           `json:"additions"`
+	Deletions int           `json:"deletions"`
+}
+
+// commitFiles returns the files sha changed compared with its first
+// parent, or all of them for a root commit.
+func commitFiles(id, sha string, parents []string) ([]*CommitFile, error) {
+	args := []string{"diff-tree", "-r", "-M", "-z", "--no-commit-id"}
+	if len(parents) == 0 {
+		args = append(args, "--root", sha)
+	} else {
+		args = append(args, parents[0], sha)
+	}
+	out, err := gitOutput(id, nil, append(args, "--name-status")...)
+	if err != nil {
+		return nil, err
+	}
+	files := []*CommitFile{}
+	byPath := make(map[string]*CommitFile)
+	fields := strings.Split(string(out), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		code := fields[i]
+		if code == "" {
+			break
+		}
+		f := &CommitFile{Path: fields[i+1], Status: statusNames[code[0]]}
+		if (code[0] == 'R' || code[0] == 'C') && i+2 < len(fields) {
+			f.From, f.Path = f.Path, fields[i+2]
+			i++
+		}
+		files = append(files, f)
+		byPath[f.Path] = f
+	}
+
+	out, err = gitOutput(id, nil, append(args, "--numstat")...)
+	if err != nil {
+		return nil, err
+	}
+	fields = strings.Split(string(out), "\x00")
+	for i := 0; i < len(fields); i++ {
+		// Each file is "added\tdeleted\tpath", or for renames and copies
+		// "added\tdeleted\t" followed by both paths as fields of their own.
+		stat := strings.SplitN(fields[i], "\t", 3)
+		if len(stat) != 3 {
+			continue
+		}
+		path := stat[2]
+		if path == "" && i+2 < len(fields) {
+			path = fields[i+2]
+			i += 2
+		}
+		f := byPath[path]
+		if f == nil {
+			continue
+		}
+		if stat[0] == "-" {
+			f.Binary = true
+			continue
+		}
+		f.Additions, _ = strconv.Atoi(stat[0])
+		f.Deletions, _ = strconv.Atoi(stat[1])
+	}
+	return files, nil
+}
+
+func getCommit(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	ref := mux.Vars(r)["sha"]
+	if strings.HasPrefix(ref, "-") {
+		return errNotFound
+	}
+
+	defer rlockRepo(id)()
+	sha, err := gitCmd(id, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		return errNotFound
+	}
+	commits, err := gitLog(id, "-n", "1", sha)
+	if err != nil {
+		return err
+	}
+	if len(commits) == 0 {
+		return errNotFound
+	}
+	c := &CommitDetail{Commit: commits[0], Parents: []string{}}
+	c.Issues = newIssueLinker(id).find(c.Subject, c.Body)
+	out, err := gitCmd(id, "rev-list", "--parents", "-n", "1", sha)
+	if err != nil {
+		return err
+	}
+	if f := strings.Fields(out); len(f) > 1 {
+		c.Parents = f[1:]
+	}
+	if c.Files, err = commitFiles(id, sha, c.Parents); err != nil {
+		return err
+	}
+	for _, f := range c.Files {
+		c.Additions += f.Additions
+		c.Deletions += f.Deletions
+	}
+	return renderJSON(w, http.StatusOK, c)
+}
+
+// createCommit stages the given paths, or everything when there are none,
+// and commits them. The author, when given, is also the committer.
+// Changes to files owned by others wait for an owner's approval when the
+// repository's code owners allow it, and are refused otherwise.
+func createCommit(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	var req CommitRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	if err := req.validate(id); err != nil {
+		return err
+	}
+
+	defer rlockRepo(id)()
+	changed, err := changedPaths(id, req.Paths)
+	if err != nil {
+		return err
+	}
+	if len(changed) == 0 {
+		return &httputil.HTTPError{http.StatusConflict,
+			errors.New("nothing to commit")}
+	}
+	if owned, err := checkCommitOwners(r, id, changed); err != nil {
+		return err
+	} else if owned != nil {
+		req.Changed = changed
+		a := &Approval{Commit: &req, Owned: owned}
+		if err := requestApproval(r, id, a); err != nil {
+			return err
+		}
+		return renderJSON(w, http.StatusAccepted, a)
+	}
+	c, err := commitChanges(id, &req)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusCreated, c)
+}
+
+// CommitRequest is what to commit: the changes under Paths, or all of
+// them, and by whom. Changed lists the changed files, when known.
+type CommitRequest struct {
+	Message string   `json:"message"`
+	Author  string   `json:"author,omitempty"`
+	Email   string   `json:"email,omitempty"`
+	Paths   []string `json:"paths,omitempty"`
+	Changed []string `json:"changed,omitempty"`
+}
+
+// validate checks c, making its paths relative to the repository.
+func (c *CommitRequest) validate(id string) error {
+	if strings.TrimSpace(c.Message) == "" {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("message is required")}
+	}
+	if strings.ContainsAny(c.Author, "<>\n") || strings.ContainsAny(c.Email, "<>\n ") {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("invalid author or email")}
+	}
+	for i, p := range c.Paths {
+		abs, err := repoPath(id, p)
+		if err != nil {
+			return err
+		}
+		c.Paths[i] = repoRel(id, abs)
+		if hasGitDir(c.Paths[i]) {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				errors.New("invalid path " + p)}
+		}
+	}
+	c.Changed = nil
+	return nil
+}
+
+// changedPaths returns the files with uncommitted changes under paths, or
+// anywhere when there are none, including the sources of renames.
+func changedPaths(id string, paths []string) ([]string, error) {
+	args := append([]string{"status", "--porcelain=v1", "-z",
+		"--untracked-files=all", "--"}, paths...)
+	out, err := gitOutput(id, nil, args...)
+	if err != nil {
+		return nil, err
+	}
+	changed := []string{}
+	fields := strings.Split(string(out), "\x00")
+	for i := 0; i < len(fields); i++ {
+		f := fields[i]
+		if len(f) < 4 {
+			continue
+		}
+		changed = append(changed, f[3:])
+		if (f[0] == 'R' || f[0] == 'C') && i+1 < len(fields) {
+			i++
+			changed = append(changed, fields[i])
+		}
+	}
+	return changed, nil
+}
+
+// commitChanges stages and commits the changes c asks for, publishing the
+// commit. The author, when given, is also the committer. The caller holds
+// the repository lock.
+func commitChanges(id string, c *CommitRequest) (*Commit, error) {
+	var env []string
+	if c.Author != "" {
+		env = append(env, "GIT_AUTHOR_NAME="+c.Author,
+			"GIT_COMMITTER_NAME="+c.Author)
+	}
+	if c.Email != "" {
+		env = append(env, "GIT_AUTHOR_EMAIL="+c.Email,
+			"GIT_COMMITTER_EMAIL="+c.Email)
+	}
+	senv, err := signingEnv(id)
+	if err != nil {
+		return nil, err
+	}
+	env = append(env, senv...)
+	paths := c.Paths
+	add := []string{"add", "-A", "--"}
+	if len(paths) > 0 {
+		add = append(add, paths...)
+	}
+	if _, err := gitCmd(id, add...); err != nil {
+		return nil, err
+	}
+	commit := []string{"commit", "-m", c.Message}
+	if len(paths) > 0 {
+		commit = append(append(commit, "--"), paths...)
+	}
+	if _, err := gitCmdEnv(id, env, commit...); err != nil {
+		return nil, &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	commits, err := gitLog(id, "-n", "1")
+	if err != nil {
+		return nil, err
+	}
+	if len(commits) == 0 {
+		return nil, errors.New("commit not found after committing")
+	}
+	invalidateTreeCache(id)
+	publish(&Event{Type: eventRepoCommitted, Repo: id,
+		Data: map[string]interface{}{"sha": commits[0].SHA}})
+	return commits[0], nil
+}
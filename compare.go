@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+// regexpLogLocation matches the line and column of a diagnostic, which
+// shift with unrelated edits and are ignored when comparing warnings.
+var regexpLogLocation = regexp.MustCompile(`:\d+(:\d+)?: `)
+
+type ArtifactChange struct {
+	Name  string `json:"name"`
+	A     int64  `json:"a"`
+	B     int64  `json:"b"`
+	Delta int64  `json:"delta"`
+}
+
+// buildWarnings returns the distinct warnings in a build's log, with
+// repository paths and line numbers removed.
+func buildWarnings(b *Build) (map[string]bool, error) {
+	f, err := os.Open(buildLogPath(b.Repo, b.ID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]bool{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	abs, _ := os.Getwd()
+	prefix := filepath.Join(abs, b.Repo) + string(filepath.Separator)
+	warnings := make(map[string]bool)
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := s.Text()
+		if logLevel(line) != levelWarning {
+			continue
+		}
+		line = strings.Replace(line, prefix, "", -1)
+		line = regexpLogLocation.ReplaceAllString(line, ": ")
+		warnings[strings.TrimSpace(line)] = true
+	}
+	return warnings, s.Err()
+}
+
+func warningDiff(a, b map[string]bool) []string {
+	diff := []string{}
+	for w := range b {
+		if !a[w] {
+			diff = append(diff, w)
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
+
+func buildDuration(b *Build) float64 {
+	if b.Finished == nil {
+		return 0
+	}
+	return b.Finished.Sub(b.Started).Seconds()
+}
+
+func compareBuilds(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	var builds [2]*Build
+	for i, param := range []string{"a", "b"} {
+		b, err := findBuild(r.URL.Query().Get(param))
+		if err != nil {
+			return err
+		}
+		if b == nil || b.Repo != id {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				errors.New(param + " must be a build of this repository")}
+		}
+		builds[i] = b
+	}
+	a, b := builds[0], builds[1]
+
+	wa, err := buildWarnings(a)
+	if err != nil {
+		return err
+	}
+	wb, err := buildWarnings(b)
+	if err != nil {
+		return err
+	}
+
+	names := make(map[string]bool)
+	for name := range a.Artifacts {
+		names[name] = true
+	}
+	for name := range b.Artifacts {
+		names[name] = true
+	}
+	artifacts := []*ArtifactChange{}
+	for name := range names {
+		c := &ArtifactChange{Name: name, A: a.Artifacts[name], B: b.Artifacts[name]}
+		c.Delta = c.B - c.A
+		artifacts = append(artifacts, c)
+	}
+	sort.Slice(artifacts, func(i, j int) bool {
+		return artifacts[i].Name < artifacts[j].Name
+	})
+
+	return renderJSON(w, http.StatusOK, map[string]interface{}{
+		"a": a,
+		"b": b,
+		"duration": map[string]float64{
+			"a":     buildDuration(a),
+			"b":     buildDuration(b),
+			"delta": buildDuration(b) - buildDuration(a),
+		},
+		"warnings": map[string][]string{
+			"new":   warningDiff(wa, wb),
+			"fixed": warningDiff(wb, wa),
+		},
+		"artifacts": artifacts,
+	})
+}
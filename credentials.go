@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+const (
+	credentialSSH   = "ssh"
+	credentialToken = "token"
+)
+
+// Credential is an SSH private key or access token git uses to reach
+// private remotes. Only its description is ever returned; the secret is
+// kept in a file of its own.
+type Credential struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Username string    `json:"username,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+func credentialName(id string) string {
+	return filepath.Join("credentials", id+".json")
+}
+
+func credentialSecretPath(id string) string {
+	return filepath.Join(dataDir, "credentials", id+".secret")
+}
+
+func loadCredential(id string) (*Credential, error) {
+	if strings.ContainsAny(id, `/\.`) || id == "" {
+		return nil, nil
+	}
+	var c Credential
+	if err := readJSON(credentialName(id), &c); err != nil {
+		return nil, err
+	}
+	if c.ID == "" {
+		return nil, nil
+	}
+	return &c, nil
+}
+
+// tokenEnv authenticates HTTPS remotes with a token. It is passed as
+// configuration in the environment rather than in the remote URL, so it
+// never ends up in .git/config, command lines or error messages.
+func tokenEnv(username, token string) []string {
+	if username == "" {
+		username = "x-access-token"
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + token))
+	return []string{"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http.extraHeader",
+		"GIT_CONFIG_VALUE_0=Authorization: Basic " + auth}
+}
+
+func sshKeyEnv(key string) []string {
+	return []string{"GIT_SSH_COMMAND=ssh -i '" + strings.Replace(key, "'", `'\''`, -1) +
+		"' -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new"}
+}
+
+// credentialEnv returns the environment for git to use a credential.
+func credentialEnv(id string) ([]string, error) {
+	c, err := loadCredential(id)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("unknown credential " + id)}
+	}
+	secret, err := filepath.Abs(credentialSecretPath(c.ID))
+	if err != nil {
+		return nil, err
+	}
+	if c.Type == credentialSSH {
+		return sshKeyEnv(secret), nil
+	}
+	token, err := ioutil.ReadFile(secret)
+	if err != nil {
+		return nil, err
+	}
+	return tokenEnv(c.Username, strings.TrimSpace(string(token))), nil
+}
+
+// repoAuthEnv returns the environment for git to authenticate to the
+// remotes of a repository: with token if one is given, else with the
+// credential it was cloned with, else the SSH key set with GIT_SSH_KEY.
+func repoAuthEnv(id, token string) ([]string, error) {
+	env := []string{"GIT_TERMINAL_PROMPT=0"}
+	if token != "" {
+		return append(env, tokenEnv("", token)...), nil
+	}
+	if m, _ := loadRepoMeta(id); m != nil && m.Credential != "" {
+		cenv, err := credentialEnv(m.Credential)
+		if err != nil {
+			return nil, err
+		}
+		return append(env, cenv...), nil
+	}
+	if key := os.Getenv("GIT_SSH_KEY"); key != "" {
+		env = append(env, sshKeyEnv(key)...)
+	}
+	return env, nil
+}
+
+func listCredentials(w http.ResponseWriter, r *http.Request) error {
+	matches, err := filepath.Glob(filepath.Join(dataDir, "credentials", "*.json"))
+	if err != nil {
+		return err
+	}
+	creds := []*Credential{}
+	for _, m := range matches {
+		c, err := loadCredential(strings.TrimSuffix(filepath.Base(m), ".json"))
+		if err != nil {
+			return err
+		}
+		if c != nil {
+			creds = append(creds, c)
+		}
+	}
+	sort.Slice(creds, func(i, j int) bool {
+		return creds[i].Created.Before(creds[j].Created)
+	})
+	return renderJSON(w, http.StatusOK, creds)
+}
+
+func createCredential(w http.ResponseWriter, r *http.Request) error {
+	var req struct {
+		Name       string `json:"name"`
+		Type       string `json:"type"`
+		Username   string `json:"username"`
+		PrivateKey string `json:"privateKey"`
+		Token      string `json:"token"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	c := &Credential{
+		ID:       newID(),
+		Name:     req.Name,
+		Type:     req.Type,
+		Username: req.Username,
+		Created:  time.Now(),
+	}
+	var secret string
+	switch req.Type {
+	case credentialSSH:
+		if !strings.Contains(req.PrivateKey, "PRIVATE KEY-----") {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				errors.New("privateKey must be a PEM or OpenSSH private key")}
+		}
+		secret = strings.TrimSpace(req.PrivateKey) + "\n"
+		c.Username = ""
+	case credentialToken:
+		if strings.TrimSpace(req.Token) == "" {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				errors.New("token is required")}
+		}
+		secret = strings.TrimSpace(req.Token)
+	default:
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("type must be ssh or token")}
+	}
+
+	p := credentialSecretPath(c.ID)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	// ssh refuses keys other users can read.
+	if err := ioutil.WriteFile(p, []byte(secret), 0600); err != nil {
+		return err
+	}
+	if err := writeJSON(credentialName(c.ID), c); err != nil {
+		os.Remove(p)
+		return err
+	}
+	return renderJSON(w, http.StatusCreated, c)
+}
+
+func deleteCredential(w http.ResponseWriter, r *http.Request) error {
+	c, err := loadCredential(mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		return errNotFound
+	}
+	if err := os.Remove(credentialSecretPath(c.ID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(filepath.Join(dataDir, credentialName(c.ID))); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
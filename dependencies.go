@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+const (
+	managerCocoaPods = "cocoapods"
+	managerSPM       = "spm"
+)
+
+var errNoDependencies = &httputil.HTTPError{http.StatusUnprocessableEntity,
+	errors.New("no Podfile or Swift packages found")}
+
+// DependencyStatus is the outcome of the last dependency resolution of a
+// repository, or of one of its projects: the package managers run, the
+// commit they ran at, and while it runs, the job doing it, if any.
+type DependencyStatus struct {
+	Managers []string   `json:"managers"`
+	Project  string     `json:"project,omitempty"`
+	State    string     `json:"state"`
+	Job      string     `json:"job,omitempty"`
+	Commit   string     `json:"commit,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// dependencyManagers returns the package managers the app in dir uses:
+// CocoaPods with a Podfile, and Swift packages with a Package.swift or a
+// project that declares packages.
+func dependencyManagers(dir string) []string {
+	var managers []string
+	if fileExists(filepath.Join(dir, "Podfile")) {
+		managers = append(managers, managerCocoaPods)
+	}
+	if manifest, swift, err := packageManifest(dir); err == nil {
+		if pkgs, err := declaredPackages(manifest, swift); err == nil && (swift || len(pkgs) > 0) {
+			managers = append(managers, managerSPM)
+		}
+	}
+	return managers
+}
+
+// resolveDependencies installs the pods and resolves the Swift packages of
+// the app in dir, writing the tools' output to out. The caller holds the
+// repository lock.
+func resolveDependencies(ctx context.Context, dir string, managers []string,
+	env []string, out io.Writer) error {
+	for _, m := range managers {
+		var err error
+		switch m {
+		case managerCocoaPods:
+			err = runCmdEnv(ctx, dir, env, out, "pod", "install")
+		case managerSPM:
+			if fileExists(filepath.Join(dir, "Package.swift")) {
+				err = runCmdEnv(ctx, dir, env, out, "swift", "package", "resolve")
+			} else {
+				err = runCmdEnv(ctx, dir, env, out, "xcodebuild", "-resolvePackageDependencies")
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordDependencies keeps s as the repository's dependency status.
+func recordDependencies(id string, s *DependencyStatus) {
+	if _, err := updateRepoMeta(id, func(m *RepoMeta) {
+		m.Dependencies = s
+	}); err != nil {
+		log.Printf("repository %s: recording dependencies: %v", id, err)
+	}
+}
+
+// runDependencies resolves the dependencies of project, or of the
+// repository, recording the outcome. job is that running it, if any. The
+// caller holds the repository lock.
+func runDependencies(ctx context.Context, id string, project *Project,
+	managers []string, job string, out io.Writer) error {
+	s := &DependencyStatus{Managers: managers, State: jobRunning, Job: job,
+		Started: time.Now()}
+	if project != nil {
+		s.Project = project.Name
+	}
+	s.Commit, _ = gitCmd(id, "rev-parse", "HEAD")
+	recordDependencies(id, s)
+
+	env, err := secretEnv(id)
+	if err == nil {
+		err = resolveDependencies(ctx, projectDir(id, project), managers, env, out)
+	}
+	done := *s
+	finished := time.Now()
+	done.Finished = &finished
+	done.State = jobSucceeded
+	if err != nil {
+		done.State = jobFailed
+		done.Error = redact(err.Error())
+	}
+	recordDependencies(id, &done)
+	return err
+}
+
+// startDependencies resolves the dependencies of a freshly cloned
+// repository in the background, returning the status it starts with and
+// the job resolving them, or nil if it has none to resolve.
+func startDependencies(id string) (*DependencyStatus, *Job) {
+	managers := dependencyManagers(id)
+	if len(managers) == 0 {
+		return nil, nil
+	}
+	// The job records its own ID, which it is only given once started.
+	ids := make(chan string, 1)
+	j := startJob(id, "dependencies", func(out io.Writer) error {
+		return runDependencies(context.Background(), id, nil, managers, <-ids, out)
+	})
+	ids <- j.ID
+	return &DependencyStatus{Managers: managers, State: jobQueued, Job: j.ID,
+		Started: j.Created}, j
+}
+
+// installDependencies runs pod install and resolves Swift packages, as the
+// repository or with project one of its projects needs, sending the
+// output as server-sent events. A "dependencies" event with the managers
+// found comes first and a "done" event with the outcome last.
+func installDependencies(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	project, err := findProject(id, r.URL.Query().Get("project"))
+	if err != nil {
+		return err
+	}
+	managers := dependencyManagers(projectDir(id, project))
+	if len(managers) == 0 {
+		return errNoDependencies
+	}
+
+	defer rlockRepo(id)()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	sse := newSSEWriter(w)
+	sse.event("dependencies", managers)
+	lw := newLineWriter(sse.data)
+	rw := newRedactWriter(lw)
+	runDependencies(r.Context(), id, project, managers, "", rw)
+	rw.Flush()
+	lw.Flush()
+	m, err := loadRepoMeta(id)
+	if err != nil || m == nil {
+		return err
+	}
+	return sse.event("done", m.Dependencies)
+}
+
+// dependenciesBeforeBuild resolves the dependencies of the build's
+// directory, if it has any, for builds asked to with resolve=1.
+func dependenciesBeforeBuild(id string, opts *BuildOptions, out io.Writer) error {
+	managers := dependencyManagers(opts.dir(id))
+	if len(managers) == 0 {
+		return nil
+	}
+	return runDependencies(opts.context(), id, opts.project, managers, "", out)
+}
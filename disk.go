@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/launchmango/backend/httputil"
+)
+
+const (
+	eventDiskLow     = "disk.low"
+	eventDiskEvicted = "disk.evicted"
+
+	defaultDiskMinFree = 5 << 30
+	diskCheckInterval  = time.Minute
+	repoTouchInterval  = time.Hour
+	auditLogName       = "audit.log"
+)
+
+var (
+	diskMu  sync.Mutex
+	diskLow bool
+
+	auditMu sync.Mutex
+)
+
+// diskMinFree is the free space, in bytes, below which clones are refused,
+// set with DISK_MIN_FREE.
+func diskMinFree() uint64 {
+	if n, err := strconv.ParseUint(os.Getenv("DISK_MIN_FREE"), 10, 64); err == nil {
+		return n
+	}
+	return defaultDiskMinFree
+}
+
+// diskTargetFree is the free space eviction aims for, set with
+// DISK_TARGET_FREE and defaulting to twice the minimum.
+func diskTargetFree() uint64 {
+	if n, err := strconv.ParseUint(os.Getenv("DISK_TARGET_FREE"), 10, 64); err == nil {
+		return n
+	}
+	return 2 * diskMinFree()
+}
+
+// diskAutoEvict reports whether DerivedData and repositories may be evicted
+// when space runs low, enabled with DISK_AUTO_EVICT=1.
+func diskAutoEvict() bool {
+	return os.Getenv("DISK_AUTO_EVICT") == "1"
+}
+
+func derivedDataDir() string {
+	if d := os.Getenv("DERIVED_DATA"); d != "" {
+		return d
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, "Library", "Developer", "Xcode", "DerivedData")
+}
+
+type DiskStatus struct {
+	Free      uint64 `json:"free"`
+	Total     uint64 `json:"total"`
+	MinFree   uint64 `json:"minFree"`
+	Low       bool   `json:"low"`
+	AutoEvict bool   `json:"autoEvict"`
+}
+
+func diskStatus() (*DiskStatus, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(".", &st); err != nil {
+		return nil, err
+	}
+	s := &DiskStatus{
+		Free:      st.Bavail * uint64(st.Bsize),
+		Total:     st.Blocks * uint64(st.Bsize),
+		MinFree:   diskMinFree(),
+		AutoEvict: diskAutoEvict(),
+	}
+	s.Low = s.Free < s.MinFree
+	return s, nil
+}
+
+// checkDiskSpace refuses work that needs space, like cloning, when free
+// space is below the minimum.
+func checkDiskSpace() error {
+	s, err := diskStatus()
+	if err != nil {
+		return err
+	}
+	if s.Low {
+		return &httputil.HTTPError{http.StatusInsufficientStorage,
+			fmt.Errorf("only %d MB of disk space is free, below the %d MB minimum",
+				s.Free>>20, s.MinFree>>20)}
+	}
+	return nil
+}
+
+// AuditEntry is a line of the audit log, which records actions the server
+// takes on its own, such as evicting data.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Repo   string    `json:"repo,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+func audit(action, repo, detail string) {
+	e := &AuditEntry{Time: time.Now(), Action: action, Repo: repo, Detail: detail}
+	log.Printf("audit: %s %s %s", action, repo, detail)
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	f, err := os.OpenFile(filepath.Join(dataDir, auditLogName),
+		os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("audit: %v", err)
+		return
+	}
+	defer f.Close()
+	f.Write(append(b, '\n'))
+}
+
+// touchRepo records that the repository was used, for choosing which to
+// evict. It writes at most once per repoTouchInterval.
+func touchRepo(id string) {
+	m, err := loadRepoMeta(id)
+	if err != nil || m == nil || time.Since(m.Used) < repoTouchInterval {
+		return
+	}
+	m.Used = time.Now()
+	if err := saveRepoMeta(m); err != nil {
+		log.Printf("touch %s: %v", id, err)
+	}
+}
+
+// evictable is something that can be removed to free space.
+type evictable struct {
+	kind string // "deriveddata" or "repository"
+	repo string
+	path string
+	used time.Time
+}
+
+func evictionCandidates() []*evictable {
+	var derived, repos []*evictable
+	if fis, err := ioutil.ReadDir(derivedDataDir()); err == nil {
+		for _, fi := range fis {
+			if fi.IsDir() {
+				derived = append(derived, &evictable{kind: "deriveddata",
+					path: filepath.Join(derivedDataDir(), fi.Name()), used: fi.ModTime()})
+			}
+		}
+	}
+	ids, _ := repoIDs()
+	for _, id := range ids {
+		m, _ := loadRepoMeta(id)
+		if m == nil {
+			// Without metadata the repository couldn't be recloned.
+			continue
+		}
+		used := m.Used
+		if used.IsZero() {
+			used = m.Created
+		}
+		repos = append(repos, &evictable{kind: "repository", repo: id, path: id, used: used})
+	}
+	byUse := func(s []*evictable) {
+		sort.Slice(s, func(i, j int) bool { return s[i].used.Before(s[j].used) })
+	}
+	byUse(derived)
+	byUse(repos)
+
+	// DerivedData can always be rebuilt, so it goes before repositories.
+	return append(derived, repos...)
+}
+
+// evictForSpace removes least recently used DerivedData, then repository
+// checkouts, until the target free space is reached.
+func evictForSpace() error {
+	target := diskTargetFree()
+	for _, c := range evictionCandidates() {
+		s, err := diskStatus()
+		if err != nil {
+			return err
+		}
+		if s.Free >= target {
+			return nil
+		}
+		if err := evict(c); err != nil {
+			log.Printf("evict %s: %v", c.path, err)
+			continue
+		}
+	}
+	return nil
+}
+
+func evict(c *evictable) error {
+	if c.kind == "repository" {
+		unlock, ok := tryLockRepo(c.repo)
+		if !ok {
+			return errors.New("repository is busy")
+		}
+		defer unlock()
+		m, err := loadRepoMeta(c.repo)
+		if err != nil || m == nil {
+			return errors.New("no metadata")
+		}
+		forgetTree(c.repo)
+		now := time.Now()
+		m.Evicted = &now
+		if err := saveRepoMeta(m); err != nil {
+			return err
+		}
+	}
+	size := dirSize(c.path)
+	if err := os.RemoveAll(c.path); err != nil {
+		return err
+	}
+	detail := fmt.Sprintf("%s %s (%d bytes)", c.kind, c.path, size)
+	audit("evict", c.repo, detail)
+	publish(&Event{Type: eventDiskEvicted, Repo: c.repo,
+		Data: map[string]interface{}{"kind": c.kind, "path": c.path, "size": size}})
+	return nil
+}
+
+// checkDisk publishes an event when free space drops below the minimum and
+// evicts if that's enabled.
+func checkDisk() {
+	s, err := diskStatus()
+	if err != nil {
+		log.Printf("disk: %v", err)
+		return
+	}
+	diskMu.Lock()
+	defer diskMu.Unlock()
+	if s.Low && !diskLow {
+		audit("disk.low", "", fmt.Sprintf("%d bytes free", s.Free))
+		publish(&Event{Type: eventDiskLow,
+			Data: map[string]interface{}{"free": s.Free, "minFree": s.MinFree}})
+	}
+	diskLow = s.Low
+	if s.Low && s.AutoEvict {
+		if err := evictForSpace(); err != nil {
+			log.Printf("disk: %v", err)
+		}
+	}
+}
+
+func monitorDisk() {
+	for {
+		checkDisk()
+		time.Sleep(diskCheckInterval)
+	}
+}
+
+func getDiskStatus(w http.ResponseWriter, r *http.Request) error {
+	s, err := diskStatus()
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, s)
+}
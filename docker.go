@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+const registryCredentialsFile = "registry.json"
+
+var (
+	regexpDockerTag    = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	regexpDockerDigest = regexp.MustCompile(`digest: (sha256:[0-9a-f]{64})`)
+)
+
+type RegistryCredentials struct {
+	Server   string `json:"server"`
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+}
+
+type dockerProvider struct{}
+
+func (dockerProvider) Name() string { return "docker" }
+
+func (dockerProvider) Detect(id string) bool {
+	return fileExists(filepath.Join(id, "Dockerfile"))
+}
+
+// Build builds the image, passing secrets as build secrets, which the
+// Dockerfile can mount with RUN --mount=type=secret,id=NAME without them
+// ending up in a layer.
+func (dockerProvider) Build(id string, opts *BuildOptions, out io.Writer) error {
+	args := []string{"build", "-t", dockerLocalImage(id)}
+	for _, e := range opts.env {
+		name := e[:strings.Index(e, "=")]
+		args = append(args, "--secret", "id="+name+",env="+name)
+	}
+	return dockerCmdContext(opts.context(), opts.dir(id), out, nil, opts.env,
+		append(args, ".")...)
+}
+
+// dockerLocalImage names the image built for repository id. Docker wants
+// repository names in lowercase, which ULIDs aren't.
+func dockerLocalImage(id string) string {
+	return "launchmango/" + strings.ToLower(id) + ":latest"
+}
+
+// dockerCmd runs docker with a config directory of its own so registry
+// logins don't leak into the host user's ~/.docker.
+func dockerCmd(dir string, out io.Writer, stdin io.Reader, arg ...string) error {
+	return dockerCmdContext(context.Background(), dir, out, stdin, nil, arg...)
+}
+
+func dockerCmdContext(ctx context.Context, dir string, out io.Writer,
+	stdin io.Reader, env []string, arg ...string) error {
+	config, err := filepath.Abs(filepath.Join(dataDir, "docker"))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(config, 0700); err != nil {
+		return err
+	}
+	cmd := exec.Command("docker", arg...)
+	cmd.Dir = dir
+	cmd.Env = append(append(os.Environ(), env...), "DOCKER_CONFIG="+config)
+	cmd.Stdin = stdin
+	cmd.Stdout = out
+	cmd.Stderr = out
+	return runGroup(ctx, cmd)
+}
+
+func getRegistryCredentials(w http.ResponseWriter, r *http.Request) error {
+	var c RegistryCredentials
+	if err := readJSON(registryCredentialsFile, &c); err != nil {
+		return err
+	}
+	c.Password = ""
+	return renderJSON(w, http.StatusOK, &c)
+}
+
+func setRegistryCredentials(w http.ResponseWriter, r *http.Request) error {
+	var c RegistryCredentials
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	if c.Server == "" || c.Username == "" || c.Password == "" {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("server, username and password are required")}
+	}
+	if err := writeJSON(registryCredentialsFile, &c); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func pushImage(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	var req struct {
+		Tag string `json:"tag"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+
+	settings, err := loadRepoSettings(id)
+	if err != nil {
+		return err
+	}
+	if settings.DockerImage == "" {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("set dockerImage in the repository settings first")}
+	}
+	var creds RegistryCredentials
+	if err := readJSON(registryCredentialsFile, &creds); err != nil {
+		return err
+	}
+	if creds.Server == "" {
+		return &httputil.HTTPError{http.StatusPreconditionFailed,
+			errors.New("registry credentials are not configured")}
+	}
+
+	if req.Tag == "" {
+		if req.Tag, err = gitCmd(id, "rev-parse", "--short", "HEAD"); err != nil {
+			return err
+		}
+	}
+	if !regexpDockerTag.MatchString(req.Tag) {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("invalid image tag")}
+	}
+	image := settings.DockerImage + ":" + req.Tag
+
+	j := startResultJob(id, "docker-push", func(out io.Writer) (interface{}, error) {
+		if err := dockerCmd(id, out, strings.NewReader(creds.Password), "login",
+			creds.Server, "-u", creds.Username, "--password-stdin"); err != nil {
+			return nil, err
+		}
+		if err := dockerCmd(id, out, nil, "tag", dockerLocalImage(id),
+			image); err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := dockerCmd(id, io.MultiWriter(out, &buf), nil, "push",
+			image); err != nil {
+			return nil, err
+		}
+		m := regexpDockerDigest.FindStringSubmatch(buf.String())
+		if m == nil {
+			return nil, fmt.Errorf("pushed %s but no digest was reported", image)
+		}
+		return map[string]string{"image": image, "digest": m[1]}, nil
+	})
+	return renderJSON(w, http.StatusAccepted, j)
+}
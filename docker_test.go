@@ -0,0 +1,26 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+// regexpDockerReference matches a repository:tag reference as Docker's
+// reference grammar defines it, without a registry host.
+var regexpDockerReference = regexp.MustCompile(
+	`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*:[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+func TestDockerLocalImage(t *testing.T) {
+	for _, id := range []string{
+		newULID(),
+		"01HV3K8Z4Q9X7T2M5N6B0C1D2E",
+		"0123456789abcdef0123456789abcdef",
+	} {
+		if !validRepoID(id) {
+			t.Fatalf("%s is not a valid repository ID", id)
+		}
+		if image := dockerLocalImage(id); !regexpDockerReference.MatchString(image) {
+			t.Errorf("dockerLocalImage(%q) = %q, not a valid image reference", id, image)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// emailRecipients returns the repository's configured recipients and the
+// users who opted into email for e.
+func emailRecipients(e *Event) []string {
+	kind := e.Category()
+	if !(e.Type == eventBuildFailed || kind == "job") {
+		return nil
+	}
+	var to []string
+	if settings, err := loadRepoSettings(e.Repo); err == nil {
+		to = append(to, settings.EmailRecipients...)
+	}
+	if users, err := loadUsers(); err == nil {
+		for _, u := range users {
+			if u.wantsEmail(kind, e.Repo) {
+				to = append(to, u.Email)
+			}
+		}
+	}
+	return to
+}
+
+func notifyEmail(to string, e *Event) error {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		return errors.New("SMTP_ADDR is not set")
+	}
+	return sendMail(addr, []string{to}, emailSubject(e), emailBody(e))
+}
+
+func emailSubject(e *Event) string {
+	name, err := repoName(e.Repo)
+	if err != nil {
+		name = e.Repo
+	}
+	return fmt.Sprintf("[launchmango] %s: %s", name, e.Type)
+}
+
+func emailBody(e *Event) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Repository: %s\n", e.Repo)
+	fmt.Fprintf(&buf, "Event: %s\n", e.Type)
+	fmt.Fprintf(&buf, "Time: %s\n", e.Time.Format(time.RFC1123))
+	for k, v := range e.Data {
+		fmt.Fprintf(&buf, "\n%s:\n%v\n", k, v)
+	}
+	return buf.String()
+}
+
+func sendMail(addr string, to []string, subject, body string) error {
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = "launchmango@localhost"
+	}
+	var auth smtp.Auth
+	if user := os.Getenv("SMTP_USER"); user != "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return smtp.SendMail(addr, auth, from, to, msg.Bytes())
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/launchmango/backend/httputil"
+)
+
+const (
+	eventHistorySize    = 10000
+	defaultEventHistory = 100
+	eventLogName        = "events.log"
+)
+
+// eventHistory keeps the most recent events so clients that were
+// disconnected can catch up on what they missed. Events are also appended
+// to dataDir/events.log, which is read back when the server starts and
+// compacted once it holds twice as many events as are kept.
+var eventHistory = struct {
+	sync.Mutex
+	loaded sync.Once
+	events []*Event
+	logged int // events in the log file
+}{}
+
+func eventLogPath() string {
+	return filepath.Join(dataDir, eventLogName)
+}
+
+func loadEventHistory() {
+	eventHistory.loaded.Do(func() {
+		f, err := os.Open(eventLogPath())
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("events: %v", err)
+			}
+			return
+		}
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		s.Buffer(make([]byte, 64*1024), 1024*1024)
+		for s.Scan() {
+			var e Event
+			if json.Unmarshal(s.Bytes(), &e) != nil {
+				continue
+			}
+			eventHistory.logged++
+			eventHistory.events = append(eventHistory.events, &e)
+			if len(eventHistory.events) > 2*eventHistorySize {
+				eventHistory.events = append([]*Event(nil),
+					eventHistory.events[len(eventHistory.events)-eventHistorySize:]...)
+			}
+		}
+		if n := len(eventHistory.events); n > eventHistorySize {
+			eventHistory.events = eventHistory.events[n-eventHistorySize:]
+		}
+	})
+}
+
+// recordEvent adds e to the history. It is called by publish before the
+// subscribers run, so the history is in the order events were published.
+func recordEvent(e *Event) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("events: %v", err)
+		return
+	}
+	loadEventHistory()
+	eventHistory.Lock()
+	defer eventHistory.Unlock()
+	eventHistory.events = append(eventHistory.events, e)
+	if n := len(eventHistory.events); n > eventHistorySize {
+		eventHistory.events = append([]*Event(nil),
+			eventHistory.events[n-eventHistorySize:]...)
+	}
+
+	if eventHistory.logged >= 2*eventHistorySize {
+		if err := compactEventLog(); err != nil {
+			log.Printf("events: %v", err)
+		}
+		return
+	}
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		log.Printf("events: %v", err)
+		return
+	}
+	f, err := os.OpenFile(eventLogPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("events: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err == nil {
+		eventHistory.logged++
+	}
+}
+
+// compactEventLog rewrites the log with only the events kept in memory.
+// The caller holds the history lock.
+func compactEventLog() error {
+	tmp := eventLogPath() + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	enc := json.NewEncoder(bw)
+	for _, e := range eventHistory.events {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, eventLogPath()); err != nil {
+		return err
+	}
+	eventHistory.logged = len(eventHistory.events)
+	return nil
+}
+
+// getEventHistory returns past events, oldest first, optionally only those
+// of a type or category ("build" matches "build.failed"), of a repository
+// or published after since. At most limit events are returned: the first
+// ones after since, so a client can page forward by passing the time of
+// the last event it got, or else the most recent ones.
+func getEventHistory(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	typ, repo := q.Get("type"), q.Get("repo")
+	var since time.Time
+	if s := q.Get("since"); s != "" {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				errors.New("since must be an RFC 3339 time")}
+		}
+		since = t
+	}
+	limit := defaultEventHistory
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				errors.New("limit must be a positive integer")}
+		}
+		limit = n
+	}
+
+	loadEventHistory()
+	eventHistory.Lock()
+	events := []*Event{}
+	for _, e := range eventHistory.events {
+		if typ != "" && e.Type != typ && e.Category() != typ {
+			continue
+		}
+		if repo != "" && e.Repo != repo {
+			continue
+		}
+		if !since.IsZero() && !e.Time.After(since) {
+			continue
+		}
+		events = append(events, e)
+	}
+	eventHistory.Unlock()
+	if len(events) > limit {
+		if since.IsZero() {
+			events = events[len(events)-limit:]
+		} else {
+			events = events[:limit]
+		}
+	}
+	return renderJSON(w, http.StatusOK, events)
+}
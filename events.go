@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	eventBuildStarted   = "build.started"
+	eventBuildSucceeded = "build.succeeded"
+	eventBuildFailed    = "build.failed"
+	eventRunStarted     = "run.started"
+	eventRunFinished    = "run.finished"
+	eventRunFailed      = "run.failed"
+
+	eventTestStarted = "test.started"
+	eventTestPassed  = "test.passed"
+	eventTestFailed  = "test.failed"
+
+	eventJobSucceeded = "job.succeeded"
+	eventJobFailed    = "job.failed"
+
+	eventSymbolsUploaded = "symbols.uploaded"
+	eventSymbolsFailed   = "symbols.failed"
+
+	eventRepoPulled    = "repo.pulled"
+	eventRepoCommitted = "repo.committed"
+	eventRepoEdited    = "repo.edited"
+
+	eventApprovalRequested = "approval.requested"
+)
+
+type Event struct {
+	Type string                 `json:"type"`
+	Repo string                 `json:"repo,omitempty"`
+	Time time.Time              `json:"time"`
+	Data map[string]interface{} `json:"data,omitempty"`
+}
+
+// Category returns the part of the event type before the first dot, e.g.
+// "build" for "build.failed".
+func (e *Event) Category() string {
+	if i := strings.Index(e.Type, "."); i >= 0 {
+		return e.Type[:i]
+	}
+	return e.Type
+}
+
+var (
+	listenersMu sync.RWMutex
+	listeners   []func(*Event)
+)
+
+func subscribe(fn func(*Event)) {
+	listenersMu.Lock()
+	listeners = append(listeners, fn)
+	listenersMu.Unlock()
+}
+
+// publish records e in the history and delivers it to every subscriber.
+// Subscribers run in their own goroutines so a slow notifier never holds up
+// a request.
+func publish(e *Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	recordEvent(e)
+	listenersMu.RLock()
+	defer listenersMu.RUnlock()
+	for _, fn := range listeners {
+		go fn(e)
+	}
+}
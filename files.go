@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+var errPreconditionFailed = &httputil.HTTPError{http.StatusPreconditionFailed,
+	errors.New("file has changed since it was read")}
+
+// fileETag identifies a version of a file by its size and modification
+// time, which changes on every write since files are replaced by renaming.
+func fileETag(fi os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, fi.Size(), fi.ModTime().UnixNano())
+}
+
+// serveFileAtRef serves the file at rel as committed at ref, a commit,
+// branch or tag. Its ETag is the blob's hash, since it never changes.
+func serveFileAtRef(w http.ResponseWriter, r *http.Request, id, rel, ref string) error {
+	if strings.HasPrefix(ref, "-") {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("invalid ref")}
+	}
+	if hasGitDir(rel) {
+		return errNotFound
+	}
+	defer rlockRepo(id)()
+	commit, err := gitCmd(id, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		return errNotFound
+	}
+	object := commit + ":" + rel
+	if typ, err := gitCmd(id, "cat-file", "-t", object); err != nil || typ != "blob" {
+		return errNotFound
+	}
+	blob, err := gitCmd(id, "rev-parse", object)
+	if err != nil {
+		return err
+	}
+	content, err := gitOutput(id, nil, "cat-file", "blob", blob)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", `"`+blob+`"`)
+	http.ServeContent(w, r, filepath.Base(rel), time.Time{}, bytes.NewReader(content))
+	return nil
+}
+
+// checkIfMatch checks the If-Match header of a request to change the file
+// described by fi. It is required, so a client can't overwrite changes it
+// hasn't seen.
+func checkIfMatch(r *http.Request, fi os.FileInfo) error {
+	h := r.Header.Get("If-Match")
+	if h == "" {
+		return &httputil.HTTPError{http.StatusPreconditionRequired,
+			errors.New("If-Match is required to change an existing file")}
+	}
+	etag := fileETag(fi)
+	for _, t := range strings.Split(h, ",") {
+		if t = strings.TrimSpace(t); t == "*" || t == etag {
+			return nil
+		}
+	}
+	return errPreconditionFailed
+}
+
+// fileBody returns the new contents of a file sent to be written and their
+// length, or -1 if unknown. They are the request body, or the first file of
+// a multipart/form-data body, which is how browsers send binary files.
+func fileBody(r *http.Request) (io.Reader, int64, error) {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mt != "multipart/form-data" {
+		return r.Body, r.ContentLength, nil
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, 0, &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, 0, &httputil.HTTPError{http.StatusBadRequest,
+				errors.New("no file in upload")}
+		}
+		if err != nil {
+			return nil, 0, &httputil.HTTPError{http.StatusBadRequest, err}
+		}
+		if partFileName(part.Header) != "" {
+			return part, -1, nil
+		}
+		part.Close()
+	}
+}
+
+// checkParent checks that the directory p is to be created in exists, or
+// creates it when the request asks for it with ?mkdirs=1.
+func checkParent(p string, r *http.Request) error {
+	dir := filepath.Dir(p)
+	fi, err := os.Stat(dir)
+	if err == nil {
+		if !fi.IsDir() {
+			return &httputil.HTTPError{http.StatusConflict,
+				errors.New("parent is not a directory")}
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if r.URL.Query().Get("mkdirs") != "1" {
+		return &httputil.HTTPError{http.StatusNotFound,
+			errors.New("parent directory doesn't exist; pass mkdirs=1 to create it")}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return &httputil.HTTPError{http.StatusConflict, err}
+	}
+	return nil
+}
+
+// parentNode lists the directory containing p, so clients can update their
+// tree after a change to p.
+func parentNode(id, p string) *FileNode {
+	dir := filepath.Dir(p)
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil
+	}
+	return listDir(id, dir, fi, 1)
+}
+
+// createDirectory creates a directory in the repository, and its parents
+// with ?mkdirs=1. It responds with the directory the new one was made in.
+func createDirectory(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	var req struct {
+		Path string `json:"path"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	p, err := repoPath(id, req.Path)
+	if err != nil {
+		return err
+	}
+	if hasGitDir(repoRel(id, p)) {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("can't create inside .git")}
+	}
+	if err := checkOwners(r, id, repoRel(id, p)); err != nil {
+		return err
+	}
+	defer rlockRepo(id)()
+	if _, err := os.Lstat(p); err == nil {
+		return &httputil.HTTPError{http.StatusConflict,
+			errors.New("path already exists")}
+	}
+	if err := checkParent(p, r); err != nil {
+		return err
+	}
+	if err := os.Mkdir(p, 0755); err != nil {
+		if os.IsExist(err) {
+			return &httputil.HTTPError{http.StatusConflict,
+				errors.New("path already exists")}
+		}
+		return err
+	}
+	invalidateTreeCache(id)
+	publish(&Event{Type: eventRepoEdited, Repo: id,
+		Data: map[string]interface{}{"action": "mkdir",
+			"paths": []string{repoRel(id, p)}}})
+	return renderJSON(w, http.StatusCreated, parentNode(id, p))
+}
+
+// MoveResult describes a file or directory after it was moved.
+type MoveResult struct {
+	From string    `json:"from"`
+	To   string    `json:"to"`
+	Git  bool      `json:"git"`
+	Node *FileNode `json:"node"`
+}
+
+// moveRepoFile moves a file or directory to the destination path in the
+// body, creating its parents with ?mkdirs=1. Tracked files are moved with
+// git mv, so the move is staged like git would; anything else is renamed.
+func moveRepoFile(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	var req struct {
+		Destination string `json:"destination"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	src, err := repoPath(id, mux.Vars(r)["path"])
+	if err != nil {
+		return err
+	}
+	dst, err := repoPath(id, req.Destination)
+	if err != nil {
+		return err
+	}
+	from, to := repoRel(id, src), repoRel(id, dst)
+	if hasGitDir(from) || hasGitDir(to) {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("can't move to or from .git")}
+	}
+	if from == to || strings.HasPrefix(to, from+"/") {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("can't move a path into itself")}
+	}
+
+	defer rlockRepo(id)()
+	if _, err := os.Lstat(src); err != nil {
+		if os.IsNotExist(err) {
+			return errNotFound
+		}
+		return err
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return &httputil.HTTPError{http.StatusConflict,
+			errors.New("destination already exists")}
+	}
+	if err := checkParent(dst, r); err != nil {
+		return err
+	}
+	// What is moved must be the user's both where it is and where it goes.
+	if err := checkOwners(r, id, append(treePaths(src, to), from)...); err != nil {
+		return err
+	}
+	res := &MoveResult{From: from, To: to}
+	// ls-files lists nothing, without failing, for untracked paths.
+	if tracked, err := gitCmd(id, "ls-files", "--", from); err == nil && tracked != "" {
+		if _, err := gitCmd(id, "mv", "--", from, to); err != nil {
+			return err
+		}
+		res.Git = true
+	} else if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	invalidateTreeCache(id)
+	publish(&Event{Type: eventRepoEdited, Repo: id,
+		Data: map[string]interface{}{"action": "move",
+			"paths": []string{from, to}}})
+	if fi, err := os.Lstat(dst); err == nil {
+		res.Node = listDir(id, dst, fi, 1)
+	}
+	return renderJSON(w, http.StatusOK, res)
+}
+
+// revertRepoFile discards the changes to a file or directory, staged or
+// not, restoring it as committed at HEAD. Files added under a directory
+// since are left; delete them instead. It responds with the directory the
+// path is in.
+func revertRepoFile(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	p, err := repoPath(id, mux.Vars(r)["path"])
+	if err != nil {
+		return err
+	}
+	rel := repoRel(id, p)
+	if hasGitDir(rel) {
+		return errNotFound
+	}
+	if err := checkOwners(r, id, rel); err != nil {
+		return err
+	}
+
+	defer rlockRepo(id)()
+	if _, err := gitCmd(id, "cat-file", "-e", "HEAD:"+rel); err != nil {
+		return &httputil.HTTPError{http.StatusNotFound,
+			errors.New("path is not committed; delete it instead")}
+	}
+	if _, err := gitCmd(id, "checkout", "HEAD", "--", rel); err != nil {
+		return err
+	}
+	invalidateTreeCache(id)
+	publish(&Event{Type: eventRepoEdited, Repo: id,
+		Data: map[string]interface{}{"action": "revert", "paths": []string{rel}}})
+	return renderJSON(w, http.StatusOK, parentNode(id, p))
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+const firebaseCredentialsFile = "firebase-service-account.json"
+
+var (
+	regexpFirebaseGroup      = regexp.MustCompile("^[a-z0-9-]+$")
+	regexpFirebaseConsoleURL = regexp.MustCompile(
+		`Firebase console: (https://\S+)`)
+	regexpFirebaseTesterURL = regexp.MustCompile(
+		`testers who have access: (https://\S+)`)
+)
+
+type FirebaseRelease struct {
+	IPA        string   `json:"ipa"`
+	AppID      string   `json:"appID"`
+	Groups     []string `json:"groups,omitempty"`
+	Testers    []string `json:"testers,omitempty"`
+	Status     string   `json:"status"`
+	ConsoleURL string   `json:"consoleURL,omitempty"`
+	TesterURL  string   `json:"testerURL,omitempty"`
+	Output     string   `json:"output,omitempty"`
+}
+
+func setFirebaseCredentials(w http.ResponseWriter, r *http.Request) error {
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	var account struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+	}
+	if err := json.Unmarshal(body, &account); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	if account.Type != "service_account" || account.ClientEmail == "" {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("body must be a Google service account key")}
+	}
+
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return err
+	}
+	path := filepath.Join(dataDir, firebaseCredentialsFile)
+	if err := ioutil.WriteFile(path, body, 0600); err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, map[string]string{
+		"clientEmail": account.ClientEmail,
+	})
+}
+
+func distributeFirebase(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	var req struct {
+		IPA          string   `json:"ipa"`
+		AppID        string   `json:"appID"`
+		Groups       []string `json:"groups"`
+		Testers      []string `json:"testers"`
+		ReleaseNotes string   `json:"releaseNotes"`
+		// Changelog generates the release notes from commits when
+		// releaseNotes is empty.
+		Changelog *ChangelogRange `json:"changelog"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	for _, g := range req.Groups {
+		if !regexpFirebaseGroup.MatchString(g) {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				errors.New("invalid tester group alias: " + g)}
+		}
+	}
+
+	if req.AppID == "" {
+		settings, err := loadRepoSettings(id)
+		if err != nil {
+			return err
+		}
+		req.AppID = settings.FirebaseAppID
+	}
+	if req.AppID == "" {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("appID is required (or set firebaseAppID in settings)")}
+	}
+
+	credentials, err := filepath.Abs(filepath.Join(dataDir,
+		firebaseCredentialsFile))
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(credentials); os.IsNotExist(err) {
+		return &httputil.HTTPError{http.StatusPreconditionFailed,
+			errors.New("Firebase credentials are not configured")}
+	}
+
+	ipa, err := resolveIPA(id, req.IPA)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"appdistribution:distribute", ipa, "--app", req.AppID}
+	if len(req.Groups) > 0 {
+		args = append(args, "--groups", strings.Join(req.Groups, ","))
+	}
+	if len(req.Testers) > 0 {
+		args = append(args, "--testers", strings.Join(req.Testers, ","))
+	}
+	if req.ReleaseNotes == "" && req.Changelog != nil {
+		unlock := rlockRepo(id)
+		cl, err := buildChangelog(id, req.Changelog.From, req.Changelog.To)
+		unlock()
+		if err != nil {
+			return err
+		}
+		req.ReleaseNotes = cl.Markdown
+	}
+	if req.ReleaseNotes != "" {
+		args = append(args, "--release-notes", req.ReleaseNotes)
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command("firebase", args...)
+	cmd.Env = append(os.Environ(),
+		"GOOGLE_APPLICATION_CREDENTIALS="+credentials)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	runErr := cmd.Run()
+
+	release := FirebaseRelease{
+		IPA:     repoRel(id, ipa),
+		AppID:   req.AppID,
+		Groups:  req.Groups,
+		Testers: req.Testers,
+		Output:  strings.TrimSpace(out.String()),
+	}
+	if m := regexpFirebaseConsoleURL.FindStringSubmatch(release.Output); m != nil {
+		release.ConsoleURL = m[1]
+	}
+	if m := regexpFirebaseTesterURL.FindStringSubmatch(release.Output); m != nil {
+		release.TesterURL = m[1]
+	}
+	if runErr != nil {
+		release.Status = "failed"
+		return renderJSON(w, http.StatusBadGateway, &release)
+	}
+	release.Status = "distributed"
+	return renderJSON(w, http.StatusOK, &release)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+type flutterProvider struct{}
+
+func (flutterProvider) Name() string { return "flutter" }
+
+func (flutterProvider) Detect(id string) bool {
+	b, err := ioutil.ReadFile(filepath.Join(id, "pubspec.yaml"))
+	return err == nil && strings.Contains(string(b), "sdk: flutter")
+}
+
+func (flutterProvider) Build(id string, opts *BuildOptions, out io.Writer) error {
+	ctx, dir := opts.context(), opts.dir(id)
+	if err := runCmdEnv(ctx, dir, opts.env, out, "flutter", "pub", "get"); err != nil {
+		return err
+	}
+	return runCmdEnv(ctx, dir, opts.env, out, "flutter", "build", "ios", "--simulator", "--debug")
+}
+
+// Run starts `flutter run` attached to the chosen simulator. The process
+// stays in the foreground so hot reload commands can be sent to it.
+func (p flutterProvider) Run(id string, opts *RunOptions) (*Run, error) {
+	args := []string{"run", "--debug"}
+	if opts.Device != "" {
+		args = append(args, "-d", opts.Device)
+	}
+	cmd := exec.Command("flutter", args...)
+	cmd.Dir = opts.dir(id)
+	cmd.Env = opts.runEnv()
+	return startRun(id, p.Name(), cmd)
+}
+
+func (flutterProvider) Reload(run *Run, restart bool) error {
+	if restart {
+		return run.Send("R")
+	}
+	return run.Send("r")
+}
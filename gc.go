@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	gcBuildOutput = "build"
+	gcDerivedData = "deriveddata"
+	gcSimApp      = "simapp"
+	gcArtifact    = "artifact"
+
+	defaultGCInterval           = 24 * time.Hour
+	defaultBuildOutputRetention = 7 * 24 * time.Hour
+	defaultArtifactRetention    = 30 * 24 * time.Hour
+	defaultSimAppRetention      = 3 * 24 * time.Hour
+
+	simAppsName = "simapps.json"
+)
+
+// GCItem is something garbage collection removed, with the bytes it took.
+type GCItem struct {
+	Kind string `json:"kind"`
+	Repo string `json:"repo,omitempty"`
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// GCReport reports a garbage collection of stale build outputs.
+type GCReport struct {
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	Reclaimed int64     `json:"reclaimed"`
+	Items     []*GCItem `json:"items"`
+}
+
+func (rep *GCReport) add(out io.Writer, kind, repo, path string, size int64) {
+	rep.Items = append(rep.Items, &GCItem{Kind: kind, Repo: repo, Path: path, Size: size})
+	rep.Reclaimed += size
+	fmt.Fprintf(out, "Removed %s %s (%d bytes)\n", kind, path, size)
+}
+
+// SimApp is an app installed on a simulator to be run, recorded so it can
+// be uninstalled once it hasn't been run for a while.
+type SimApp struct {
+	Device    string    `json:"device"`
+	BundleID  string    `json:"bundleID"`
+	Repo      string    `json:"repo"`
+	Installed time.Time `json:"installed"`
+}
+
+var (
+	gcMu   sync.Mutex
+	lastGC *GCReport
+
+	simAppsMu sync.Mutex
+)
+
+// envDuration is the duration set with the environment variable name, or
+// def.
+func envDuration(name string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(name)); err == nil {
+		return d
+	}
+	return def
+}
+
+// gcInterval is how often garbage is collected, set with GC_INTERVAL as a
+// duration like "12h"; zero turns scheduled collection off.
+func gcInterval() time.Duration { return envDuration("GC_INTERVAL", defaultGCInterval) }
+
+// buildOutputRetention is how long build directories and DerivedData are
+// kept after they were last written, set with BUILD_OUTPUT_RETENTION.
+func buildOutputRetention() time.Duration {
+	return envDuration("BUILD_OUTPUT_RETENTION", defaultBuildOutputRetention)
+}
+
+// artifactRetention is how long build artifacts and cached build products
+// are kept, set with ARTIFACT_RETENTION.
+func artifactRetention() time.Duration {
+	return envDuration("ARTIFACT_RETENTION", defaultArtifactRetention)
+}
+
+// simAppRetention is how long apps stay installed on simulators after
+// they were last run, set with SIM_APP_RETENTION.
+func simAppRetention() time.Duration {
+	return envDuration("SIM_APP_RETENTION", defaultSimAppRetention)
+}
+
+// recordSimApp records that the app was installed on a simulator to run.
+func recordSimApp(repo, device, bundleID string) {
+	simAppsMu.Lock()
+	defer simAppsMu.Unlock()
+	var apps []*SimApp
+	if err := readJSON(simAppsName, &apps); err != nil {
+		log.Printf("simulator apps: %v", err)
+		return
+	}
+	found := false
+	for _, a := range apps {
+		if a.Device == device && a.BundleID == bundleID {
+			a.Repo, a.Installed, found = repo, time.Now(), true
+		}
+	}
+	if !found {
+		apps = append(apps, &SimApp{Device: device, BundleID: bundleID,
+			Repo: repo, Installed: time.Now()})
+	}
+	if err := writeJSON(simAppsName, apps); err != nil {
+		log.Printf("simulator apps: %v", err)
+	}
+}
+
+// newestModTime returns when anything under p was last modified.
+func newestModTime(p string) time.Time {
+	var newest time.Time
+	filepath.Walk(p, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && fi.ModTime().After(newest) {
+			newest = fi.ModTime()
+		}
+		return nil
+	})
+	return newest
+}
+
+// collectBuildOutputs removes the build directories of the repository and
+// its projects that no build has written to since cutoff. Directories git
+// tracks files in aren't build outputs and are left alone.
+func collectBuildOutputs(rep *GCReport, out io.Writer, id string, cutoff time.Time) error {
+	unlock, ok := tryRepoBuildLock(id)
+	if !ok {
+		fmt.Fprintf(out, "Skipped %s: building\n", id)
+		return nil
+	}
+	defer unlock()
+	defer rlockRepo(id)()
+	settings, err := loadRepoSettings(id)
+	if err != nil {
+		return err
+	}
+	dirs := []string{id}
+	for _, p := range settings.Projects {
+		dirs = append(dirs, projectDir(id, p))
+	}
+	for _, dir := range dirs {
+		for _, p := range []string{filepath.Join(dir, "build"), filepath.Join(dir, "ios", "build")} {
+			if fi, err := os.Stat(p); err != nil || !fi.IsDir() {
+				continue
+			}
+			if newestModTime(p).After(cutoff) {
+				continue
+			}
+			rel := repoRel(id, p)
+			if tracked, err := gitCmd(id, "ls-files", "--", rel); err != nil || tracked != "" {
+				continue
+			}
+			size := dirSize(p)
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+			rep.add(out, gcBuildOutput, id, rel, size)
+		}
+	}
+	invalidateTreeCache(id)
+	return nil
+}
+
+// collectDerivedData removes DerivedData no build has used since cutoff.
+func collectDerivedData(rep *GCReport, out io.Writer, cutoff time.Time) {
+	fis, err := ioutil.ReadDir(derivedDataDir())
+	if err != nil {
+		return
+	}
+	for _, fi := range fis {
+		p := filepath.Join(derivedDataDir(), fi.Name())
+		if !fi.IsDir() || fi.ModTime().After(cutoff) || newestModTime(p).After(cutoff) {
+			continue
+		}
+		size := dirSize(p)
+		if err := os.RemoveAll(p); err != nil {
+			fmt.Fprintf(out, "Removing %s: %v\n", p, err)
+			continue
+		}
+		rep.add(out, gcDerivedData, "", p, size)
+	}
+}
+
+// collectArtifacts removes the artifacts of the repository's builds that
+// finished before cutoff. The builds' records and logs are kept.
+func collectArtifacts(rep *GCReport, out io.Writer, id string, cutoff time.Time) error {
+	builds, err := repoBuilds(id)
+	if err != nil {
+		return err
+	}
+	for _, b := range builds {
+		if b.Finished == nil || b.Finished.After(cutoff) {
+			continue
+		}
+		dir := buildArtifactsDir(id, b.ID)
+		if !fileExists(dir) {
+			continue
+		}
+		size := dirSize(dir)
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+		rep.add(out, gcArtifact, id, fmt.Sprintf("build %d artifacts", b.Number), size)
+	}
+	return nil
+}
+
+// collectCachedArtifacts removes cached build products not restored since
+// cutoff.
+func collectCachedArtifacts(rep *GCReport, out io.Writer, cutoff time.Time) error {
+	artifactCacheMu.Lock()
+	defer artifactCacheMu.Unlock()
+	index, err := loadCacheIndex()
+	if err != nil {
+		return err
+	}
+	removed := false
+	for key, e := range index {
+		if e.Used.After(cutoff) {
+			continue
+		}
+		if err := os.Remove(artifactCachePath(key)); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(out, "Removing cached %s: %v\n", key, err)
+			continue
+		}
+		delete(index, key)
+		removed = true
+		rep.add(out, gcArtifact, e.Repo, "cache "+e.Commit, e.Size)
+	}
+	if !removed {
+		return nil
+	}
+	return writeJSON(artifactCacheIndex, index)
+}
+
+// collectSimApps uninstalls apps from simulators that haven't been run
+// since cutoff. Apps that fail to uninstall, as from simulators that no
+// longer exist, are forgotten.
+func collectSimApps(rep *GCReport, out io.Writer, cutoff time.Time) error {
+	simAppsMu.Lock()
+	defer simAppsMu.Unlock()
+	var apps []*SimApp
+	if err := readJSON(simAppsName, &apps); err != nil {
+		return err
+	}
+	var kept []*SimApp
+	for _, a := range apps {
+		if a.Installed.After(cutoff) {
+			kept = append(kept, a)
+			continue
+		}
+		var size int64
+		if container, err := simctl("get_app_container", a.Device, a.BundleID); err == nil {
+			size = dirSize(container)
+		}
+		if _, err := simctl("uninstall", a.Device, a.BundleID); err != nil {
+			fmt.Fprintf(out, "Uninstalling %s from %s: %v\n", a.BundleID, a.Device, err)
+			continue
+		}
+		rep.add(out, gcSimApp, a.Repo, a.Device+"/"+a.BundleID, size)
+	}
+	return writeJSON(simAppsName, kept)
+}
+
+// collectGarbage removes build outputs, DerivedData, simulator apps and
+// artifacts older than their retention, reporting the space reclaimed.
+func collectGarbage(out io.Writer) (*GCReport, error) {
+	gcMu.Lock()
+	defer gcMu.Unlock()
+	rep := &GCReport{Started: time.Now(), Items: []*GCItem{}}
+	outputCutoff := time.Now().Add(-buildOutputRetention())
+	artifactCutoff := time.Now().Add(-artifactRetention())
+	ids, err := repoIDs()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if err := collectBuildOutputs(rep, out, id, outputCutoff); err != nil {
+			fmt.Fprintf(out, "%s: %v\n", id, err)
+		}
+		if err := collectArtifacts(rep, out, id, artifactCutoff); err != nil {
+			fmt.Fprintf(out, "%s: %v\n", id, err)
+		}
+	}
+	collectDerivedData(rep, out, outputCutoff)
+	if err := collectCachedArtifacts(rep, out, artifactCutoff); err != nil {
+		fmt.Fprintf(out, "cache: %v\n", err)
+	}
+	if err := collectSimApps(rep, out, time.Now().Add(-simAppRetention())); err != nil {
+		fmt.Fprintf(out, "simulators: %v\n", err)
+	}
+	rep.Finished = time.Now()
+	fmt.Fprintf(out, "Reclaimed %d bytes\n", rep.Reclaimed)
+	audit("gc", "", fmt.Sprintf("%d items (%d bytes)", len(rep.Items), rep.Reclaimed))
+	lastGC = rep
+	return rep, nil
+}
+
+func collectGarbagePeriodically() {
+	interval := gcInterval()
+	if interval <= 0 {
+		return
+	}
+	for {
+		time.Sleep(interval)
+		if _, err := collectGarbage(ioutil.Discard); err != nil {
+			log.Printf("gc: %v", err)
+		}
+	}
+}
+
+func getGarbageCollection(w http.ResponseWriter, r *http.Request) error {
+	gcMu.Lock()
+	rep := lastGC
+	gcMu.Unlock()
+	if rep == nil {
+		return errNotFound
+	}
+	return renderJSON(w, http.StatusOK, rep)
+}
+
+// runGarbageCollection collects garbage now, as a job whose result is the
+// report.
+func runGarbageCollection(w http.ResponseWriter, r *http.Request) error {
+	j := startResultJob("", "gc", func(out io.Writer) (interface{}, error) {
+		return collectGarbage(out)
+	})
+	return renderJSON(w, http.StatusAccepted, j)
+}
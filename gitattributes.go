@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+)
+
+const (
+	eolLF   = "lf"
+	eolCRLF = "crlf"
+
+	// sniffLen is how much of a file git looks at to tell text from
+	// binary: any NUL byte in it makes the file binary.
+	sniffLen = 8000
+)
+
+// checkAttrs returns the values git gives the attributes of the file at
+// rel, from .gitattributes files and .git/info/attributes: "set", "unset",
+// "unspecified", or the value assigned.
+func checkAttrs(id, rel string, attrs ...string) (map[string]string, error) {
+	args := append(append([]string{"check-attr", "-z"}, attrs...), "--", rel)
+	out, err := gitOutput(id, nil, args...)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	fields := splitNul(out)
+	for i := 0; i+2 < len(fields); i += 3 {
+		values[fields[i+1]] = fields[i+2]
+	}
+	return values, nil
+}
+
+// isBinary tells whether content, the start of a file, is binary.
+func isBinary(content []byte) bool {
+	if len(content) > sniffLen {
+		content = content[:sniffLen]
+	}
+	return bytes.IndexByte(content, 0) >= 0
+}
+
+// lineEndings returns eolLF or eolCRLF when all of text's lines end that
+// way, "mixed" when they don't, or "" when it has no line breaks.
+func lineEndings(text []byte) string {
+	lines := bytes.Count(text, []byte("\n"))
+	crlf := bytes.Count(text, []byte("\r\n"))
+	switch {
+	case lines == 0:
+		return ""
+	case crlf == 0:
+		return eolLF
+	case crlf == lines:
+		return eolCRLF
+	}
+	return "mixed"
+}
+
+// sniffFile returns the start of the file at p, or nil if it can't be read.
+func sniffFile(p string) []byte {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	b := make([]byte, sniffLen)
+	n, _ := io.ReadFull(f, b)
+	return b[:n]
+}
+
+// textAttrs classifies the file at rel, whose content starts with start,
+// as git does: binary when its attributes unset text, as with the binary
+// macro, text when they set it, and otherwise by its content.
+func textAttrs(id, rel string, start []byte) (text bool, attrs map[string]string, err error) {
+	if attrs, err = checkAttrs(id, rel, "text", "eol", "crlf"); err != nil {
+		return false, nil, err
+	}
+	switch {
+	case attrs["text"] == "unset" || attrs["crlf"] == "unset":
+		return false, attrs, nil
+	case attrs["text"] == "set" || attrs["eol"] == eolLF || attrs["eol"] == eolCRLF:
+		return true, attrs, nil
+	}
+	return !isBinary(start), attrs, nil
+}
+
+// fileEOL returns the line ending text written to the file at rel, at p,
+// should have: the one its eol attribute asks for, else the one it already
+// uses throughout, else LF if its attributes make it text. It is "" when
+// the file's line endings are to be left as written, as for binary files.
+func fileEOL(id, rel, p string) (string, error) {
+	start := sniffFile(p)
+	text, attrs, err := textAttrs(id, rel, start)
+	if err != nil || !text {
+		return "", err
+	}
+	switch {
+	case attrs["eol"] == eolLF || attrs["eol"] == eolCRLF:
+		return attrs["eol"], nil
+	case attrs["crlf"] == "input":
+		return eolLF, nil
+	}
+	if eol := lineEndings(start); eol == eolLF || eol == eolCRLF {
+		return eol, nil
+	}
+	if start == nil && (attrs["text"] == "set" || attrs["text"] == "auto") {
+		return eolLF, nil
+	}
+	return "", nil
+}
+
+// eolReader converts the line endings of text read from r to eol, leaving
+// lone carriage returns be.
+type eolReader struct {
+	r       *bufio.Reader
+	eol     string
+	pending []byte
+}
+
+func (e *eolReader) Read(p []byte) (int, error) {
+	var err error
+	for len(e.pending) < len(p) && err == nil {
+		var c byte
+		if c, err = e.r.ReadByte(); err != nil {
+			break
+		}
+		switch c {
+		case '\r':
+			if next, perr := e.r.Peek(1); perr == nil && next[0] == '\n' {
+				continue
+			}
+			e.pending = append(e.pending, c)
+		case '\n':
+			e.pending = append(e.pending, e.eol...)
+		default:
+			e.pending = append(e.pending, c)
+		}
+	}
+	if len(e.pending) == 0 {
+		return 0, err
+	}
+	n := copy(p, e.pending)
+	e.pending = e.pending[n:]
+	return n, nil
+}
+
+// textReader returns r, which is to be written to the file at rel, at p,
+// with its line endings converted as fileEOL says, unless it's binary.
+func textReader(id, rel, p string, r io.Reader) (io.Reader, error) {
+	eol, err := fileEOL(id, rel, p)
+	if err != nil || eol == "" {
+		return r, err
+	}
+	br := bufio.NewReaderSize(r, sniffLen)
+	if start, _ := br.Peek(sniffLen); isBinary(start) {
+		return br, nil
+	}
+	e := &eolReader{r: br, eol: "\n"}
+	if eol == eolCRLF {
+		e.eol = "\r\n"
+	}
+	return e, nil
+}
+
+// setTextHeaders describes the file at rel, whose content starts with
+// start, in the headers of a response serving it. X-File-Kind is text or
+// binary, by the file's attributes or else its content, and for text,
+// X-Line-Endings is lf, crlf or mixed. Files whose extension has no media
+// type are served as plain text or as bytes accordingly.
+func setTextHeaders(h http.Header, id, rel string, start []byte) error {
+	text, _, err := textAttrs(id, rel, start)
+	if err != nil {
+		return err
+	}
+	known := mime.TypeByExtension(path.Ext(rel)) != ""
+	if !text {
+		h.Set("X-File-Kind", "binary")
+		if !known {
+			h.Set("Content-Type", "application/octet-stream")
+		}
+		return nil
+	}
+	h.Set("X-File-Kind", "text")
+	if !known {
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	if eol := lineEndings(start); eol != "" {
+		h.Set("X-Line-Endings", eol)
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+const githubAPI = "https://api.github.com"
+
+var (
+	regexpGitHubRemote = regexp.MustCompile(
+		`github\.com[:/]([^/]+)/([^/]+?)(\.git)?/?$`)
+	regexpBranchName = regexp.MustCompile(`^[A-Za-z0-9._/-]+$`)
+)
+
+type PullRequest struct {
+	Number int    `json:"number"`
+	Title  string `json:"title"`
+	Body   string `json:"body,omitempty"`
+	State  string `json:"state"`
+	URL    string `json:"url"`
+	Head   string `json:"head"`
+	Base   string `json:"base"`
+	User   string `json:"user,omitempty"`
+}
+
+type githubPull struct {
+	Number  int    `json:"number"`
+	Title   string `json:"title"`
+	Body    string `json:"body"`
+	State   string `json:"state"`
+	HTMLURL string `json:"html_url"`
+	Head    struct {
+		Ref string `json:"ref"`
+	} `json:"head"`
+	Base struct {
+		Ref string `json:"ref"`
+	} `json:"base"`
+	User struct {
+		Login string `json:"login"`
+	} `json:"user"`
+}
+
+func (p *githubPull) pullRequest() *PullRequest {
+	return &PullRequest{
+		Number: p.Number,
+		Title:  p.Title,
+		Body:   p.Body,
+		State:  p.State,
+		URL:    p.HTMLURL,
+		Head:   p.Head.Ref,
+		Base:   p.Base.Ref,
+		User:   p.User.Login,
+	}
+}
+
+// githubRepo returns the owner and name of the GitHub repository the
+// origin remote of repoPath points to.
+func githubRepo(repoPath string) (string, string, error) {
+	remote, err := gitRemote(repoPath)
+	if err != nil {
+		return "", "", err
+	}
+	m := regexpGitHubRemote.FindStringSubmatch(remote)
+	if m == nil {
+		return "", "", &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("origin is not a GitHub remote")}
+	}
+	return m[1], m[2], nil
+}
+
+func githubRequest(method, path string, body, v interface{}) error {
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, githubAPI+path, rd)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "token "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		status := resp.StatusCode
+		if status >= 500 {
+			status = http.StatusBadGateway
+		}
+		return &httputil.HTTPError{status,
+			fmt.Errorf("github: %s", e.Message)}
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func createBranch(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	var req struct {
+		Name string `json:"name"`
+		From string `json:"from"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	if !validRef(req.Name) {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("invalid branch name")}
+	}
+	if strings.HasPrefix(req.From, "-") {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("invalid starting point")}
+	}
+
+	defer rlockRepo(id)()
+	args := []string{"checkout", "-b", req.Name}
+	if req.From != "" {
+		from, err := gitCmd(id, "rev-parse", "--verify", "--end-of-options",
+			req.From+"^{commit}")
+		if err != nil {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				fmt.Errorf("unknown starting point %q", req.From)}
+		}
+		args = append(args, from)
+	}
+	if _, err := gitCmd(id, args...); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	head, err := gitCmd(id, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+
+	return renderJSON(w, http.StatusCreated, map[string]string{
+		"name": req.Name,
+		"head": head,
+	})
+}
+
+func listPulls(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	owner, name, err := githubRepo(id)
+	if err != nil {
+		return err
+	}
+
+	var pulls []githubPull
+	if err := githubRequest("GET",
+		fmt.Sprintf("/repos/%s/%s/pulls?state=open", owner, name),
+		nil, &pulls); err != nil {
+		return err
+	}
+
+	prs := []*PullRequest{}
+	for i := range pulls {
+		prs = append(prs, pulls[i].pullRequest())
+	}
+	return renderJSON(w, http.StatusOK, prs)
+}
+
+func createPull(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	var req struct {
+		Title string `json:"title"`
+		Body  string `json:"body"`
+		Head  string `json:"head"`
+		Base  string `json:"base"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	if req.Title == "" {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("title is required")}
+	}
+
+	owner, name, err := githubRepo(id)
+	if err != nil {
+		return err
+	}
+
+	if req.Head == "" {
+		if req.Head, err = gitCmd(id, "rev-parse", "--abbrev-ref",
+			"HEAD"); err != nil {
+			return err
+		}
+	}
+	if req.Base == "" {
+		var info struct {
+			DefaultBranch string `json:"default_branch"`
+		}
+		if err := githubRequest("GET",
+			fmt.Sprintf("/repos/%s/%s", owner, name), nil, &info); err != nil {
+			return err
+		}
+		req.Base = info.DefaultBranch
+	}
+	if !validRef(req.Head) || !validRef(req.Base) {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("invalid branch name")}
+	}
+	if req.Head == req.Base {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("head and base must differ")}
+	}
+
+	if _, err := gitCmd(id, "push", "-u", "--", "origin", req.Head); err != nil {
+		return &httputil.HTTPError{http.StatusBadGateway, err}
+	}
+
+	var pull githubPull
+	if err := githubRequest("POST",
+		fmt.Sprintf("/repos/%s/%s/pulls", owner, name), &req,
+		&pull); err != nil {
+		return err
+	}
+
+	return renderJSON(w, http.StatusCreated, pull.pullRequest())
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+// emptyTree is the hash of git's empty tree, which uncommitted changes are
+// compared with before the first commit.
+const emptyTree = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+var statusNames = map[byte]string{
+	'M': "modified",
+	'T': "typechange",
+	'A': "added",
+	'D': "deleted",
+	'R': "renamed",
+	'C': "copied",
+}
+
+// unmergedStatuses are the porcelain codes of paths with merge conflicts.
+var unmergedStatuses = map[string]bool{
+	"DD": true, "AU": true, "UD": true, "UA": true, "DU": true, "AA": true, "UU": true,
+}
+
+// StatusEntry is a changed path. From is the path it was renamed or copied
+// from.
+type StatusEntry struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	From   string `json:"from,omitempty"`
+}
+
+// WorkingStatus lists the uncommitted changes of a repository: those
+// staged, those in the working tree that aren't, untracked files and paths
+// with conflicts. A path may be both staged and modified.
+type WorkingStatus struct {
+	Branch     string         `json:"branch"`
+	Staged     []*StatusEntry `json:"staged"`
+	Modified   []*StatusEntry `json:"modified"`
+	Untracked  []string       `json:"untracked"`
+	Conflicted []string       `json:"conflicted"`
+}
+
+// gitOutput runs git like gitCmd, but returns its output untrimmed, for
+// formats where leading spaces and final newlines matter. Exit codes in ok
+// aren't errors.
+func gitOutput(id string, ok []int, arg ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", arg...)
+	cmd.Dir = id
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if exit, isExit := err.(*exec.ExitError); isExit {
+		for _, code := range ok {
+			if exit.ExitCode() == code {
+				return out, nil
+			}
+		}
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("git %s: %s", arg[0], msg)
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// splitNul splits the output of a git command given -z into its fields.
+func splitNul(out []byte) []string {
+	if len(out) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+}
+
+func readWorkingStatus(id string) (*WorkingStatus, error) {
+	out, err := gitOutput(id, nil, "status", "--porcelain=v1", "-z",
+		"--branch", "--untracked-files=all")
+	if err != nil {
+		return nil, err
+	}
+	st := &WorkingStatus{
+		Staged:     []*StatusEntry{},
+		Modified:   []*StatusEntry{},
+		Untracked:  []string{},
+		Conflicted: []string{},
+	}
+	fields := strings.Split(string(out), "\x00")
+	for i := 0; i < len(fields); i++ {
+		f := fields[i]
+		if strings.HasPrefix(f, "## ") {
+			branch := strings.TrimPrefix(f, "## ")
+			branch = strings.TrimPrefix(branch, "No commits yet on ")
+			if j := strings.Index(branch, "..."); j >= 0 {
+				branch = branch[:j]
+			}
+			if strings.HasPrefix(branch, "HEAD ") {
+				// A detached HEAD is on no branch.
+				branch = ""
+			}
+			st.Branch = branch
+			continue
+		}
+		if len(f) < 4 {
+			continue
+		}
+		x, y, path := f[0], f[1], f[3:]
+		from := ""
+		if x == 'R' || x == 'C' {
+			// The source of a rename or copy follows as its own field.
+			if i+1 < len(fields) {
+				i++
+				from = fields[i]
+			}
+		}
+		switch {
+		case x == '?':
+			st.Untracked = append(st.Untracked, path)
+		case x == '!':
+		case unmergedStatuses[f[:2]]:
+			st.Conflicted = append(st.Conflicted, path)
+		default:
+			if name, ok := statusNames[x]; ok {
+				st.Staged = append(st.Staged, &StatusEntry{Path: path, Status: name, From: from})
+			}
+			if name, ok := statusNames[y]; ok {
+				st.Modified = append(st.Modified, &StatusEntry{Path: path, Status: name})
+			}
+		}
+	}
+	return st, nil
+}
+
+func getRepoStatus(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	defer rlockRepo(id)()
+	st, err := readWorkingStatus(id)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, st)
+}
+
+// getRepoDiff renders the uncommitted changes of the repository, or of the
+// file or directory named by path, as a unified diff against HEAD. Staged
+// and unstaged changes are shown together, or only those staged with
+// staged=1. Untracked files are shown as added unless staged=1.
+func getRepoDiff(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	q := r.URL.Query()
+	staged := q.Get("staged") == "1"
+	rel := "."
+	if p := q.Get("path"); strings.Trim(p, "/") != "" {
+		var err error
+		if rel, err = cleanRel(p); err != nil {
+			return err
+		}
+		if hasGitDir(rel) {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				errors.New("invalid path " + p)}
+		}
+	}
+
+	defer rlockRepo(id)()
+	diff, err := repoDiff(id, rel, staged)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+	_, err = w.Write(diff)
+	return err
+}
+
+// repoDiff returns the uncommitted changes under rel. The caller holds the
+// repository lock.
+func repoDiff(id, rel string, staged bool) ([]byte, error) {
+	base := "HEAD"
+	if _, err := gitCmd(id, "rev-parse", "--verify", "--quiet", "HEAD"); err != nil {
+		base = emptyTree
+	}
+	args := []string{"diff", "--no-color", "--no-ext-diff"}
+	if staged {
+		args = append(args, "--cached")
+	}
+	args = append(args, base, "--", rel)
+	diff, err := gitOutput(id, nil, args...)
+	if err != nil {
+		return nil, err
+	}
+	if !staged {
+		out, err := gitOutput(id, nil, "ls-files", "--others", "--exclude-standard", "-z", "--", rel)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range strings.Split(string(out), "\x00") {
+			if path == "" {
+				continue
+			}
+			// git diff --no-index exits with 1 when the files differ, as
+			// a new file always does.
+			d, err := gitOutput(id, []int{1}, "diff", "--no-color", "--no-ext-diff",
+				"--no-index", "--", os.DevNull, path)
+			if err != nil {
+				return nil, err
+			}
+			diff = append(diff, d...)
+		}
+	}
+	return diff, nil
+}
+
+// ResetResult reports where a reset moved HEAD from and to.
+type ResetResult struct {
+	Mode string `json:"mode"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+// resetRepo moves HEAD to ref, HEAD by default. A soft reset keeps every
+// change, staged; a mixed one keeps them unstaged. A hard reset throws
+// away uncommitted changes to tracked files, and with clean untracked
+// files too, so it needs confirm.
+func resetRepo(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	var req struct {
+		Mode    string `json:"mode"`
+		Ref     string `json:"ref"`
+		Clean   bool   `json:"clean"`
+		Confirm bool   `json:"confirm"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	switch req.Mode {
+	case "soft", "mixed":
+		if req.Clean {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				errors.New("clean needs a hard reset")}
+		}
+	case "hard":
+		if !req.Confirm {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				errors.New("a hard reset discards uncommitted changes; set confirm to go ahead")}
+		}
+	default:
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("mode must be soft, mixed or hard")}
+	}
+	if req.Ref == "" {
+		req.Ref = "HEAD"
+	}
+	if strings.HasPrefix(req.Ref, "-") {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("invalid ref")}
+	}
+
+	defer rlockRepo(id)()
+	old, err := gitCmd(id, "rev-parse", "HEAD")
+	if err != nil {
+		return &httputil.HTTPError{http.StatusConflict,
+			errors.New("repository has no commits")}
+	}
+	sha, err := gitCmd(id, "rev-parse", "--verify", "--quiet", req.Ref+"^{commit}")
+	if err != nil {
+		return &httputil.HTTPError{http.StatusNotFound,
+			fmt.Errorf("unknown ref %s", req.Ref)}
+	}
+	if err := checkResetOwners(r, id, sha, req.Mode == "hard", req.Clean); err != nil {
+		return err
+	}
+	if _, err := gitCmd(id, "reset", "--"+req.Mode, sha); err != nil {
+		return err
+	}
+	if req.Clean {
+		if _, err := gitCmd(id, "clean", "-f", "-d"); err != nil {
+			return err
+		}
+	}
+	if req.Mode == "hard" {
+		audit("reset", id, fmt.Sprintf("%s to %s clean=%t", old, sha, req.Clean))
+	}
+	invalidateTreeCache(id)
+	publish(&Event{Type: eventRepoEdited, Repo: id,
+		Data: map[string]interface{}{"action": "reset", "mode": req.Mode,
+			"old": old, "new": sha}})
+	return renderJSON(w, http.StatusOK, &ResetResult{Mode: req.Mode, Old: old, New: sha})
+}
+
+// checkResetOwners checks the user owns the files a reset to sha changes:
+// those committed differently there, which like a commit can't wait for
+// approval, and with hard those changed in the working tree, and with
+// clean the untracked files. The caller holds the repository lock.
+func checkResetOwners(r *http.Request, id, sha string, hard, clean bool) error {
+	out, err := gitOutput(id, nil, "diff", "--name-only", "-z", "HEAD", sha)
+	if err != nil {
+		return err
+	}
+	if owned, err := checkCommitOwners(r, id, splitNul(out)); err != nil {
+		return err
+	} else if owned != nil {
+		return ownedError(owned)
+	}
+	var discarded []string
+	if hard {
+		if out, err = gitOutput(id, nil, "diff", "--name-only", "-z", "HEAD"); err != nil {
+			return err
+		}
+		discarded = append(discarded, splitNul(out)...)
+	}
+	if clean {
+		if out, err = gitOutput(id, nil, "ls-files", "--others", "--exclude-standard", "-z"); err != nil {
+			return err
+		}
+		discarded = append(discarded, splitNul(out)...)
+	}
+	return checkOwners(r, id, discarded...)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+const (
+	trackerGitHub = "github"
+	trackerJira   = "jira"
+)
+
+var (
+	regexpGitHubIssue = regexp.MustCompile(`(?:^|[^\w&/])#(\d+)\b`)
+	regexpJiraIssue   = regexp.MustCompile(`\b([A-Z][A-Z0-9]+-\d+)\b`)
+)
+
+type IssueRef struct {
+	Key     string `json:"key"`
+	Tracker string `json:"tracker"`
+	URL     string `json:"url,omitempty"`
+}
+
+type Branch struct {
+	Name    string      `json:"name"`
+	Head    string      `json:"head"`
+	Current bool        `json:"current"`
+	Issues  []*IssueRef `json:"issues,omitempty"`
+}
+
+type issueLinker struct {
+	githubURL string
+	jiraURL   string
+}
+
+func newIssueLinker(id string) *issueLinker {
+	l := &issueLinker{}
+	if owner, name, err := githubRepo(id); err == nil {
+		l.githubURL = fmt.Sprintf("https://github.com/%s/%s/issues/", owner, name)
+	}
+	if s, err := loadRepoSettings(id); err == nil && s.JiraURL != "" {
+		l.jiraURL = strings.TrimSuffix(s.JiraURL, "/") + "/browse/"
+	}
+	return l
+}
+
+// find returns the issues referenced in texts, in order of first mention.
+func (l *issueLinker) find(texts ...string) []*IssueRef {
+	var refs []*IssueRef
+	seen := make(map[string]bool)
+	for _, text := range texts {
+		if l.githubURL != "" {
+			for _, m := range regexpGitHubIssue.FindAllStringSubmatch(text, -1) {
+				key := "#" + m[1]
+				if !seen[key] {
+					seen[key] = true
+					refs = append(refs, &IssueRef{key, trackerGitHub,
+						l.githubURL + m[1]})
+				}
+			}
+		}
+		for _, m := range regexpJiraIssue.FindAllStringSubmatch(text, -1) {
+			if !seen[m[1]] {
+				seen[m[1]] = true
+				ref := &IssueRef{Key: m[1], Tracker: trackerJira}
+				if l.jiraURL != "" {
+					ref.URL = l.jiraURL + m[1]
+				}
+				refs = append(refs, ref)
+			}
+		}
+	}
+	return refs
+}
+
+func listBranches(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	out, err := gitCmd(id, "for-each-ref",
+		"--format=%(refname:short)%1f%(objectname)%1f%(HEAD)", "refs/heads")
+	if err != nil {
+		return err
+	}
+	linker := newIssueLinker(id)
+	branches := []*Branch{}
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Split(line, "\x1f")
+		if len(f) != 3 {
+			continue
+		}
+		// Branch names use separators instead of spaces, e.g.
+		// feature/ABC-123-login or fix-#42.
+		name := strings.NewReplacer("/", " ", "_", " ").Replace(f[0])
+		branches = append(branches, &Branch{
+			Name:    f[0],
+			Head:    f[1],
+			Current: f[2] == "*",
+			Issues:  linker.find(name),
+		})
+	}
+	return renderJSON(w, http.StatusOK, branches)
+}
+
+// findGitHubRepo returns the ID of the cloned repository whose origin is
+// owner/name on GitHub.
+func findGitHubRepo(owner, name string) string {
+	ids, err := repoIDs()
+	if err != nil {
+		return ""
+	}
+	for _, id := range ids {
+		o, n, err := githubRepo(id)
+		if err == nil && strings.EqualFold(o, owner) && strings.EqualFold(n, name) {
+			return id
+		}
+	}
+	return ""
+}
+
+func verifyGitHubSignature(r *http.Request, body []byte) bool {
+	secret := os.Getenv("GITHUB_WEBHOOK_SECRET")
+	if secret == "" {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Hub-Signature-256")))
+}
+
+// githubWebhook receives GitHub events. When a pull request is merged the
+// issues it references are posted to the repository's issue webhooks so
+// trackers can transition them.
+func githubWebhook(w http.ResponseWriter, r *http.Request) error {
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if !verifyGitHubSignature(r, body) {
+		return &httputil.HTTPError{http.StatusForbidden,
+			fmt.Errorf("invalid webhook signature")}
+	}
+	if r.Header.Get("X-GitHub-Event") != "pull_request" {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	var ev struct {
+		Action      string `json:"action"`
+		PullRequest struct {
+			Number int    `json:"number"`
+			Title  string `json:"title"`
+			Body   string `json:"body"`
+			Merged bool   `json:"merged"`
+			URL    string `json:"html_url"`
+			Head   struct {
+				Ref string `json:"ref"`
+			} `json:"head"`
+		} `json:"pull_request"`
+		Repository struct {
+			Name  string `json:"name"`
+			Owner struct {
+				Login string `json:"login"`
+			} `json:"owner"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &ev); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	if ev.Action != "closed" || !ev.PullRequest.Merged {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	id := findGitHubRepo(ev.Repository.Owner.Login, ev.Repository.Name)
+	if id == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	settings, err := loadRepoSettings(id)
+	if err != nil {
+		return err
+	}
+	pr := ev.PullRequest
+	issues := newIssueLinker(id).find(pr.Title, pr.Body,
+		strings.NewReplacer("/", " ", "_", " ").Replace(pr.Head.Ref))
+	if len(issues) == 0 || len(settings.IssueWebhooks) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"repo":       id,
+		"pull":       pr.Number,
+		"url":        pr.URL,
+		"transition": settings.IssueTransition,
+		"issues":     issues,
+	})
+	if err != nil {
+		return err
+	}
+	for _, hook := range settings.IssueWebhooks {
+		go func(hook string) {
+			resp, err := http.Post(hook, "application/json", bytes.NewReader(payload))
+			if err != nil {
+				log.Println("issue webhook:", err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				log.Printf("issue webhook: %s: %s", hook, resp.Status)
+			}
+		}(hook)
+	}
+	return renderJSON(w, http.StatusOK, issues)
+}
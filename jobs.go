@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+
+	defaultJobRetention = 24 * time.Hour
+)
+
+// jobRetention is how long finished jobs are kept in memory, set with
+// JOB_RETENTION. Their logs stay on disk after.
+func jobRetention() time.Duration {
+	return envDuration("JOB_RETENTION", defaultJobRetention)
+}
+
+// Job is a long running command executed in the background on behalf of
+// a repository, e.g. "pod install".
+type Job struct {
+	ID       string
+	Repo     string
+	Kind     string
+	State    string
+	Created  time.Time
+	Started  time.Time
+	Finished time.Time
+	Error    string
+	Result   interface{}
+
+	mu   sync.Mutex
+	log  ringBuffer
+	done chan struct{} // closed once the job is over
+}
+
+func (j *Job) MarshalJSON() ([]byte, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	v := struct {
+		ID       string      `json:"id"`
+		Repo     string      `json:"repo"`
+		Kind     string      `json:"kind"`
+		State    string      `json:"state"`
+		Created  time.Time   `json:"created"`
+		Started  *time.Time  `json:"started,omitempty"`
+		Finished *time.Time  `json:"finished,omitempty"`
+		Error    string      `json:"error,omitempty"`
+		Result   interface{} `json:"result,omitempty"`
+		Log      string      `json:"log"`
+	}{
+		ID:      j.ID,
+		Repo:    j.Repo,
+		Kind:    j.Kind,
+		State:   j.State,
+		Created: j.Created,
+		Error:   j.Error,
+		Result:  j.Result,
+		Log:     j.log.String(),
+	}
+	if !j.Started.IsZero() {
+		v.Started = &j.Started
+	}
+	if !j.Finished.IsZero() {
+		v.Finished = &j.Finished
+	}
+	// Results can hold command output, which may contain secrets.
+	b, err := json.Marshal(&v)
+	if err != nil {
+		return nil, err
+	}
+	return redactJSON(b), nil
+}
+
+var (
+	jobsMu sync.Mutex
+	jobs   = make(map[string]*Job)
+)
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func findJob(id string) *Job {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	return jobs[id]
+}
+
+// startJob runs fn in the background, capturing everything it writes, and
+// publishes a job event when it finishes. The repository is locked for
+// reading while fn runs; jobs for no repository, which may lock several
+// themselves, aren't given a lock.
+func startJob(repo, kind string, fn func(out io.Writer) error) *Job {
+	return startResultJob(repo, kind, func(out io.Writer) (interface{}, error) {
+		return nil, fn(out)
+	})
+}
+
+// startResultJob is like startJob for jobs that produce a result, which is
+// reported alongside the job's state.
+func startResultJob(repo, kind string,
+	fn func(out io.Writer) (interface{}, error)) *Job {
+	j := &Job{
+		ID:      newID(),
+		Repo:    repo,
+		Kind:    kind,
+		State:   jobQueued,
+		Created: time.Now(),
+		done:    make(chan struct{}),
+	}
+	jobsMu.Lock()
+	jobs[j.ID] = j
+	jobsMu.Unlock()
+
+	go func() {
+		j.mu.Lock()
+		j.State = jobRunning
+		j.Started = time.Now()
+		j.mu.Unlock()
+
+		if err := j.log.persist("jobs", j.ID); err != nil {
+			log.Printf("job %s: %v", j.ID, err)
+		}
+		unlock := func() {}
+		if repo != "" {
+			unlock = rlockRepo(repo)
+		}
+		rw := newRedactWriter(&j.log)
+		result, err := fn(rw)
+		rw.Flush()
+		unlock()
+		j.log.Close()
+
+		j.mu.Lock()
+		j.Finished = time.Now()
+		j.Result = result
+		e := &Event{Type: eventJobSucceeded, Repo: repo,
+			Data: map[string]interface{}{"job": j.ID, "kind": kind}}
+		if err != nil {
+			j.State = jobFailed
+			j.Error = redact(err.Error())
+			e.Type = eventJobFailed
+			e.Data["error"] = j.Error
+		} else {
+			j.State = jobSucceeded
+		}
+		j.mu.Unlock()
+		close(j.done)
+		publish(e)
+		time.AfterFunc(jobRetention(), func() {
+			jobsMu.Lock()
+			delete(jobs, j.ID)
+			jobsMu.Unlock()
+		})
+	}()
+	return j
+}
+
+// repoJobs returns the jobs of the given kind started for repo.
+func repoJobs(repo, kind string) []*Job {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	var list []*Job
+	for _, j := range jobs {
+		if j.Repo == repo && j.Kind == kind {
+			list = append(list, j)
+		}
+	}
+	return list
+}
+
+// getJobLog serves the log of a job, still there once the job is gone.
+func getJobLog(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if b, err := hex.DecodeString(id); err != nil || len(b) != 8 {
+		return errNotFound
+	}
+	return serveLogFile(w, r, "jobs", id)
+}
+
+func getJob(w http.ResponseWriter, r *http.Request) error {
+	j := findJob(mux.Vars(r)["id"])
+	if j == nil {
+		return errNotFound
+	}
+	return renderJSON(w, http.StatusOK, j)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// lineWriter calls fn with each complete line written to it, without the
+// trailing newline. A final partial line is delivered by Flush.
+type lineWriter struct {
+	fn func(line string)
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func newLineWriter(fn func(line string)) *lineWriter {
+	return &lineWriter{fn: fn}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		line := string(bytes.TrimRight(w.buf.Next(i+1), "\r\n"))
+		w.fn(line)
+	}
+	return len(p), nil
+}
+
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.buf.Len() > 0 {
+		w.fn(w.buf.String())
+		w.buf.Reset()
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+const (
+	defaultTreeDepth    = 1
+	defaultTreePageSize = 1000
+)
+
+// TreePage is a directory listed by the tree endpoint. When the directory
+// has more entries than fit in a page, Next is the name to pass as after
+// to get the rest.
+type TreePage struct {
+	Path string    `json:"path"`
+	Node *FileNode `json:"node"`
+	Next string    `json:"next,omitempty"`
+}
+
+// listDir reads the subtree at path from disk, depth levels deep.
+// Directories below that are marked collapsed. Like the watched tree, it
+// stops at the tree limits, marking the directories it couldn't finish as
+// truncated.
+func listDir(id, path string, f os.FileInfo, depth int) *FileNode {
+	loadTreeLimits()
+	return (&repoTree{id: id}).list(path, f, depth)
+}
+
+func (t *repoTree) list(path string, f os.FileInfo, depth int) *FileNode {
+	node := newFileNode(t.id, path, f)
+	t.files++
+	if !f.IsDir() {
+		t.size += f.Size()
+		return node
+	}
+	if depth <= 0 {
+		node.Collapsed = true
+		return node
+	}
+	entries, _ := ioutil.ReadDir(path)
+	for _, e := range entries {
+		if excludedName(e.Name()) {
+			continue
+		}
+		if t.full() {
+			node.Truncated = true
+			break
+		}
+		node.Children[e.Name()] = t.list(filepath.Join(path, e.Name()), e, depth-1)
+	}
+	return node
+}
+
+// pruneNode returns a copy of n cut to depth levels.
+func pruneNode(n *FileNode, depth int) *FileNode {
+	c := *n
+	if n.Type != typeDir {
+		return &c
+	}
+	c.Children = make(map[string]*FileNode)
+	if depth <= 0 {
+		c.Collapsed = true
+		return &c
+	}
+	for k, v := range n.Children {
+		c.Children[k] = pruneNode(v, depth-1)
+	}
+	return &c
+}
+
+// repoTreeAt returns the node at the repository relative path rel with
+// depth levels below it, or the whole cached subtree when depth is zero.
+// Partial repositories are listed from git, since most of their files
+// aren't on disk. Listings other than the watched tree are cached until
+// the checkout or the listed directory changes.
+func repoTreeAt(id, rel string, partial bool, depth int) *FileNode {
+	if depth == 0 && !partial {
+		return listTreeAt(id, rel, partial, depth)
+	}
+	return cachedListing(id, treeCacheKey(id, rel, partial, depth),
+		currentTreeStamp(id, rel), func() *FileNode {
+			return listTreeAt(id, rel, partial, depth)
+		})
+}
+
+func listTreeAt(id, rel string, partial bool, depth int) *FileNode {
+	var parts []string
+	if rel != "" {
+		parts = strings.Split(rel, "/")
+	}
+	if depth == 0 || partial {
+		var root *FileNode
+		if partial {
+			root = gitTree(id)
+		} else {
+			root = cachedTree(id)
+		}
+		if root == nil {
+			return nil
+		}
+		n := lookupNode(root, parts)
+		if n == nil || depth == 0 {
+			return n
+		}
+		return pruneNode(n, depth)
+	}
+	if skipTreePath(rel) {
+		return nil
+	}
+	p := filepath.Join(id, filepath.FromSlash(rel))
+	f, err := os.Lstat(p)
+	if err != nil {
+		return nil
+	}
+	return listDir(id, p, f, depth)
+}
+
+// treeDepth reads the depth query parameter: the default when absent, or
+// zero for the whole tree.
+func treeDepth(r *http.Request) (int, error) {
+	s := r.URL.Query().Get("depth")
+	if s == "" {
+		return defaultTreeDepth, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("depth must be a non-negative integer")}
+	}
+	loadTreeLimits()
+	if treeLimits.maxDepth > 0 && n > treeLimits.maxDepth {
+		n = treeLimits.maxDepth
+	}
+	return n, nil
+}
+
+// getRepoTree lists a directory of the repository on demand. Entries of
+// the directory are paged by name with limit and after.
+func getRepoTree(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	q := r.URL.Query()
+	rel := strings.TrimPrefix(path.Clean("/"+q.Get("path")), "/")
+	depth, err := treeDepth(r)
+	if err != nil {
+		return err
+	}
+	limit := defaultTreePageSize
+	if s := q.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				errors.New("limit must be a positive integer")}
+		}
+	}
+
+	if rel != "" {
+		if err := confined(id, filepath.Join(id, filepath.FromSlash(rel))); err != nil {
+			if os.IsNotExist(err) {
+				return errNotFound
+			}
+			return err
+		}
+	}
+	n := repoTreeAt(id, rel, isPartial(id), depth)
+	if n == nil {
+		return errNotFound
+	}
+	page := &TreePage{Path: rel, Node: n}
+	if n.Type == typeDir {
+		names := make([]string, 0, len(n.Children))
+		for name := range n.Children {
+			if name > q.Get("after") {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		if len(names) > limit {
+			names = names[:limit]
+			page.Next = names[limit-1]
+		}
+		c := *n
+		c.Children = make(map[string]*FileNode, len(names))
+		for _, name := range names {
+			c.Children[name] = n.Children[name]
+		}
+		page.Node = &c
+	}
+
+	bw := bufio.NewWriter(w)
+	w.WriteHeader(http.StatusOK)
+	if err := writeTreePageJSON(bw, page); err != nil {
+		return err
+	}
+	bw.WriteByte('\n')
+	return flushJSON(bw, w)
+}
@@ -0,0 +1,691 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+var regexpLanguage = regexp.MustCompile(`^(Base|[a-z]{2,3}([-_][A-Za-z0-9]+)*)$`)
+
+const (
+	formatStrings   = "strings"
+	formatXCStrings = "xcstrings"
+)
+
+// LocalizationTable is one strings table, either a set of
+// <lang>.lproj/<name>.strings(dict) files or a String Catalog. Plural
+// variants from .stringsdict files are exposed as "key#variable.category".
+type LocalizationTable struct {
+	Name           string           `json:"name"`
+	Format         string           `json:"format"`
+	SourceLanguage string           `json:"sourceLanguage"`
+	Languages      []*LanguageStats `json:"languages"`
+
+	path  string // catalog file, or the directory holding the .lproj folders
+	langs map[string]bool
+}
+
+type LanguageStats struct {
+	Language     string  `json:"language"`
+	Total        int     `json:"total"`
+	Translated   int     `json:"translated"`
+	Completeness float64 `json:"completeness"`
+}
+
+// stringsEntry is a key/value pair in a .strings file along with the byte
+// range of the value token, so values can be replaced in place without
+// losing comments or ordering.
+type stringsEntry struct {
+	Key        string
+	Value      string
+	start, end int
+}
+
+func decodeStringsFile(b []byte) string {
+	switch {
+	case bytes.HasPrefix(b, []byte{0xff, 0xfe}), bytes.HasPrefix(b, []byte{0xfe, 0xff}):
+		big := b[0] == 0xfe
+		b = b[2:]
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			if big {
+				u[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+			} else {
+				u[i] = uint16(b[2*i+1])<<8 | uint16(b[2*i])
+			}
+		}
+		return string(utf16.Decode(u))
+	case bytes.HasPrefix(b, []byte{0xef, 0xbb, 0xbf}):
+		return string(b[3:])
+	}
+	return string(b)
+}
+
+type stringsParser struct {
+	s   string
+	pos int
+}
+
+func (p *stringsParser) skip() error {
+	for p.pos < len(p.s) {
+		switch {
+		case strings.HasPrefix(p.s[p.pos:], "/*"):
+			end := strings.Index(p.s[p.pos+2:], "*/")
+			if end < 0 {
+				return errors.New("unterminated comment")
+			}
+			p.pos += end + 4
+		case strings.HasPrefix(p.s[p.pos:], "//"):
+			end := strings.IndexByte(p.s[p.pos:], '\n')
+			if end < 0 {
+				end = len(p.s) - p.pos
+			}
+			p.pos += end
+		case strings.ContainsRune(" \t\r\n", rune(p.s[p.pos])):
+			p.pos++
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (p *stringsParser) token() (string, error) {
+	if p.pos >= len(p.s) {
+		return "", errors.New("unexpected end of file")
+	}
+	if p.s[p.pos] != '"' {
+		start := p.pos
+		for p.pos < len(p.s) && !strings.ContainsRune(" \t\r\n=;", rune(p.s[p.pos])) {
+			p.pos++
+		}
+		if start == p.pos {
+			return "", fmt.Errorf("unexpected %q at offset %d", p.s[p.pos], p.pos)
+		}
+		return p.s[start:p.pos], nil
+	}
+
+	var buf strings.Builder
+	for p.pos++; p.pos < len(p.s); p.pos++ {
+		c := p.s[p.pos]
+		if c == '"' {
+			p.pos++
+			return buf.String(), nil
+		}
+		if c != '\\' || p.pos+1 >= len(p.s) {
+			buf.WriteByte(c)
+			continue
+		}
+		p.pos++
+		switch c = p.s[p.pos]; c {
+		case 'n':
+			buf.WriteByte('\n')
+		case 't':
+			buf.WriteByte('\t')
+		case 'r':
+			buf.WriteByte('\r')
+		case 'U', 'u':
+			if p.pos+4 < len(p.s) {
+				if r, err := strconv.ParseUint(p.s[p.pos+1:p.pos+5], 16, 32); err == nil {
+					buf.WriteRune(rune(r))
+					p.pos += 4
+					continue
+				}
+			}
+			buf.WriteByte(c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return "", errors.New("unterminated string")
+}
+
+func (p *stringsParser) expect(c byte) error {
+	if err := p.skip(); err != nil {
+		return err
+	}
+	if p.pos >= len(p.s) || p.s[p.pos] != c {
+		return fmt.Errorf("expected %q at offset %d", c, p.pos)
+	}
+	p.pos++
+	return nil
+}
+
+func parseStrings(s string) ([]*stringsEntry, error) {
+	p := &stringsParser{s: s}
+	var entries []*stringsEntry
+	for {
+		if err := p.skip(); err != nil {
+			return nil, err
+		}
+		if p.pos >= len(s) {
+			return entries, nil
+		}
+		key, err := p.token()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect('='); err != nil {
+			return nil, err
+		}
+		if err := p.skip(); err != nil {
+			return nil, err
+		}
+		e := &stringsEntry{Key: key, start: p.pos}
+		if e.Value, err = p.token(); err != nil {
+			return nil, err
+		}
+		e.end = p.pos
+		if err := p.expect(';'); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+}
+
+func quoteStrings(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`, "\r", `\r`)
+	return `"` + r.Replace(s) + `"`
+}
+
+func readStrings(path string) (string, []*stringsEntry, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	s := decodeStringsFile(b)
+	entries, err := parseStrings(s)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return s, entries, nil
+}
+
+// writeStrings sets values in a .strings file, replacing existing values in
+// place and appending new keys. The file is written back as UTF-8.
+func writeStrings(path string, values map[string]string) error {
+	s, entries, err := readStrings(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	seen := make(map[string]bool)
+	var buf strings.Builder
+	last := 0
+	for _, e := range entries {
+		v, ok := values[e.Key]
+		if !ok {
+			continue
+		}
+		seen[e.Key] = true
+		buf.WriteString(s[last:e.start])
+		buf.WriteString(quoteStrings(v))
+		last = e.end
+	}
+	buf.WriteString(s[last:])
+
+	var added []string
+	for k := range values {
+		if !seen[k] {
+			added = append(added, k)
+		}
+	}
+	sort.Strings(added)
+	if len(added) > 0 && buf.Len() > 0 && !strings.HasSuffix(buf.String(), "\n") {
+		buf.WriteString("\n")
+	}
+	for _, k := range added {
+		fmt.Fprintf(&buf, "%s = %s;\n", quoteStrings(k), quoteStrings(values[k]))
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(buf.String()), 0644)
+}
+
+func readPlistJSON(path string) (map[string]interface{}, error) {
+	out, err := exec.Command("plutil", "-convert", "json", "-o", "-", path).Output()
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	var v map[string]interface{}
+	return v, json.Unmarshal(out, &v)
+}
+
+func writePlistJSON(path string, v map[string]interface{}) error {
+	tmp, err := ioutil.TempFile("", "plist-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = json.NewEncoder(tmp).Encode(v)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	return runCmd("plutil", "-convert", "xml1", "-o", path, tmp.Name())
+}
+
+func pluralKey(key, variable, category string) string {
+	return key + "#" + variable + "." + category
+}
+
+// stringsdictValues flattens the plural rules of a .stringsdict file.
+func stringsdictValues(path string) (map[string]string, error) {
+	dict, err := readPlistJSON(path)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	for key, v := range dict {
+		entry, _ := v.(map[string]interface{})
+		for variable, rules := range entry {
+			rules, ok := rules.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			for category, s := range rules {
+				if s, ok := s.(string); ok && !strings.HasPrefix(category, "NSStringFormat") {
+					values[pluralKey(key, variable, category)] = s
+				}
+			}
+		}
+	}
+	return values, nil
+}
+
+func writeStringsdict(path string, values map[string]string) error {
+	dict, err := readPlistJSON(path)
+	if err != nil {
+		return err
+	}
+	for k, s := range values {
+		i := strings.LastIndex(k, "#")
+		j := strings.LastIndex(k, ".")
+		if i < 0 || j < i {
+			return fmt.Errorf("invalid plural key %q", k)
+		}
+		entry, _ := dict[k[:i]].(map[string]interface{})
+		rules, _ := entry[k[i+1:j]].(map[string]interface{})
+		if rules == nil {
+			return fmt.Errorf("%s has no plural rule %s", filepath.Base(path), k[:j])
+		}
+		rules[k[j+1:]] = s
+	}
+	return writePlistJSON(path, dict)
+}
+
+func (t *LocalizationTable) files(lang string) (stringsPath, dictPath string) {
+	base := filepath.Join(t.path, lang+".lproj", filepath.Base(t.Name))
+	return base + ".strings", base + ".stringsdict"
+}
+
+// values returns the strings of lang in the table.
+func (t *LocalizationTable) values(lang string) (map[string]string, error) {
+	if t.Format == formatXCStrings {
+		catalog, err := readCatalog(t.path)
+		if err != nil {
+			return nil, err
+		}
+		return catalogValues(catalog, lang), nil
+	}
+
+	values := make(map[string]string)
+	stringsPath, dictPath := t.files(lang)
+	_, entries, err := readStrings(stringsPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range entries {
+		values[e.Key] = e.Value
+	}
+	if fileExists(dictPath) {
+		plurals, err := stringsdictValues(dictPath)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range plurals {
+			values[k] = v
+		}
+	}
+	return values, nil
+}
+
+func (t *LocalizationTable) setValues(lang string, values map[string]string) error {
+	if t.Format == formatXCStrings {
+		catalog, err := readCatalog(t.path)
+		if err != nil {
+			return err
+		}
+		setCatalogValues(catalog, lang, values)
+		b, err := json.MarshalIndent(catalog, "", "  ")
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(t.path, append(b, '\n'), 0644)
+	}
+
+	stringsPath, dictPath := t.files(lang)
+	plain := make(map[string]string)
+	plurals := make(map[string]string)
+	for k, v := range values {
+		if strings.Contains(k, "#") && fileExists(dictPath) {
+			plurals[k] = v
+		} else {
+			plain[k] = v
+		}
+	}
+	if len(plurals) > 0 {
+		if err := writeStringsdict(dictPath, plurals); err != nil {
+			return &httputil.HTTPError{http.StatusBadRequest, err}
+		}
+	}
+	if len(plain) > 0 {
+		return writeStrings(stringsPath, plain)
+	}
+	return nil
+}
+
+func readCatalog(path string) (map[string]interface{}, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var catalog map[string]interface{}
+	if err := json.Unmarshal(b, &catalog); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return catalog, nil
+}
+
+func catalogStrings(catalog map[string]interface{}) map[string]interface{} {
+	m, _ := catalog["strings"].(map[string]interface{})
+	if m == nil {
+		m = make(map[string]interface{})
+		catalog["strings"] = m
+	}
+	return m
+}
+
+// catalogValues returns the translated values of lang in a String Catalog.
+// Keys without a translation in the source language stand for themselves.
+func catalogValues(catalog map[string]interface{}, lang string) map[string]string {
+	source, _ := catalog["sourceLanguage"].(string)
+	values := make(map[string]string)
+	for key, v := range catalogStrings(catalog) {
+		entry, _ := v.(map[string]interface{})
+		if translate, ok := entry["shouldTranslate"].(bool); ok && !translate {
+			continue
+		}
+		locs, _ := entry["localizations"].(map[string]interface{})
+		loc, _ := locs[lang].(map[string]interface{})
+		unit, _ := loc["stringUnit"].(map[string]interface{})
+		if s, ok := unit["value"].(string); ok {
+			values[key] = s
+		} else if lang == source {
+			values[key] = key
+		}
+	}
+	return values
+}
+
+func setCatalogValues(catalog map[string]interface{}, lang string, values map[string]string) {
+	all := catalogStrings(catalog)
+	for key, s := range values {
+		entry, _ := all[key].(map[string]interface{})
+		if entry == nil {
+			entry = make(map[string]interface{})
+			all[key] = entry
+		}
+		locs, _ := entry["localizations"].(map[string]interface{})
+		if locs == nil {
+			locs = make(map[string]interface{})
+			entry["localizations"] = locs
+		}
+		locs[lang] = map[string]interface{}{
+			"stringUnit": map[string]interface{}{
+				"state": "translated",
+				"value": s,
+			},
+		}
+	}
+}
+
+func catalogLanguages(catalog map[string]interface{}) map[string]bool {
+	langs := make(map[string]bool)
+	if source, ok := catalog["sourceLanguage"].(string); ok {
+		langs[source] = true
+	}
+	for _, v := range catalogStrings(catalog) {
+		entry, _ := v.(map[string]interface{})
+		locs, _ := entry["localizations"].(map[string]interface{})
+		for lang := range locs {
+			langs[lang] = true
+		}
+	}
+	return langs
+}
+
+// localizationTables finds the strings tables in the repository.
+func localizationTables(id string) (map[string]*LocalizationTable, error) {
+	tables := make(map[string]*LocalizationTable)
+	err := filepath.Walk(id, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() {
+			switch f.Name() {
+			case ".git", "Pods", "Carthage", "build", "node_modules":
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(id, path)
+		if err != nil {
+			return err
+		}
+		ext := filepath.Ext(path)
+		switch ext {
+		case ".xcstrings":
+			name := filepath.ToSlash(strings.TrimSuffix(rel, ext))
+			tables[name] = &LocalizationTable{Name: name, Format: formatXCStrings, path: path}
+		case ".strings", ".stringsdict":
+			lproj := filepath.Dir(path)
+			if filepath.Ext(lproj) != ".lproj" {
+				return nil
+			}
+			dir := filepath.Dir(lproj)
+			relDir, err := filepath.Rel(id, dir)
+			if err != nil {
+				return err
+			}
+			name := filepath.ToSlash(filepath.Join(relDir, strings.TrimSuffix(f.Name(), ext)))
+			t := tables[name]
+			if t == nil {
+				t = &LocalizationTable{Name: name, Format: formatStrings, path: dir,
+					langs: make(map[string]bool)}
+				tables[name] = t
+			}
+			t.langs[strings.TrimSuffix(filepath.Base(lproj), ".lproj")] = true
+		}
+		return nil
+	})
+	return tables, err
+}
+
+// stats fills in the table's source language and per-language completeness,
+// measured against the keys of the source language.
+func (t *LocalizationTable) stats() error {
+	langs := t.langs
+	if t.Format == formatXCStrings {
+		catalog, err := readCatalog(t.path)
+		if err != nil {
+			return err
+		}
+		t.SourceLanguage, _ = catalog["sourceLanguage"].(string)
+		langs = catalogLanguages(catalog)
+	} else {
+		for _, l := range []string{"Base", "en"} {
+			if langs[l] {
+				t.SourceLanguage = l
+				break
+			}
+		}
+	}
+
+	all := make(map[string]map[string]string)
+	for lang := range langs {
+		values, err := t.values(lang)
+		if err != nil {
+			return err
+		}
+		all[lang] = values
+	}
+	ref := all[t.SourceLanguage]
+	if ref == nil {
+		ref = make(map[string]string)
+		for _, values := range all {
+			for k, v := range values {
+				ref[k] = v
+			}
+		}
+	}
+
+	t.Languages = []*LanguageStats{}
+	for lang, values := range all {
+		s := &LanguageStats{Language: lang, Total: len(ref)}
+		for k := range ref {
+			if values[k] != "" {
+				s.Translated++
+			}
+		}
+		if s.Total > 0 {
+			s.Completeness = float64(s.Translated) / float64(s.Total)
+		}
+		t.Languages = append(t.Languages, s)
+	}
+	sort.Slice(t.Languages, func(i, j int) bool {
+		return t.Languages[i].Language < t.Languages[j].Language
+	})
+	return nil
+}
+
+func findTable(id, name string) (*LocalizationTable, error) {
+	tables, err := localizationTables(id)
+	if err != nil {
+		return nil, err
+	}
+	t := tables[name]
+	if t == nil {
+		return nil, &httputil.HTTPError{http.StatusNotFound,
+			fmt.Errorf("no strings table %q", name)}
+	}
+	return t, nil
+}
+
+func listLocalizations(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	tables, err := localizationTables(id)
+	if err != nil {
+		return err
+	}
+	list := []*LocalizationTable{}
+	for _, t := range tables {
+		if err := t.stats(); err != nil {
+			return err
+		}
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return renderJSON(w, http.StatusOK, list)
+}
+
+func getLocalization(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	lang := mux.Vars(r)["lang"]
+	if !regexpLanguage.MatchString(lang) {
+		return errNotFound
+	}
+	t, err := findTable(id, r.URL.Query().Get("table"))
+	if err != nil {
+		return err
+	}
+	values, err := t.values(lang)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, values)
+}
+
+func setLocalization(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	lang := mux.Vars(r)["lang"]
+	if !regexpLanguage.MatchString(lang) {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			fmt.Errorf("invalid language %q", lang)}
+	}
+	t, err := findTable(id, r.URL.Query().Get("table"))
+	if err != nil {
+		return err
+	}
+
+	var values map[string]string
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&values); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	for k, v := range values {
+		if k == "" || !utf8.ValidString(k) || !utf8.ValidString(v) {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				fmt.Errorf("invalid entry %q", k)}
+		}
+	}
+	var paths []string
+	if t.Format == formatXCStrings {
+		paths = []string{repoRel(id, t.path)}
+	} else {
+		stringsPath, dictPath := t.files(lang)
+		paths = []string{repoRel(id, stringsPath), repoRel(id, dictPath)}
+	}
+	if err := checkOwners(r, id, paths...); err != nil {
+		return err
+	}
+	defer rlockRepo(id)()
+	if err := t.setValues(lang, values); err != nil {
+		return err
+	}
+	invalidateTreeCache(id)
+
+	values, err = t.values(lang)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, values)
+}
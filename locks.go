@@ -0,0 +1,72 @@
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// Repositories are guarded by a fixed set of striped read/write locks.
+// Work inside a repository (builds, jobs, file writes) holds its stripe for
+// reading; cloning and deleting hold it for writing. Two repositories may
+// share a stripe, so locks on several repositories must be taken through
+// lockRepos, which acquires stripes in index order, and a goroutine must
+// not take a repository lock while already holding one.
+const repoLockStripes = 64
+
+var repoLocks [repoLockStripes]sync.RWMutex
+
+func repoStripes(ids []string) []int {
+	seen := make(map[int]bool)
+	var stripes []int
+	for _, id := range ids {
+		h := fnv.New32a()
+		h.Write([]byte(id))
+		i := int(h.Sum32() % repoLockStripes)
+		if !seen[i] {
+			seen[i] = true
+			stripes = append(stripes, i)
+		}
+	}
+	sort.Ints(stripes)
+	return stripes
+}
+
+// lockRepos locks the repositories for writing, or for reading when shared
+// is set, and returns the function that unlocks them.
+func lockRepos(shared bool, ids ...string) func() {
+	stripes := repoStripes(ids)
+	for _, i := range stripes {
+		if shared {
+			repoLocks[i].RLock()
+		} else {
+			repoLocks[i].Lock()
+		}
+	}
+	return func() {
+		for j := len(stripes) - 1; j >= 0; j-- {
+			if shared {
+				repoLocks[stripes[j]].RUnlock()
+			} else {
+				repoLocks[stripes[j]].Unlock()
+			}
+		}
+	}
+}
+
+func rlockRepo(id string) func() {
+	return lockRepos(true, id)
+}
+
+func lockRepo(id string) func() {
+	return lockRepos(false, id)
+}
+
+// tryLockRepo locks the repository for writing if nothing else holds it.
+func tryLockRepo(id string) (func(), bool) {
+	i := repoStripes([]string{id})[0]
+	if !repoLocks[i].TryLock() {
+		return nil, false
+	}
+	return repoLocks[i].Unlock, true
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/launchmango/backend/httputil"
+)
+
+// macosProvider builds and launches Mac apps, e.g. companion apps living
+// next to an iOS project.
+type macosProvider struct{}
+
+func (macosProvider) Name() string { return "macos" }
+
+func (macosProvider) Detect(id string) bool {
+	projects, _ := filepath.Glob(filepath.Join(id, "*.xcodeproj", "project.pbxproj"))
+	for _, p := range projects {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		src := string(b)
+		if strings.Contains(src, "SDKROOT = macosx;") &&
+			!strings.Contains(src, "SDKROOT = iphoneos;") {
+			return true
+		}
+	}
+	return false
+}
+
+func (macosProvider) Build(id string, opts *BuildOptions, out io.Writer) error {
+	dir := opts.dir(id)
+	symroot, err := filepath.Abs(filepath.Join(dir, "build"))
+	if err != nil {
+		return err
+	}
+	args := append(opts.schemeArgs(dir, "Debug"), "-sdk", opts.sdk("macosx"),
+		"SYMROOT="+symroot)
+	return xcodebuild(dir, opts, out, args...)
+}
+
+func (p macosProvider) Run(id string, opts *RunOptions) (*Run, error) {
+	apps, _ := filepath.Glob(filepath.Join(opts.dir(id), "build", "Debug", "*.app"))
+	if len(apps) == 0 {
+		return nil, &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("no macOS app found; build the repository first")}
+	}
+	app := apps[0]
+	exe, err := plistValue(filepath.Join(app, "Contents", "Info.plist"),
+		"CFBundleExecutable")
+	if err != nil {
+		return nil, err
+	}
+
+	// Launch the executable directly rather than via open(1) so its
+	// output is captured and the process can be stopped.
+	cmd := exec.Command(filepath.Join(app, "Contents", "MacOS", exe))
+	cmd.Dir = opts.dir(id)
+	cmd.Env = opts.runEnv()
+	return startRun(id, p.Name(), cmd)
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"crypto/md5"
+	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -15,7 +17,10 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime/debug"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/launchmango/backend/httputil"
@@ -24,11 +29,18 @@ import (
 const (
 	typeFile = "file"
 	typeDir  = "dir"
+
+	// killGrace is how long a cancelled command has to exit once asked.
+	killGrace = 10 * time.Second
 )
 
 var (
 	errNotFound = &httputil.HTTPError{http.StatusNotFound,
 		errors.New("not found")}
+	errNoRemote = &httputil.HTTPError{http.StatusBadRequest,
+		errors.New("repository has no origin remote")}
+	// regexpMD5 matches the IDs of repositories cloned before IDs were
+	// generated, which were the MD5 of the URL.
 	regexpMD5 = regexp.MustCompile("[0-9a-f]{32}")
 )
 
@@ -38,13 +50,48 @@ type FileNode struct {
 	Size     int64                `json:"size"`
 	URL      string               `json:"url,omitempty"`
 	Children map[string]*FileNode `json:"children,omitempty"`
+
+	// Truncated is set on directories whose contents were cut short by the
+	// tree limits.
+	Truncated bool `json:"truncated,omitempty"`
+
+	// Collapsed is set on directories whose contents weren't listed for
+	// being deeper than asked for.
+	Collapsed bool `json:"collapsed,omitempty"`
 }
 
 type Repository struct {
-	ID    string    `json:"id"`
-	Name  string    `json:"name"`
-	URL   string    `json:"url"`
-	Files *FileNode `json:"files,omitempty"`
+	ID     string    `json:"id"`
+	Name   string    `json:"name"`
+	URL    string    `json:"url"`
+	Branch string    `json:"branch,omitempty"`
+	Files  *FileNode `json:"files,omitempty"`
+	Error  string    `json:"error,omitempty"`
+
+	// Partial repositories are cloned without file contents, which are
+	// fetched as files are requested.
+	Partial bool `json:"partial,omitempty"`
+
+	// Credential is the ID of the credential to clone with, for private
+	// repositories.
+	Credential string `json:"credential,omitempty"`
+
+	Created       *time.Time        `json:"created,omitempty"`
+	DefaultBranch string            `json:"defaultBranch,omitempty"`
+	Labels        []string          `json:"labels,omitempty"`
+	LastBuild     *BuildStatus      `json:"lastBuild,omitempty"`
+	Dependencies  *DependencyStatus `json:"dependencies,omitempty"`
+	Readiness     *Readiness        `json:"readiness,omitempty"`
+
+	// ResolveDependencies, when creating a repository, installs its pods
+	// and resolves its Swift packages once cloned.
+	ResolveDependencies bool `json:"resolveDependencies,omitempty"`
+
+	// Warm, when creating a repository, are the steps run in the
+	// background once cloned to get it ready to open and build:
+	// "dependencies", which is what ResolveDependencies does, and "index".
+	// Their progress is the repository's Readiness.
+	Warm []string `json:"warm,omitempty"`
 }
 
 type handler func(w http.ResponseWriter, r *http.Request) error
@@ -61,7 +108,17 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	err := h(&rb, r)
 	if err == nil {
 		rb.WriteTo(w)
-	} else if e, ok := err.(*httputil.HTTPError); ok {
+	} else {
+		serveError(w, r, err)
+	}
+}
+
+func serveError(w http.ResponseWriter, r *http.Request, err error) {
+	if e, ok := err.(*errBuildBusy); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(e.retryAfter/time.Second)))
+		err = e.HTTPError
+	}
+	if e, ok := err.(*httputil.HTTPError); ok {
 		if e.Status >= 500 {
 			logError(r, err, nil)
 		}
@@ -103,14 +160,8 @@ func handleError(resp http.ResponseWriter, req *http.Request,
 	json.NewEncoder(resp).Encode(&data)
 }
 
-func md5String(s string) string {
-	h := md5.New()
-	io.WriteString(h, s)
-	return fmt.Sprintf("%x", h.Sum(nil))
-}
-
 func fileExists(filename string) bool {
-	if _, err := os.Stat("./" + filename); err != nil {
+	if _, err := os.Stat(filename); err != nil {
 		if os.IsNotExist(err) {
 			return false
 		}
@@ -125,18 +176,110 @@ func runCmd(name string, arg ...string) error {
 	return cmd.Run()
 }
 
+func runCmdIn(dir string, out io.Writer, name string, arg ...string) error {
+	return runCmdContext(context.Background(), dir, out, name, arg...)
+}
+
+// runCmdContext is like runCmdIn but kills the command when ctx is done.
+func runCmdContext(ctx context.Context, dir string, out io.Writer,
+	name string, arg ...string) error {
+	return runCmdEnv(ctx, dir, nil, out, name, arg...)
+}
+
+// runCmdEnv is like runCmdContext with extra environment variables.
+func runCmdEnv(ctx context.Context, dir string, env []string, out io.Writer,
+	name string, arg ...string) error {
+	cmd := exec.Command(name, arg...)
+	cmd.Dir = dir
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	return runGroup(ctx, cmd)
+}
+
+// runGroup runs cmd in a process group of its own and, when ctx is done,
+// stops the whole group: with SIGTERM, then SIGKILL if it hasn't exited
+// after killGrace. Killing only cmd would leave the compilers and
+// simulators tools like xcodebuild start running, holding its output open.
+func runGroup(ctx context.Context, cmd *exec.Cmd) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+		}
+		pgid := -cmd.Process.Pid
+		syscall.Kill(pgid, syscall.SIGTERM)
+		select {
+		case <-done:
+		case <-time.After(killGrace):
+			syscall.Kill(pgid, syscall.SIGKILL)
+		}
+	}()
+	err := cmd.Wait()
+	close(done)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func gitCmd(repoPath string, arg ...string) (string, error) {
+	return gitCmdEnv(repoPath, nil, arg...)
+}
+
+// gitCmdEnv is like gitCmd with extra environment variables.
+func gitCmdEnv(repoPath string, env []string, arg ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", arg...)
+	cmd.Dir = repoPath
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", arg[0], msg)
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// gitRemote returns the URL of the origin remote, or errNoRemote if there
+// isn't one.
 func gitRemote(repoPath string) (string, error) {
 	cmd := exec.Command("git", "config", "--get", "remote.origin.url")
 	cmd.Dir = repoPath
 	u, err := cmd.Output()
 	if err != nil {
+		// git config exits with 1 when the key isn't set.
+		if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() == 1 {
+			return "", errNoRemote
+		}
 		return "", err
 	}
 	return strings.TrimSpace(string(u)), nil
 }
 
+// repoName returns the name stored for the repository when it was added
+// or renamed, else the name of its origin remote, falling back to its ID.
 func repoName(repoPath string) (string, error) {
+	if m, _ := loadRepoMeta(filepath.Base(repoPath)); m != nil && m.Name != "" {
+		return m.Name, nil
+	}
 	remote, err := gitRemote(repoPath)
+	if err == errNoRemote {
+		return filepath.Base(repoPath), nil
+	}
 	if err != nil {
 		return "", err
 	}
@@ -148,60 +291,10 @@ func repoName(repoPath string) (string, error) {
 	return name, nil
 }
 
-func loadRepoFiles(repo *Repository) {
-	var first *FileNode
-	visitFunc := func(path string, f os.FileInfo, err error) error {
-		if strings.Contains(path, ".git") { // don't traverse git
-			return nil
-		}
-
-		fileType := "file"
-		if f.IsDir() {
-			fileType = "dir"
-		}
-
-		node := &FileNode{
-			Type:     fileType,
-			Name:     f.Name(),
-			Size:     f.Size(),
-			Children: make(map[string]*FileNode),
-		}
-
-		if first == nil {
-			first = node
-			return nil
-		}
-
-		if node.Type == "file" {
-			node.URL = fmt.Sprintf("/repositories/%s/files/%s", repo.ID,
-				strings.Join(strings.Split(path, "/")[1:], "/"))
-		}
-
-		parentPathParts := strings.Split(path, "/")[1:]
-		if len(parentPathParts) <= 1 {
-			first.Children[node.Name] = node
-			return nil
-		}
-		parentPathParts = parentPathParts[:len(parentPathParts)-1]
-		setDeepNode(first, parentPathParts, node)
-
-		return nil
-	}
-
-	filepath.Walk(repo.ID, visitFunc)
-	repo.Files = first
-}
-
-func setDeepNode(b *FileNode, keys []string, f *FileNode) {
-	v, ok := b.Children[keys[0]]
-	if ok && len(keys) > 1 {
-		setDeepNode(v, keys[1:], f)
-		return
-	}
-
-	if len(keys) == 1 {
-		b.Children[f.Name] = f
-	}
+// loadRepoFiles loads the repository's file tree to depth levels, or all
+// of it when depth is zero.
+func loadRepoFiles(repo *Repository, depth int) {
+	repo.Files = repoTreeAt(repo.ID, "", repo.Partial, depth)
 }
 
 func printNode(f *FileNode, nesting int) {
@@ -221,28 +314,268 @@ func main() {
 	if port == "" {
 		port = "3000"
 	}
+	dir := flag.String("workspace", os.Getenv("WORKSPACE"),
+		"directory to clone repositories into (default: the current directory)")
+	restore := flag.String("restore", "",
+		"backup to restore into the workspace before starting")
+	flag.IntVar(&maxBuilds, "max-concurrent-builds", buildWorkers(),
+		"how many builds may run at once; others queue or are refused")
+	flag.Parse()
+	if err := initWorkspace(*dir); err != nil {
+		log.Fatalf("workspace: %v", err)
+	}
+	if *restore != "" {
+		if !filepath.IsAbs(*restore) {
+			*restore = filepath.Join(assetDir, *restore)
+		}
+		if err := restoreBackup(*restore); err != nil {
+			log.Fatalf("restore: %v", err)
+		}
+	}
+
+	subscribe(notify)
+	subscribe(uploadSymbolsAfterBuild)
+	subscribe(recordActivity)
+	subscribe(recordBuildStatus)
+	subscribe(recordSessions)
+	subscribe(buildAfterPull)
+	reconcileOnStartup()
+	go monitorDisk()
+	go startSimPool()
+	go purgeTrashPeriodically()
+	go collectGarbagePeriodically()
 
 	r := mux.NewRouter()
 	r.HandleFunc("/", handleRoot).Methods("GET")
 	r.HandleFunc("/app", handleApp).Methods("GET")
+	r.Handle("/notifications/rules",
+		handler(listNotificationRules)).Methods("GET")
+	r.Handle("/notifications/rules",
+		handler(createNotificationRule)).Methods("POST")
+	r.Handle("/notifications/rules/{id}",
+		handler(deleteNotificationRule)).Methods("DELETE")
+	r.Handle("/events/history", handler(getEventHistory)).Methods("GET")
+	r.Handle("/admin/toolchain", handler(getToolchain)).Methods("GET")
+	r.Handle("/secrets", handler(listSecrets)).Methods("GET")
+	r.Handle("/secrets/{name}", handler(setSecret)).Methods("PUT")
+	r.Handle("/secrets/{name}", handler(deleteSecret)).Methods("DELETE")
+	r.Handle("/repositories/{id}/secrets", handler(listSecrets)).Methods("GET")
+	r.Handle("/repositories/{id}/secrets/{name}", handler(setSecret)).Methods("PUT")
+	r.Handle("/repositories/{id}/secrets/{name}", handler(deleteSecret)).Methods("DELETE")
+	r.Handle("/credentials", handler(listCredentials)).Methods("GET")
+	r.Handle("/credentials", handler(createCredential)).Methods("POST")
+	r.Handle("/credentials/{id}", handler(deleteCredential)).Methods("DELETE")
+	r.Handle("/admin/reconcile", handler(getReconciliation)).Methods("GET")
+	r.Handle("/admin/reconcile", handler(runReconciliation)).Methods("POST")
+	r.Handle("/admin/disk", handler(getDiskStatus)).Methods("GET")
+	r.Handle("/admin/gc", handler(getGarbageCollection)).Methods("GET")
+	r.Handle("/admin/gc", handler(runGarbageCollection)).Methods("POST")
+	r.Handle("/admin/simulators", handler(getSimPool)).Methods("GET")
+	r.Handle("/simulators", handler(listSimulators)).Methods("GET")
+	r.Handle("/simulators/{udid}/boot", handler(startSimulator)).Methods("POST")
+	r.Handle("/simulators/{udid}/shutdown", handler(stopSimulator)).Methods("POST")
+	r.Handle("/admin/treecache", handler(getTreeCacheStats)).Methods("GET")
+	r.Handle("/admin/backup", streamHandler(createBackup)).Methods("POST")
+	r.Handle("/admin/repositories/export", handler(exportRepos)).Methods("GET")
+	r.Handle("/admin/repositories/import", handler(importRepos)).Methods("POST")
+	r.Handle("/xcodes", handler(listXcodes)).Methods("GET")
+	r.Handle("/users", handler(listUsers)).Methods("GET")
+	r.Handle("/users/{name}", handler(getUser)).Methods("GET")
+	r.Handle("/users/{name}", handler(setUser)).Methods("PUT")
 	r.Handle("/repositories", handler(createRepo)).Methods("POST")
-	r.Handle("/repositories", handler(listRepos)).Methods("GET")
-	r.Handle("/repositories/{id}", handler(getRepo)).Methods("GET")
-	r.Handle("/repositories/{id}", handler(deleteRepo)).Methods("DELETE")
+	r.Handle("/repositories", streamHandler(listRepos)).Methods("GET")
+	r.Handle("/repositories/{id}", streamHandler(getRepo)).Methods("GET")
+	r.Handle("/repositories/{id}", writable(deleteRepo)).Methods("DELETE")
+	r.Handle("/repositories/{id}", handler(updateRepo)).Methods("PATCH")
+	r.Handle("/repositories/{id}/tree", streamHandler(getRepoTree)).Methods("GET")
+	r.Handle("/repositories/{id}/search", handler(searchRepo)).Methods("GET")
+	r.Handle("/repositories/{id}/archive",
+		streamHandler(getRepoArchive)).Methods("GET")
+	r.Handle("/repositories/{id}/pull", handler(pullRepo)).Methods("POST")
 	r.Handle("/repositories/{id}/build", handler(buildRepo)).Methods("POST")
+	// GET is allowed too since EventSource can't POST.
+	r.Handle("/repositories/{id}/build/stream",
+		streamHandler(streamBuild)).Methods("GET", "POST")
 	r.Handle("/repositories/{id}/run", handler(runRepo)).Methods("GET")
+	r.Handle("/repositories/{id}/projects", handler(listProjects)).Methods("GET")
+	r.Handle("/repositories/{id}/projects/{name}", handler(setProject)).Methods("PUT")
+	r.Handle("/repositories/{id}/projects/{name}", handler(deleteProject)).Methods("DELETE")
+	r.Handle("/repositories/{id}/settings",
+		handler(getRepoSettings)).Methods("GET")
+	r.Handle("/repositories/{id}/settings",
+		handler(setRepoSettings)).Methods("PUT")
+	r.Handle("/repositories/{id}/signing-key",
+		handler(getSigningKey)).Methods("GET")
+	r.Handle("/repositories/{id}/signing-key",
+		handler(setSigningKey)).Methods("PUT")
+	r.Handle("/repositories/{id}/signing-key",
+		handler(deleteSigningKey)).Methods("DELETE")
+	r.Handle("/repositories/{id}/commits", handler(listCommits)).Methods("GET")
+	r.Handle("/repositories/{id}/commits/{sha}", handler(getCommit)).Methods("GET")
+	r.Handle("/repositories/{id}/changelog", handler(getChangelog)).Methods("GET")
+	r.Handle("/repositories/{id}/status", handler(getRepoStatus)).Methods("GET")
+	r.Handle("/repositories/{id}/diff", handler(getRepoDiff)).Methods("GET")
+	r.Handle("/repositories/{id}/commit", writable(createCommit)).Methods("POST")
+	r.Handle("/repositories/{id}/approvals", handler(listApprovals)).Methods("GET")
+	r.Handle("/repositories/{id}/approvals", writable(proposeCommit)).Methods("POST")
+	r.Handle("/repositories/{id}/approvals/{approval}",
+		handler(getApproval)).Methods("GET")
+	r.Handle("/repositories/{id}/approvals/{approval}/approve",
+		writable(approveCommit)).Methods("POST")
+	r.Handle("/repositories/{id}/approvals/{approval}",
+		handler(rejectApproval)).Methods("DELETE")
+	r.Handle("/repositories/{id}/push", writable(pushRepo)).Methods("POST")
+	r.Handle("/repositories/{id}/branches", handler(listBranches)).Methods("GET")
+	r.Handle("/repositories/{id}/branches", writable(createBranch)).Methods("POST")
+	r.Handle("/repositories/{id}/pulls", handler(listPulls)).Methods("GET")
+	r.Handle("/repositories/{id}/pulls", writable(createPull)).Methods("POST")
+	r.Handle("/repositories/{id}/pods", handler(listPods)).Methods("GET")
+	r.Handle("/repositories/{id}/pods", writable(addPod)).Methods("POST")
+	r.Handle("/repositories/{id}/pods/{name:.+}",
+		writable(removePod)).Methods("DELETE")
+	r.Handle("/repositories/{id}/packages",
+		handler(listPackages)).Methods("GET")
+	r.Handle("/repositories/{id}/packages",
+		writable(addPackage)).Methods("POST")
+	r.Handle("/repositories/{id}/packages",
+		writable(removePackage)).Methods("DELETE")
+	r.Handle("/repositories/{id}/packages/update",
+		writable(updatePackages)).Methods("POST")
+	r.Handle("/repositories/{id}/dependencies/install",
+		streamHandler(writable(installDependencies))).Methods("POST")
+	r.Handle("/cocoapods/search", handler(searchPods)).Methods("GET")
+	r.Handle("/jobs/{id}", handler(getJob)).Methods("GET")
+	r.Handle("/jobs/{id}/log", streamHandler(getJobLog)).Methods("GET")
+	r.Handle("/repositories/{id}/docker/push",
+		handler(pushImage)).Methods("POST")
+	r.Handle("/docker/registry",
+		handler(getRegistryCredentials)).Methods("GET")
+	r.Handle("/docker/registry",
+		handler(setRegistryCredentials)).Methods("PUT")
+	r.Handle("/repositories/{id}/artifacts",
+		handler(uploadArtifact)).Methods("POST")
+	r.Handle("/artifacts/{key:.+}", streamHandler(serveArtifact)).Methods("GET")
+	r.Handle("/repositories/{id}/distribute/testflight",
+		handler(distributeTestFlight)).Methods("POST")
+	r.Handle("/repositories/{id}/distribute/testflight",
+		handler(getTestFlightStatus)).Methods("GET")
+	r.Handle("/repositories/{id}/distribute/firebase",
+		handler(distributeFirebase)).Methods("POST")
+	r.Handle("/firebase/credentials",
+		handler(setFirebaseCredentials)).Methods("PUT")
+	r.Handle("/repositories/{id}/dsyms/upload",
+		handler(uploadRepoSymbols)).Methods("POST")
+	r.Handle("/sentry/credentials",
+		handler(setSentryCredentials)).Methods("PUT")
+	r.Handle("/appstoreconnect/credentials",
+		handler(getASCCredentials)).Methods("GET")
+	r.Handle("/appstoreconnect/credentials",
+		handler(setASCCredentials)).Methods("PUT")
+	r.Handle("/appstoreconnect/apps", handler(listASCApps)).Methods("GET")
+	r.Handle("/appstoreconnect/apps/{appID}/builds",
+		handler(listASCBuilds)).Methods("GET")
+	r.Handle("/appstoreconnect/bundle-ids",
+		handler(listASCBundleIDs)).Methods("GET")
+	r.Handle("/appstoreconnect/bundle-ids",
+		handler(createASCBundleID)).Methods("POST")
+	r.Handle("/repositories/{id}/tests", handler(runUITests)).Methods("POST")
+	r.Handle("/repositories/{id}/tests", handler(listTestRuns)).Methods("GET")
+	r.Handle("/repositories/{id}/tests/{jobID}",
+		handler(getTestRun)).Methods("GET")
+	r.Handle("/repositories/{id}/localizations",
+		handler(listLocalizations)).Methods("GET")
+	r.Handle("/repositories/{id}/localizations/{lang}",
+		handler(getLocalization)).Methods("GET")
+	r.Handle("/repositories/{id}/localizations/{lang}",
+		writable(setLocalization)).Methods("PUT")
+	r.Handle("/repositories/{id}/size", handler(analyzeRepoSize)).Methods("POST")
+	r.Handle("/repositories/{id}/size", handler(listSizeReports)).Methods("GET")
+	r.Handle("/repositories/{id}/size/{report}",
+		handler(getSizeReport)).Methods("GET")
+	r.Handle("/repositories/{id}/screenshots",
+		handler(captureScreenshots)).Methods("POST")
+	r.Handle("/repositories/{id}/screenshots",
+		handler(listScreenshotRuns)).Methods("GET")
+	r.Handle("/repositories/{id}/screenshots/{run}/approve",
+		handler(approveScreenshots)).Methods("POST")
+	r.Handle("/repositories/{id}/screenshots/files/{path:.+}",
+		handler(serveScreenshot)).Methods("GET")
+	r.Handle("/repositories/{id}/runs", handler(listRepoRuns)).Methods("GET")
+	r.Handle("/repositories/{id}/builds", handler(listBuilds)).Methods("GET")
+	r.Handle("/repositories/{id}/builds", handler(queueBuild)).Methods("POST")
+	r.Handle("/repositories/{id}/builds/compare",
+		handler(compareBuilds)).Methods("GET")
+	r.Handle("/repositories/{id}/builds/{build}",
+		handler(getRepoBuild)).Methods("GET")
+	r.Handle("/repositories/{id}/builds/{build}",
+		handler(cancelBuild)).Methods("DELETE")
+	r.Handle("/repositories/{id}/builds/{build}/log",
+		handler(getRepoBuildLog)).Methods("GET")
+	r.Handle("/repositories/{id}/builds/{build}/artifacts",
+		handler(listBuildArtifacts)).Methods("GET")
+	r.Handle("/repositories/{id}/builds/{build}/artifacts/{name}",
+		streamHandler(downloadBuildArtifact)).Methods("GET")
+	r.Handle("/builds/{id}", handler(getBuild)).Methods("GET")
+	r.Handle("/builds/{id}/log", handler(getBuildLog)).Methods("GET")
+	r.Handle("/runs/{id}", handler(getRun)).Methods("GET")
+	r.Handle("/runs/{id}/log", streamHandler(getRunLog)).Methods("GET")
+	r.Handle("/runs/{id}", handler(stopRun)).Methods("DELETE")
+	r.Handle("/runs/{id}/reload", handler(reloadRun)).Methods("POST")
 	r.Handle("/repositories/{id}/files/{path:.+}",
-		handler(getRepoFile)).Methods("GET")
+		streamHandler(getRepoFile)).Methods("GET")
 	r.Handle("/repositories/{id}/files/{path:.+}",
-		handler(setRepoFile)).Methods("PUT")
+		writable(setRepoFile)).Methods("PUT")
+	r.Handle("/repositories/{id}/files/{path:.+}",
+		writable(deleteRepoFile)).Methods("DELETE")
+	r.Handle("/repositories/{id}/files/{path:.+}",
+		writable(moveRepoFile)).Methods("PATCH")
+	r.Handle("/repositories/{id}/directories",
+		writable(createDirectory)).Methods("POST")
+	r.Handle("/repositories/{id}/xcode", handler(getXcodeProject)).Methods("GET")
+	r.Handle("/repositories/{id}/xcconfigs", handler(listXCConfigs)).Methods("GET")
+	r.Handle("/repositories/{id}/xcconfigs/{path:.+}", handler(getXCConfig)).Methods("GET")
+	r.Handle("/repositories/{id}/xcconfigs/{path:.+}", writable(updateXCConfig)).Methods("PATCH")
+	r.Handle("/repositories/{id}/appinfo", handler(getAppInfo)).Methods("GET")
+	r.Handle("/repositories/{id}/appinfo", writable(updateAppInfo)).Methods("PATCH")
+	r.Handle("/repositories/{id}/releases", writable(createRelease)).Methods("POST")
+	r.Handle("/repositories/{id}/activity", handler(getActivity)).Methods("GET")
+	r.Handle("/repositories/{id}/sessions", handler(startSession)).Methods("POST")
+	r.Handle("/repositories/{id}/sessions", handler(listSessions)).Methods("GET")
+	r.Handle("/sessions/{id}", handler(getSession)).Methods("GET")
+	r.Handle("/sessions/{id}/stop", handler(stopSession)).Methods("POST")
+	r.Handle("/sessions/{id}/notes", handler(addSessionNote)).Methods("POST")
+	r.Handle("/repositories/{id}/trash", handler(listTrash)).Methods("GET")
+	r.Handle("/repositories/{id}/trash/{item}/restore",
+		writable(restoreTrash)).Methods("POST")
+	r.Handle("/repositories/{id}/trash/{item}",
+		handler(purgeTrashItem)).Methods("DELETE")
+	r.Handle("/repositories/{id}/files/{path:.+}/revert",
+		writable(revertRepoFile)).Methods("POST")
+	r.Handle("/repositories/{id}/reset", writable(resetRepo)).Methods("POST")
+	r.Handle("/repositories/{id}/files",
+		writable(uploadRepoFiles)).Methods("POST")
+	r.Handle("/repositories/{id}/uploads",
+		handler(uploadOptions)).Methods("OPTIONS")
+	r.Handle("/repositories/{id}/uploads",
+		writable(createUpload)).Methods("POST")
+	r.Handle("/repositories/{id}/uploads/{upload}",
+		handler(headUpload)).Methods("HEAD")
+	r.Handle("/repositories/{id}/uploads/{upload}",
+		writable(patchUpload)).Methods("PATCH")
+	r.Handle("/repositories/{id}/uploads/{upload}",
+		handler(deleteUpload)).Methods("DELETE")
+	r.Handle("/repositories/{id}/files/{path:.+}",
+		writable(uploadRepoFiles)).Methods("POST")
+	r.Handle("/slack/actions", handler(slackActions)).Methods("POST")
+	r.Handle("/webhooks/github", handler(githubWebhook)).Methods("POST")
 	http.Handle("/static/", http.StripPrefix("/static/",
-		http.FileServer(http.Dir("./static/"))))
+		http.FileServer(http.Dir(assetPath("static")))))
 	http.Handle("/", r)
 	log.Fatal(http.ListenAndServe(":"+port, nil))
 }
 
 func handleRoot(w http.ResponseWriter, r *http.Request) {
-	file, err := os.Open("./index.html")
+	file, err := os.Open(assetPath("index.html"))
 	if err != nil {
 		log.Println(err)
 		return
@@ -251,7 +584,7 @@ func handleRoot(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleApp(w http.ResponseWriter, r *http.Request) {
-	file, err := os.Open("./app.html")
+	file, err := os.Open(assetPath("app.html"))
 	if err != nil {
 		log.Println(err)
 		return
@@ -271,146 +604,587 @@ func createRepo(w http.ResponseWriter, r *http.Request) error {
 			errors.New("url is required")}
 	}
 
-	repo.URL = repo.URL
-	repo.ID = md5String(repo.URL)
-	if fileExists(repo.ID) {
+	if strings.HasPrefix(repo.URL, "-") || strings.HasPrefix(repo.Branch, "-") {
 		return &httputil.HTTPError{http.StatusBadRequest,
-			errors.New("repo already exists")}
+			errors.New("invalid url or branch")}
 	}
 
-	if err := runCmd("git", "clone", "--recursive", repo.URL, repo.ID); err != nil {
+	env := []string{"GIT_TERMINAL_PROMPT=0"}
+	if repo.Credential != "" {
+		cenv, err := credentialEnv(repo.Credential)
+		if err != nil {
+			return err
+		}
+		env = append(env, cenv...)
+	}
+
+	if err := validateWarmSteps(repo.Warm); err != nil {
+		return err
+	}
+
+	if err := checkDiskSpace(); err != nil {
 		return err
 	}
 
-	loadRepoFiles(&repo)
+	repo.ID = newULID()
+	if _, err := cloneRepo(&repo, env); err != nil {
+		return err
+	}
+	switch {
+	case len(repo.Warm) > 0:
+		repo.Readiness, repo.Dependencies = startWarmup(repo.ID, repo.Warm)
+	case repo.ResolveDependencies:
+		repo.Dependencies, _ = startDependencies(repo.ID)
+	}
+
+	loadRepoFiles(&repo, defaultTreeDepth)
 
 	return renderJSON(w, http.StatusOK, &repo)
 }
 
-func listRepos(w http.ResponseWriter, r *http.Request) error {
-	repos := []*Repository{}
+// cloneRepo clones repo.URL into the directory repo.ID and records its
+// metadata, filling in the rest of repo.
+func cloneRepo(repo *Repository, env []string) (*RepoMeta, error) {
+	defer lockRepo(repo.ID)()
+	args := []string{"clone", "--recursive"}
+	if repo.Branch != "" {
+		args = append(args, "--branch", repo.Branch)
+	}
+	if repo.Partial {
+		args = append(args, partialCloneArgs()...)
+	}
+	if _, err := gitCmdEnv(".", env, append(args, repo.URL, repo.ID)...); err != nil {
+		os.RemoveAll(repo.ID)
+		return nil, &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	name, err := repoName(repo.ID)
+	if err != nil {
+		return nil, err
+	}
+	repo.Name = name
+	meta := &RepoMeta{ID: repo.ID, Name: name, URL: repo.URL,
+		Branch: repo.Branch, Partial: repo.Partial, Credential: repo.Credential,
+		Created: time.Now(), DefaultBranch: defaultBranch(repo.ID)}
+	if err := saveRepoMeta(meta); err != nil {
+		return nil, err
+	}
+	repo.Created = &meta.Created
+	repo.DefaultBranch = meta.DefaultBranch
+	return meta, nil
+}
 
+func repoIDs() ([]string, error) {
 	d, err := os.Open(".")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer d.Close()
 	fi, err := d.Readdir(-1)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	var ids []string
 	for _, fi := range fi {
-		if fi.Mode().IsDir() {
-			if regexpMD5.MatchString(fi.Name()) {
-				remote, err := gitRemote(fi.Name())
-				if err != nil {
-					return err
-				}
+		if fi.Mode().IsDir() && validRepoID(fi.Name()) {
+			ids = append(ids, fi.Name())
+		}
+	}
+	return ids, nil
+}
 
-				name, err := repoName(fi.Name())
-				if err != nil {
-					return err
-				}
+const repoScanWorkers = 8
 
-				repo := &Repository{ID: fi.Name(), Name: name, URL: remote}
-				loadRepoFiles(repo)
+// describeRepo describes a repository from its metadata, falling back on
+// git for a repository that has none.
+func describeRepo(id string) (*Repository, error) {
+	m, err := loadRepoMeta(id)
+	if err != nil {
+		return nil, err
+	}
+	if m != nil {
+		return repoFromMeta(m), nil
+	}
+	remote, err := gitRemote(id)
+	if err != nil && err != errNoRemote {
+		return nil, err
+	}
+	name, err := repoName(id)
+	if err != nil {
+		return nil, err
+	}
+	return &Repository{ID: id, Name: name, URL: remote}, nil
+}
 
-				repos = append(repos, repo)
-			}
+// scanRepo loads a repository for listing. Failures are reported in the
+// repository's Error rather than failing the whole listing.
+func scanRepo(id string, depth int) *Repository {
+	repo, err := describeRepo(id)
+	if err != nil {
+		return &Repository{ID: id, Error: err.Error()}
+	}
+	loadRepoFiles(repo, depth)
+	return repo
+}
+
+// listRepos lists the repositories in the metadata store, optionally only
+// those with a label, and streams them in order, loading their trees in
+// parallel and flushing each one as soon as it and those before it are
+// ready.
+func listRepos(w http.ResponseWriter, r *http.Request) error {
+	depth, err := treeDepth(r)
+	if err != nil {
+		return err
+	}
+	metas, err := allRepoMeta()
+	if err != nil {
+		return err
+	}
+	label := r.URL.Query().Get("label")
+	var ids []string
+	for _, m := range metas {
+		if m.Missing != nil || m.Evicted != nil || (label != "" && !m.hasLabel(label)) {
+			continue
 		}
+		ids = append(ids, m.ID)
 	}
 
-	return renderJSON(w, http.StatusOK, repos)
+	results := make([]chan *Repository, len(ids))
+	sem := make(chan struct{}, repoScanWorkers)
+	for i, id := range ids {
+		results[i] = make(chan *Repository, 1)
+		go func(id string, c chan<- *Repository) {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			c <- scanRepo(id, depth)
+		}(id, results[i])
+	}
+
+	bw := bufio.NewWriter(w)
+	w.WriteHeader(http.StatusOK)
+	bw.WriteByte('[')
+	for i, c := range results {
+		if i > 0 {
+			bw.WriteByte(',')
+		}
+		if err := writeRepoJSON(bw, <-c); err != nil {
+			return err
+		}
+		if err := flushJSON(bw, w); err != nil {
+			return err
+		}
+	}
+	bw.WriteString("]\n")
+	return flushJSON(bw, w)
 }
 
+// getRepo returns a repository with the top level of its files, or as
+// many levels as depth asks for; /repositories/{id}/tree lists the rest.
 func getRepo(w http.ResponseWriter, r *http.Request) error {
 	id := mux.Vars(r)["id"]
-	if !fileExists(id) {
+	if !repoExists(id) {
 		return errNotFound
 	}
-
-	remote, err := gitRemote(id)
+	depth, err := treeDepth(r)
 	if err != nil {
 		return err
 	}
 
-	name, err := repoName(id)
+	repo, err := describeRepo(id)
 	if err != nil {
 		return err
 	}
+	loadRepoFiles(repo, depth)
 
-	repo := Repository{ID: id, Name: name, URL: remote}
-	loadRepoFiles(&repo)
-
-	renderJSON(w, http.StatusOK, &repo)
-	return nil
+	bw := bufio.NewWriter(w)
+	w.WriteHeader(http.StatusOK)
+	if err := writeRepoJSON(bw, repo); err != nil {
+		return err
+	}
+	bw.WriteByte('\n')
+	return flushJSON(bw, w)
 }
 
 func deleteRepo(w http.ResponseWriter, r *http.Request) error {
 	id := mux.Vars(r)["id"]
-	if !fileExists(id) {
+	if !repoExists(id) {
 		return errNotFound
 	}
+	unlock, ok := tryLockRepo(id)
+	if !ok {
+		return &httputil.HTTPError{http.StatusConflict,
+			errors.New("repository is busy; try again when its builds and jobs finish")}
+	}
+	defer unlock()
+	forgetTree(id)
+	invalidateTreeCache(id)
 	if err := os.RemoveAll(id); err != nil {
 		return err
 	}
-	return nil
+	if err := removeRepoMeta(id); err != nil {
+		return err
+	}
+	if err := os.Remove(activityLogPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.RemoveAll(filepath.Join(dataDir, "secrets", id)); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(filepath.Join(dataDir, "approvals", id)); err != nil {
+		return err
+	}
+	if err := removeSigningKey(id); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(filepath.Join(dataDir, "uploads", id)); err != nil {
+		return err
+	}
+	// Build records outlive the repository, but not the bundles they kept.
+	artifacts, _ := filepath.Glob(buildArtifactsDir(id, "*"))
+	for _, dir := range artifacts {
+		if err := os.RemoveAll(filepath.Dir(dir)); err != nil {
+			return err
+		}
+	}
+	forgetSecretValues()
+	return os.RemoveAll(filepath.Join(dataDir, "trash", id))
+}
+
+// buildRequest reads the provider and options of a build request. With
+// project, the build is of that project, whose settings fill in the
+// options not given. The xcodebuild choices can also be made in a JSON
+// body, which are checked against the Xcode project and saved as the
+// defaults of later builds.
+func buildRequest(r *http.Request, id string) (buildProvider, *BuildOptions, error) {
+	project, err := findProject(id, r.URL.Query().Get("project"))
+	if err != nil {
+		return nil, nil, err
+	}
+	p, err := repoProvider(id, r.URL.Query().Get("provider"), project)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := readBuildBody(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	chosen := &BuildDefaults{
+		Scheme:        r.URL.Query().Get("scheme"),
+		Configuration: r.URL.Query().Get("configuration"),
+		SDK:           r.URL.Query().Get("sdk"),
+		Destination:   r.URL.Query().Get("destination"),
+	}
+	if body != nil {
+		chosen = body
+	} else if err := chosen.validate(); err != nil {
+		return nil, nil, err
+	}
+	settings, err := loadRepoSettings(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts := &BuildOptions{
+		Platform:      r.URL.Query().Get("platform"),
+		Destination:   chosen.Destination,
+		Xcode:         r.URL.Query().Get("xcode"),
+		Scheme:        chosen.Scheme,
+		Configuration: chosen.Configuration,
+		SDK:           chosen.SDK,
+		Flags:         chosen.Flags,
+		Resolve:       r.URL.Query().Get("resolve") == "1",
+		project:       project,
+	}
+	if body == nil {
+		opts.useDefaults(buildDefaults(settings, project))
+	}
+	if project != nil {
+		if opts.Platform == "" {
+			opts.Platform = project.Platform
+		}
+		if opts.Xcode == "" {
+			opts.Xcode = project.Xcode
+		}
+	}
+	if opts.Platform != "" {
+		if _, err := simulatorPlatform(opts.Platform); err != nil {
+			return nil, nil, err
+		}
+	}
+	if opts.xcode, err = resolveXcode(id, opts.Xcode); err != nil {
+		return nil, nil, err
+	}
+	if body != nil {
+		if err := checkScheme(id, opts); err != nil {
+			return nil, nil, err
+		}
+		name := ""
+		if project != nil {
+			name = project.Name
+		}
+		if err := saveBuildDefaults(id, name, body); err != nil {
+			return nil, nil, err
+		}
+	}
+	if opts.env, err = secretEnv(id); err != nil {
+		return nil, nil, err
+	}
+	profile, err := findRunProfile(id, r.URL.Query().Get("profile"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.xcconfig, err = profile.xcconfigPath(id); err != nil {
+		return nil, nil, err
+	}
+	return p, opts, nil
 }
 
 func buildRepo(w http.ResponseWriter, r *http.Request) error {
 	id := mux.Vars(r)["id"]
-	if !fileExists(id) {
+	if !repoExists(id) {
 		return errNotFound
 	}
 
-	cmd := exec.Command("xcodebuild", "-arch", "i386", "-sdk", "iphonesimulator")
-	cmd.Stdout = w
-	cmd.Stderr = w
-	cmd.Dir = id
-	err := cmd.Run()
+	p, opts, err := buildRequest(r, id)
+	if err != nil {
+		return err
+	}
+	release, err := acquireBuild(opts.context(), id, false)
 	if err != nil {
+		return err
+	}
+	if opts.xcode != nil {
+		w.Header().Set("X-Xcode-Version",
+			opts.xcode.Version+" ("+opts.xcode.Build+")")
+	}
+	b := newBuild(id, p.Name(), opts.project)
+	w.Header().Set("X-Build-ID", b.ID)
+	if err := runBuild(b, p, opts, w, release); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return nil
 	}
 	return nil
 }
 
-func runRepo(w http.ResponseWriter, r *http.Request) error {
+// streamBuild runs a build like buildRepo but sends its output as
+// server-sent events, one per line, as the build runs. A "build" event with
+// the build record comes first and a "done" event with the final record
+// last.
+func streamBuild(w http.ResponseWriter, r *http.Request) error {
 	id := mux.Vars(r)["id"]
-	if !fileExists(id) {
+	if !repoExists(id) {
 		return errNotFound
 	}
 
-	files, _ := ioutil.ReadDir("./" + id)
-	var projectName string
-	for _, f := range files {
-		if strings.HasSuffix(f.Name(), ".xcodeproj") {
-			projectName = strings.TrimSuffix(f.Name(), ".xcodeproj")
-			break
-		}
+	p, opts, err := buildRequest(r, id)
+	if err != nil {
+		return err
+	}
+	release, err := acquireBuild(opts.context(), id, false)
+	if err != nil {
+		return err
 	}
+	b := newBuild(id, p.Name(), opts.project)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Build-ID", b.ID)
+	w.WriteHeader(http.StatusOK)
+	sse := newSSEWriter(w)
+	sse.event("build", b)
+	lw := newLineWriter(sse.data)
+	runBuild(b, p, opts, lw, release)
+	lw.Flush()
+	return sse.event("done", b)
+}
 
-	go runCmd("osascript", "trigger_move_simulator.applescript")
+// build runs the provider's build for b, streaming output to out and
+// keeping a copy as the build's log.
+func build(b *Build, p buildProvider, opts *BuildOptions, out io.Writer) error {
+	id := b.Repo
+	defer rlockRepo(id)()
+	touchRepo(id)
+	settings, err := loadRepoSettings(id)
+	if err != nil {
+		return err
+	}
+	timeout := buildTimeout(settings)
+	ctx, cancel := context.WithTimeout(opts.context(), timeout)
+	defer cancel()
+	opts.ctx = ctx
+	commit, _ := gitCmd(id, "rev-parse", "HEAD")
+	b.begin(opts.Scheme, commit, buildEnvironment(opts))
+	if err := b.save(); err != nil {
+		return err
+	}
+	f, err := b.createLog()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	lw := newLineWriter(b.line)
 
-	buf := new(bytes.Buffer)
-	cmd := exec.Command("ios-sim", "launch",
-		"build/Release-iphonesimulator/"+projectName+".app")
-	cmd.Stdout = buf
-	cmd.Stderr = buf
-	cmd.Dir = id
-	err := cmd.Run()
-	log.Println(buf)
+	data := map[string]interface{}{"provider": p.Name(), "build": b.ID}
+	if opts.xcode != nil {
+		data["xcode"] = opts.xcode
+	}
+	if b.Project != "" {
+		data["project"] = b.Project
+	}
+	publish(&Event{Type: eventBuildStarted, Repo: id, Data: data})
+	rw := newRedactWriter(io.MultiWriter(out, f, lw))
+	w := io.Writer(rw)
+	err = materialize(id, w)
+	key, commit, cacheable := artifactCacheKey(id, p, opts)
+	cached := false
+	if err == nil && cacheable {
+		var rerr error
+		if cached, rerr = restoreArtifacts(id, key, w); rerr != nil {
+			log.Printf("build %s: restoring cache: %v", b.ID, rerr)
+		}
+	}
+	if cached {
+		b.Cached = true
+	} else if err == nil {
+		if opts.Resolve {
+			err = dependenciesBeforeBuild(id, opts, w)
+		}
+		if err == nil {
+			err = p.Build(id, opts, w)
+		}
+		switch opts.context().Err() {
+		case context.DeadlineExceeded:
+			err = fmt.Errorf("build timed out after %s", timeout)
+		case context.Canceled:
+			err = errBuildCancelled
+		}
+		if err == nil && cacheable {
+			if cerr := cacheArtifacts(id, b.dir, key, commit); cerr != nil {
+				log.Printf("build %s: caching artifacts: %v", b.ID, cerr)
+			}
+		}
+	}
+	rw.Flush()
+	lw.Flush()
+	if serr := b.finish(err); serr != nil {
+		log.Printf("build %s: %v", b.ID, serr)
+	}
+	data = map[string]interface{}{"build": b.ID}
+	if b.Project != "" {
+		data["project"] = b.Project
+	}
 	if err != nil {
+		data["error"] = redact(err.Error())
+		publish(&Event{Type: eventBuildFailed, Repo: id, Data: data})
 		return err
 	}
+	data["cached"] = cached
+	publish(&Event{Type: eventBuildSucceeded, Repo: id, Data: data})
 	return nil
 }
 
+// runRepo launches the app. Providers that can't run what they built
+// themselves have it installed and launched on a simulator with simctl:
+// the app named artifact, of build or of the newest build that has it, or
+// with a platform and neither, the app built for it in the working tree.
+// The run reports the device, the app's bundle ID and its PID.
+func runRepo(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	project, err := findProject(id, r.URL.Query().Get("project"))
+	if err != nil {
+		return err
+	}
+	p, err := repoProvider(id, r.URL.Query().Get("provider"), project)
+	if err != nil {
+		return err
+	}
+	opts := &RunOptions{
+		Platform:     r.URL.Query().Get("platform"),
+		Device:       r.URL.Query().Get("device"),
+		PairedDevice: r.URL.Query().Get("pairedDevice"),
+		project:      project,
+	}
+	if project != nil {
+		if opts.Platform == "" {
+			opts.Platform = project.Platform
+		}
+		if opts.Device == "" {
+			opts.Device = project.Device
+		}
+	}
+	if opts.Device == "" && (opts.Platform == "" || opts.Platform == "ios") {
+		// Fall back on the simulator the user prefers, if any.
+		if opts.Device, err = preferredSimulator(r.URL.Query().Get("user")); err != nil {
+			return err
+		}
+	}
+	if opts.env, err = secretEnv(id); err != nil {
+		return err
+	}
+	profile, err := findRunProfile(id, r.URL.Query().Get("profile"))
+	if err != nil {
+		return err
+	}
+	if profile != nil {
+		opts.env = append(opts.env, profile.environ()...)
+	}
+	if rp, ok := p.(runProvider); ok {
+		run, err := rp.Run(id, opts)
+		if err != nil {
+			return err
+		}
+		return renderJSON(w, http.StatusCreated, run)
+	}
+	artifact, buildID := r.URL.Query().Get("artifact"), r.URL.Query().Get("build")
+	cleanup := func() {}
+	if opts.Platform == "" || artifact != "" || buildID != "" {
+		var projectName string
+		if opts.Platform == "" {
+			files, _ := ioutil.ReadDir(opts.dir(id))
+			for _, f := range files {
+				if strings.HasSuffix(f.Name(), ".xcodeproj") {
+					projectName = strings.TrimSuffix(f.Name(), ".xcodeproj")
+					break
+				}
+			}
+			opts.Platform = "ios"
+		}
+		if cleanup, err = opts.useArtifact(id, buildID, artifact, projectName); err != nil {
+			return err
+		}
+	}
+	run, err := runOnSimulator(id, opts)
+	if err != nil {
+		cleanup()
+		return err
+	}
+	go func() {
+		<-run.done
+		cleanup()
+	}()
+	return renderJSON(w, http.StatusCreated, run)
+}
+
 func getRepoFile(w http.ResponseWriter, r *http.Request) error {
 	id := mux.Vars(r)["id"]
-	path := mux.Vars(r)["path"]
-	filePath := fmt.Sprintf("%s/%s", id, path)
+	if !repoExists(id) {
+		return errNotFound
+	}
+	filePath, err := repoPath(id, mux.Vars(r)["path"])
+	if err != nil {
+		return err
+	}
+	if ref := r.URL.Query().Get("ref"); ref != "" {
+		return serveFileAtRef(w, r, id, repoRel(id, filePath), ref)
+	}
 	file, err := os.Open(filePath)
+	if os.IsNotExist(err) && isPartial(id) {
+		if err := fetchPath(id, repoRel(id, filePath)); err != nil {
+			return err
+		}
+		file, err = os.Open(filePath)
+	}
 	if err != nil {
 		if os.IsNotExist(err) {
 			return errNotFound
@@ -418,28 +1192,117 @@ func getRepoFile(w http.ResponseWriter, r *http.Request) error {
 
 		return err
 	}
+	defer file.Close()
 
-	io.Copy(w, file)
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return errNotFound
+	}
+	w.Header().Set("ETag", fileETag(fi))
+	start := make([]byte, sniffLen)
+	n, _ := io.ReadFull(file, start)
+	if err := setTextHeaders(w.Header(), id, repoRel(id, filePath), start[:n]); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), file)
 	return nil
 }
 
+// setRepoFile creates or replaces a file. Text is written with the line
+// endings .gitattributes asks for, or those the file already has, unless
+// raw=1 asks for the bytes sent.
 func setRepoFile(w http.ResponseWriter, r *http.Request) error {
 	id := mux.Vars(r)["id"]
-	path := mux.Vars(r)["path"]
-	filePath := fmt.Sprintf("%s/%s", id, path)
-	file, err := os.Open(filePath)
+	if !repoExists(id) {
+		return errNotFound
+	}
+	filePath, err := repoPath(id, mux.Vars(r)["path"])
 	if err != nil {
-		if os.IsNotExist(err) {
-			return errNotFound
-		}
-
-		return nil
+		return err
 	}
-	defer file.Close()
+	if hasGitDir(repoRel(id, filePath)) {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("can't write inside .git")}
+	}
+	if err := checkOwners(r, id, repoRel(id, filePath)); err != nil {
+		return err
+	}
+	defer rlockRepo(id)()
 
+	status := http.StatusOK
+	// The precondition is checked before the body is read, to fail early,
+	// and again as the new contents replace the file.
+	check := func() error {
+		fi, err := os.Stat(filePath)
+		switch {
+		case err == nil && fi.IsDir():
+			return &httputil.HTTPError{http.StatusBadRequest,
+				errors.New("path is a directory")}
+		case err == nil:
+			status = http.StatusOK
+			return checkIfMatch(r, fi)
+		case os.IsNotExist(err):
+			if r.Header.Get("If-Match") != "" {
+				return errPreconditionFailed
+			}
+			status = http.StatusCreated
+			return nil
+		}
+		return err
+	}
+	if err := check(); err != nil {
+		return err
+	}
+	if status == http.StatusCreated {
+		if err := checkParent(filePath, r); err != nil {
+			return err
+		}
+	}
 	defer r.Body.Close()
-	body, _ := ioutil.ReadAll(r.Body) // TODO: stream this
-	f, _ := file.Stat()
-	ioutil.WriteFile(filePath, body, f.Mode())
-	return nil
+	body, length, err := fileBody(r)
+	if err != nil {
+		return err
+	}
+	if max := fileSizeLimit(); max > 0 && length > max {
+		return errFileTooLarge
+	}
+	sr := newSizeReader(body)
+	contents := io.Reader(sr)
+	if r.URL.Query().Get("raw") != "1" {
+		if contents, err = textReader(id, repoRel(id, filePath), filePath, sr); err != nil {
+			return err
+		}
+	}
+	// Check the whole body arrived before it replaces the file.
+	checkLength := func() error {
+		if length >= 0 && sr.n != length {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				fmt.Errorf("got %d bytes of %d", sr.n, length)}
+		}
+		return check()
+	}
+	if _, err := writeUpload(filePath, contents, checkLength); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return &httputil.HTTPError{http.StatusBadRequest, err}
+		}
+		return err
+	}
+	invalidateTreeCache(id)
+	if fi, err := os.Stat(filePath); err == nil {
+		w.Header().Set("ETag", fileETag(fi))
+	}
+	action := "write"
+	if status == http.StatusCreated {
+		action = "create"
+	}
+	publish(&Event{Type: eventRepoEdited, Repo: id,
+		Data: map[string]interface{}{"action": action,
+			"paths": []string{repoRel(id, filePath)}}})
+	return renderJSON(w, status, parentNode(id, filePath))
 }
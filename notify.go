@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+const (
+	notificationRulesFile = "notification-rules.json"
+
+	channelSlack   = "slack"
+	channelEmail   = "email"
+	channelWebhook = "webhook"
+)
+
+// NotificationRule sends events whose type matches Event (a glob such as
+// "build.failed", "build.*" or "*") for Repo, or every repository when
+// Repo is empty, to Target on Channel.
+type NotificationRule struct {
+	ID      string `json:"id"`
+	Event   string `json:"event"`
+	Repo    string `json:"repo,omitempty"`
+	Channel string `json:"channel"`
+	Target  string `json:"target"`
+}
+
+func (rule *NotificationRule) matches(e *Event) bool {
+	if rule.Repo != "" && rule.Repo != e.Repo {
+		return false
+	}
+	ok, _ := path.Match(rule.Event, e.Type)
+	return ok
+}
+
+func (rule *NotificationRule) validate() error {
+	if _, err := path.Match(rule.Event, ""); err != nil || rule.Event == "" {
+		return errors.New("event must be an event type or glob")
+	}
+	switch rule.Channel {
+	case channelSlack:
+		if rule.Target == "" {
+			return errors.New("target must be a Slack channel")
+		}
+	case channelEmail:
+		if !strings.Contains(rule.Target, "@") {
+			return errors.New("target must be an email address")
+		}
+	case channelWebhook:
+		u, err := url.Parse(rule.Target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return errors.New("target must be an http(s) URL")
+		}
+	default:
+		return fmt.Errorf("unknown channel %q", rule.Channel)
+	}
+	return nil
+}
+
+var notificationRulesMu sync.Mutex
+
+func loadNotificationRules() ([]*NotificationRule, error) {
+	rules := []*NotificationRule{}
+	if err := readJSON(notificationRulesFile, &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// defaultRules are the deliveries implied by per-repository settings and
+// user preferences, kept so configurations predating rules still work.
+func defaultRules(e *Event) []*NotificationRule {
+	var rules []*NotificationRule
+	if os.Getenv("SLACK_BOT_TOKEN") != "" {
+		switch e.Category() {
+		case "build", "run", "test":
+			if channel := slackChannel(e.Repo); channel != "" {
+				rules = append(rules, &NotificationRule{Channel: channelSlack,
+					Target: channel})
+			}
+		}
+	}
+	if os.Getenv("SMTP_ADDR") != "" {
+		for _, to := range emailRecipients(e) {
+			rules = append(rules, &NotificationRule{Channel: channelEmail,
+				Target: to})
+		}
+	}
+	return rules
+}
+
+// notify delivers e once to every channel/target matched by a rule.
+func notify(e *Event) {
+	if e.Repo == "" {
+		return
+	}
+	rules, err := loadNotificationRules()
+	if err != nil {
+		log.Println("notify:", err)
+		return
+	}
+
+	matched := defaultRules(e)
+	for _, rule := range rules {
+		if rule.matches(e) {
+			matched = append(matched, rule)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, rule := range matched {
+		key := rule.Channel + "\x00" + rule.Target
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		var err error
+		switch rule.Channel {
+		case channelSlack:
+			err = notifySlack(rule.Target, e)
+		case channelEmail:
+			err = notifyEmail(rule.Target, e)
+		case channelWebhook:
+			err = notifyWebhook(rule.Target, e)
+		}
+		if err != nil {
+			log.Printf("notify: %s %s: %v", rule.Channel, rule.Target, err)
+		}
+	}
+}
+
+func notifyWebhook(target string, e *Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(target, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook: %s", resp.Status)
+	}
+	return nil
+}
+
+func listNotificationRules(w http.ResponseWriter, r *http.Request) error {
+	rules, err := loadNotificationRules()
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, rules)
+}
+
+func createNotificationRule(w http.ResponseWriter, r *http.Request) error {
+	var rule NotificationRule
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	if err := rule.validate(); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	rule.ID = newID()
+
+	notificationRulesMu.Lock()
+	defer notificationRulesMu.Unlock()
+	rules, err := loadNotificationRules()
+	if err != nil {
+		return err
+	}
+	if err := writeJSON(notificationRulesFile, append(rules, &rule)); err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusCreated, &rule)
+}
+
+func deleteNotificationRule(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+
+	notificationRulesMu.Lock()
+	defer notificationRulesMu.Unlock()
+	rules, err := loadNotificationRules()
+	if err != nil {
+		return err
+	}
+	kept := rules[:0]
+	for _, rule := range rules {
+		if rule.ID != id {
+			kept = append(kept, rule)
+		}
+	}
+	if len(kept) == len(rules) {
+		return errNotFound
+	}
+	if err := writeJSON(notificationRulesFile, kept); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/launchmango/backend/httputil"
+)
+
+// Partial repositories are cloned without file contents and with a sparse
+// checkout of the top level only. Directories are checked out, fetching
+// their blobs, the first time a file in them is requested, and in full
+// before a build.
+
+func partialCloneArgs() []string {
+	return []string{"--filter=blob:none", "--sparse"}
+}
+
+func isPartial(id string) bool {
+	m, _ := loadRepoMeta(id)
+	return m != nil && m.Partial
+}
+
+// gitTree builds the file tree of a partial repository from HEAD, so files
+// that haven't been fetched yet are listed too, with a size of zero.
+func gitTree(id string) *FileNode {
+	f, err := os.Lstat(id)
+	if err != nil {
+		return nil
+	}
+	root := newFileNode(id, id, f)
+	cmd := exec.Command("git", "ls-tree", "-r", "-z", "--name-only", "HEAD")
+	cmd.Dir = id
+	out, err := cmd.Output()
+	if err != nil {
+		return root
+	}
+	for _, name := range bytes.Split(out, []byte{0}) {
+		rel := string(name)
+		if rel == "" || skipTreePath(rel) {
+			continue
+		}
+		n := root
+		parts := strings.Split(rel, "/")
+		for i, part := range parts[:len(parts)-1] {
+			child := n.Children[part]
+			if child == nil {
+				child = &FileNode{Type: typeDir, Name: part,
+					Children: make(map[string]*FileNode)}
+				if fi, err := os.Lstat(filepath.Join(id, filepath.FromSlash(
+					strings.Join(parts[:i+1], "/")))); err == nil {
+					child.Size = fi.Size()
+				}
+				n.Children[part] = child
+			}
+			n = child
+		}
+		file := &FileNode{
+			Type:     typeFile,
+			Name:     parts[len(parts)-1],
+			URL:      fileURL(id, rel),
+			Children: make(map[string]*FileNode),
+		}
+		if fi, err := os.Lstat(filepath.Join(id, filepath.FromSlash(rel))); err == nil {
+			file.Size = fi.Size()
+		}
+		n.Children[file.Name] = file
+	}
+	return root
+}
+
+// fetchPath checks out the directory holding the repository relative file
+// rel in a partial repository, fetching its contents.
+func fetchPath(id, rel string) error {
+	dir := path.Dir(path.Clean("/" + filepath.ToSlash(rel)))
+	if dir == "/" {
+		return nil
+	}
+	dir = strings.TrimPrefix(dir, "/")
+	if strings.HasPrefix(dir, "-") {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("invalid path")}
+	}
+	env, err := repoAuthEnv(id, "")
+	if err != nil {
+		return err
+	}
+	defer rlockRepo(id)()
+	if _, err := gitCmdEnv(id, env, "sparse-checkout", "add", dir); err != nil {
+		return err
+	}
+	invalidateTreeCache(id)
+	return nil
+}
+
+// materialize checks out all of a partial repository, e.g. before building.
+func materialize(id string, out io.Writer) error {
+	if !isPartial(id) {
+		return nil
+	}
+	return runCmdIn(id, out, "git", "sparse-checkout", "disable")
+}
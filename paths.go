@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/launchmango/backend/httputil"
+)
+
+var errPathEscapes = &httputil.HTTPError{http.StatusBadRequest,
+	errors.New("path escapes the repository")}
+
+// cleanRel cleans a slash separated path relative to a repository,
+// rejecting paths that climb out of it. Backslashes are taken as
+// separators too, so "..\" can't sneak past, and a leading slash is
+// ignored.
+func cleanRel(rel string) (string, error) {
+	if strings.ContainsRune(rel, 0) {
+		return "", &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("invalid path")}
+	}
+	rel = strings.TrimLeft(strings.Replace(rel, `\`, "/", -1), "/")
+	clean := path.Clean(rel)
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", errPathEscapes
+	}
+	if clean == "." {
+		return "", &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("path is required")}
+	}
+	return clean, nil
+}
+
+// confined checks that p is inside dir once symlinks are resolved. When p
+// doesn't exist, its nearest existing ancestor is checked instead, so paths
+// about to be created can't be written through a link either. Dangling
+// symlinks are refused, since where they lead can't be checked.
+func confined(dir, p string) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	existing := p
+	var rest []string
+	for {
+		real, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			real = filepath.Join(append([]string{real}, rest...)...)
+			if real != root && !strings.HasPrefix(real, root+string(filepath.Separator)) {
+				return errPathEscapes
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if _, lerr := os.Lstat(existing); lerr == nil {
+			return errPathEscapes
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return err
+		}
+		rest = append([]string{filepath.Base(existing)}, rest...)
+		existing = parent
+	}
+}
+
+// repoPath resolves rel inside the repository id, rejecting paths that
+// would escape it, whether with .. or through a symlink.
+func repoPath(id, rel string) (string, error) {
+	if !validRepoID(id) {
+		return "", errNotFound
+	}
+	clean, err := cleanRel(rel)
+	if err != nil {
+		return "", err
+	}
+	p := filepath.Join(id, filepath.FromSlash(clean))
+	if err := confined(id, p); err != nil {
+		if os.IsNotExist(err) {
+			return "", errNotFound
+		}
+		return "", err
+	}
+	return p, nil
+}
+
+// repoRel returns p relative to repository id, with forward slashes.
+func repoRel(id, p string) string {
+	rel, err := filepath.Rel(id, p)
+	if err != nil {
+		return filepath.ToSlash(p)
+	}
+	return filepath.ToSlash(rel)
+}
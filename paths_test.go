@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCleanRel(t *testing.T) {
+	for _, test := range []struct {
+		rel string
+		// unescape is how many times rel is percent-decoded first, as a
+		// router or a proxy in front of it might.
+		unescape int
+		want     string // "" when the path is refused
+	}{
+		{rel: "a/b", want: "a/b"},
+		{rel: "a/./b/", want: "a/b"},
+		{rel: "a/../b", want: "b"},
+		{rel: "..foo", want: "..foo"},
+		{rel: "a/..b", want: "a/..b"},
+		{rel: ".."},
+		{rel: "../"},
+		{rel: "../a"},
+		{rel: "a/../../b"},
+		{rel: "a/b/../../.."},
+		{rel: "/etc/passwd", want: "etc/passwd"},
+		{rel: "//etc/passwd", want: "etc/passwd"},
+		{rel: "/../etc/passwd"},
+		{rel: `..\`},
+		{rel: `..\a`},
+		{rel: `a\..\..\b`},
+		{rel: `a\b`, want: "a/b"},
+		{rel: `\..\etc`},
+
+		// Undecoded, percent escapes are just characters in a name.
+		{rel: "%2e%2e/", want: "%2e%2e"},
+		{rel: "..%2f", want: "..%2f"},
+		{rel: "..%2fetc", want: "..%2fetc"},
+		{rel: "%2e%2e%2f%2e%2e%2fetc", want: "%2e%2e%2f%2e%2e%2fetc"},
+		{rel: "%252e%252e%252f", want: "%252e%252e%252f"},
+		{rel: "%2e%2e/", unescape: 1},
+		{rel: "..%2f", unescape: 1},
+		{rel: "..%2fetc", unescape: 1},
+		{rel: "%2e%2e%2f%2e%2e%2fetc", unescape: 1},
+		{rel: "..%5c", unescape: 1},
+		{rel: "%252e%252e%252f", unescape: 1, want: "%2e%2e%2f"},
+		{rel: "%252e%252e%252f", unescape: 2},
+		{rel: "..%252f..%252fetc", unescape: 2},
+
+		{rel: ""},
+		{rel: "."},
+		{rel: "/"},
+		{rel: "a/.."},
+		{rel: "a\x00b"},
+		{rel: "%00", unescape: 1},
+	} {
+		rel := test.rel
+		for i := 0; i < test.unescape; i++ {
+			var err error
+			if rel, err = url.PathUnescape(rel); err != nil {
+				t.Fatalf("unescaping %q: %v", test.rel, err)
+			}
+		}
+		got, err := cleanRel(rel)
+		switch {
+		case test.want == "" && err == nil:
+			t.Errorf("cleanRel(%q) = %q, want an error", rel, got)
+		case test.want != "" && err != nil:
+			t.Errorf("cleanRel(%q): %v, want %q", rel, err, test.want)
+		case got != test.want:
+			t.Errorf("cleanRel(%q) = %q, want %q", rel, got, test.want)
+		}
+	}
+}
+
+// symlinkRepo makes a repository directory with symlinks inside it
+// leading in and out of it, next to a directory outside it.
+func symlinkRepo(t *testing.T, root, id string) string {
+	repo := filepath.Join(root, id)
+	for _, dir := range []string{filepath.Join(repo, "sub"), filepath.Join(root, "outside")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"in":       "sub",
+		"up":       "..",
+		"out":      filepath.Join("..", "outside"),
+		"abs":      filepath.Join(root, "outside"),
+		"etc":      "/etc",
+		"dangling": "missing",
+		"sub/back": filepath.Join("..", "..", "outside"),
+	} {
+		if err := os.Symlink(target, filepath.Join(repo, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return repo
+}
+
+func TestConfined(t *testing.T) {
+	root := t.TempDir()
+	repo := symlinkRepo(t, root, "repo")
+	for _, test := range []struct {
+		rel string
+		ok  bool
+	}{
+		{"", true},
+		{"sub", true},
+		{"sub/new", true},
+		{"new/deeper/file", true},
+		{"in", true},
+		{"in/new", true},
+		{"up", false},
+		{"up/repo/sub", true},
+		{"up/outside", false},
+		{"out", false},
+		{"out/new", false},
+		{"out/new/deeper", false},
+		{"abs", false},
+		{"abs/new", false},
+		{"etc", false},
+		{"etc/new", false},
+		{"dangling", false},
+		{"dangling/new", false},
+		{"sub/back", false},
+		{"sub/back/new", false},
+		{"in/back/new", false},
+	} {
+		err := confined(repo, filepath.Join(repo, filepath.FromSlash(test.rel)))
+		if test.ok && err != nil {
+			t.Errorf("confined(%q): %v", test.rel, err)
+		}
+		if !test.ok && err != errPathEscapes {
+			t.Errorf("confined(%q) = %v, want %v", test.rel, err, errPathEscapes)
+		}
+	}
+}
+
+func TestRepoPath(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	if err := os.Chdir(root); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	id := newULID()
+	symlinkRepo(t, ".", id)
+	for _, test := range []struct {
+		rel  string
+		want string // "" when the path is refused
+	}{
+		{rel: "sub/file", want: "sub/file"},
+		{rel: "/sub/file", want: "sub/file"},
+		{rel: `sub\file`, want: "sub/file"},
+		{rel: "in/new", want: "in/new"},
+		{rel: "%2e%2e", want: "%2e%2e"},
+		{rel: "../outside"},
+		{rel: "sub/../../outside"},
+		{rel: `..\outside`},
+		{rel: "/../outside"},
+		{rel: "out/new"},
+		{rel: "abs/new"},
+		{rel: "etc/passwd"},
+		{rel: "dangling/new"},
+		{rel: "sub/back/new"},
+		{rel: "up/outside/new"},
+	} {
+		p, err := repoPath(id, test.rel)
+		switch {
+		case test.want == "" && err == nil:
+			t.Errorf("repoPath(%q) = %q, want an error", test.rel, p)
+		case test.want != "" && err != nil:
+			t.Errorf("repoPath(%q): %v", test.rel, err)
+		case test.want != "" && p != filepath.Join(id, filepath.FromSlash(test.want)):
+			t.Errorf("repoPath(%q) = %q, want %q", test.rel, p, test.want)
+		}
+	}
+	if _, err := repoPath("../"+id, "sub"); err != errNotFound {
+		t.Errorf("repoPath with an invalid ID = %v, want %v", err, errNotFound)
+	}
+}
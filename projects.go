@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+var regexpProjectName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// A Project is an app in a subdirectory of a monorepo, built and run on
+// its own by passing project=Name to the build and run endpoints. Its
+// settings are the defaults for those requests; Provider is detected in
+// Path when empty.
+type Project struct {
+	Name          string   `json:"name"`
+	Path          string   `json:"path"`
+	Provider      string   `json:"provider,omitempty"`
+	Platform      string   `json:"platform,omitempty"`
+	Destination   string   `json:"destination,omitempty"`
+	Xcode         string   `json:"xcode,omitempty"`
+	Device        string   `json:"device,omitempty"`
+	Scheme        string   `json:"scheme,omitempty"`
+	Configuration string   `json:"configuration,omitempty"`
+	SDK           string   `json:"sdk,omitempty"`
+	Flags         []string `json:"flags,omitempty"`
+
+	// Detected is the provider that would build the project, when listed.
+	Detected string `json:"detected,omitempty"`
+}
+
+// projectDir returns the directory to build in: the repository's, or that
+// of project.
+func projectDir(id string, project *Project) string {
+	if project == nil {
+		return id
+	}
+	return filepath.Join(id, filepath.FromSlash(project.Path))
+}
+
+func (o *BuildOptions) dir(id string) string { return projectDir(id, o.project) }
+
+func (o *RunOptions) dir(id string) string { return projectDir(id, o.project) }
+
+func (p *Project) validate() error {
+	if !regexpProjectName.MatchString(p.Name) {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			fmt.Errorf("invalid project name %q", p.Name)}
+	}
+	rel, err := cleanRel(p.Path)
+	if err != nil || rel == "." || hasGitDir(rel) {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			fmt.Errorf("invalid path for project %s", p.Name)}
+	}
+	p.Path = rel
+	if p.Provider != "" && findProvider(p.Provider) == nil {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			fmt.Errorf("unknown build provider %q", p.Provider)}
+	}
+	if p.Platform != "" {
+		if _, err := simulatorPlatform(p.Platform); err != nil {
+			return err
+		}
+	}
+	if err := buildDefaults(nil, p).validate(); err != nil {
+		return err
+	}
+	p.Detected = ""
+	return nil
+}
+
+// validateProjects checks the projects of a repository's settings, whose
+// names must be unique.
+func validateProjects(projects []*Project) error {
+	seen := make(map[string]bool)
+	for _, p := range projects {
+		if p == nil {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				errors.New("invalid project")}
+		}
+		if err := p.validate(); err != nil {
+			return err
+		}
+		if seen[p.Name] {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				fmt.Errorf("duplicate project %s", p.Name)}
+		}
+		seen[p.Name] = true
+	}
+	return nil
+}
+
+// findProject returns the repository's project called name, or nil when
+// name is empty.
+func findProject(id, name string) (*Project, error) {
+	if name == "" {
+		return nil, nil
+	}
+	settings, err := loadRepoSettings(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range settings.Projects {
+		if p.Name == name {
+			if fi, err := os.Stat(projectDir(id, p)); err != nil || !fi.IsDir() {
+				return nil, &httputil.HTTPError{http.StatusConflict,
+					fmt.Errorf("project %s has no directory %s", p.Name, p.Path)}
+			}
+			return p, nil
+		}
+	}
+	return nil, &httputil.HTTPError{http.StatusNotFound,
+		fmt.Errorf("no project %q", name)}
+}
+
+func listProjects(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	settings, err := loadRepoSettings(id)
+	if err != nil {
+		return err
+	}
+	projects := []*Project{}
+	for _, p := range settings.Projects {
+		for _, bp := range buildProviders {
+			if bp.Detect(projectDir(id, p)) {
+				p.Detected = bp.Name()
+				break
+			}
+		}
+		projects = append(projects, p)
+	}
+	return renderJSON(w, http.StatusOK, projects)
+}
+
+// setProject adds the project named in the URL or replaces it.
+func setProject(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	var p Project
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	p.Name = mux.Vars(r)["name"]
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	settings, err := loadRepoSettings(id)
+	if err != nil {
+		return err
+	}
+	status := http.StatusCreated
+	for i, old := range settings.Projects {
+		if old.Name == p.Name {
+			settings.Projects[i] = &p
+			status = http.StatusOK
+		}
+	}
+	if status == http.StatusCreated {
+		settings.Projects = append(settings.Projects, &p)
+	}
+	if err := saveRepoSettings(id, settings); err != nil {
+		return err
+	}
+	return renderJSON(w, status, &p)
+}
+
+func deleteProject(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	name := mux.Vars(r)["name"]
+	settings, err := loadRepoSettings(id)
+	if err != nil {
+		return err
+	}
+	for i, p := range settings.Projects {
+		if p.Name == name {
+			settings.Projects = append(settings.Projects[:i], settings.Projects[i+1:]...)
+			if err := saveRepoSettings(id, settings); err != nil {
+				return err
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+	}
+	return errNotFound
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/launchmango/backend/httputil"
+)
+
+// BuildOptions are the per-request choices for a build. Providers ignore
+// the ones that don't apply to them.
+type BuildOptions struct {
+	Platform      string
+	Destination   string
+	Xcode         string
+	Scheme        string
+	Configuration string
+	SDK           string
+	Flags         []string // passed on to xcodebuild
+	Resolve       bool     // install pods and resolve packages first
+
+	xcode    *XcodeInstall
+	ctx      context.Context
+	env      []string // secrets, as NAME=value
+	project  *Project
+	xcconfig string // the run profile's, as an absolute path
+}
+
+// context returns the context that cancels the build.
+func (o *BuildOptions) context() context.Context {
+	if o.ctx != nil {
+		return o.ctx
+	}
+	return context.Background()
+}
+
+// A buildProvider builds one kind of project found in a repository.
+type buildProvider interface {
+	Name() string
+	Detect(id string) bool
+	Build(id string, opts *BuildOptions, out io.Writer) error
+}
+
+// RunOptions are the per-request choices for launching an app.
+type RunOptions struct {
+	Platform     string
+	Device       string
+	PairedDevice string
+
+	env     []string // secrets, as NAME=value
+	project *Project
+	app     string // a build artifact to launch, if not the working tree's
+}
+
+// runEnv returns the environment for a run's command. simctl passes the
+// variables prefixed with SIMCTL_CHILD_ on to the app it launches.
+func (o *RunOptions) runEnv() []string {
+	env := append(os.Environ(), o.env...)
+	for _, e := range o.env {
+		env = append(env, "SIMCTL_CHILD_"+e)
+	}
+	return env
+}
+
+// A runProvider can also launch what it built, returning the tracked run.
+type runProvider interface {
+	Run(id string, opts *RunOptions) (*Run, error)
+}
+
+// A hotReloader can apply code changes to one of its runs without
+// relaunching it.
+type hotReloader interface {
+	Reload(run *Run, restart bool) error
+}
+
+// buildProviders are tried in order; the first whose Detect matches
+// builds the repository.
+var buildProviders = []buildProvider{
+	flutterProvider{},
+	reactNativeProvider{},
+	macosProvider{},
+	xcodeProvider{},
+	dockerProvider{},
+}
+
+// repoProvider returns the provider called name, or when name is empty
+// the one named in the project's or repository's settings, otherwise the
+// first one detected in the project's directory. Xcode is assumed when
+// nothing matches.
+func repoProvider(id, name string, project *Project) (buildProvider, error) {
+	if name == "" && project != nil {
+		name = project.Provider
+	} else if name == "" {
+		settings, err := loadRepoSettings(id)
+		if err != nil {
+			return nil, err
+		}
+		name = settings.Provider
+	}
+	if name != "" {
+		if p := findProvider(name); p != nil {
+			return p, nil
+		}
+		return nil, &httputil.HTTPError{http.StatusBadRequest,
+			fmt.Errorf("unknown build provider %q", name)}
+	}
+	for _, p := range buildProviders {
+		if p.Detect(projectDir(id, project)) {
+			return p, nil
+		}
+	}
+	return xcodeProvider{}, nil
+}
+
+type xcodeProvider struct{}
+
+func (xcodeProvider) Name() string { return "xcode" }
+
+func (xcodeProvider) Detect(id string) bool {
+	for _, pattern := range []string{"*.xcodeproj", "*.xcworkspace"} {
+		if m, _ := filepath.Glob(filepath.Join(id, pattern)); len(m) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// schemeArgs returns the xcodebuild arguments for the scheme and
+// configuration chosen, if any, falling back on configuration.
+func (o *BuildOptions) schemeArgs(dir, configuration string) []string {
+	var args []string
+	if o.Scheme != "" {
+		args = append(containerArgs(dir), "-scheme", o.Scheme)
+	}
+	if o.Configuration != "" {
+		configuration = o.Configuration
+	}
+	if configuration != "" {
+		args = append(args, "-configuration", configuration)
+	}
+	return args
+}
+
+// sdk returns the SDK chosen, or else def.
+func (o *BuildOptions) sdk(def string) string {
+	if o.SDK != "" {
+		return o.SDK
+	}
+	return def
+}
+
+func (xcodeProvider) Build(id string, opts *BuildOptions, out io.Writer) error {
+	dir := opts.dir(id)
+	if opts.Platform == "" && opts.Destination == "" {
+		// xcodebuild builds for the SDK's usual architectures, into
+		// build/<configuration>-<sdk>.
+		args := append(opts.schemeArgs(dir, ""), "-sdk", opts.sdk("iphonesimulator"))
+		return xcodebuild(dir, opts, out, args...)
+	}
+	platform := opts.Platform
+	if platform == "" {
+		platform = "ios"
+	}
+	plat, err := simulatorPlatform(platform)
+	if err != nil {
+		return err
+	}
+	symroot, err := filepath.Abs(filepath.Join(dir, "build"))
+	if err != nil {
+		return err
+	}
+	args := append(opts.schemeArgs(dir, "Debug"), "-sdk", opts.sdk(plat.SDK),
+		"-destination", plat.destination(opts.Destination), "SYMROOT="+symroot)
+	return xcodebuild(dir, opts, out, args...)
+}
+
+// plistValue reads a top-level key from a property list in any format.
+func plistValue(path, key string) (string, error) {
+	out, err := exec.Command("plutil", "-extract", key, "raw", "-o", "-",
+		path).Output()
+	if err != nil {
+		return "", fmt.Errorf("reading %s from %s: %v", key, path, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func findProvider(name string) buildProvider {
+	for _, p := range buildProviders {
+		if p.Name() == name {
+			return p
+		}
+	}
+	return nil
+}
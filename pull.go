@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+// PullResult reports what a pull changed.
+type PullResult struct {
+	Old        string      `json:"old"`
+	New        string      `json:"new"`
+	Updated    bool        `json:"updated"`
+	Commits    []*Commit   `json:"commits"`
+	Repository *Repository `json:"repository"`
+}
+
+func validRef(s string) bool {
+	return regexpBranchName.MatchString(s) && !strings.HasPrefix(s, "-") &&
+		!strings.Contains(s, "..")
+}
+
+// pullRepo fetches from a remote, origin by default, and fast-forwards the
+// checked out branch, to its upstream or the branch given. The file tree
+// is rescanned so it reflects the new checkout.
+func pullRepo(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	var req struct {
+		Remote string `json:"remote"`
+		Branch string `json:"branch"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	if req.Remote == "" {
+		req.Remote = "origin"
+	}
+	if !validRef(req.Remote) || (req.Branch != "" && !validRef(req.Branch)) {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("invalid remote or branch")}
+	}
+
+	env, err := repoAuthEnv(id, "")
+	if err != nil {
+		return err
+	}
+	unlock := rlockRepo(id)
+	old, err := gitCmd(id, "rev-parse", "HEAD")
+	if err != nil {
+		unlock()
+		return err
+	}
+	args := []string{"fetch", req.Remote}
+	if req.Branch != "" {
+		args = append(args, req.Branch)
+	}
+	if _, err := gitCmdEnv(id, env, args...); err != nil {
+		unlock()
+		return &httputil.HTTPError{http.StatusBadGateway, err}
+	}
+	args = []string{"pull", "--ff-only", req.Remote}
+	if req.Branch != "" {
+		args = append(args, req.Branch)
+	}
+	if _, err := gitCmdEnv(id, env, args...); err != nil {
+		unlock()
+		return &httputil.HTTPError{http.StatusConflict, err}
+	}
+	head, err := gitCmd(id, "rev-parse", "HEAD")
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	res := &PullResult{Old: old, New: head, Updated: old != head,
+		Commits: []*Commit{}}
+	if res.Updated {
+		if res.Commits, err = gitLog(id, old+".."+head); err != nil {
+			return err
+		}
+	}
+	forgetTree(id)
+	invalidateTreeCache(id)
+	res.Repository = scanRepo(id, defaultTreeDepth)
+	publish(&Event{Type: eventRepoPulled, Repo: id,
+		Data: map[string]interface{}{"old": old, "new": head}})
+	return renderJSON(w, http.StatusOK, res)
+}
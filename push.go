@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+// PushError is rendered when git push fails, with git's own output so the
+// client can show why.
+type PushError struct {
+	Status   int    `json:"status"`
+	Message  string `json:"message"`
+	Stderr   string `json:"stderr"`
+	Rejected bool   `json:"rejected"`
+}
+
+func (e *PushError) Error() string { return e.Message }
+
+// pushRepo pushes the checked out branch to origin, authenticating with
+// the token given or the repository's credential. Force pushes use
+// --force-with-lease so they don't overwrite commits that haven't been
+// fetched.
+func pushRepo(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	var req struct {
+		Token string `json:"token"`
+		Force bool   `json:"force"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+
+	defer rlockRepo(id)()
+	branch, head, err := pushBranch(id, req.Token, req.Force)
+	if e, ok := err.(*PushError); ok {
+		return renderJSON(w, e.Status, map[string]interface{}{"error": e})
+	}
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, map[string]interface{}{
+		"remote": "origin",
+		"branch": branch,
+		"head":   head,
+		"forced": req.Force,
+	})
+}
+
+// pushBranch pushes the checked out branch to origin, returning it and the
+// commit pushed. A push git fails is reported as a *PushError. The caller
+// holds the repository lock.
+func pushBranch(id, token string, force bool) (branch, head string, err error) {
+	branch, err = gitCmd(id, "rev-parse", "--abbrev-ref", "HEAD")
+	if err != nil {
+		return "", "", err
+	}
+	if branch == "HEAD" {
+		return "", "", &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("no branch is checked out")}
+	}
+	if _, err := gitRemote(id); err != nil {
+		return "", "", err
+	}
+	env, err := repoAuthEnv(id, token)
+	if err != nil {
+		return "", "", err
+	}
+	args := []string{"push", "--porcelain"}
+	if force {
+		args = append(args, "--force-with-lease")
+	}
+	ref := "refs/heads/" + branch
+	args = append(args, "origin", ref+":"+ref)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Dir = id
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		out := stderr.String()
+		if token != "" {
+			out = strings.Replace(out, token, "****", -1)
+		}
+		// With --porcelain, rejected refs are reported on stdout as
+		// lines starting with "!".
+		rejected := strings.Contains(stdout.String(), "\n!\t") ||
+			strings.HasPrefix(stdout.String(), "!\t")
+		e := &PushError{Status: http.StatusBadGateway,
+			Message: "git push failed", Stderr: strings.TrimSpace(out),
+			Rejected: rejected}
+		if rejected {
+			e.Status = http.StatusConflict
+			e.Message = "push was rejected by the remote"
+		}
+		return "", "", e
+	}
+
+	head, err = gitCmd(id, "rev-parse", "HEAD")
+	if err != nil {
+		return "", "", err
+	}
+	return branch, head, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/launchmango/backend/httputil"
+)
+
+const metroProvider = "metro"
+
+var (
+	metroMu   sync.Mutex
+	metroRuns = make(map[string]*Run)
+)
+
+type reactNativeProvider struct{}
+
+func (reactNativeProvider) Name() string { return "react-native" }
+
+func (reactNativeProvider) Detect(id string) bool {
+	b, err := ioutil.ReadFile(filepath.Join(id, "package.json"))
+	if err != nil {
+		return false
+	}
+	var pkg struct {
+		Dependencies map[string]string `json:"dependencies"`
+	}
+	if json.Unmarshal(b, &pkg) != nil {
+		return false
+	}
+	_, ok := pkg.Dependencies["react-native"]
+	return ok
+}
+
+// workspace returns the iOS shell app's workspace, relative to dir, and
+// scheme, which share the app's name.
+func (reactNativeProvider) workspace(dir string) (string, string, error) {
+	m, _ := filepath.Glob(filepath.Join(dir, "ios", "*.xcworkspace"))
+	if len(m) == 0 {
+		return "", "", &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("no iOS workspace found; run pod install in ios/")}
+	}
+	ws := repoRel(dir, m[0])
+	return ws, strings.TrimSuffix(filepath.Base(ws), ".xcworkspace"), nil
+}
+
+func (p reactNativeProvider) Build(id string, opts *BuildOptions,
+	out io.Writer) error {
+	dir := opts.dir(id)
+	install := []string{"npm", "install"}
+	if fileExists(filepath.Join(dir, "yarn.lock")) {
+		install = []string{"yarn", "install", "--frozen-lockfile"}
+	}
+	ctx := opts.context()
+	if err := runCmdEnv(ctx, dir, opts.env, out, install[0], install[1:]...); err != nil {
+		return err
+	}
+	if fileExists(filepath.Join(dir, "ios", "Podfile")) {
+		if err := runCmdEnv(ctx, filepath.Join(dir, "ios"), opts.env, out, "pod", "install"); err != nil {
+			return err
+		}
+	}
+	ws, scheme, err := p.workspace(dir)
+	if err != nil {
+		return err
+	}
+	return xcodebuild(dir, opts, out, "-workspace", ws, "-scheme", scheme,
+		"-configuration", "Debug", "-sdk", "iphonesimulator",
+		"-derivedDataPath", filepath.Join("ios", "build"))
+}
+
+// metro returns the Metro bundler run of the app in dir, starting one when
+// none is running.
+func (reactNativeProvider) metro(id, dir string) (*Run, error) {
+	metroMu.Lock()
+	defer metroMu.Unlock()
+	if run := metroRuns[dir]; run != nil {
+		run.mu.Lock()
+		running := run.State == runRunning
+		run.mu.Unlock()
+		if running {
+			return run, nil
+		}
+	}
+	cmd := exec.Command("npx", "react-native", "start")
+	cmd.Dir = dir
+	run, err := startRun(id, metroProvider, cmd)
+	if err != nil {
+		return nil, err
+	}
+	metroRuns[dir] = run
+	return run, nil
+}
+
+func (p reactNativeProvider) Run(id string, opts *RunOptions) (*Run, error) {
+	dir := opts.dir(id)
+	apps, _ := filepath.Glob(filepath.Join(dir, "ios", "build", "Build",
+		"Products", "Debug-iphonesimulator", "*.app"))
+	if len(apps) == 0 {
+		return nil, &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("no app found; build the repository first")}
+	}
+	app := apps[0]
+	bundleID, err := plistValue(filepath.Join(app, "Info.plist"),
+		"CFBundleIdentifier")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := p.metro(id, dir); err != nil {
+		return nil, err
+	}
+
+	device := opts.Device
+	if device == "" {
+		device = "booted"
+	} else {
+		// Booting an already booted device fails harmlessly.
+		exec.Command("xcrun", "simctl", "boot", device).Run()
+	}
+	if out, err := exec.Command("xcrun", "simctl", "install", device,
+		app).CombinedOutput(); err != nil {
+		return nil, &httputil.HTTPError{http.StatusBadRequest,
+			errors.New(strings.TrimSpace(string(out)))}
+	}
+	if device != "booted" {
+		recordSimApp(id, device, bundleID)
+	}
+	cmd := exec.Command("xcrun", "simctl", "launch", "--console", device,
+		bundleID)
+	cmd.Dir = dir
+	cmd.Env = opts.runEnv()
+	return startRun(id, p.Name(), cmd)
+}
+
+// Reload asks Metro to reload the JS bundle in the running app. Metro has
+// no separate restart, so restart is treated the same.
+func (p reactNativeProvider) Reload(run *Run, restart bool) error {
+	metroMu.Lock()
+	metro := metroRuns[run.Repo]
+	metroMu.Unlock()
+	if metro == nil {
+		return &httputil.HTTPError{http.StatusConflict,
+			errors.New("Metro is not running")}
+	}
+	return metro.Send("r")
+}
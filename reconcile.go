@@ -0,0 +1,197 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of discrepancy found when reconciling repositories.
+const (
+	discrepancyMissing  = "missing"  // metadata without a directory
+	discrepancyRestored = "restored" // a missing directory is back
+	discrepancyAdopted  = "adopted"  // legacy directory given metadata
+	discrepancyOrphan   = "orphan"   // directory without metadata
+	discrepancyURL      = "url"      // remote differs from the metadata
+)
+
+type Discrepancy struct {
+	Repo   string `json:"repo"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Reconciliation reports a comparison of the repository directories with
+// the repository metadata.
+type Reconciliation struct {
+	Time          time.Time      `json:"time"`
+	Repositories  int            `json:"repositories"`
+	Discrepancies []*Discrepancy `json:"discrepancies"`
+}
+
+var (
+	reconcileMu   sync.Mutex
+	lastReconcile *Reconciliation
+)
+
+func metaIDs() ([]string, error) {
+	fi, err := ioutil.ReadDir(filepath.Join(dataDir, "repositories"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ids []string
+	for _, fi := range fi {
+		if id := strings.TrimSuffix(fi.Name(), ".json"); id != fi.Name() && validRepoID(id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// reconcileRepos compares the repository directories with their metadata.
+// Metadata whose directory has vanished is marked missing, and directories
+// left by the legacy MD5 layout are adopted by recording metadata for them.
+func reconcileRepos() (*Reconciliation, error) {
+	reconcileMu.Lock()
+	defer reconcileMu.Unlock()
+	dirs, err := repoIDs()
+	if err != nil {
+		return nil, err
+	}
+	metas, err := metaIDs()
+	if err != nil {
+		return nil, err
+	}
+	rec := &Reconciliation{Time: time.Now(), Discrepancies: []*Discrepancy{}}
+	report := func(id, kind, detail string) {
+		rec.Discrepancies = append(rec.Discrepancies,
+			&Discrepancy{Repo: id, Kind: kind, Detail: detail})
+	}
+
+	onDisk := make(map[string]bool, len(dirs))
+	for _, id := range dirs {
+		onDisk[id] = true
+	}
+	for _, id := range metas {
+		unlock := lockRepo(id)
+		m, err := loadRepoMeta(id)
+		if err != nil || m == nil {
+			unlock()
+			report(id, discrepancyOrphan, "unreadable metadata")
+			continue
+		}
+		switch {
+		case !onDisk[id] && m.Evicted != nil:
+		case !onDisk[id] && m.Missing == nil:
+			now := time.Now()
+			m.Missing = &now
+			err = saveRepoMeta(m)
+			report(id, discrepancyMissing, m.URL)
+		case !onDisk[id]:
+			report(id, discrepancyMissing, "since "+m.Missing.Format(time.RFC3339))
+		case m.Missing != nil || m.Evicted != nil:
+			m.Missing = nil
+			m.Evicted = nil
+			err = saveRepoMeta(m)
+			report(id, discrepancyRestored, m.URL)
+		}
+		if onDisk[id] {
+			if remote, rerr := gitRemote(id); rerr == nil && remote != m.URL {
+				report(id, discrepancyURL, remote)
+			}
+			// Metadata recorded before default branches were kept.
+			if m.DefaultBranch == "" && err == nil {
+				if m.DefaultBranch = defaultBranch(id); m.DefaultBranch != "" {
+					err = saveRepoMeta(m)
+				}
+			}
+		}
+		unlock()
+		if err != nil {
+			return nil, err
+		}
+		delete(onDisk, id)
+	}
+
+	for _, id := range dirs {
+		if !onDisk[id] {
+			continue
+		}
+		if !regexpULID.MatchString(id) {
+			if err := adoptRepo(id); err != nil {
+				report(id, discrepancyOrphan, err.Error())
+				continue
+			}
+			report(id, discrepancyAdopted, "")
+			continue
+		}
+		report(id, discrepancyOrphan, "no metadata")
+	}
+	rec.Repositories = len(dirs)
+
+	lastReconcile = rec
+	return rec, nil
+}
+
+// adoptRepo records metadata for a repository cloned before IDs were
+// generated.
+func adoptRepo(id string) error {
+	defer lockRepo(id)()
+	remote, err := gitRemote(id)
+	if err != nil && err != errNoRemote {
+		return err
+	}
+	name, err := repoName(id)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(id)
+	if err != nil {
+		return err
+	}
+	branch, _ := gitCmd(id, "rev-parse", "--abbrev-ref", "HEAD")
+	if branch == "HEAD" {
+		branch = ""
+	}
+	return saveRepoMeta(&RepoMeta{ID: id, Name: name, URL: remote,
+		Branch: branch, Created: fi.ModTime(), DefaultBranch: defaultBranch(id)})
+}
+
+// reconcileOnStartup reconciles the repositories when the server starts,
+// logging what it finds.
+func reconcileOnStartup() {
+	rec, err := reconcileRepos()
+	if err != nil {
+		log.Printf("reconcile: %v", err)
+		return
+	}
+	for _, d := range rec.Discrepancies {
+		log.Printf("reconcile: %s: %s %s", d.Repo, d.Kind, d.Detail)
+	}
+}
+
+func getReconciliation(w http.ResponseWriter, r *http.Request) error {
+	reconcileMu.Lock()
+	rec := lastReconcile
+	reconcileMu.Unlock()
+	if rec == nil {
+		return errNotFound
+	}
+	return renderJSON(w, http.StatusOK, rec)
+}
+
+func runReconciliation(w http.ResponseWriter, r *http.Request) error {
+	rec, err := reconcileRepos()
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, rec)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+// Release is a version of the app committed and tagged for release.
+// Archive is where to download the tagged sources.
+type Release struct {
+	Version   string `json:"version"`
+	Build     string `json:"build"`
+	Commit    string `json:"commit"`
+	Tag       string `json:"tag"`
+	Archive   string `json:"archive"`
+	Changelog string `json:"changelog"`
+}
+
+// bumpVersion increments the component of a dotted version named by part:
+// "major", "minor" or "patch", resetting those after it. An empty part
+// increments the last component, as for build numbers.
+func bumpVersion(v, part string) (string, error) {
+	if v == "" {
+		v = "0"
+	}
+	nums := strings.Split(v, ".")
+	i := len(nums) - 1
+	switch part {
+	case "":
+	case "major":
+		i = 0
+	case "minor":
+		i = 1
+	case "patch":
+		i = 2
+	default:
+		return "", &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("bump must be major, minor or patch")}
+	}
+	for len(nums) <= i {
+		nums = append(nums, "0")
+	}
+	n, err := strconv.Atoi(nums[i])
+	if err != nil {
+		return "", fmt.Errorf("version %s is not numeric", v)
+	}
+	nums[i] = strconv.Itoa(n + 1)
+	for j := i + 1; j < len(nums); j++ {
+		nums[j] = "0"
+	}
+	return strings.Join(nums, "."), nil
+}
+
+// createRelease bumps the app's build number, and its version when asked
+// to with bump or set with version, commits the change and tags it, by
+// default v<version>-<build>. Nothing else in the working tree is
+// committed. The tag's message carries the changelog since the previous
+// tag.
+func createRelease(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	var req struct {
+		Bump    string `json:"bump"`
+		Version string `json:"version"`
+		Tag     string `json:"tag"`
+		Message string `json:"message"`
+		Author  string `json:"author"`
+		Email   string `json:"email"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	if req.Version != "" && !regexpAppVersion.MatchString(req.Version) {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("version must be up to three numbers separated by periods")}
+	}
+	if strings.ContainsAny(req.Author, "<>\n") || strings.ContainsAny(req.Email, "<>\n ") {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("invalid author or email")}
+	}
+
+	defer rlockRepo(id)()
+	info, err := readAppInfo(id)
+	if err != nil {
+		return err
+	}
+	version := info.Version
+	switch {
+	case req.Version != "":
+		version = req.Version
+	case req.Bump != "":
+		if version, err = bumpVersion(version, req.Bump); err != nil {
+			return err
+		}
+	}
+	build, err := bumpVersion(info.Build, "")
+	if err != nil {
+		return &httputil.HTTPError{http.StatusConflict, err}
+	}
+	if version == "" {
+		return &httputil.HTTPError{http.StatusConflict,
+			errors.New("the app has no version; set one")}
+	}
+	tag := req.Tag
+	if tag == "" {
+		tag = "v" + version + "-" + build
+	}
+	if strings.HasPrefix(tag, "-") {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("invalid tag")}
+	}
+	if _, err := gitCmd(id, "check-ref-format", "refs/tags/"+tag); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("invalid tag")}
+	}
+	if _, err := gitCmd(id, "rev-parse", "--verify", "--quiet", "refs/tags/"+tag); err == nil {
+		return &httputil.HTTPError{http.StatusConflict,
+			fmt.Errorf("tag %s already exists", tag)}
+	}
+
+	// A release is committed at once, so it can't wait for approval.
+	if owned, err := checkCommitOwners(r, id, appFiles(id)); err != nil {
+		return err
+	} else if owned != nil {
+		return ownedError(owned)
+	}
+	changed, err := setAppInfo(id, nil, &version, &build)
+	if err != nil {
+		return err
+	}
+	if len(changed) == 0 {
+		return &httputil.HTTPError{http.StatusConflict,
+			errors.New("the project sets no build number to bump")}
+	}
+	invalidateTreeCache(id)
+
+	var env []string
+	if req.Author != "" {
+		env = append(env, "GIT_AUTHOR_NAME="+req.Author,
+			"GIT_COMMITTER_NAME="+req.Author)
+	}
+	if req.Email != "" {
+		env = append(env, "GIT_AUTHOR_EMAIL="+req.Email,
+			"GIT_COMMITTER_EMAIL="+req.Email)
+	}
+	senv, err := signingEnv(id)
+	if err != nil {
+		return err
+	}
+	env = append(env, senv...)
+	message := req.Message
+	if strings.TrimSpace(message) == "" {
+		message = fmt.Sprintf("Release %s (%s)", version, build)
+	}
+	if _, err := gitCmd(id, append([]string{"add", "--"}, changed...)...); err != nil {
+		return err
+	}
+	commit := append([]string{"commit", "-m", message, "--"}, changed...)
+	if _, err := gitCmdEnv(id, env, commit...); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	cl, err := buildChangelog(id, "", "HEAD")
+	if err != nil {
+		return err
+	}
+	tagMessage := message
+	if cl.Markdown != "" {
+		tagMessage += "\n\n" + cl.Markdown
+	}
+	if _, err := gitCmdEnv(id, env, "tag", "-a", "--cleanup=verbatim", "-m", tagMessage, tag); err != nil {
+		return err
+	}
+	sha, err := gitCmd(id, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	invalidateTreeCache(id)
+	publish(&Event{Type: eventRepoCommitted, Repo: id,
+		Data: map[string]interface{}{"sha": sha, "tag": tag}})
+	return renderJSON(w, http.StatusCreated, &Release{
+		Version:   version,
+		Build:     build,
+		Commit:    sha,
+		Tag:       tag,
+		Archive:   "/repositories/" + id + "/archive?ref=" + url.QueryEscape(tag),
+		Changelog: cl.Markdown,
+	})
+}
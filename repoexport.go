@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/launchmango/backend/httputil"
+)
+
+const repoExportVersion = 1
+
+// RepoExport is the definition of every repository on a server, without
+// the checkouts, for setting up the same repositories on another one.
+type RepoExport struct {
+	Version      int               `json:"version"`
+	Exported     time.Time         `json:"exported"`
+	Repositories []*RepoDefinition `json:"repositories"`
+}
+
+// RepoDefinition describes how to set up one repository again. Credentials
+// and secrets are referred to by name and ID only; they have to exist on
+// the importing server.
+type RepoDefinition struct {
+	ID         string        `json:"id"`
+	Name       string        `json:"name,omitempty"`
+	URL        string        `json:"url"`
+	Branch     string        `json:"branch,omitempty"`
+	Partial    bool          `json:"partial,omitempty"`
+	Credential string        `json:"credential,omitempty"`
+	Labels     []string      `json:"labels,omitempty"`
+	Settings   *RepoSettings `json:"settings,omitempty"`
+}
+
+// ImportResult reports what became of a repository definition on import.
+type ImportResult struct {
+	URL   string `json:"url"`
+	ID    string `json:"id,omitempty"`
+	State string `json:"state"` // "cloned", "exists" or "failed"
+	Error string `json:"error,omitempty"`
+}
+
+func exportRepos(w http.ResponseWriter, r *http.Request) error {
+	metas, err := allRepoMeta()
+	if err != nil {
+		return err
+	}
+	export := &RepoExport{Version: repoExportVersion, Exported: time.Now(),
+		Repositories: []*RepoDefinition{}}
+	for _, m := range metas {
+		d := &RepoDefinition{ID: m.ID, Name: m.Name, URL: m.URL,
+			Branch: m.Branch, Partial: m.Partial, Credential: m.Credential,
+			Labels: m.Labels}
+		if d.Settings, err = loadRepoSettings(m.ID); err != nil {
+			return err
+		}
+		export.Repositories = append(export.Repositories, d)
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="repositories.json"`)
+	return renderJSON(w, http.StatusOK, export)
+}
+
+// importRepos clones the repositories of an export in a background job.
+// A repository is skipped when one with the same ID, or the same URL and
+// branch, already exists, so an import can be run again after a failure.
+// Imported repositories keep their IDs, so links to them still work.
+func importRepos(w http.ResponseWriter, r *http.Request) error {
+	var export RepoExport
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&export); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	if export.Version != repoExportVersion {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			fmt.Errorf("unsupported export version %d", export.Version)}
+	}
+	for _, d := range export.Repositories {
+		if d.URL == "" || strings.HasPrefix(d.URL, "-") || strings.HasPrefix(d.Branch, "-") {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				fmt.Errorf("invalid url or branch for repository %s", d.ID)}
+		}
+		if d.ID != "" && !validRepoID(d.ID) {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				fmt.Errorf("invalid repository ID %s", d.ID)}
+		}
+		labels, err := cleanLabels(d.Labels)
+		if err != nil {
+			return err
+		}
+		d.Labels = labels
+	}
+
+	j := startResultJob("", "import", func(out io.Writer) (interface{}, error) {
+		results := make([]*ImportResult, len(export.Repositories))
+		failed := 0
+		for i, d := range export.Repositories {
+			results[i] = importRepo(d, out)
+			if results[i].State == "failed" {
+				failed++
+			}
+		}
+		if failed > 0 {
+			return results, fmt.Errorf("%d of %d repositories failed to import",
+				failed, len(results))
+		}
+		return results, nil
+	})
+	return renderJSON(w, http.StatusAccepted, j)
+}
+
+func importRepo(d *RepoDefinition, out io.Writer) *ImportResult {
+	res := &ImportResult{URL: d.URL}
+	metas, err := allRepoMeta()
+	if err != nil {
+		res.State, res.Error = "failed", err.Error()
+		return res
+	}
+	for _, m := range metas {
+		if m.ID == d.ID || (m.URL == d.URL && m.Branch == d.Branch) {
+			fmt.Fprintf(out, "%s: exists as %s\n", d.URL, m.ID)
+			res.ID, res.State = m.ID, "exists"
+			return res
+		}
+	}
+
+	id := d.ID
+	if id == "" || repoExists(id) {
+		id = newULID()
+	}
+	fmt.Fprintf(out, "%s: cloning into %s\n", d.URL, id)
+	err = func() error {
+		if err := checkDiskSpace(); err != nil {
+			return err
+		}
+		env := []string{"GIT_TERMINAL_PROMPT=0"}
+		if d.Credential != "" {
+			cenv, err := credentialEnv(d.Credential)
+			if err != nil {
+				return err
+			}
+			env = append(env, cenv...)
+		}
+		repo := &Repository{ID: id, URL: d.URL, Branch: d.Branch,
+			Partial: d.Partial, Credential: d.Credential}
+		if _, err := cloneRepo(repo, env); err != nil {
+			return err
+		}
+		if _, err := updateRepoMeta(id, func(m *RepoMeta) {
+			if d.Name != "" {
+				m.Name = d.Name
+			}
+			m.Labels = d.Labels
+		}); err != nil {
+			return err
+		}
+		if d.Settings != nil {
+			return saveRepoSettings(id, d.Settings)
+		}
+		return nil
+	}()
+	res.ID = id
+	if err != nil {
+		if he, ok := err.(*httputil.HTTPError); ok {
+			err = he.Err
+		}
+		fmt.Fprintf(out, "%s: %v\n", d.URL, err)
+		res.State, res.Error = "failed", err.Error()
+		return res
+	}
+	res.State = "cloned"
+	return res
+}
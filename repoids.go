@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+var regexpULID = regexp.MustCompile(`^[0-9A-HJKMNP-TV-Z]{26}$`)
+
+// RepoMeta is what the server records about a repository it cloned.
+// Repositories cloned before IDs were generated have no metadata and are
+// still addressed by the MD5 of their URL.
+type RepoMeta struct {
+	ID      string `json:"id"`
+	Name    string `json:"name,omitempty"`
+	URL     string `json:"url"`
+	Branch  string `json:"branch,omitempty"`
+	Partial bool   `json:"partial,omitempty"`
+
+	// Credential is the ID of the credential used to reach the remote.
+	Credential string `json:"credential,omitempty"`
+
+	Created time.Time `json:"created"`
+
+	// Missing is when the repository's directory was found to be gone.
+	Missing *time.Time `json:"missing,omitempty"`
+
+	// Used is roughly when the repository was last used, and Evicted when
+	// its checkout was removed to free disk space.
+	Used    time.Time  `json:"used,omitempty"`
+	Evicted *time.Time `json:"evicted,omitempty"`
+
+	DefaultBranch string       `json:"defaultBranch,omitempty"`
+	LastBuild     *BuildStatus `json:"lastBuild,omitempty"`
+	Builds        int          `json:"builds,omitempty"` // how many were started
+	Labels        []string     `json:"labels,omitempty"`
+
+	// Dependencies is how resolving the app's pods and packages last went.
+	Dependencies *DependencyStatus `json:"dependencies,omitempty"`
+
+	// Readiness is how warming the repository up after cloning went.
+	Readiness *Readiness `json:"readiness,omitempty"`
+}
+
+// newULID returns a lexically sortable identifier: a millisecond timestamp
+// followed by 80 random bits, in Crockford base32.
+func newULID() string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(time.Now().UnixNano()/int64(time.Millisecond))<<16)
+	rand.Read(b[6:])
+
+	// 128 bits in 26 characters, the first of which carries only 3 bits.
+	out := make([]byte, 26)
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out)
+}
+
+// validRepoID reports whether id has the form of a repository ID, either
+// a generated ULID or a legacy MD5.
+func validRepoID(id string) bool {
+	return regexpULID.MatchString(id) || (len(id) == 32 && regexpMD5.MatchString(id))
+}
+
+func repoMetaName(id string) string {
+	return filepath.Join("repositories", id+".json")
+}
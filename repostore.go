@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+var regexpLabel = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:/-]{0,63}$`)
+
+// BuildStatus is the outcome of a repository's last build.
+type BuildStatus struct {
+	ID       string     `json:"id"`
+	State    string     `json:"state"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// repoStore indexes the metadata of every repository in memory, so listing
+// repositories doesn't read a file or run git for each. It is loaded from
+// dataDir/repositories on first use and written through on every change.
+var repoStore = struct {
+	sync.Mutex
+	metas map[string]*RepoMeta
+}{}
+
+func (m *RepoMeta) copy() *RepoMeta {
+	c := *m
+	c.Labels = append([]string(nil), m.Labels...)
+	return &c
+}
+
+// loadRepoStore reads the metadata files. The caller holds the store lock.
+func loadRepoStore() error {
+	if repoStore.metas != nil {
+		return nil
+	}
+	ids, err := metaIDs()
+	if err != nil {
+		return err
+	}
+	metas := make(map[string]*RepoMeta, len(ids))
+	for _, id := range ids {
+		var m RepoMeta
+		if err := readJSON(repoMetaName(id), &m); err != nil {
+			log.Printf("repository %s: %v", id, err)
+			continue
+		}
+		if m.ID != "" {
+			metas[m.ID] = &m
+		}
+	}
+	repoStore.metas = metas
+	return nil
+}
+
+func loadRepoMeta(id string) (*RepoMeta, error) {
+	repoStore.Lock()
+	defer repoStore.Unlock()
+	if err := loadRepoStore(); err != nil {
+		return nil, err
+	}
+	m := repoStore.metas[id]
+	if m == nil {
+		return nil, nil
+	}
+	return m.copy(), nil
+}
+
+func saveRepoMeta(m *RepoMeta) error {
+	repoStore.Lock()
+	defer repoStore.Unlock()
+	if err := loadRepoStore(); err != nil {
+		return err
+	}
+	if err := writeJSON(repoMetaName(m.ID), m); err != nil {
+		return err
+	}
+	repoStore.metas[m.ID] = m.copy()
+	return nil
+}
+
+// updateRepoMeta changes the metadata of repository id with fn, atomically
+// with respect to other updates. It returns nil if there is none.
+func updateRepoMeta(id string, fn func(m *RepoMeta)) (*RepoMeta, error) {
+	repoStore.Lock()
+	defer repoStore.Unlock()
+	if err := loadRepoStore(); err != nil {
+		return nil, err
+	}
+	old := repoStore.metas[id]
+	if old == nil {
+		return nil, nil
+	}
+	m := old.copy()
+	fn(m)
+	if err := writeJSON(repoMetaName(id), m); err != nil {
+		return nil, err
+	}
+	repoStore.metas[id] = m
+	return m.copy(), nil
+}
+
+func removeRepoMeta(id string) error {
+	repoStore.Lock()
+	defer repoStore.Unlock()
+	if repoStore.metas != nil {
+		delete(repoStore.metas, id)
+	}
+	err := os.Remove(filepath.Join(dataDir, repoMetaName(id)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// allRepoMeta returns the metadata of every repository, oldest first.
+func allRepoMeta() ([]*RepoMeta, error) {
+	repoStore.Lock()
+	defer repoStore.Unlock()
+	if err := loadRepoStore(); err != nil {
+		return nil, err
+	}
+	metas := make([]*RepoMeta, 0, len(repoStore.metas))
+	for _, m := range repoStore.metas {
+		metas = append(metas, m.copy())
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		if !metas[i].Created.Equal(metas[j].Created) {
+			return metas[i].Created.Before(metas[j].Created)
+		}
+		return metas[i].ID < metas[j].ID
+	})
+	return metas, nil
+}
+
+// hasLabel reports whether m is labelled with label.
+func (m *RepoMeta) hasLabel(label string) bool {
+	for _, l := range m.Labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// repoFromMeta describes a repository from its metadata alone.
+func repoFromMeta(m *RepoMeta) *Repository {
+	created := m.Created
+	return &Repository{
+		ID:            m.ID,
+		Name:          m.Name,
+		URL:           m.URL,
+		Branch:        m.Branch,
+		Partial:       m.Partial,
+		Created:       &created,
+		DefaultBranch: m.DefaultBranch,
+		Labels:        m.Labels,
+		LastBuild:     m.LastBuild,
+		Dependencies:  m.Dependencies,
+		Readiness:     m.Readiness,
+	}
+}
+
+// defaultBranch returns the branch origin's HEAD points to, or else the
+// branch checked out.
+func defaultBranch(id string) string {
+	if ref, err := gitCmd(id, "symbolic-ref", "--short", "refs/remotes/origin/HEAD"); err == nil {
+		return strings.TrimPrefix(ref, "origin/")
+	}
+	if branch, err := gitCmd(id, "rev-parse", "--abbrev-ref", "HEAD"); err == nil && branch != "HEAD" {
+		return branch
+	}
+	return ""
+}
+
+// recordBuildStatus keeps the outcome of the build of each repository that
+// finished last.
+func recordBuildStatus(e *Event) {
+	if e.Type != eventBuildSucceeded && e.Type != eventBuildFailed {
+		return
+	}
+	id, _ := e.Data["build"].(string)
+	b, err := findBuild(id)
+	if err != nil || b == nil {
+		return
+	}
+	_, err = updateRepoMeta(e.Repo, func(m *RepoMeta) {
+		m.LastBuild = &BuildStatus{ID: b.ID, State: b.State, Finished: b.Finished}
+	})
+	if err != nil {
+		log.Printf("repository %s: recording build: %v", e.Repo, err)
+	}
+}
+
+// cleanLabels validates labels, dropping duplicates.
+func cleanLabels(labels []string) ([]string, error) {
+	seen := make(map[string]bool)
+	clean := []string{}
+	for _, l := range labels {
+		l = strings.TrimSpace(l)
+		if !regexpLabel.MatchString(l) {
+			return nil, &httputil.HTTPError{http.StatusBadRequest,
+				errors.New("invalid label " + l)}
+		}
+		if !seen[l] {
+			seen[l] = true
+			clean = append(clean, l)
+		}
+	}
+	sort.Strings(clean)
+	return clean, nil
+}
+
+// updateRepo renames a repository or replaces its labels. The name is kept
+// in its metadata, so it overrides the one taken from the remote.
+func updateRepo(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	var req struct {
+		Name   *string  `json:"name"`
+		Labels []string `json:"labels"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	if req.Name != nil && strings.TrimSpace(*req.Name) == "" {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("name can't be empty")}
+	}
+	var labels []string
+	if req.Labels != nil {
+		var err error
+		if labels, err = cleanLabels(req.Labels); err != nil {
+			return err
+		}
+	}
+	m, err := updateRepoMeta(id, func(m *RepoMeta) {
+		if req.Name != nil {
+			m.Name = strings.TrimSpace(*req.Name)
+		}
+		if req.Labels != nil {
+			m.Labels = labels
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return &httputil.HTTPError{http.StatusConflict,
+			errors.New("repository has no metadata; reconcile it first")}
+	}
+	return renderJSON(w, http.StatusOK, repoFromMeta(m))
+}
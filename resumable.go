@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+// Resumable uploads follow the tus protocol, version 1.0.0, with its
+// creation and termination extensions: an upload is created with its
+// length and destination, and its bytes are then sent in PATCH requests,
+// each starting at the offset the server has, which HEAD tells after a
+// broken connection.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination"
+
+	// uploadExpiry is how long an unfinished upload is kept after it was
+	// last written to.
+	uploadExpiry = 24 * time.Hour
+)
+
+var regexpUploadID = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// maxUploadSize bounds the size of a resumable upload, set in bytes with
+// MAX_UPLOAD_SIZE; zero means no limit. It is separate from MAX_FILE_SIZE
+// since these are meant for the big files single requests fail to send.
+var maxUploadSize = struct {
+	once sync.Once
+	n    int64
+}{n: 4 << 30}
+
+func uploadSizeLimit() int64 {
+	maxUploadSize.once.Do(func() {
+		if n, err := strconv.ParseInt(os.Getenv("MAX_UPLOAD_SIZE"), 10, 64); err == nil {
+			maxUploadSize.n = n
+		}
+	})
+	return maxUploadSize.n
+}
+
+// Upload is a resumable upload of the file at Path. ETag is that of the
+// file it replaces, or "" for a new file; the upload fails if the file has
+// changed by the time it completes.
+type Upload struct {
+	ID      string    `json:"id"`
+	Repo    string    `json:"repo"`
+	Path    string    `json:"path"`
+	Length  int64     `json:"length"`
+	ETag    string    `json:"etag,omitempty"`
+	User    string    `json:"user,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// writingUploads holds the uploads a PATCH is writing to, which another
+// can't until it's done.
+var writingUploads = struct {
+	sync.Mutex
+	ids map[string]bool
+}{ids: make(map[string]bool)}
+
+func uploadName(repo, id string) string {
+	return filepath.Join("uploads", repo, id+".json")
+}
+
+func uploadDataPath(repo, id string) string {
+	return filepath.Join(dataDir, "uploads", repo, id+".part")
+}
+
+func loadUpload(repo, id string) (*Upload, error) {
+	if !regexpUploadID.MatchString(id) {
+		return nil, nil
+	}
+	var u *Upload
+	if err := readJSON(uploadName(repo, id), &u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func removeUpload(repo, id string) error {
+	if err := os.Remove(uploadDataPath(repo, id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(filepath.Join(dataDir, uploadName(repo, id)))
+}
+
+// purgeUploads removes the repository's uploads nobody has written to for
+// uploadExpiry.
+func purgeUploads(repo string) {
+	matches, _ := filepath.Glob(filepath.Join(dataDir, "uploads", repo, "*.part"))
+	for _, m := range matches {
+		if fi, err := os.Stat(m); err == nil && time.Since(fi.ModTime()) > uploadExpiry {
+			removeUpload(repo, strings.TrimSuffix(filepath.Base(m), ".part"))
+		}
+	}
+}
+
+// uploadOffset returns how many bytes of u have been received.
+func uploadOffset(u *Upload) (int64, error) {
+	fi, err := os.Stat(uploadDataPath(u.Repo, u.ID))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// tusHeaders sets the headers every tus response carries, and checks the
+// client speaks the version supported.
+func tusHeaders(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if v := r.Header.Get("Tus-Resumable"); v != "" && v != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		return &httputil.HTTPError{http.StatusPreconditionFailed,
+			fmt.Errorf("unsupported tus version %s", v)}
+	}
+	return nil
+}
+
+// uploadMetadata decodes an Upload-Metadata header: comma-separated keys,
+// each followed by its value in base64.
+func uploadMetadata(h string) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(h, ",") {
+		f := strings.Fields(pair)
+		if len(f) == 0 {
+			continue
+		}
+		var v []byte
+		if len(f) > 1 {
+			var err error
+			if v, err = base64.StdEncoding.DecodeString(f[1]); err != nil {
+				return nil, &httputil.HTTPError{http.StatusBadRequest,
+					fmt.Errorf("invalid Upload-Metadata value for %s", f[0])}
+			}
+		}
+		meta[f[0]] = string(v)
+	}
+	return meta, nil
+}
+
+// uploadOptions describes the resumable uploads supported.
+func uploadOptions(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	if max := uploadSizeLimit(); max > 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(max, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// createUpload starts a resumable upload of Upload-Length bytes to the
+// path given in the Upload-Metadata header, or with ?path=. Replacing an
+// existing file takes If-Match, as writing it does.
+func createUpload(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	if err := tusHeaders(w, r); err != nil {
+		return err
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("Upload-Length is required")}
+	}
+	if max := uploadSizeLimit(); max > 0 && length > max {
+		return errFileTooLarge
+	}
+	meta, err := uploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		return err
+	}
+	rel := meta["path"]
+	if rel == "" {
+		rel = r.URL.Query().Get("path")
+	}
+	if rel == "" {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("path is required")}
+	}
+	p, err := repoPath(id, rel)
+	if err != nil {
+		return err
+	}
+	if hasGitDir(repoRel(id, p)) {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("can't write inside .git")}
+	}
+	if err := checkOwners(r, id, repoRel(id, p)); err != nil {
+		return err
+	}
+
+	u := &Upload{ID: newID(), Repo: id, Path: repoRel(id, p), Length: length,
+		User: requestUser(r), Created: time.Now()}
+	fi, err := os.Stat(p)
+	switch {
+	case err == nil && fi.IsDir():
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("path is a directory")}
+	case err == nil:
+		if err := checkIfMatch(r, fi); err != nil {
+			return err
+		}
+		u.ETag = fileETag(fi)
+	case os.IsNotExist(err):
+		if r.Header.Get("If-Match") != "" {
+			return errPreconditionFailed
+		}
+		if err := checkParent(p, r); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	purgeUploads(id)
+	data := uploadDataPath(id, u.ID)
+	if err := os.MkdirAll(filepath.Dir(data), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(data, nil, 0600); err != nil {
+		return err
+	}
+	if err := writeJSON(uploadName(id, u.ID), u); err != nil {
+		os.Remove(data)
+		return err
+	}
+	w.Header().Set("Location", "/repositories/"+id+"/uploads/"+u.ID)
+	if length == 0 {
+		if err := finishUpload(r, u); err != nil {
+			return err
+		}
+	}
+	return renderJSON(w, http.StatusCreated, u)
+}
+
+// headUpload tells how much of an upload has been received.
+func headUpload(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	if !repoExists(vars["id"]) {
+		return errNotFound
+	}
+	if err := tusHeaders(w, r); err != nil {
+		return err
+	}
+	u, err := loadUpload(vars["id"], vars["upload"])
+	if err != nil {
+		return err
+	}
+	if u == nil {
+		return errNotFound
+	}
+	offset, err := uploadOffset(u)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// patchUpload appends the body to an upload, which must resume at the
+// offset received so far. What arrives is kept even if the connection
+// breaks, to be resumed from. Once all of it has arrived, the file takes
+// its place in the repository.
+func patchUpload(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	if err := tusHeaders(w, r); err != nil {
+		return err
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		return &httputil.HTTPError{http.StatusUnsupportedMediaType,
+			errors.New("Content-Type must be application/offset+octet-stream")}
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("Upload-Offset is required")}
+	}
+	u, err := loadUpload(id, vars["upload"])
+	if err != nil {
+		return err
+	}
+	if u == nil {
+		return errNotFound
+	}
+
+	writingUploads.Lock()
+	busy := writingUploads.ids[u.ID]
+	writingUploads.ids[u.ID] = true
+	writingUploads.Unlock()
+	if busy {
+		return &httputil.HTTPError{http.StatusConflict,
+			errors.New("upload is being written to")}
+	}
+	defer func() {
+		writingUploads.Lock()
+		delete(writingUploads.ids, u.ID)
+		writingUploads.Unlock()
+	}()
+
+	have, err := uploadOffset(u)
+	if err != nil {
+		return err
+	}
+	if offset != have {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(have, 10))
+		return &httputil.HTTPError{http.StatusConflict,
+			fmt.Errorf("upload is at offset %d", have)}
+	}
+	if r.ContentLength > u.Length-have {
+		return &httputil.HTTPError{http.StatusRequestEntityTooLarge,
+			errors.New("body goes past Upload-Length")}
+	}
+	f, err := os.OpenFile(uploadDataPath(id, u.ID), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	n, err := io.Copy(f, io.LimitReader(r.Body, u.Length-have))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	offset = have + n
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	if offset == u.Length {
+		if err := finishUpload(r, u); err != nil {
+			return err
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// finishUpload moves a complete upload into the repository, if the file
+// it replaces hasn't changed since it started and its owners still allow.
+func finishUpload(r *http.Request, u *Upload) error {
+	id := u.Repo
+	defer rlockRepo(id)()
+	p, err := repoPath(id, u.Path)
+	if err != nil {
+		return err
+	}
+	if err := checkOwners(r, id, u.Path); err != nil {
+		return err
+	}
+	data := uploadDataPath(id, u.ID)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	mode := os.FileMode(0644)
+	writeMu.Lock()
+	fi, err := os.Stat(p)
+	switch {
+	case err == nil && (fi.IsDir() || fileETag(fi) != u.ETag):
+		err = errPreconditionFailed
+	case err == nil:
+		mode = fi.Mode()
+	case os.IsNotExist(err) && u.ETag == "":
+		err = nil
+	case os.IsNotExist(err):
+		err = errPreconditionFailed
+	}
+	if err == nil {
+		if err = os.Chmod(data, mode); err == nil {
+			err = os.Rename(data, p)
+		}
+	}
+	writeMu.Unlock()
+	if err != nil {
+		if err == errPreconditionFailed {
+			removeUpload(id, u.ID)
+		}
+		return err
+	}
+	if err := os.Remove(filepath.Join(dataDir, uploadName(id, u.ID))); err != nil {
+		return err
+	}
+	invalidateTreeCache(id)
+	publish(&Event{Type: eventRepoEdited, Repo: id,
+		Data: map[string]interface{}{"action": "upload", "paths": []string{u.Path}}})
+	return nil
+}
+
+// deleteUpload abandons an upload, throwing away what it received.
+func deleteUpload(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	if !repoExists(vars["id"]) {
+		return errNotFound
+	}
+	if err := tusHeaders(w, r); err != nil {
+		return err
+	}
+	u, err := loadUpload(vars["id"], vars["upload"])
+	if err != nil {
+		return err
+	}
+	if u == nil {
+		return errNotFound
+	}
+	if err := removeUpload(u.Repo, u.ID); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
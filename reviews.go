@@ -0,0 +1,360 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+var regexpApprovalID = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// Approval is a commit waiting for review: one its author proposed, or one
+// changing files owned by others. Owned maps those files to their owners,
+// one of whom must approve each. Reviewers, when given, are those who may
+// approve it, and with Push the commit is pushed once made.
+type Approval struct {
+	ID          string              `json:"id"`
+	Repo        string              `json:"repo"`
+	User        string              `json:"user"`
+	Created     time.Time           `json:"created"`
+	Commit      *CommitRequest      `json:"commit"`
+	Owned       map[string][]string `json:"owned"`
+	Reviewers   []string            `json:"reviewers,omitempty"`
+	Push        bool                `json:"push,omitempty"`
+	Fingerprint string              `json:"fingerprint"`
+}
+
+// ApprovalResult is the commit an approval made, and how pushing it went
+// when it was to be pushed.
+type ApprovalResult struct {
+	*Commit
+	Pushed    bool       `json:"pushed,omitempty"`
+	PushError *PushError `json:"pushError,omitempty"`
+}
+
+// changeFingerprint identifies the contents of the changed files, so an
+// approval is only for the changes the reviewers saw.
+func changeFingerprint(id string, changed []string) (string, error) {
+	files := append([]string{}, changed...)
+	sort.Strings(files)
+	h := sha256.New()
+	for _, f := range files {
+		hash := "deleted"
+		if fi, err := os.Lstat(filepath.Join(id, filepath.FromSlash(f))); err == nil && !fi.IsDir() {
+			if hash, err = gitCmd(id, "hash-object", "--", f); err != nil {
+				return "", err
+			}
+		}
+		fmt.Fprintf(h, "%s\x00%s\n", f, hash)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func approvalName(repo, id string) string {
+	return filepath.Join("approvals", repo, id+".json")
+}
+
+func loadApproval(repo, id string) (*Approval, error) {
+	if !regexpApprovalID.MatchString(id) {
+		return nil, nil
+	}
+	var a *Approval
+	if err := readJSON(approvalName(repo, id), &a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// requestApproval records a, whose Commit, Owned, Reviewers and Push are
+// filled in, for review, telling its reviewers. The caller holds the
+// repository lock.
+func requestApproval(r *http.Request, id string, a *Approval) error {
+	fp, err := changeFingerprint(id, a.Commit.Changed)
+	if err != nil {
+		return err
+	}
+	a.ID, a.Repo, a.User = newID(), id, requestUser(r)
+	a.Created, a.Fingerprint = time.Now(), fp
+	if err := writeJSON(approvalName(id, a.ID), a); err != nil {
+		return err
+	}
+	approvers := append([]string{}, a.Reviewers...)
+	seen := make(map[string]bool)
+	for _, owners := range a.Owned {
+		for _, o := range owners {
+			if !seen[o] {
+				seen[o] = true
+				approvers = append(approvers, o)
+			}
+		}
+	}
+	sort.Strings(approvers)
+	publish(&Event{Type: eventApprovalRequested, Repo: id,
+		Data: map[string]interface{}{"approval": a.ID, "user": a.User,
+			"owners": approvers, "message": a.Commit.Message}})
+	return nil
+}
+
+// proposeCommit puts the uncommitted changes under paths, or all of them,
+// up for review rather than committing them. Any user but the author may
+// approve, or with reviewers one of those, as long as they also own the
+// files that need their owners' approval.
+func proposeCommit(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	user := requestUser(r)
+	if user == "" {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("user is required")}
+	}
+	var req struct {
+		CommitRequest
+		Reviewers []string `json:"reviewers"`
+		Push      bool     `json:"push"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	c := &req.CommitRequest
+	if err := c.validate(id); err != nil {
+		return err
+	}
+	for _, reviewer := range req.Reviewers {
+		if !regexpUserName.MatchString(reviewer) || reviewer == user {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				fmt.Errorf("invalid reviewer %q", reviewer)}
+		}
+	}
+
+	defer rlockRepo(id)()
+	changed, err := changedPaths(id, c.Paths)
+	if err != nil {
+		return err
+	}
+	if len(changed) == 0 {
+		return &httputil.HTTPError{http.StatusConflict,
+			errors.New("nothing to commit")}
+	}
+	c.Changed = changed
+	a := &Approval{Commit: c, Owned: map[string][]string{},
+		Reviewers: req.Reviewers, Push: req.Push}
+	co, err := loadCodeOwners(id)
+	if err != nil {
+		return err
+	}
+	if co != nil {
+		a.Owned = ownedByOthers(id, co, user, changed)
+	}
+	if err := requestApproval(r, id, a); err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusCreated, a)
+}
+
+func listApprovals(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	files, err := ioutil.ReadDir(filepath.Join(dataDir, "approvals", id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	approvals := []*Approval{}
+	for _, fi := range files {
+		a, err := loadApproval(id, strings.TrimSuffix(fi.Name(), ".json"))
+		if err != nil {
+			return err
+		}
+		if a != nil {
+			approvals = append(approvals, a)
+		}
+	}
+	sort.Slice(approvals, func(i, j int) bool {
+		return approvals[i].Created.Before(approvals[j].Created)
+	})
+	return renderJSON(w, http.StatusOK, approvals)
+}
+
+// getApproval returns an approval with the diff up for review. Stale is
+// set when the changes have been edited since, so approving would fail.
+func getApproval(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	a, err := loadApproval(id, vars["approval"])
+	if err != nil {
+		return err
+	}
+	if a == nil {
+		return errNotFound
+	}
+
+	defer rlockRepo(id)()
+	paths := a.Commit.Paths
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	var diff []byte
+	for _, p := range paths {
+		d, err := repoDiff(id, p, false)
+		if err != nil {
+			return err
+		}
+		diff = append(diff, d...)
+	}
+	changed, err := changedPaths(id, a.Commit.Paths)
+	if err != nil {
+		return err
+	}
+	fp, err := changeFingerprint(id, changed)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, &struct {
+		*Approval
+		Diff  string `json:"diff"`
+		Stale bool   `json:"stale"`
+	}{a, string(diff), fp != a.Fingerprint})
+}
+
+// checkReviewer checks user may review a, whose commit would now change
+// the changed files. It must be one of its reviewers, if it names any, and
+// own each of the files owned by others than its author, by the owners now
+// in force.
+func (a *Approval) checkReviewer(user string, changed []string) error {
+	if user == "" || user == a.User {
+		return &httputil.HTTPError{http.StatusForbidden,
+			errors.New("a commit needs a reviewer other than its author")}
+	}
+	if len(a.Reviewers) > 0 && !containsString(a.Reviewers, user) {
+		return &httputil.HTTPError{http.StatusForbidden,
+			fmt.Errorf("%s isn't a reviewer of this commit", user)}
+	}
+	co, err := loadCodeOwners(a.Repo)
+	if err != nil || co == nil {
+		return err
+	}
+	for f, owners := range ownedByOthers(a.Repo, co, a.User, changed) {
+		if !containsString(owners, user) {
+			return ownedError(map[string][]string{f: owners})
+		}
+	}
+	return nil
+}
+
+// approveCommit makes the commit an approval waits for, once a reviewer
+// approves it, and pushes it if asked to. The author can't approve their
+// own commit, the approver must own each of the files owned by others,
+// and the files must not have changed since. The push uses the
+// repository's credential, or a token in the body.
+func approveCommit(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	user := requestUser(r)
+	if user == "" {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("user is required")}
+	}
+	var req struct {
+		Token string `json:"token"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+
+	defer rlockRepo(id)()
+	a, err := loadApproval(id, vars["approval"])
+	if err != nil {
+		return err
+	}
+	if a == nil {
+		return errNotFound
+	}
+	changed, err := changedPaths(id, a.Commit.Paths)
+	if err != nil {
+		return err
+	}
+	if err := a.checkReviewer(user, changed); err != nil {
+		return err
+	}
+	fp, err := changeFingerprint(id, changed)
+	if err != nil {
+		return err
+	}
+	if fp != a.Fingerprint {
+		return &httputil.HTTPError{http.StatusConflict,
+			errors.New("the changes have been edited since approval was requested; request it again")}
+	}
+	c, err := commitChanges(id, a.Commit)
+	if err != nil {
+		return err
+	}
+	audit("approve", id, fmt.Sprintf("%s approved %s's commit %s", user, a.User, c.SHA))
+	if err := os.Remove(filepath.Join(dataDir, approvalName(id, a.ID))); err != nil {
+		return err
+	}
+	res := &ApprovalResult{Commit: c}
+	if a.Push {
+		_, _, err := pushBranch(id, req.Token, false)
+		if e, ok := err.(*PushError); ok {
+			res.PushError = e
+		} else if err != nil {
+			res.PushError = &PushError{Status: http.StatusBadGateway,
+				Message: err.Error()}
+		} else {
+			res.Pushed = true
+		}
+	}
+	return renderJSON(w, http.StatusCreated, res)
+}
+
+// rejectApproval drops an approval request, leaving the changes in the
+// working tree. Its author can withdraw it too.
+func rejectApproval(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	a, err := loadApproval(id, vars["approval"])
+	if err != nil {
+		return err
+	}
+	if a == nil {
+		return errNotFound
+	}
+	if user := requestUser(r); user != a.User {
+		if err := a.checkReviewer(user, a.Commit.Changed); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(filepath.Join(dataDir, approvalName(id, a.ID))); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	ringBufferLines = 2000
+	ringLineLength  = 4096
+)
+
+// ringBuffer keeps the last ringBufferLines lines written to it, so the
+// output of chatty commands can be served while they run without growing
+// without bound. When persisted, everything written is also appended to a
+// log file on disk.
+type ringBuffer struct {
+	mu      sync.Mutex
+	lines   []string
+	next    int
+	dropped int
+	partial []byte
+	file    *os.File
+}
+
+func logFilePath(kind, id string) string {
+	return filepath.Join(dataDir, "logs", kind, id+".log")
+}
+
+// persist starts copying output to the log file for the named job or run.
+func (b *ringBuffer) persist(kind, id string) error {
+	p := logFilePath(kind, id)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.file = f
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *ringBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.file == nil {
+		return nil
+	}
+	err := b.file.Close()
+	b.file = nil
+	return err
+}
+
+func (b *ringBuffer) push(line string) {
+	if len(line) > ringLineLength {
+		line = line[:ringLineLength] + "…"
+	}
+	if len(b.lines) < ringBufferLines {
+		b.lines = append(b.lines, line)
+		return
+	}
+	b.lines[b.next] = line
+	b.next = (b.next + 1) % ringBufferLines
+	b.dropped++
+}
+
+func (b *ringBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(p)
+	if b.file != nil {
+		b.file.Write(p)
+	}
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			b.partial = append(b.partial, p...)
+			if len(b.partial) > ringLineLength {
+				b.push(string(b.partial))
+				b.partial = b.partial[:0]
+			}
+			break
+		}
+		b.partial = append(b.partial, p[:i]...)
+		b.push(strings.TrimSuffix(string(b.partial), "\r"))
+		b.partial = b.partial[:0]
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+func (b *ringBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var s strings.Builder
+	if b.dropped > 0 {
+		fmt.Fprintf(&s, "[%d lines truncated]\n", b.dropped)
+	}
+	for i := range b.lines {
+		s.WriteString(b.lines[(b.next+i)%len(b.lines)])
+		s.WriteByte('\n')
+	}
+	s.Write(b.partial)
+	return s.String()
+}
+
+// serveLogFile serves the full persisted log of a job or run.
+func serveLogFile(w http.ResponseWriter, r *http.Request, kind, id string) error {
+	p := logFilePath(kind, id)
+	if !fileExists(p) {
+		return errNotFound
+	}
+	return serveLog(w, r, p)
+}
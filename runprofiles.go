@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/launchmango/backend/httputil"
+)
+
+var regexpEnvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// A RunProfile is a named environment for the app, such as staging or
+// production, chosen with profile= when building or running. Env is added
+// to the launch environment of runs. XCConfig, a path in the repository,
+// is layered over the project's build settings by xcodebuild, for values
+// compiled into the app.
+type RunProfile struct {
+	Name     string            `json:"name"`
+	Env      map[string]string `json:"env,omitempty"`
+	XCConfig string            `json:"xcconfig,omitempty"`
+}
+
+func validateRunProfiles(profiles []*RunProfile) error {
+	seen := make(map[string]bool)
+	for _, p := range profiles {
+		if p == nil || !regexpProjectName.MatchString(p.Name) {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				errors.New("invalid run profile name")}
+		}
+		if seen[p.Name] {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				fmt.Errorf("duplicate run profile %s", p.Name)}
+		}
+		seen[p.Name] = true
+		for name := range p.Env {
+			if !regexpEnvName.MatchString(name) {
+				return &httputil.HTTPError{http.StatusBadRequest,
+					fmt.Errorf("invalid environment variable %q in run profile %s", name, p.Name)}
+			}
+		}
+		if p.XCConfig != "" {
+			rel, err := cleanRel(p.XCConfig)
+			if err != nil || hasGitDir(rel) || filepath.Ext(rel) != ".xcconfig" {
+				return &httputil.HTTPError{http.StatusBadRequest,
+					fmt.Errorf("invalid xcconfig for run profile %s", p.Name)}
+			}
+			p.XCConfig = rel
+		}
+	}
+	return nil
+}
+
+// findRunProfile returns the repository's run profile called name, or nil
+// when name is empty.
+func findRunProfile(id, name string) (*RunProfile, error) {
+	if name == "" {
+		return nil, nil
+	}
+	settings, err := loadRepoSettings(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range settings.RunProfiles {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return nil, &httputil.HTTPError{http.StatusNotFound,
+		fmt.Errorf("no run profile %q", name)}
+}
+
+// environ returns the profile's variables as NAME=value, sorted so runs
+// are reproducible.
+func (p *RunProfile) environ() []string {
+	var env []string
+	for name, value := range p.Env {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// xcconfigPath returns the absolute path of the profile's xcconfig in
+// repository id, or "" if it has none.
+func (p *RunProfile) xcconfigPath(id string) (string, error) {
+	if p == nil || p.XCConfig == "" {
+		return "", nil
+	}
+	rel, err := repoPath(id, p.XCConfig)
+	if err != nil {
+		return "", err
+	}
+	if !fileExists(rel) {
+		return "", &httputil.HTTPError{http.StatusConflict,
+			fmt.Errorf("run profile %s: %s does not exist", p.Name, p.XCConfig)}
+	}
+	return filepath.Abs(rel)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+const (
+	runRunning = "running"
+	runExited  = "exited"
+	runStopped = "stopped"
+	runFailed  = "failed"
+
+	runStopTimeout = 5 * time.Second
+)
+
+// Run is an app process launched for a repository, tracked so its output
+// can be read and the process stopped later. PID is the process started;
+// for apps launched on a simulator, that is simctl, and AppPID is the
+// app's own.
+type Run struct {
+	ID       string
+	Repo     string
+	Provider string
+	Device   string
+	BundleID string
+	PID      int
+	AppPID   int
+	State    string
+	Started  time.Time
+	Finished time.Time
+	Error    string
+
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	done  chan struct{}
+	mu    sync.Mutex
+	log   ringBuffer
+}
+
+func (run *Run) MarshalJSON() ([]byte, error) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	v := struct {
+		ID       string     `json:"id"`
+		Repo     string     `json:"repo"`
+		Provider string     `json:"provider"`
+		Device   string     `json:"device,omitempty"`
+		BundleID string     `json:"bundleID,omitempty"`
+		PID      int        `json:"pid"`
+		AppPID   int        `json:"appPID,omitempty"`
+		State    string     `json:"state"`
+		Started  time.Time  `json:"started"`
+		Finished *time.Time `json:"finished,omitempty"`
+		Error    string     `json:"error,omitempty"`
+		Log      string     `json:"log"`
+	}{
+		ID:       run.ID,
+		Repo:     run.Repo,
+		Provider: run.Provider,
+		Device:   run.Device,
+		BundleID: run.BundleID,
+		PID:      run.PID,
+		AppPID:   run.AppPID,
+		State:    run.State,
+		Started:  run.Started,
+		Error:    run.Error,
+		Log:      run.log.String(),
+	}
+	if !run.Finished.IsZero() {
+		v.Finished = &run.Finished
+	}
+	return json.Marshal(&v)
+}
+
+// Stop terminates the process, killing it if it hasn't exited shortly
+// after SIGTERM.
+func (run *Run) Stop() {
+	run.mu.Lock()
+	if run.State != runRunning {
+		run.mu.Unlock()
+		return
+	}
+	run.State = runStopped
+	run.mu.Unlock()
+
+	run.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-run.done:
+	case <-time.After(runStopTimeout):
+		run.cmd.Process.Kill()
+		<-run.done
+	}
+}
+
+// Send writes input to the process's stdin, as if typed in its terminal.
+func (run *Run) Send(input string) error {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	if run.State != runRunning {
+		return &httputil.HTTPError{http.StatusConflict,
+			errors.New("run is not running")}
+	}
+	_, err := io.WriteString(run.stdin, input)
+	return err
+}
+
+var (
+	runsMu sync.Mutex
+	runs   = make(map[string]*Run)
+)
+
+// startRun starts cmd, capturing its output, and tracks it until it exits.
+// A writer already set as cmd's stdout, such as one watching for a line,
+// is given a copy of all output.
+func startRun(repo, provider string, cmd *exec.Cmd) (*Run, error) {
+	run := &Run{
+		ID:       newID(),
+		Repo:     repo,
+		Provider: provider,
+		State:    runRunning,
+		cmd:      cmd,
+		done:     make(chan struct{}),
+	}
+	if err := run.log.persist("runs", run.ID); err != nil {
+		return nil, err
+	}
+	rw := newRedactWriter(&run.log)
+	out := io.Writer(rw)
+	if cmd.Stdout != nil {
+		out = io.MultiWriter(rw, cmd.Stdout)
+	}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		run.log.Close()
+		return nil, err
+	}
+	run.stdin = stdin
+	if err := cmd.Start(); err != nil {
+		run.log.Close()
+		return nil, err
+	}
+	run.PID = cmd.Process.Pid
+	run.Started = time.Now()
+
+	runsMu.Lock()
+	runs[run.ID] = run
+	runsMu.Unlock()
+
+	publish(&Event{Type: eventRunStarted, Repo: repo,
+		Data: map[string]interface{}{"run": run.ID, "provider": provider}})
+	go func() {
+		err := cmd.Wait()
+		rw.Flush()
+		run.log.Close()
+		run.mu.Lock()
+		run.Finished = time.Now()
+		e := &Event{Type: eventRunFinished, Repo: repo,
+			Data: map[string]interface{}{"run": run.ID}}
+		if run.State == runRunning {
+			run.State = runExited
+			if err != nil {
+				run.State = runFailed
+				run.Error = redact(err.Error())
+				e.Type = eventRunFailed
+				e.Data["error"] = run.Error
+			}
+		}
+		run.mu.Unlock()
+		close(run.done)
+		publish(e)
+	}()
+	return run, nil
+}
+
+func findRun(id string) *Run {
+	runsMu.Lock()
+	defer runsMu.Unlock()
+	return runs[id]
+}
+
+func getRun(w http.ResponseWriter, r *http.Request) error {
+	run := findRun(mux.Vars(r)["id"])
+	if run == nil {
+		return errNotFound
+	}
+	return renderJSON(w, http.StatusOK, run)
+}
+
+// getRunLog serves a run's output. Logs stay on disk after the run is
+// forgotten, e.g. when the server restarts, and are served from there.
+func getRunLog(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if strings.ContainsAny(id, `/\.`) {
+		return errNotFound
+	}
+	return serveLogFile(w, r, "runs", id)
+}
+
+func stopRun(w http.ResponseWriter, r *http.Request) error {
+	run := findRun(mux.Vars(r)["id"])
+	if run == nil {
+		return errNotFound
+	}
+	run.Stop()
+	return renderJSON(w, http.StatusOK, run)
+}
+
+func listRepoRuns(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	list := []*Run{}
+	runsMu.Lock()
+	for _, run := range runs {
+		if run.Repo == id {
+			list = append(list, run)
+		}
+	}
+	runsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Started.After(list[j].Started)
+	})
+	return renderJSON(w, http.StatusOK, list)
+}
+
+func reloadRun(w http.ResponseWriter, r *http.Request) error {
+	run := findRun(mux.Vars(r)["id"])
+	if run == nil {
+		return errNotFound
+	}
+	hr, ok := findProvider(run.Provider).(hotReloader)
+	if !ok {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			fmt.Errorf("%s runs do not support hot reload", run.Provider)}
+	}
+	if err := hr.Reload(run, r.URL.Query().Get("restart") == "1"); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+const (
+	screenshotNew       = "new"
+	screenshotUnchanged = "unchanged"
+	screenshotChanged   = "changed"
+
+	// Channel differences at or below this are treated as rendering noise.
+	screenshotTolerance = 8 << 8
+	defaultScreenDelay  = 2
+)
+
+var (
+	regexpScreenName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	regexpLocale     = regexp.MustCompile(`^[a-z]{2,3}(_[A-Z]{2})?$`)
+)
+
+// Screen is one screen to capture, reached either by opening DeepLink in
+// the app or by running the XCUITest Test, whose screenshot attachments
+// are collected.
+type Screen struct {
+	Name     string `json:"name"`
+	DeepLink string `json:"deepLink,omitempty"`
+	Test     string `json:"test,omitempty"`
+	Scheme   string `json:"scheme,omitempty"`
+	Delay    int    `json:"delay,omitempty"`
+}
+
+type ScreenshotConfig struct {
+	Devices []string  `json:"devices"`
+	Locales []string  `json:"locales"`
+	Screens []*Screen `json:"screens"`
+}
+
+type Screenshot struct {
+	Device    string  `json:"device"`
+	Locale    string  `json:"locale"`
+	Screen    string  `json:"screen"`
+	Status    string  `json:"status"`
+	DiffRatio float64 `json:"diffRatio"`
+	Path      string  `json:"path"`
+	Baseline  string  `json:"baseline,omitempty"`
+	Diff      string  `json:"diff,omitempty"`
+}
+
+func (c *ScreenshotConfig) validate() error {
+	if len(c.Devices) == 0 || len(c.Screens) == 0 {
+		return errors.New("screenshots need at least one device and screen")
+	}
+	for _, d := range c.Devices {
+		if !regexpUDID.MatchString(d) {
+			return fmt.Errorf("device %q is not a simulator UDID", d)
+		}
+	}
+	for _, l := range c.Locales {
+		if !regexpLocale.MatchString(l) {
+			return fmt.Errorf("invalid locale %q", l)
+		}
+	}
+	for _, s := range c.Screens {
+		if !regexpScreenName.MatchString(s.Name) {
+			return fmt.Errorf("invalid screen name %q", s.Name)
+		}
+		if (s.DeepLink == "") == (s.Test == "") {
+			return fmt.Errorf("screen %s needs exactly one of deepLink or test", s.Name)
+		}
+		if s.Test != "" && (!regexpTestIdentifier.MatchString(s.Test) || s.Scheme == "") {
+			return fmt.Errorf("screen %s needs a valid test and scheme", s.Name)
+		}
+	}
+	return nil
+}
+
+func screenshotsDir(id string, elem ...string) string {
+	return filepath.Join(append([]string{dataDir, "screenshots", id}, elem...)...)
+}
+
+// localeArgs are launch arguments that make an app start in locale.
+func localeArgs(locale string) []string {
+	lang := strings.SplitN(locale, "_", 2)[0]
+	return []string{"-AppleLanguages", "(" + lang + ")", "-AppleLocale", locale}
+}
+
+// captureScreens takes the screenshots for one device and locale into dir.
+func captureScreens(id string, cfg *ScreenshotConfig, device, locale, app,
+	bundleID, dir string, out io.Writer) error {
+	if err := bootSimulator(device); err != nil {
+		return err
+	}
+	if _, err := simctl("install", device, app); err != nil {
+		return err
+	}
+	xcode, err := resolveXcode(id, "")
+	if err != nil {
+		return err
+	}
+
+	for _, s := range cfg.Screens {
+		fmt.Fprintf(out, "==> %s %s %s\n", device, locale, s.Name)
+		dest := filepath.Join(dir, s.Name+".png")
+		if s.DeepLink != "" {
+			simctl("terminate", device, bundleID)
+			args := append([]string{"launch", device, bundleID}, localeArgs(locale)...)
+			if _, err := simctl(args...); err != nil {
+				return err
+			}
+			if _, err := simctl("openurl", device, s.DeepLink); err != nil {
+				return err
+			}
+			delay := s.Delay
+			if delay == 0 {
+				delay = defaultScreenDelay
+			}
+			time.Sleep(time.Duration(delay) * time.Second)
+			if _, err := simctl("io", device, "screenshot", dest); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// UI test flows attach their own screenshots; keep the last one.
+		bundle := filepath.Join(dir, s.Name+".xcresult")
+		lang := strings.SplitN(locale, "_", 2)[0]
+		args := []string{"test", "-scheme", s.Scheme,
+			"-destination", "platform=iOS Simulator,id=" + device,
+			"-only-testing:" + s.Test, "-resultBundlePath", bundle,
+			"-testLanguage", lang}
+		if i := strings.Index(locale, "_"); i > 0 {
+			args = append(args, "-testRegion", locale[i+1:])
+		}
+		if err := xcodebuild(id, &BuildOptions{xcode: xcode}, out, args...); err != nil {
+			return err
+		}
+		attachments := filepath.Join(dir, s.Name+"-attachments")
+		if err := runCmdIn(id, out, "xcrun", "xcresulttool", "export",
+			"attachments", "--path", bundle, "--output-path", attachments); err != nil {
+			return err
+		}
+		pngs, _ := filepath.Glob(filepath.Join(attachments, "*.png"))
+		if len(pngs) == 0 {
+			return fmt.Errorf("test %s attached no screenshots", s.Test)
+		}
+		if err := os.Rename(pngs[len(pngs)-1], dest); err != nil {
+			return err
+		}
+		os.RemoveAll(bundle)
+		os.RemoveAll(attachments)
+	}
+	return nil
+}
+
+func decodePNG(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+func absDiff(a, b uint32) uint32 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// diffImages returns the fraction of differing pixels between a and b and
+// an image with differences painted red over a faded copy of b.
+func diffImages(a, b image.Image) (float64, image.Image) {
+	bounds := b.Bounds()
+	if a.Bounds() != bounds {
+		return 1, nil
+	}
+	diff := image.NewRGBA(bounds)
+	changed := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r1, g1, b1, _ := a.At(x, y).RGBA()
+			r2, g2, b2, _ := b.At(x, y).RGBA()
+			if absDiff(r1, r2) > screenshotTolerance ||
+				absDiff(g1, g2) > screenshotTolerance ||
+				absDiff(b1, b2) > screenshotTolerance {
+				changed++
+				diff.Set(x, y, color.RGBA{255, 0, 0, 255})
+				continue
+			}
+			gray := uint8((r2 + g2 + b2) / 3 >> 8)
+			diff.Set(x, y, color.RGBA{gray, gray, gray, 64})
+		}
+	}
+	total := bounds.Dx() * bounds.Dy()
+	if total == 0 {
+		return 0, diff
+	}
+	return float64(changed) / float64(total), diff
+}
+
+// compareScreenshots builds the report for a run against the baseline,
+// writing diff images next to the run's screenshots.
+func compareScreenshots(id, runID string, cfg *ScreenshotConfig) ([]*Screenshot, error) {
+	report := []*Screenshot{}
+	for _, device := range cfg.Devices {
+		for _, locale := range cfg.Locales {
+			for _, s := range cfg.Screens {
+				rel := filepath.Join(device, locale, s.Name+".png")
+				shot := &Screenshot{
+					Device: device,
+					Locale: locale,
+					Screen: s.Name,
+					Path:   filepath.ToSlash(filepath.Join(runID, rel)),
+				}
+				report = append(report, shot)
+
+				cur, err := decodePNG(screenshotsDir(id, runID, rel))
+				if err != nil {
+					return nil, err
+				}
+				base, err := decodePNG(screenshotsDir(id, "baseline", rel))
+				if os.IsNotExist(err) {
+					shot.Status = screenshotNew
+					continue
+				} else if err != nil {
+					return nil, err
+				}
+				shot.Baseline = filepath.ToSlash(filepath.Join("baseline", rel))
+
+				ratio, diff := diffImages(base, cur)
+				shot.DiffRatio = ratio
+				if ratio == 0 {
+					shot.Status = screenshotUnchanged
+					continue
+				}
+				shot.Status = screenshotChanged
+				if diff == nil {
+					continue
+				}
+				diffRel := strings.TrimSuffix(rel, ".png") + ".diff.png"
+				f, err := os.Create(screenshotsDir(id, runID, diffRel))
+				if err != nil {
+					return nil, err
+				}
+				err = png.Encode(f, diff)
+				f.Close()
+				if err != nil {
+					return nil, err
+				}
+				shot.Diff = filepath.ToSlash(filepath.Join(runID, diffRel))
+			}
+		}
+	}
+	return report, nil
+}
+
+func captureScreenshots(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	settings, err := loadRepoSettings(id)
+	if err != nil {
+		return err
+	}
+	cfg := settings.Screenshots
+	if cfg == nil {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("set screenshots in the repository settings first")}
+	}
+	if err := cfg.validate(); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	if len(cfg.Locales) == 0 {
+		cfg.Locales = []string{"en_US"}
+	}
+
+	apps, _ := filepath.Glob(filepath.Join(id, "build", "Debug-iphonesimulator", "*.app"))
+	if len(apps) == 0 {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("no simulator app found; build with platform=ios first")}
+	}
+	app := apps[0]
+	bundleID, err := plistValue(filepath.Join(app, "Info.plist"), "CFBundleIdentifier")
+	if err != nil {
+		return err
+	}
+
+	runID := time.Now().UTC().Format("20060102T150405")
+	j := startResultJob(id, "screenshots", func(out io.Writer) (interface{}, error) {
+		for _, device := range cfg.Devices {
+			for _, locale := range cfg.Locales {
+				dir := screenshotsDir(id, runID, device, locale)
+				if err := os.MkdirAll(dir, 0700); err != nil {
+					return nil, err
+				}
+				if err := captureScreens(id, cfg, device, locale, app, bundleID,
+					dir, out); err != nil {
+					return nil, err
+				}
+			}
+		}
+		report, err := compareScreenshots(id, runID, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"run": runID, "screenshots": report}, nil
+	})
+	return renderJSON(w, http.StatusAccepted, j)
+}
+
+func listScreenshotRuns(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	return renderJSON(w, http.StatusOK, repoJobs(id, "screenshots"))
+}
+
+// approveScreenshots makes a run's screenshots the new baseline.
+func approveScreenshots(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	runID := mux.Vars(r)["run"]
+	src := screenshotsDir(id, runID)
+	if runID == "baseline" || !fileExists(src) {
+		return errNotFound
+	}
+	err := filepath.Walk(src, func(p string, f os.FileInfo, err error) error {
+		if err != nil || f.IsDir() || strings.HasSuffix(p, ".diff.png") {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		dest := screenshotsDir(id, "baseline", rel)
+		if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+			return err
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(dest, b, 0600)
+	})
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func serveScreenshot(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	p := filepath.Clean("/" + mux.Vars(r)["path"])
+	if !strings.HasSuffix(p, ".png") {
+		return errNotFound
+	}
+	file := screenshotsDir(id, p)
+	if !fileExists(file) {
+		return errNotFound
+	}
+	http.ServeFile(w, r, file)
+	return nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+const (
+	defaultSearchLimit   = 100
+	maxSearchLimit       = 1000
+	defaultSearchContext = 2
+	maxSearchContext     = 10
+	maxSearchLineLength  = 500
+	searchTimeout        = 30 * time.Second
+)
+
+// SearchMatch is a line matching a search, with the lines around it.
+// Column is the byte offset of the match in the line, from 1.
+type SearchMatch struct {
+	Path   string   `json:"path"`
+	URL    string   `json:"url"`
+	Line   int      `json:"line"`
+	Column int      `json:"column"`
+	Text   string   `json:"text"`
+	Before []string `json:"before,omitempty"`
+	After  []string `json:"after,omitempty"`
+}
+
+// SearchResults is a page of matches. Next is the offset of the next page,
+// when there is one.
+type SearchResults struct {
+	Matches []*SearchMatch `json:"matches"`
+	Next    int            `json:"next,omitempty"`
+}
+
+func truncateLine(s string) string {
+	if len(s) > maxSearchLineLength {
+		return s[:maxSearchLineLength] + "…"
+	}
+	return s
+}
+
+func searchIntParam(r *http.Request, name string, def, max int) (int, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, &httputil.HTTPError{http.StatusBadRequest,
+			errors.New(name + " must be a non-negative integer")}
+	}
+	if n > max {
+		n = max
+	}
+	return n, nil
+}
+
+// searchRepo finds the lines of the repository's files matching q, a fixed
+// string or with regex=1 an extended regular expression, ignoring case
+// unless case=1. Untracked files are searched too, except those git
+// ignores; the directories excluded from the tree are not. path limits
+// the search to a directory or file. Matches are paged with offset and
+// limit, and come with context lines around them.
+func searchRepo(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	q := r.URL.Query()
+	pattern := q.Get("q")
+	if pattern == "" {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("q is required")}
+	}
+	limit, err := searchIntParam(r, "limit", defaultSearchLimit, maxSearchLimit)
+	if err != nil {
+		return err
+	}
+	if limit == 0 {
+		limit = defaultSearchLimit
+	}
+	offset, err := searchIntParam(r, "offset", 0, int(^uint(0)>>1))
+	if err != nil {
+		return err
+	}
+	lines, err := searchIntParam(r, "context", defaultSearchContext, maxSearchContext)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"grep", "--untracked", "-I", "-n", "-z", "--column",
+		"--no-color", "--full-name"}
+	if q.Get("regex") == "1" {
+		args = append(args, "-E")
+	} else {
+		args = append(args, "-F")
+	}
+	if q.Get("case") != "1" {
+		args = append(args, "-i")
+	}
+	args = append(args, "-e", pattern, "--")
+	if p := q.Get("path"); strings.Trim(p, "/") != "" {
+		rel, err := cleanRel(p)
+		if err != nil {
+			return err
+		}
+		abs, err := repoPath(id, rel)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(abs); err != nil {
+			return errNotFound
+		}
+		args = append(args, rel)
+	} else {
+		args = append(args, ".")
+	}
+	for _, name := range loadTreeExcludes() {
+		args = append(args, ":(exclude,glob)**/"+name+"/**")
+	}
+
+	defer rlockRepo(id)()
+	ctx, cancel := context.WithTimeout(r.Context(), searchTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = id
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	res := &SearchResults{Matches: []*SearchMatch{}}
+	s := bufio.NewScanner(stdout)
+	s.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	n := 0
+	for s.Scan() {
+		fields := strings.SplitN(s.Text(), "\x00", 4)
+		if len(fields) != 4 {
+			continue
+		}
+		n++
+		if n <= offset {
+			continue
+		}
+		if len(res.Matches) == limit {
+			res.Next = offset + limit
+			break
+		}
+		line, _ := strconv.Atoi(fields[1])
+		column, _ := strconv.Atoi(fields[2])
+		res.Matches = append(res.Matches, &SearchMatch{
+			Path:   fields[0],
+			URL:    fileURL(id, fields[0]),
+			Line:   line,
+			Column: column,
+			Text:   truncateLine(fields[3]),
+		})
+	}
+	if res.Next != 0 {
+		// Stop git once there is a page, rather than reading every match.
+		cancel()
+	}
+	err = cmd.Wait()
+	if res.Next == 0 && err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return &httputil.HTTPError{http.StatusGatewayTimeout,
+				errors.New("search took too long; narrow it with path")}
+		}
+		// git grep exits with 1 when nothing matches.
+		if exit, ok := err.(*exec.ExitError); !ok || exit.ExitCode() != 1 {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				errors.New(strings.TrimSpace(stderr.String()))}
+		}
+	}
+	if lines > 0 {
+		addSearchContext(id, res.Matches, lines)
+	}
+	return renderJSON(w, http.StatusOK, res)
+}
+
+// addSearchContext fills in the lines around each match, reading each file
+// once.
+func addSearchContext(id string, matches []*SearchMatch, n int) {
+	var path string
+	var lines []string
+	for _, m := range matches {
+		if m.Path != path {
+			path, lines = m.Path, nil
+			if b, err := ioutil.ReadFile(filepath.Join(id, filepath.FromSlash(path))); err == nil {
+				lines = strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+			}
+		}
+		i := m.Line - 1
+		if i < 0 || i >= len(lines) {
+			continue
+		}
+		start := i - n
+		if start < 0 {
+			start = 0
+		}
+		for j := start; j < i; j++ {
+			m.Before = append(m.Before, truncateLine(strings.TrimSuffix(lines[j], "\r")))
+		}
+		for j := i + 1; j < len(lines) && j <= i+n; j++ {
+			m.After = append(m.After, truncateLine(strings.TrimSuffix(lines[j], "\r")))
+		}
+	}
+}
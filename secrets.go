@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+const (
+	// serverScope is the directory of the secrets shared by every
+	// repository. It can't be mistaken for a repository ID.
+	serverScope = "_server"
+
+	secretsKeyName = "secrets.key"
+	redacted       = "****"
+
+	// minRedactLength keeps very short values, which would match all over
+	// the logs, from being redacted.
+	minRedactLength = 4
+)
+
+var regexpSecretName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,127}$`)
+
+// Secret describes a value kept encrypted for builds and runs. The value
+// itself is never returned by the API.
+type Secret struct {
+	Name    string    `json:"name"`
+	Repo    string    `json:"repo,omitempty"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+type storedSecret struct {
+	Secret
+	// Value is the nonce and the AES-GCM sealed value, base64 encoded.
+	Value string `json:"value"`
+}
+
+func secretName(scope, name string) string {
+	return filepath.Join("secrets", scope, name+".json")
+}
+
+var secretsKey struct {
+	once sync.Once
+	key  []byte
+	err  error
+}
+
+// loadSecretsKey returns the master key secrets are encrypted with: the
+// base64 encoded 32 bytes of SECRETS_KEY, or else a key generated on first
+// use and kept in the data directory.
+func loadSecretsKey() ([]byte, error) {
+	secretsKey.once.Do(func() {
+		if s := os.Getenv("SECRETS_KEY"); s != "" {
+			secretsKey.key, secretsKey.err = base64.StdEncoding.DecodeString(s)
+			if secretsKey.err == nil && len(secretsKey.key) != 32 {
+				secretsKey.err = errors.New("SECRETS_KEY must be 32 bytes, base64 encoded")
+			}
+			return
+		}
+		p := filepath.Join(dataDir, secretsKeyName)
+		b, err := ioutil.ReadFile(p)
+		if err == nil {
+			secretsKey.key, secretsKey.err = base64.StdEncoding.DecodeString(
+				strings.TrimSpace(string(b)))
+			return
+		}
+		if !os.IsNotExist(err) {
+			secretsKey.err = err
+			return
+		}
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			secretsKey.err = err
+			return
+		}
+		if err := os.MkdirAll(dataDir, 0700); err != nil {
+			secretsKey.err = err
+			return
+		}
+		secretsKey.err = ioutil.WriteFile(p,
+			[]byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)
+		secretsKey.key = key
+	})
+	return secretsKey.key, secretsKey.err
+}
+
+func secretsCipher() (cipher.AEAD, error) {
+	key, err := loadSecretsKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealSecret encrypts value, binding it to where it is stored so it can't
+// be moved to another name or scope.
+func sealSecret(scope, name, value string) (string, error) {
+	gcm, err := secretsCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(value), []byte(scope+"/"+name))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func openSecret(scope, name, sealed string) (string, error) {
+	gcm, err := secretsCipher()
+	if err != nil {
+		return "", err
+	}
+	b, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(b) < gcm.NonceSize() {
+		return "", fmt.Errorf("secret %s is corrupt", name)
+	}
+	value, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():],
+		[]byte(scope+"/"+name))
+	if err != nil {
+		return "", fmt.Errorf("secret %s can't be decrypted: %v", name, err)
+	}
+	return string(value), nil
+}
+
+func loadSecret(scope, name string) (*storedSecret, error) {
+	if !regexpSecretName.MatchString(name) {
+		return nil, nil
+	}
+	var s storedSecret
+	if err := readJSON(secretName(scope, name), &s); err != nil {
+		return nil, err
+	}
+	if s.Name == "" {
+		return nil, nil
+	}
+	return &s, nil
+}
+
+func scopeSecrets(scope string) ([]*storedSecret, error) {
+	matches, err := filepath.Glob(filepath.Join(dataDir, "secrets", scope, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	secrets := []*storedSecret{}
+	for _, m := range matches {
+		s, err := loadSecret(scope, strings.TrimSuffix(filepath.Base(m), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		if s != nil {
+			secrets = append(secrets, s)
+		}
+	}
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i].Name < secrets[j].Name })
+	return secrets, nil
+}
+
+// secretEnv returns the secrets named in the repository's settings as
+// environment variables. A repository's own secret takes precedence over
+// a server secret of the same name.
+func secretEnv(id string) ([]string, error) {
+	settings, err := loadRepoSettings(id)
+	if err != nil {
+		return nil, err
+	}
+	var env []string
+	for _, name := range settings.Secrets {
+		s, err := loadSecret(id, name)
+		if err != nil {
+			return nil, err
+		}
+		scope := id
+		if s == nil {
+			scope = serverScope
+			if s, err = loadSecret(scope, name); err != nil {
+				return nil, err
+			}
+		}
+		if s == nil {
+			return nil, &httputil.HTTPError{http.StatusBadRequest,
+				fmt.Errorf("secret %s is not set", name)}
+		}
+		value, err := openSecret(scope, s.Name, s.Value)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, s.Name+"="+value)
+	}
+	return env, nil
+}
+
+// secretValues caches the decrypted values of every secret, for redaction.
+var secretValues = struct {
+	sync.Mutex
+	loaded bool
+	values []string
+}{}
+
+func forgetSecretValues() {
+	secretValues.Lock()
+	secretValues.loaded = false
+	secretValues.values = nil
+	secretValues.Unlock()
+}
+
+func knownSecretValues() []string {
+	secretValues.Lock()
+	defer secretValues.Unlock()
+	if secretValues.loaded {
+		return secretValues.values
+	}
+	dirs, _ := ioutil.ReadDir(filepath.Join(dataDir, "secrets"))
+	var values []string
+	for _, d := range dirs {
+		secrets, _ := scopeSecrets(d.Name())
+		for _, s := range secrets {
+			v, err := openSecret(d.Name(), s.Name, s.Value)
+			if err == nil && len(v) >= minRedactLength {
+				values = append(values, v)
+			}
+		}
+	}
+	// Longest first, so a secret containing another is replaced whole.
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	secretValues.values = values
+	secretValues.loaded = true
+	return values
+}
+
+// redact replaces the values of secrets in s.
+func redact(s string) string {
+	for _, v := range knownSecretValues() {
+		s = strings.Replace(s, v, redacted, -1)
+	}
+	return s
+}
+
+// redactJSON replaces the values of secrets in an encoded JSON document,
+// where they may appear escaped.
+func redactJSON(b []byte) []byte {
+	for _, v := range knownSecretValues() {
+		b = bytes.Replace(b, []byte(v), []byte(redacted), -1)
+		if enc, err := json.Marshal(v); err == nil {
+			if esc := enc[1 : len(enc)-1]; !bytes.Equal(esc, []byte(v)) {
+				b = bytes.Replace(b, esc, []byte(redacted), -1)
+			}
+		}
+	}
+	return b
+}
+
+// redactWriter redacts secrets from what is written through it a line at
+// a time, so values split across writes are still caught. Flush writes
+// what is left of the last line.
+type redactWriter struct {
+	lw *lineWriter
+}
+
+func newRedactWriter(w io.Writer) *redactWriter {
+	return &redactWriter{lw: newLineWriter(func(line string) {
+		io.WriteString(w, redact(line)+"\n")
+	})}
+}
+
+func (w *redactWriter) Write(p []byte) (int, error) {
+	return w.lw.Write(p)
+}
+
+func (w *redactWriter) Flush() {
+	w.lw.Flush()
+}
+
+// secretScope returns the scope of a secrets request: the repository in
+// the route, or the server.
+func secretScope(r *http.Request) (string, error) {
+	id, ok := mux.Vars(r)["id"]
+	if !ok {
+		return serverScope, nil
+	}
+	if !repoExists(id) {
+		return "", errNotFound
+	}
+	return id, nil
+}
+
+func listSecrets(w http.ResponseWriter, r *http.Request) error {
+	scope, err := secretScope(r)
+	if err != nil {
+		return err
+	}
+	stored, err := scopeSecrets(scope)
+	if err != nil {
+		return err
+	}
+	secrets := make([]*Secret, len(stored))
+	for i, s := range stored {
+		secrets[i] = &s.Secret
+	}
+	return renderJSON(w, http.StatusOK, secrets)
+}
+
+// setSecret creates or replaces a secret. Names are those of environment
+// variables, since that is how secrets are handed to builds and runs.
+func setSecret(w http.ResponseWriter, r *http.Request) error {
+	scope, err := secretScope(r)
+	if err != nil {
+		return err
+	}
+	name := mux.Vars(r)["name"]
+	if !regexpSecretName.MatchString(name) {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("secret names must be environment variable names")}
+	}
+	var req struct {
+		Value *string `json:"value"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	if req.Value == nil {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("value is required")}
+	}
+
+	s, err := loadSecret(scope, name)
+	if err != nil {
+		return err
+	}
+	status := http.StatusOK
+	now := time.Now()
+	if s == nil {
+		s = &storedSecret{Secret: Secret{Name: name, Created: now}}
+		if scope != serverScope {
+			s.Repo = scope
+		}
+		status = http.StatusCreated
+	}
+	s.Updated = now
+	if s.Value, err = sealSecret(scope, name, *req.Value); err != nil {
+		return err
+	}
+	if err := writeJSON(secretName(scope, name), s); err != nil {
+		return err
+	}
+	forgetSecretValues()
+	audit("secret.set", s.Repo, name)
+	return renderJSON(w, status, &s.Secret)
+}
+
+func deleteSecret(w http.ResponseWriter, r *http.Request) error {
+	scope, err := secretScope(r)
+	if err != nil {
+		return err
+	}
+	s, err := loadSecret(scope, mux.Vars(r)["name"])
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return errNotFound
+	}
+	if err := os.Remove(filepath.Join(dataDir, secretName(scope, s.Name))); err != nil {
+		return err
+	}
+	forgetSecretValues()
+	audit("secret.delete", s.Repo, s.Name)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+// withSecrets runs in a fresh data directory holding the secrets, given as
+// scope, name and value, and forgets them afterwards.
+func withSecrets(t *testing.T, secrets [][3]string) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		forgetSecretValues()
+	})
+	for _, s := range secrets {
+		sealed, err := sealSecret(s[0], s[1], s[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored := &storedSecret{Secret: Secret{Name: s[1]}, Value: sealed}
+		if err := writeJSON(secretName(s[0], s[1]), stored); err != nil {
+			t.Fatal(err)
+		}
+	}
+	forgetSecretValues()
+}
+
+var redactSecrets = [][3]string{
+	{serverScope, "SHORT", "hunter22"},
+	{serverScope, "LONG", "hunter22-production"},
+	{serverScope, "EMPTY", ""},
+	{serverScope, "TINY", "abc"},
+	{serverScope, "QUOTED", `pa"ss\word`},
+	{serverScope, "HTML", "<tok&en>"},
+	{serverScope, "TAB", "tab\tsecret"},
+	{"01HV3K8Z4Q9X7T2M5N6B0C1D2E", "REPO", "repo-secret-1"},
+}
+
+func TestRedact(t *testing.T) {
+	withSecrets(t, redactSecrets)
+	for _, test := range []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"nothing secret here", "nothing secret here"},
+		{"token hunter22", "token ****"},
+		{"hunter22hunter22", "********"},
+		{"token hunter22-production end", "token **** end"},
+		{"hunter22-prod", "****-prod"},
+		{"hunter2", "hunter2"},
+		{"abc is too short to redact", "abc is too short to redact"},
+		{`password pa"ss\word`, "password ****"},
+		{`pa\"ss\\word stays escaped`, `pa\"ss\\word stays escaped`},
+		{"<tok&en>", "****"},
+		{"tab\tsecret", "****"},
+		{"repo-secret-1 of a repository", "**** of a repository"},
+	} {
+		if got := redact(test.in); got != test.want {
+			t.Errorf("redact(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestRedactJSON(t *testing.T) {
+	withSecrets(t, redactSecrets)
+	for _, test := range []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"no secrets", "no secrets"},
+		{"hunter22-production and hunter22", "**** and ****"},
+		{`with pa"ss\word`, "with ****"},
+		{"<tok&en>!", "****!"},
+		{"tab\tsecret\n", "****\n"},
+		{"abc", "abc"},
+	} {
+		b, err := json.Marshal(map[string]string{"log": test.in})
+		if err != nil {
+			t.Fatal(err)
+		}
+		redacted := redactJSON(b)
+		var v map[string]string
+		if err := json.Unmarshal(redacted, &v); err != nil {
+			t.Errorf("redactJSON(%s) = %s, not JSON: %v", b, redacted, err)
+			continue
+		}
+		if v["log"] != test.want {
+			t.Errorf("redactJSON(%s) = %s, want %q", b, redacted, test.want)
+		}
+	}
+}
+
+func TestSecretEnv(t *testing.T) {
+	const id = "01HV3K8Z4Q9X7T2M5N6B0C1D2E"
+	withSecrets(t, [][3]string{
+		{serverScope, "SHARED", "server value"},
+		{serverScope, "API_KEY", "server key"},
+		{id, "API_KEY", "repo key=with equals"},
+		{id, "EMPTY", ""},
+		{"01HV3K8Z4Q9X7T2M5N6B0C1D2F", "OTHER", "another repo's"},
+	})
+
+	if err := saveRepoSettings(id, &RepoSettings{
+		Secrets: []string{"API_KEY", "SHARED", "EMPTY"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	env, err := secretEnv(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"API_KEY=repo key=with equals", "SHARED=server value", "EMPTY="}
+	if strings.Join(env, "\n") != strings.Join(want, "\n") {
+		t.Errorf("secretEnv = %q, want %q", env, want)
+	}
+
+	// Another repository's secrets aren't reachable.
+	if err := saveRepoSettings(id, &RepoSettings{Secrets: []string{"OTHER"}}); err != nil {
+		t.Fatal(err)
+	}
+	if env, err := secretEnv(id); err == nil {
+		t.Errorf("secretEnv with another repository's secret = %q, want an error", env)
+	}
+
+	// Sealed values are bound to their scope and name.
+	s, err := loadSecret(serverScope, "SHARED")
+	if err != nil || s == nil {
+		t.Fatalf("loadSecret: %v, %v", s, err)
+	}
+	if v, err := openSecret(serverScope, "SHARED", s.Value); err != nil || v != "server value" {
+		t.Errorf("openSecret = %q, %v, want %q", v, err, "server value")
+	}
+	if v, err := openSecret(id, "SHARED", s.Value); err == nil {
+		t.Errorf("openSecret in another scope = %q, want an error", v)
+	}
+	if v, err := openSecret(serverScope, "API_KEY", s.Value); err == nil {
+		t.Errorf("openSecret under another name = %q, want an error", v)
+	}
+	if v, err := openSecret(serverScope, "SHARED", "not base64!"); err == nil {
+		t.Errorf("openSecret of a corrupt value = %q, want an error", v)
+	}
+}
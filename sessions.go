@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+// sessionMaxAge is how long a session records before it is ended, in case
+// it is never stopped.
+const sessionMaxAge = 24 * time.Hour
+
+// Session groups what happens in a repository while it records, such as
+// edits, builds, runs and tests, into a timeline that can be shared by its
+// ID and replayed.
+type Session struct {
+	ID      string     `json:"id"`
+	Repo    string     `json:"repo"`
+	Title   string     `json:"title,omitempty"`
+	User    string     `json:"user,omitempty"`
+	Started time.Time  `json:"started"`
+	Ended   *time.Time `json:"ended,omitempty"`
+}
+
+// SessionEntry is a step of a session's timeline: an event of the
+// repository, or a note added to the session. Offset is the time since the
+// session started, in milliseconds, for replaying it. Log is the URL of
+// the log of the build, run or job the entry is about.
+type SessionEntry struct {
+	Time   time.Time              `json:"time"`
+	Offset int64                  `json:"offset"`
+	Type   string                 `json:"type"`
+	Data   map[string]interface{} `json:"data,omitempty"`
+	Log    string                 `json:"log,omitempty"`
+}
+
+// SessionTimeline is a session with everything recorded in it, oldest
+// first.
+type SessionTimeline struct {
+	*Session
+	Timeline []*SessionEntry `json:"timeline"`
+}
+
+const sessionNote = "note"
+
+// sessions tracks the sessions that are recording, by repository.
+var sessions = struct {
+	sync.Mutex
+	loaded bool
+	active map[string][]*Session
+}{}
+
+func sessionName(id string) string {
+	return filepath.Join("sessions", id+".json")
+}
+
+func sessionLogPath(id string) string {
+	return filepath.Join(dataDir, "sessions", id+".log")
+}
+
+func loadSession(id string) (*Session, error) {
+	if strings.ContainsAny(id, `/\.`) || id == "" {
+		return nil, nil
+	}
+	var s Session
+	if err := readJSON(sessionName(id), &s); err != nil {
+		return nil, err
+	}
+	if s.ID == "" {
+		return nil, nil
+	}
+	return &s, nil
+}
+
+func allSessions() ([]*Session, error) {
+	matches, err := filepath.Glob(filepath.Join(dataDir, "sessions", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var list []*Session
+	for _, m := range matches {
+		s, err := loadSession(strings.TrimSuffix(filepath.Base(m), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		if s != nil {
+			list = append(list, s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.After(list[j].Started) })
+	return list, nil
+}
+
+// loadActiveSessions finds the sessions still recording. The caller holds
+// the sessions lock.
+func loadActiveSessions() error {
+	if sessions.loaded {
+		return nil
+	}
+	list, err := allSessions()
+	if err != nil {
+		return err
+	}
+	sessions.active = make(map[string][]*Session)
+	for _, s := range list {
+		if s.Ended == nil {
+			sessions.active[s.Repo] = append(sessions.active[s.Repo], s)
+		}
+	}
+	sessions.loaded = true
+	return nil
+}
+
+// endSession stops s recording. The caller holds the sessions lock.
+func endSession(s *Session, t time.Time) error {
+	s.Ended = &t
+	if err := writeJSON(sessionName(s.ID), s); err != nil {
+		return err
+	}
+	active := sessions.active[s.Repo][:0]
+	for _, a := range sessions.active[s.Repo] {
+		if a.ID != s.ID {
+			active = append(active, a)
+		}
+	}
+	if len(active) == 0 {
+		delete(sessions.active, s.Repo)
+	} else {
+		sessions.active[s.Repo] = active
+	}
+	return nil
+}
+
+func appendSessionEntry(s *Session, entry *SessionEntry) error {
+	entry.Offset = int64(entry.Time.Sub(s.Started) / time.Millisecond)
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(sessionLogPath(s.ID), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// eventLogURL returns the URL of the log of what an event is about.
+func eventLogURL(e *Event) string {
+	for _, k := range []string{"build", "run", "job"} {
+		if id, ok := e.Data[k].(string); ok && id != "" {
+			return "/" + k + "s/" + id + "/log"
+		}
+	}
+	return ""
+}
+
+// recordSessions adds the events of a repository to its recording
+// sessions.
+func recordSessions(e *Event) {
+	if e.Repo == "" {
+		return
+	}
+	sessions.Lock()
+	defer sessions.Unlock()
+	if err := loadActiveSessions(); err != nil {
+		log.Printf("sessions: %v", err)
+		return
+	}
+	for _, s := range append([]*Session(nil), sessions.active[e.Repo]...) {
+		if e.Time.Sub(s.Started) > sessionMaxAge {
+			if err := endSession(s, s.Started.Add(sessionMaxAge)); err != nil {
+				log.Printf("sessions: %s: %v", s.ID, err)
+			}
+			continue
+		}
+		entry := &SessionEntry{Time: e.Time, Type: e.Type, Data: e.Data,
+			Log: eventLogURL(e)}
+		if err := appendSessionEntry(s, entry); err != nil {
+			log.Printf("sessions: %s: %v", s.ID, err)
+		}
+	}
+}
+
+func sessionTimeline(s *Session) ([]*SessionEntry, error) {
+	timeline := []*SessionEntry{}
+	f, err := os.Open(sessionLogPath(s.ID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return timeline, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var entry SessionEntry
+		if json.Unmarshal(sc.Bytes(), &entry) == nil {
+			timeline = append(timeline, &entry)
+		}
+	}
+	// Subscribers run concurrently, so entries may be logged out of order.
+	sort.SliceStable(timeline, func(i, j int) bool {
+		return timeline[i].Time.Before(timeline[j].Time)
+	})
+	return timeline, sc.Err()
+}
+
+// startSession starts recording a session in a repository.
+func startSession(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	var req struct {
+		Title string `json:"title"`
+		User  string `json:"user"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	s := &Session{ID: newID(), Repo: id, Title: strings.TrimSpace(req.Title),
+		User: req.User, Started: time.Now()}
+
+	sessions.Lock()
+	defer sessions.Unlock()
+	if err := loadActiveSessions(); err != nil {
+		return err
+	}
+	if err := writeJSON(sessionName(s.ID), s); err != nil {
+		return err
+	}
+	sessions.active[id] = append(sessions.active[id], s)
+	return renderJSON(w, http.StatusCreated, s)
+}
+
+func listSessions(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	all, err := allSessions()
+	if err != nil {
+		return err
+	}
+	list := []*Session{}
+	for _, s := range all {
+		if s.Repo == id {
+			list = append(list, s)
+		}
+	}
+	return renderJSON(w, http.StatusOK, list)
+}
+
+// getSession returns a session with its timeline. Anyone with the link can
+// replay it.
+func getSession(w http.ResponseWriter, r *http.Request) error {
+	s, err := loadSession(mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return errNotFound
+	}
+	timeline, err := sessionTimeline(s)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, &SessionTimeline{Session: s, Timeline: timeline})
+}
+
+// stopSession ends the recording of a session.
+func stopSession(w http.ResponseWriter, r *http.Request) error {
+	sessions.Lock()
+	defer sessions.Unlock()
+	if err := loadActiveSessions(); err != nil {
+		return err
+	}
+	s, err := loadSession(mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return errNotFound
+	}
+	if s.Ended != nil {
+		return &httputil.HTTPError{http.StatusConflict,
+			errors.New("session has ended")}
+	}
+	if err := endSession(s, time.Now()); err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, s)
+}
+
+// addSessionNote adds a note to the timeline of a recording session, to
+// explain what is going on to whoever replays it.
+func addSessionNote(w http.ResponseWriter, r *http.Request) error {
+	var req struct {
+		Text string `json:"text"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	if strings.TrimSpace(req.Text) == "" {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("text is required")}
+	}
+
+	sessions.Lock()
+	defer sessions.Unlock()
+	s, err := loadSession(mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return errNotFound
+	}
+	if s.Ended != nil {
+		return &httputil.HTTPError{http.StatusConflict,
+			errors.New("session has ended")}
+	}
+	entry := &SessionEntry{Time: time.Now(), Type: sessionNote,
+		Data: map[string]interface{}{"text": req.Text}}
+	if err := appendSessionEntry(s, entry); err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusCreated, entry)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+const dataDir = ".launchmango"
+
+var storeMu sync.Mutex
+
+type RepoSettings struct {
+	Provider    string `json:"provider,omitempty"`
+	DockerImage string `json:"dockerImage,omitempty"`
+	Xcode       string `json:"xcode,omitempty"`
+
+	SlackChannel  string          `json:"slackChannel,omitempty"`
+	FirebaseAppID string          `json:"firebaseAppID,omitempty"`
+	Symbols       *SymbolSettings `json:"symbols,omitempty"`
+
+	Screenshots *ScreenshotConfig `json:"screenshots,omitempty"`
+
+	EmailRecipients []string `json:"emailRecipients,omitempty"`
+
+	JiraURL         string   `json:"jiraURL,omitempty"`
+	IssueWebhooks   []string `json:"issueWebhooks,omitempty"`
+	IssueTransition string   `json:"issueTransition,omitempty"`
+
+	// ReadOnly blocks changes to the repository's files and history
+	// through the API. It can still be browsed, built and pulled.
+	ReadOnly bool `json:"readOnly,omitempty"`
+
+	// Secrets are the names of the secrets passed to builds and runs as
+	// environment variables.
+	Secrets []string `json:"secrets,omitempty"`
+
+	// Projects are the apps of a monorepo that build on their own.
+	Projects []*Project `json:"projects,omitempty"`
+
+	// BuildTriggers queue builds after pulls that change the paths they
+	// watch.
+	BuildTriggers []*BuildTrigger `json:"buildTriggers,omitempty"`
+
+	// RunProfiles are the environments the app can be built and run
+	// against, like staging and production.
+	RunProfiles []*RunProfile `json:"runProfiles,omitempty"`
+
+	// BuildTimeout is how many minutes builds may run before they are
+	// stopped, if not the server's default.
+	BuildTimeout int `json:"buildTimeout,omitempty"`
+
+	// BuildDefaults are the choices of builds of the repository, rather
+	// than of one of its projects, that don't make them.
+	BuildDefaults *BuildDefaults `json:"buildDefaults,omitempty"`
+
+	// CodeOwners restricts who may change which files.
+	CodeOwners *CodeOwners `json:"codeOwners,omitempty"`
+}
+
+// readJSON decodes the named file under dataDir into v. A missing file
+// leaves v untouched.
+func readJSON(name string, v interface{}) error {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	b, err := ioutil.ReadFile(filepath.Join(dataDir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func writeJSON(name string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	path := filepath.Join(dataDir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func loadRepoSettings(id string) (*RepoSettings, error) {
+	var s RepoSettings
+	if err := readJSON(filepath.Join("repos", id+".json"), &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func saveRepoSettings(id string, s *RepoSettings) error {
+	return writeJSON(filepath.Join("repos", id+".json"), s)
+}
+
+func getRepoSettings(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	s, err := loadRepoSettings(id)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, s)
+}
+
+func setRepoSettings(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	s, err := loadRepoSettings(id)
+	if err != nil {
+		return err
+	}
+	owners, err := loadCodeOwners(id)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(s); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	if err := checkCodeOwnersChange(r, owners, s.CodeOwners); err != nil {
+		return err
+	}
+	if err := validateProjects(s.Projects); err != nil {
+		return err
+	}
+	if err := validateTriggers(s.BuildTriggers, s.Projects); err != nil {
+		return err
+	}
+	if err := validateRunProfiles(s.RunProfiles); err != nil {
+		return err
+	}
+	if s.BuildDefaults != nil {
+		if err := s.BuildDefaults.validate(); err != nil {
+			return err
+		}
+	}
+	if err := validateCodeOwners(s.CodeOwners); err != nil {
+		return err
+	}
+	if s.BuildTimeout < 0 {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("buildTimeout must be a number of minutes")}
+	}
+	if err := saveRepoSettings(id, s); err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, s)
+}
+
+var errReadOnly = &httputil.HTTPError{http.StatusForbidden,
+	errors.New("repository is read-only")}
+
+// writable wraps handlers that modify a repository so they fail when the
+// repository's settings make it read-only.
+func writable(h handler) handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		id := mux.Vars(r)["id"]
+		if repoExists(id) {
+			s, err := loadRepoSettings(id)
+			if err != nil {
+				return err
+			}
+			if s.ReadOnly {
+				return errReadOnly
+			}
+		}
+		return h(w, r)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+const (
+	signingSSH     = "ssh"
+	signingOpenPGP = "openpgp"
+)
+
+// SigningKey is the key a repository's commits are signed with, so that
+// remotes requiring verified commits accept them. Only its public half is
+// ever returned, to be registered with the remote's host. Name and Email,
+// when set, are the committer's, which hosts match against the key's
+// owner; the author is still whoever the commit request names.
+type SigningKey struct {
+	Format      string    `json:"format"`
+	PublicKey   string    `json:"publicKey"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Name        string    `json:"name,omitempty"`
+	Email       string    `json:"email,omitempty"`
+	Created     time.Time `json:"created"`
+}
+
+// signingDir holds a repository's signing key: the private key, its
+// description and, for OpenPGP keys, the keyring gpg signs with.
+func signingDir(id string) string {
+	return filepath.Join(dataDir, "signing", id)
+}
+
+func loadSigningKey(id string) (*SigningKey, error) {
+	var k SigningKey
+	if err := readJSON(filepath.Join("signing", id, "key.json"), &k); err != nil {
+		return nil, err
+	}
+	if k.Format == "" {
+		return nil, nil
+	}
+	return &k, nil
+}
+
+// signCmd runs a key tool with input on stdin, returning its output.
+func signCmd(env []string, input, name string, args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s: %s", name, msg)
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// installSigningKey checks the private key and sets it up in dir, filling
+// in k's public key and fingerprint. Keys protected by a passphrase are
+// refused, since nobody is there to type it when a commit is made.
+func installSigningKey(dir, privateKey string, k *SigningKey) error {
+	invalid := func(err error) error {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			fmt.Errorf("invalid %s signing key, or one with a passphrase: %v", k.Format, err)}
+	}
+	key := filepath.Join(dir, "key")
+	// ssh-keygen refuses keys other users can read.
+	if err := ioutil.WriteFile(key, []byte(strings.TrimSpace(privateKey)+"\n"), 0600); err != nil {
+		return err
+	}
+	switch k.Format {
+	case signingSSH:
+		pub, err := signCmd(nil, "", "ssh-keygen", "-y", "-P", "", "-f", key)
+		if err != nil {
+			return invalid(err)
+		}
+		k.PublicKey = pub
+		return nil
+	case signingOpenPGP:
+		home := filepath.Join(dir, "gnupg")
+		if err := os.Mkdir(home, 0700); err != nil {
+			return err
+		}
+		env := []string{"GNUPGHOME=" + home}
+		defer signCmd(env, "", "gpgconf", "--kill", "gpg-agent")
+		if _, err := signCmd(env, "", "gpg", "--batch", "--import", key); err != nil {
+			return invalid(err)
+		}
+		list, err := signCmd(env, "", "gpg", "--batch", "--with-colons", "--list-secret-keys")
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(list, "\n") {
+			if f := strings.Split(line, ":"); f[0] == "fpr" && len(f) > 9 {
+				k.Fingerprint = f[9]
+				break
+			}
+		}
+		if k.Fingerprint == "" {
+			return invalid(errors.New("no secret key found"))
+		}
+		if _, err := signCmd(env, "test", "gpg", "--batch", "--pinentry-mode", "loopback",
+			"--passphrase", "", "--local-user", k.Fingerprint, "--detach-sign"); err != nil {
+			return invalid(err)
+		}
+		k.PublicKey, err = signCmd(env, "", "gpg", "--batch", "--armor", "--export", k.Fingerprint)
+		return err
+	}
+	return &httputil.HTTPError{http.StatusBadRequest,
+		errors.New("format must be ssh or openpgp")}
+}
+
+// signingEnv returns the environment for git to sign commits with the
+// repository's key, if it has one. It comes after any committer set by
+// the request, so the key's identity wins.
+func signingEnv(id string) ([]string, error) {
+	k, err := loadSigningKey(id)
+	if err != nil || k == nil {
+		return nil, err
+	}
+	dir, err := filepath.Abs(signingDir(id))
+	if err != nil {
+		return nil, err
+	}
+	signingKey := filepath.Join(dir, "key")
+	var env []string
+	if k.Format == signingOpenPGP {
+		signingKey = k.Fingerprint
+		env = append(env, "GNUPGHOME="+filepath.Join(dir, "gnupg"))
+	}
+	env = append(env, "GIT_CONFIG_COUNT=3",
+		"GIT_CONFIG_KEY_0=commit.gpgSign", "GIT_CONFIG_VALUE_0=true",
+		"GIT_CONFIG_KEY_1=gpg.format", "GIT_CONFIG_VALUE_1="+k.Format,
+		"GIT_CONFIG_KEY_2=user.signingKey", "GIT_CONFIG_VALUE_2="+signingKey)
+	if k.Name != "" {
+		env = append(env, "GIT_COMMITTER_NAME="+k.Name)
+	}
+	if k.Email != "" {
+		env = append(env, "GIT_COMMITTER_EMAIL="+k.Email)
+	}
+	return env, nil
+}
+
+func getSigningKey(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	k, err := loadSigningKey(id)
+	if err != nil {
+		return err
+	}
+	if k == nil {
+		return errNotFound
+	}
+	return renderJSON(w, http.StatusOK, k)
+}
+
+// setSigningKey sets the key the repository's commits are signed with,
+// an SSH private key or an armored OpenPGP secret key, replacing any it
+// had.
+func setSigningKey(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	var req struct {
+		Format     string `json:"format"`
+		PrivateKey string `json:"privateKey"`
+		Name       string `json:"name"`
+		Email      string `json:"email"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	if strings.TrimSpace(req.PrivateKey) == "" {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("privateKey is required")}
+	}
+	if strings.ContainsAny(req.Name, "<>\n") || strings.ContainsAny(req.Email, "<>\n ") {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("invalid name or email")}
+	}
+	k := &SigningKey{Format: req.Format, Name: req.Name, Email: req.Email,
+		Created: time.Now()}
+
+	// The key is set up aside and swapped in, so a bad one leaves the
+	// current key in place.
+	dir := signingDir(id)
+	staging := dir + ".new"
+	os.RemoveAll(staging)
+	if err := os.MkdirAll(staging, 0700); err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	if err := installSigningKey(staging, req.PrivateKey, k); err != nil {
+		return err
+	}
+	if err := writeJSON(filepath.Join("signing", id+".new", "key.json"), k); err != nil {
+		return err
+	}
+	if err := removeSigningKey(id); err != nil {
+		return err
+	}
+	if err := os.Rename(staging, dir); err != nil {
+		return err
+	}
+	audit("signing.set", id, k.Format)
+	return renderJSON(w, http.StatusOK, k)
+}
+
+// removeSigningKey removes the repository's signing key, stopping the gpg
+// agent of its keyring, if any.
+func removeSigningKey(id string) error {
+	dir := signingDir(id)
+	if home := filepath.Join(dir, "gnupg"); fileExists(home) {
+		signCmd([]string{"GNUPGHOME=" + home}, "", "gpgconf", "--kill", "gpg-agent")
+	}
+	return os.RemoveAll(dir)
+}
+
+func deleteSigningKey(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	k, err := loadSigningKey(id)
+	if err != nil {
+		return err
+	}
+	if k == nil {
+		return errNotFound
+	}
+	if err := removeSigningKey(id); err != nil {
+		return err
+	}
+	audit("signing.delete", id, k.Format)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/launchmango/backend/httputil"
+)
+
+const (
+	simReady     = "ready"
+	simLeased    = "leased"
+	simBooting   = "booting"
+	simRecycling = "recycling"
+	simFailed    = "failed"
+
+	simPoolPrefix           = "launchmango-pool-"
+	defaultSimPoolDevice    = "com.apple.CoreSimulator.SimDeviceType.iPhone-15"
+	defaultSimPoolLeaseWait = 5 * time.Minute
+)
+
+// PooledSimulator is a simulator the pool keeps booted so run and test jobs
+// don't wait for one to boot.
+type PooledSimulator struct {
+	UDID   string    `json:"udid"`
+	Name   string    `json:"name"`
+	State  string    `json:"state"`
+	Holder string    `json:"holder,omitempty"`
+	Since  time.Time `json:"since"`
+	Error  string    `json:"error,omitempty"`
+}
+
+var simPool = struct {
+	sync.Mutex
+	sims []*PooledSimulator
+	// ready is signalled whenever a simulator becomes ready.
+	ready *sync.Cond
+}{}
+
+func init() {
+	simPool.ready = sync.NewCond(&simPool.Mutex)
+}
+
+// simPoolSize is the number of simulators to keep booted, set with
+// SIM_POOL_SIZE. The pool is disabled by default.
+func simPoolSize() int {
+	n, _ := strconv.Atoi(os.Getenv("SIM_POOL_SIZE"))
+	return n
+}
+
+// simPoolDevice is the device type of pooled simulators, set with
+// SIM_POOL_DEVICE_TYPE.
+func simPoolDevice() string {
+	if t := os.Getenv("SIM_POOL_DEVICE_TYPE"); t != "" {
+		return t
+	}
+	return defaultSimPoolDevice
+}
+
+// simPoolRuntime is the runtime of pooled simulators, set with
+// SIM_POOL_RUNTIME, or else the newest iOS runtime installed.
+func simPoolRuntime() (string, error) {
+	if r := os.Getenv("SIM_POOL_RUNTIME"); r != "" {
+		return r, nil
+	}
+	out, err := simctl("list", "runtimes", "-j")
+	if err != nil {
+		return "", err
+	}
+	var list struct {
+		Runtimes []struct {
+			Identifier  string `json:"identifier"`
+			Version     string `json:"version"`
+			IsAvailable bool   `json:"isAvailable"`
+		} `json:"runtimes"`
+	}
+	if err := json.Unmarshal([]byte(out), &list); err != nil {
+		return "", err
+	}
+	var best, version string
+	for _, r := range list.Runtimes {
+		if r.IsAvailable && strings.Contains(r.Identifier, ".iOS-") &&
+			(best == "" || versionLess(version, r.Version)) {
+			best, version = r.Identifier, r.Version
+		}
+	}
+	if best == "" {
+		return "", errors.New("no iOS simulator runtime is installed")
+	}
+	return best, nil
+}
+
+// pooledDevices returns the UDIDs of the simulators a previous run of the
+// server created for the pool, by name.
+func pooledDevices() (map[string]string, error) {
+	out, err := simctl("list", "devices", "-j")
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		Devices map[string][]struct {
+			UDID string `json:"udid"`
+			Name string `json:"name"`
+		} `json:"devices"`
+	}
+	if err := json.Unmarshal([]byte(out), &list); err != nil {
+		return nil, err
+	}
+	devices := make(map[string]string)
+	for _, ds := range list.Devices {
+		for _, d := range ds {
+			if strings.HasPrefix(d.Name, simPoolPrefix) {
+				devices[d.Name] = d.UDID
+			}
+		}
+	}
+	return devices, nil
+}
+
+// startSimPool creates the pool's simulators, reusing the ones left from a
+// previous run, and boots them in the background.
+func startSimPool() {
+	n := simPoolSize()
+	if n <= 0 {
+		return
+	}
+	existing, err := pooledDevices()
+	if err != nil {
+		log.Printf("simulator pool: %v", err)
+		return
+	}
+	runtime := ""
+	for i := 1; i <= n; i++ {
+		name := fmt.Sprintf("%s%d", simPoolPrefix, i)
+		udid, ok := existing[name]
+		if !ok {
+			if runtime == "" {
+				if runtime, err = simPoolRuntime(); err != nil {
+					log.Printf("simulator pool: %v", err)
+					return
+				}
+			}
+			if udid, err = simctl("create", name, simPoolDevice(), runtime); err != nil {
+				log.Printf("simulator pool: %v", err)
+				continue
+			}
+		}
+		sim := &PooledSimulator{UDID: udid, Name: name, State: simRecycling,
+			Since: time.Now()}
+		simPool.Lock()
+		simPool.sims = append(simPool.sims, sim)
+		simPool.Unlock()
+		go recycleSimulator(sim)
+	}
+}
+
+// recycleSimulator erases the simulator and boots it again, so the next
+// job gets a clean device with nothing left installed by the last one.
+func recycleSimulator(sim *PooledSimulator) {
+	simctl("shutdown", sim.UDID)
+	_, err := simctl("erase", sim.UDID)
+	if err == nil {
+		setSimState(sim, simBooting, "")
+		err = bootSimulator(sim.UDID)
+	}
+	if err == nil {
+		_, err = simctl("bootstatus", sim.UDID)
+	}
+	if err != nil {
+		log.Printf("simulator pool: %s: %v", sim.Name, err)
+		setSimState(sim, simFailed, err.Error())
+		return
+	}
+	setSimState(sim, simReady, "")
+}
+
+func setSimState(sim *PooledSimulator, state, msg string) {
+	simPool.Lock()
+	sim.State = state
+	sim.Error = msg
+	sim.Since = time.Now()
+	if state != simLeased {
+		sim.Holder = ""
+	}
+	if state == simReady {
+		simPool.ready.Signal()
+	}
+	simPool.Unlock()
+}
+
+// leaseSimulator waits for a simulator of the pool to be ready and leases
+// it to holder, shown in the pool's status. The returned function gives it
+// back to the pool, which recycles it.
+func leaseSimulator(holder string) (string, func(), error) {
+	if simPoolSize() <= 0 {
+		return "", nil, &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("device is required when the simulator pool is disabled")}
+	}
+	timeout := time.AfterFunc(defaultSimPoolLeaseWait, func() {
+		simPool.Lock()
+		simPool.ready.Broadcast()
+		simPool.Unlock()
+	})
+	defer timeout.Stop()
+	deadline := time.Now().Add(defaultSimPoolLeaseWait)
+
+	simPool.Lock()
+	defer simPool.Unlock()
+	for {
+		for _, sim := range simPool.sims {
+			if sim.State == simReady {
+				sim.State = simLeased
+				sim.Holder = holder
+				sim.Since = time.Now()
+				var once sync.Once
+				release := func() {
+					once.Do(func() {
+						setSimState(sim, simRecycling, "")
+						go recycleSimulator(sim)
+					})
+				}
+				return sim.UDID, release, nil
+			}
+		}
+		if !time.Now().Before(deadline) {
+			return "", nil, &httputil.HTTPError{http.StatusServiceUnavailable,
+				errors.New("no pooled simulator became available")}
+		}
+		simPool.ready.Wait()
+	}
+}
+
+func getSimPool(w http.ResponseWriter, r *http.Request) error {
+	simPool.Lock()
+	sims := make([]PooledSimulator, len(simPool.sims))
+	for i, sim := range simPool.sims {
+		sims[i] = *sim
+	}
+	simPool.Unlock()
+	sort.Slice(sims, func(i, j int) bool { return sims[i].Name < sims[j].Name })
+	return renderJSON(w, http.StatusOK, map[string]interface{}{
+		"size":       simPoolSize(),
+		"simulators": sims,
+	})
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+type simPlatform struct {
+	Name string
+	SDK  string
+	// Platform is the -destination platform name.
+	Platform string
+}
+
+// simLaunchWait is how long launching an app on a simulator waits for its
+// process to start, to report its PID.
+const simLaunchWait = 30 * time.Second
+
+var regexpUDID = regexp.MustCompile(
+	`^[0-9A-Fa-f]{8}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{12}$`)
+
+var simPlatforms = []*simPlatform{
+	{"ios", "iphonesimulator", "iOS Simulator"},
+	{"watchos", "watchsimulator", "watchOS Simulator"},
+	{"tvos", "appletvsimulator", "tvOS Simulator"},
+}
+
+func simulatorPlatform(name string) (*simPlatform, error) {
+	for _, p := range simPlatforms {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return nil, &httputil.HTTPError{http.StatusBadRequest,
+		fmt.Errorf("unknown platform %q (want ios, watchos or tvos)", name)}
+}
+
+// destination returns the xcodebuild -destination for device, a simulator
+// UDID or name. Any simulator of the platform is used when device is empty.
+func (p *simPlatform) destination(device string) string {
+	switch {
+	case device == "":
+		return "generic/platform=" + p.Platform
+	case regexpUDID.MatchString(device):
+		return "platform=" + p.Platform + ",id=" + device
+	}
+	return "platform=" + p.Platform + ",name=" + device
+}
+
+func simctl(arg ...string) (string, error) {
+	out, err := exec.Command("xcrun", append([]string{"simctl"}, arg...)...).CombinedOutput()
+	if err != nil {
+		msg := strings.TrimSpace(string(out))
+		if msg == "" {
+			msg = err.Error()
+		}
+		return "", fmt.Errorf("simctl %s: %s", arg[0], msg)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// bootSimulator boots udid, treating an already booted device as success.
+func bootSimulator(udid string) error {
+	_, err := simctl("boot", udid)
+	if err != nil && strings.Contains(err.Error(), "current state: Booted") {
+		return nil
+	}
+	return err
+}
+
+// SimDeviceType is a kind of device simulators can be created as.
+type SimDeviceType struct {
+	Identifier    string `json:"identifier"`
+	Name          string `json:"name"`
+	ProductFamily string `json:"productFamily,omitempty"`
+}
+
+// SimRuntime is an OS version simulators can run.
+type SimRuntime struct {
+	Identifier  string `json:"identifier"`
+	Name        string `json:"name"`
+	Platform    string `json:"platform,omitempty"`
+	Version     string `json:"version"`
+	Build       string `json:"build,omitempty"`
+	IsAvailable bool   `json:"isAvailable"`
+}
+
+// Simulator is a simulator device. State is simctl's, such as Booted or
+// Shutdown. Pooled simulators belong to the simulator pool, which boots
+// and shuts them down itself.
+type Simulator struct {
+	UDID        string `json:"udid"`
+	Name        string `json:"name"`
+	State       string `json:"state"`
+	DeviceType  string `json:"deviceType"`
+	Runtime     string `json:"runtime"`
+	IsAvailable bool   `json:"isAvailable"`
+	Pooled      bool   `json:"pooled,omitempty"`
+}
+
+// SimulatorList is what simctl knows about: device types, runtimes, and
+// the simulators created from them.
+type SimulatorList struct {
+	DeviceTypes []*SimDeviceType `json:"deviceTypes"`
+	Runtimes    []*SimRuntime    `json:"runtimes"`
+	Devices     []*Simulator     `json:"devices"`
+}
+
+func listSimctl() (*SimulatorList, error) {
+	out, err := simctl("list", "-j")
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		DeviceTypes []*SimDeviceType `json:"devicetypes"`
+		Runtimes    []struct {
+			SimRuntime
+			BuildVersion string `json:"buildversion"`
+		} `json:"runtimes"`
+		Devices map[string][]struct {
+			UDID                 string `json:"udid"`
+			Name                 string `json:"name"`
+			State                string `json:"state"`
+			DeviceTypeIdentifier string `json:"deviceTypeIdentifier"`
+			IsAvailable          bool   `json:"isAvailable"`
+		} `json:"devices"`
+	}
+	if err := json.Unmarshal([]byte(out), &list); err != nil {
+		return nil, err
+	}
+	sims := &SimulatorList{DeviceTypes: list.DeviceTypes,
+		Runtimes: []*SimRuntime{}, Devices: []*Simulator{}}
+	if sims.DeviceTypes == nil {
+		sims.DeviceTypes = []*SimDeviceType{}
+	}
+	for _, rt := range list.Runtimes {
+		r := rt.SimRuntime
+		r.Build = rt.BuildVersion
+		sims.Runtimes = append(sims.Runtimes, &r)
+	}
+	for runtime, devices := range list.Devices {
+		for _, d := range devices {
+			sims.Devices = append(sims.Devices, &Simulator{UDID: d.UDID, Name: d.Name,
+				State: d.State, DeviceType: d.DeviceTypeIdentifier, Runtime: runtime,
+				IsAvailable: d.IsAvailable, Pooled: strings.HasPrefix(d.Name, simPoolPrefix)})
+		}
+	}
+	sort.Slice(sims.Devices, func(i, j int) bool {
+		a, b := sims.Devices[i], sims.Devices[j]
+		if a.Runtime != b.Runtime {
+			return a.Runtime < b.Runtime
+		}
+		return a.Name < b.Name
+	})
+	return sims, nil
+}
+
+// simulatorDevice returns the simulator with the UDID in the request, which
+// must not belong to the pool.
+func simulatorDevice(r *http.Request) (*Simulator, error) {
+	udid := mux.Vars(r)["udid"]
+	if !regexpUDID.MatchString(udid) {
+		return nil, &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("not a simulator UDID")}
+	}
+	list, err := listSimctl()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range list.Devices {
+		if strings.EqualFold(d.UDID, udid) {
+			if d.Pooled {
+				return nil, &httputil.HTTPError{http.StatusConflict,
+					errors.New("pooled simulators are managed by the pool")}
+			}
+			return d, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func listSimulators(w http.ResponseWriter, r *http.Request) error {
+	list, err := listSimctl()
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, list)
+}
+
+// startSimulator boots a simulator, returning once it has started booting.
+func startSimulator(w http.ResponseWriter, r *http.Request) error {
+	d, err := simulatorDevice(r)
+	if err != nil {
+		return err
+	}
+	if !d.IsAvailable {
+		return &httputil.HTTPError{http.StatusConflict,
+			errors.New("simulator is unavailable; its runtime may be missing")}
+	}
+	if err := bootSimulator(d.UDID); err != nil {
+		return err
+	}
+	d.State = "Booted"
+	return renderJSON(w, http.StatusOK, d)
+}
+
+// stopSimulator shuts a simulator down, treating one already shut down as
+// success.
+func stopSimulator(w http.ResponseWriter, r *http.Request) error {
+	d, err := simulatorDevice(r)
+	if err != nil {
+		return err
+	}
+	if _, err := simctl("shutdown", d.UDID); err != nil &&
+		!strings.Contains(err.Error(), "current state: Shutdown") {
+		return err
+	}
+	d.State = "Shutdown"
+	return renderJSON(w, http.StatusOK, d)
+}
+
+// findSimulator returns the UDID of an available simulator named device,
+// with the given runtime ("iOS 17.2" or a runtime identifier) or else the
+// newest one. device may also be a UDID, which is returned as is.
+func findSimulator(device, runtime string) (string, error) {
+	if regexpUDID.MatchString(device) {
+		return device, nil
+	}
+	out, err := simctl("list", "devices", "available", "-j")
+	if err != nil {
+		return "", err
+	}
+	var list struct {
+		Devices map[string][]struct {
+			UDID string `json:"udid"`
+			Name string `json:"name"`
+		} `json:"devices"`
+	}
+	if err := json.Unmarshal([]byte(out), &list); err != nil {
+		return "", err
+	}
+	// Runtime identifiers look like com.apple.CoreSimulator.SimRuntime.iOS-17-2.
+	want := strings.NewReplacer(" ", "-", ".", "-").Replace(runtime)
+	var udid, newest string
+	for rt, devices := range list.Devices {
+		if runtime != "" && rt != runtime && !strings.HasSuffix(rt, "."+want) {
+			continue
+		}
+		version := strings.Replace(rt[strings.LastIndex(rt, ".")+1:], "-", ".", -1)
+		for _, d := range devices {
+			if d.Name == device && (udid == "" || versionLess(newest, version)) {
+				udid, newest = d.UDID, version
+			}
+		}
+	}
+	if udid == "" {
+		name := device
+		if runtime != "" {
+			name += " (" + runtime + ")"
+		}
+		return "", &httputil.HTTPError{http.StatusBadRequest,
+			fmt.Errorf("no simulator %s is available", name)}
+	}
+	return udid, nil
+}
+
+// ensurePaired pairs the watch simulator with phone unless the watch is
+// already part of a pair. Watch apps can only be installed on a watch that
+// is paired with a booted phone.
+func ensurePaired(watch, phone string) error {
+	out, err := simctl("list", "pairs", "-j")
+	if err != nil {
+		return err
+	}
+	var list struct {
+		Pairs map[string]struct {
+			Watch struct {
+				UDID string `json:"udid"`
+			} `json:"watch"`
+			Phone struct {
+				UDID string `json:"udid"`
+			} `json:"phone"`
+		} `json:"pairs"`
+	}
+	if err := json.Unmarshal([]byte(out), &list); err != nil {
+		return err
+	}
+	for _, pair := range list.Pairs {
+		if pair.Watch.UDID == watch {
+			return bootSimulator(pair.Phone.UDID)
+		}
+	}
+	if phone == "" {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("watch simulator is not paired; pass pairedDevice")}
+	}
+	if _, err := simctl("pair", watch, phone); err != nil {
+		return err
+	}
+	return bootSimulator(phone)
+}
+
+// runOnSimulator installs the app built for opts.Platform on opts.Device
+// and launches it attached to its console.
+func runOnSimulator(id string, opts *RunOptions) (*Run, error) {
+	plat, err := simulatorPlatform(opts.Platform)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Device != "" && !regexpUDID.MatchString(opts.Device) {
+		return nil, &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("device must be a simulator UDID")}
+	}
+	app := opts.app
+	if app == "" {
+		apps, _ := filepath.Glob(filepath.Join(opts.dir(id), "build",
+			"Debug-"+plat.SDK, "*.app"))
+		if len(apps) == 0 {
+			return nil, &httputil.HTTPError{http.StatusBadRequest,
+				fmt.Errorf("no %s app found; build with platform=%s first",
+					plat.Name, plat.Name)}
+		}
+		app = apps[0]
+	}
+	bundleID, err := plistValue(filepath.Join(app, "Info.plist"),
+		"CFBundleIdentifier")
+	if err != nil {
+		return nil, err
+	}
+
+	// Without a device, iOS apps run on a simulator leased from the pool,
+	// which is recycled once the app exits, or with the pool disabled, on
+	// defaultSimulator's.
+	release := func() {}
+	switch {
+	case opts.Device != "":
+	case plat.Name != "ios":
+		return nil, &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("device is required")}
+	case simPoolSize() > 0:
+		if opts.Device, release, err = leaseSimulator(id); err != nil {
+			return nil, err
+		}
+	default:
+		if opts.Device, err = defaultSimulator(); err != nil {
+			return nil, err
+		}
+	}
+	run, err := launchOnSimulator(id, plat, opts, app, bundleID)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	go func() {
+		<-run.done
+		release()
+	}()
+	return run, nil
+}
+
+func launchOnSimulator(id string, plat *simPlatform, opts *RunOptions,
+	app, bundleID string) (*Run, error) {
+
+	if plat.Name == "watchos" {
+		if err := ensurePaired(opts.Device, opts.PairedDevice); err != nil {
+			return nil, err
+		}
+	}
+	if err := bootSimulator(opts.Device); err != nil {
+		return nil, err
+	}
+	if _, err := simctl("install", opts.Device, app); err != nil {
+		return nil, err
+	}
+	recordSimApp(id, opts.Device, bundleID)
+	cmd := exec.Command("xcrun", "simctl", "launch", "--console",
+		opts.Device, bundleID)
+	cmd.Dir = id
+	cmd.Env = opts.runEnv()
+	// simctl launch prints "<bundle ID>: <pid>" once the app has started.
+	pids := make(chan int, 1)
+	cmd.Stdout = newLineWriter(func(line string) {
+		if pid, err := strconv.Atoi(strings.TrimPrefix(line, bundleID+": ")); err == nil {
+			select {
+			case pids <- pid:
+			default:
+			}
+		}
+	})
+	run, err := startRun(id, "xcode", cmd)
+	if err != nil {
+		return nil, err
+	}
+	run.mu.Lock()
+	run.Device, run.BundleID = opts.Device, bundleID
+	run.mu.Unlock()
+	select {
+	case pid := <-pids:
+		run.mu.Lock()
+		run.AppPID = pid
+		run.mu.Unlock()
+	case <-run.done:
+	case <-time.After(simLaunchWait):
+	}
+	return run, nil
+}
+
+// defaultSimulator returns the simulator apps run on when no device is
+// chosen and there is no pool: a booted iOS simulator, or else an iPhone
+// with the newest iOS runtime.
+func defaultSimulator() (string, error) {
+	list, err := listSimctl()
+	if err != nil {
+		return "", err
+	}
+	var udid, newest string
+	for _, d := range list.Devices {
+		if !d.IsAvailable || d.Pooled || !strings.Contains(d.Runtime, ".iOS-") {
+			continue
+		}
+		if d.State == "Booted" {
+			return d.UDID, nil
+		}
+		version := strings.Replace(d.Runtime[strings.LastIndex(d.Runtime, ".iOS-")+len(".iOS-"):], "-", ".", -1)
+		if strings.HasPrefix(d.Name, "iPhone") && (udid == "" || versionLess(newest, version)) {
+			udid, newest = d.UDID, version
+		}
+	}
+	if udid == "" {
+		return "", &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("no iOS simulator is available; pass device")}
+	}
+	return udid, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/launchmango/backend/httputil"
+)
+
+const slackAPI = "https://slack.com/api/"
+
+var errSlackSignature = &httputil.HTTPError{http.StatusForbidden,
+	errors.New("invalid slack signature")}
+
+func slackChannel(repo string) string {
+	if s, err := loadRepoSettings(repo); err == nil && s.SlackChannel != "" {
+		return s.SlackChannel
+	}
+	return os.Getenv("SLACK_CHANNEL")
+}
+
+func notifySlack(channel string, e *Event) error {
+	if os.Getenv("SLACK_BOT_TOKEN") == "" {
+		return errors.New("SLACK_BOT_TOKEN is not set")
+	}
+	return slackPost(slackAPI+"chat.postMessage", slackEventMessage(channel, e))
+}
+
+func slackEventMessage(channel string, e *Event) map[string]interface{} {
+	name, err := repoName(e.Repo)
+	if err != nil {
+		name = e.Repo
+	}
+	text := fmt.Sprintf("*%s*: %s", name, e.Type)
+	if msg, ok := e.Data["error"].(string); ok {
+		text += "\n```" + msg + "```"
+	}
+
+	blocks := []interface{}{
+		map[string]interface{}{
+			"type": "section",
+			"text": map[string]string{"type": "mrkdwn", "text": text},
+		},
+	}
+	if e.Type == eventBuildFailed || e.Type == eventBuildSucceeded {
+		// The button's value is the repository ID, followed by a slash
+		// and the project for builds of one.
+		value := e.Repo
+		if project, ok := e.Data["project"].(string); ok && project != "" {
+			value += "/" + project
+		}
+		blocks = append(blocks, map[string]interface{}{
+			"type": "actions",
+			"elements": []interface{}{
+				map[string]interface{}{
+					"type":      "button",
+					"action_id": "rebuild",
+					"value":     value,
+					"text": map[string]string{
+						"type": "plain_text",
+						"text": "Rebuild",
+					},
+				},
+			},
+		})
+	}
+
+	return map[string]interface{}{
+		"channel": channel,
+		"text":    text,
+		"blocks":  blocks,
+	}
+}
+
+func slackPost(u string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("SLACK_BOT_TOKEN"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack: status %d", resp.StatusCode)
+	}
+
+	// response_url replies answer with a plain "ok" rather than JSON.
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &result) == nil && !result.OK {
+		return fmt.Errorf("slack: %s", result.Error)
+	}
+	return nil
+}
+
+func verifySlackSignature(r *http.Request, body []byte) bool {
+	secret := os.Getenv("SLACK_SIGNING_SECRET")
+	if secret == "" {
+		return false
+	}
+	ts, err := strconv.ParseInt(r.Header.Get("X-Slack-Request-Timestamp"), 10, 64)
+	if err != nil {
+		return false
+	}
+	if d := time.Since(time.Unix(ts, 0)); d > 5*time.Minute || d < -5*time.Minute {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%d:%s", ts, body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Slack-Signature")))
+}
+
+func slackActions(w http.ResponseWriter, r *http.Request) error {
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if !verifySlackSignature(r, body) {
+		return errSlackSignature
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+
+	var payload struct {
+		ResponseURL string `json:"response_url"`
+		User        struct {
+			Username string `json:"username"`
+		} `json:"user"`
+		Actions []struct {
+			ActionID string `json:"action_id"`
+			Value    string `json:"value"`
+		} `json:"actions"`
+	}
+	if err := json.Unmarshal([]byte(form.Get("payload")), &payload); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+
+	for _, a := range payload.Actions {
+		if a.ActionID != "rebuild" {
+			continue
+		}
+		id, project, _ := strings.Cut(a.Value, "/")
+		if !validRepoID(id) || !repoExists(id) {
+			return renderJSON(w, http.StatusOK, map[string]interface{}{
+				"replace_original": false,
+				"text":             "That repository no longer exists.",
+			})
+		}
+		if _, err := queueDefaultBuild(id, project); err != nil {
+			return err
+		}
+		if payload.ResponseURL != "" {
+			go slackPost(payload.ResponseURL, map[string]interface{}{
+				"replace_original": false,
+				"text": fmt.Sprintf("Rebuild requested by @%s",
+					payload.User.Username),
+			})
+		}
+	}
+	return nil
+}
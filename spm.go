@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+var (
+	regexpPackageDecl = regexp.MustCompile(
+		`\.package\(\s*(?:name:\s*"[^"]*"\s*,\s*)?url:\s*"([^"]+)"\s*,\s*([^)]*)\)`)
+	regexpPackageDeps = regexp.MustCompile(`(?m)^([ \t]*)dependencies:\s*\[`)
+	regexpPBXPackage  = regexp.MustCompile(
+		`(?s)/\* XCRemoteSwiftPackageReference "([^"]+)" \*/ = \{.*?repositoryURL = "?([^";]+)"?;\s*requirement = \{(.*?)\};`)
+	regexpPBXRequirementField = regexp.MustCompile(`(\w+) = "?([^";]+)"?;`)
+	regexpSemver              = regexp.MustCompile(`^\d+\.\d+\.\d+$`)
+	regexpGitRef              = regexp.MustCompile(`^[A-Za-z0-9._/-]+$`)
+
+	errNoPackages = &httputil.HTTPError{http.StatusNotFound,
+		errors.New("repository has no Package.swift or Xcode project")}
+)
+
+type PackageDependency struct {
+	Name        string `json:"name,omitempty"`
+	URL         string `json:"url"`
+	Requirement string `json:"requirement"`
+}
+
+type ResolvedPackage struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	Version  string `json:"version,omitempty"`
+	Branch   string `json:"branch,omitempty"`
+	Revision string `json:"revision"`
+}
+
+// packageManifest locates what declares the repository's packages: a
+// Package.swift at the root, or else the first .xcodeproj's pbxproj.
+func packageManifest(id string) (string, bool, error) {
+	if fileExists(filepath.Join(id, "Package.swift")) {
+		return filepath.Join(id, "Package.swift"), true, nil
+	}
+	projects, _ := filepath.Glob(filepath.Join(id, "*.xcodeproj"))
+	if len(projects) == 0 {
+		return "", false, errNoPackages
+	}
+	return filepath.Join(projects[0], "project.pbxproj"), false, nil
+}
+
+func declaredPackages(manifest string, swift bool) ([]*PackageDependency, error) {
+	b, err := ioutil.ReadFile(manifest)
+	if err != nil {
+		return nil, err
+	}
+	deps := []*PackageDependency{}
+	if swift {
+		for _, m := range regexpPackageDecl.FindAllStringSubmatch(string(b), -1) {
+			deps = append(deps, &PackageDependency{
+				URL:         m[1],
+				Requirement: strings.TrimSpace(m[2]),
+			})
+		}
+		return deps, nil
+	}
+	for _, m := range regexpPBXPackage.FindAllStringSubmatch(string(b), -1) {
+		var req []string
+		for _, f := range regexpPBXRequirementField.FindAllStringSubmatch(m[3], -1) {
+			req = append(req, f[1]+": "+f[2])
+		}
+		deps = append(deps, &PackageDependency{
+			Name:        m[1],
+			URL:         m[2],
+			Requirement: strings.Join(req, ", "),
+		})
+	}
+	return deps, nil
+}
+
+func resolvedPackages(id string) ([]*ResolvedPackage, error) {
+	candidates := []string{filepath.Join(id, "Package.resolved")}
+	for _, pattern := range []string{
+		"*.xcworkspace/xcshareddata/swiftpm/Package.resolved",
+		"*.xcodeproj/project.xcworkspace/xcshareddata/swiftpm/Package.resolved",
+	} {
+		m, _ := filepath.Glob(filepath.Join(id, pattern))
+		candidates = append(candidates, m...)
+	}
+
+	for _, c := range candidates {
+		b, err := ioutil.ReadFile(c)
+		if err != nil {
+			continue
+		}
+		type state struct {
+			Version  string `json:"version"`
+			Branch   string `json:"branch"`
+			Revision string `json:"revision"`
+		}
+		// Version 1 nests pins under "object"; versions 2 and 3 don't and
+		// rename package/repositoryURL to identity/location.
+		var f struct {
+			Object struct {
+				Pins []struct {
+					Package       string `json:"package"`
+					RepositoryURL string `json:"repositoryURL"`
+					State         state  `json:"state"`
+				} `json:"pins"`
+			} `json:"object"`
+			Pins []struct {
+				Identity string `json:"identity"`
+				Location string `json:"location"`
+				State    state  `json:"state"`
+			} `json:"pins"`
+		}
+		if err := json.Unmarshal(b, &f); err != nil {
+			return nil, err
+		}
+		pkgs := []*ResolvedPackage{}
+		for _, p := range f.Object.Pins {
+			pkgs = append(pkgs, &ResolvedPackage{p.Package, p.RepositoryURL,
+				p.State.Version, p.State.Branch, p.State.Revision})
+		}
+		for _, p := range f.Pins {
+			pkgs = append(pkgs, &ResolvedPackage{p.Identity, p.Location,
+				p.State.Version, p.State.Branch, p.State.Revision})
+		}
+		return pkgs, nil
+	}
+	return []*ResolvedPackage{}, nil
+}
+
+func resolvePackages(id string, swift bool, update bool) *Job {
+	return startJob(id, "spm-resolve", func(out io.Writer) error {
+		if !swift {
+			return runCmdIn(id, out, "xcodebuild", "-resolvePackageDependencies")
+		}
+		if update {
+			return runCmdIn(id, out, "swift", "package", "update")
+		}
+		return runCmdIn(id, out, "swift", "package", "resolve")
+	})
+}
+
+func listPackages(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	manifest, swift, err := packageManifest(id)
+	if err != nil {
+		return err
+	}
+	declared, err := declaredPackages(manifest, swift)
+	if err != nil {
+		return err
+	}
+	resolved, err := resolvedPackages(id)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, map[string]interface{}{
+		"manifest": repoRel(id, manifest),
+		"declared": declared,
+		"resolved": resolved,
+	})
+}
+
+// requirementSwift renders the version requirement of a .package(...)
+// declaration from the request fields.
+func requirementSwift(from, exact, branch string) (string, error) {
+	switch {
+	case from != "" && regexpSemver.MatchString(from):
+		return fmt.Sprintf("from: %q", from), nil
+	case exact != "" && regexpSemver.MatchString(exact):
+		return fmt.Sprintf("exact: %q", exact), nil
+	case branch != "" && regexpGitRef.MatchString(branch):
+		return fmt.Sprintf("branch: %q", branch), nil
+	}
+	return "", &httputil.HTTPError{http.StatusBadRequest,
+		errors.New("one of from, exact (x.y.z) or branch is required")}
+}
+
+func addPackage(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	var req struct {
+		URL    string `json:"url"`
+		From   string `json:"from"`
+		Exact  string `json:"exact"`
+		Branch string `json:"branch"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	if req.URL == "" || strings.ContainsAny(req.URL, "\"\\\n") {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("a valid url is required")}
+	}
+	requirement, err := requirementSwift(req.From, req.Exact, req.Branch)
+	if err != nil {
+		return err
+	}
+
+	manifest, swift, err := packageManifest(id)
+	if err != nil {
+		return err
+	}
+	if !swift {
+		return &httputil.HTTPError{http.StatusUnprocessableEntity,
+			errors.New("adding packages is only supported for Package.swift; " +
+				"add it in Xcode for .xcodeproj projects")}
+	}
+	if err := checkOwners(r, id, repoRel(id, manifest)); err != nil {
+		return err
+	}
+	defer rlockRepo(id)()
+	declared, err := declaredPackages(manifest, swift)
+	if err != nil {
+		return err
+	}
+	for _, d := range declared {
+		if d.URL == req.URL {
+			return &httputil.HTTPError{http.StatusConflict,
+				errors.New("package is already a dependency")}
+		}
+	}
+
+	b, err := ioutil.ReadFile(manifest)
+	if err != nil {
+		return err
+	}
+	src := string(b)
+	loc := regexpPackageDeps.FindStringSubmatchIndex(src)
+	if loc == nil {
+		return &httputil.HTTPError{http.StatusUnprocessableEntity,
+			errors.New("Package.swift has no dependencies list")}
+	}
+	indent := src[loc[2]:loc[3]]
+	decl := fmt.Sprintf("\n%s    .package(url: %q, %s),", indent, req.URL, requirement)
+	src = src[:loc[1]] + decl + src[loc[1]:]
+
+	fi, err := os.Stat(manifest)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(manifest, []byte(src), fi.Mode()); err != nil {
+		return err
+	}
+	invalidateTreeCache(id)
+	return renderJSON(w, http.StatusAccepted, resolvePackages(id, swift, false))
+}
+
+func removePackage(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	u := r.URL.Query().Get("url")
+
+	manifest, swift, err := packageManifest(id)
+	if err != nil {
+		return err
+	}
+	if !swift {
+		return &httputil.HTTPError{http.StatusUnprocessableEntity,
+			errors.New("removing packages is only supported for Package.swift")}
+	}
+	if err := checkOwners(r, id, repoRel(id, manifest)); err != nil {
+		return err
+	}
+	defer rlockRepo(id)()
+	b, err := ioutil.ReadFile(manifest)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(b), "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		m := regexpPackageDecl.FindStringSubmatchIndex(line)
+		if m == nil || line[m[2]:m[3]] != u {
+			kept = append(kept, line)
+			continue
+		}
+		// Keep whatever else shares the line, minus the separating comma.
+		rest := line[:m[0]] + strings.TrimPrefix(line[m[1]:], ",")
+		if strings.TrimSpace(rest) != "" {
+			kept = append(kept, rest)
+		}
+	}
+	if len(kept) == len(lines) {
+		return errNotFound
+	}
+	src := strings.Join(kept, "\n")
+
+	fi, err := os.Stat(manifest)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(manifest, []byte(src), fi.Mode()); err != nil {
+		return err
+	}
+	invalidateTreeCache(id)
+	return renderJSON(w, http.StatusAccepted, resolvePackages(id, swift, false))
+}
+
+// pbxprojRequirement renders the body of an XCRemoteSwiftPackageReference
+// requirement block.
+func pbxprojRequirement(from, exact, branch string) string {
+	const indent = "\n\t\t\t\t"
+	switch {
+	case from != "":
+		return indent + "kind = upToNextMajorVersion;" +
+			indent + "minimumVersion = " + from + ";\n\t\t\t"
+	case exact != "":
+		return indent + "kind = exactVersion;" +
+			indent + "version = " + exact + ";\n\t\t\t"
+	}
+	return indent + "branch = " + branch + ";" +
+		indent + "kind = branch;\n\t\t\t"
+}
+
+func updatePackages(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	var req struct {
+		URL    string `json:"url"`
+		From   string `json:"from"`
+		Exact  string `json:"exact"`
+		Branch string `json:"branch"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+
+	manifest, swift, err := packageManifest(id)
+	if err != nil {
+		return err
+	}
+	if req.URL == "" {
+		return renderJSON(w, http.StatusAccepted, resolvePackages(id, swift, true))
+	}
+
+	// Changing the requirement of a single package.
+	requirement, err := requirementSwift(req.From, req.Exact, req.Branch)
+	if err != nil {
+		return err
+	}
+	if err := checkOwners(r, id, repoRel(id, manifest)); err != nil {
+		return err
+	}
+	defer rlockRepo(id)()
+	b, err := ioutil.ReadFile(manifest)
+	if err != nil {
+		return err
+	}
+	src := string(b)
+	found := false
+	if swift {
+		src = regexpPackageDecl.ReplaceAllStringFunc(src, func(decl string) string {
+			if regexpPackageDecl.FindStringSubmatch(decl)[1] != req.URL {
+				return decl
+			}
+			found = true
+			return fmt.Sprintf(".package(url: %q, %s)", req.URL, requirement)
+		})
+	} else {
+		for _, m := range regexpPBXPackage.FindAllStringSubmatchIndex(src, -1) {
+			if src[m[4]:m[5]] == req.URL {
+				src = src[:m[6]] +
+					pbxprojRequirement(req.From, req.Exact, req.Branch) + src[m[7]:]
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		return errNotFound
+	}
+
+	fi, err := os.Stat(manifest)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(manifest, []byte(src), fi.Mode()); err != nil {
+		return err
+	}
+	invalidateTreeCache(id)
+	return renderJSON(w, http.StatusAccepted, resolvePackages(id, swift, true))
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+const artifactURLExpiry = time.Hour
+
+// ArtifactStore persists build outputs outside the repository working
+// trees and hands out time-limited URLs to download them.
+type ArtifactStore interface {
+	Put(key string, r io.Reader, size int64) error
+	Delete(key string) error
+	URL(key string, expiry time.Duration) (string, error)
+}
+
+var (
+	artifactStoreOnce sync.Once
+	artifactStore     ArtifactStore
+)
+
+func artifacts() ArtifactStore {
+	artifactStoreOnce.Do(func() {
+		if os.Getenv("ARTIFACT_STORE") == "s3" {
+			artifactStore = &s3Store{
+				endpoint:  strings.TrimSuffix(os.Getenv("S3_ENDPOINT"), "/"),
+				bucket:    os.Getenv("S3_BUCKET"),
+				region:    os.Getenv("S3_REGION"),
+				accessKey: os.Getenv("S3_ACCESS_KEY"),
+				secretKey: os.Getenv("S3_SECRET_KEY"),
+			}
+			return
+		}
+		artifactStore = &localStore{root: filepath.Join(dataDir, "artifacts")}
+	})
+	return artifactStore
+}
+
+type localStore struct {
+	root string
+
+	secretOnce sync.Once
+	secret     []byte
+}
+
+func (s *localStore) Put(key string, r io.Reader, size int64) error {
+	p := filepath.Join(s.root, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(p)
+		return err
+	}
+	return f.Close()
+}
+
+func (s *localStore) Delete(key string) error {
+	err := os.Remove(filepath.Join(s.root, filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// urlSecret returns the key used to sign local artifact URLs, creating it
+// on first use so signed URLs survive restarts.
+func (s *localStore) urlSecret() []byte {
+	s.secretOnce.Do(func() {
+		p := filepath.Join(dataDir, "artifact-url.key")
+		if b, err := ioutil.ReadFile(p); err == nil && len(b) > 0 {
+			s.secret = b
+			return
+		}
+		s.secret = make([]byte, 32)
+		rand.Read(s.secret)
+		os.MkdirAll(dataDir, 0700)
+		ioutil.WriteFile(p, s.secret, 0600)
+	})
+	return s.secret
+}
+
+func (s *localStore) signature(key string, expires int64) string {
+	mac := hmac.New(sha256.New, s.urlSecret())
+	fmt.Fprintf(mac, "%s\n%d", key, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *localStore) URL(key string, expiry time.Duration) (string, error) {
+	expires := time.Now().Add(expiry).Unix()
+	v := url.Values{}
+	v.Set("expires", strconv.FormatInt(expires, 10))
+	v.Set("sig", s.signature(key, expires))
+	return "/artifacts/" + key + "?" + v.Encode(), nil
+}
+
+type s3Store struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+}
+
+func awsEscape(s string, encodeSlash bool) string {
+	var buf strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~':
+			buf.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			buf.WriteByte(b)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, data)
+	return mac.Sum(nil)
+}
+
+// presign returns a SigV4 query-signed URL for the object key. Path-style
+// addressing is used so MinIO and other S3-compatible servers work too.
+func (s *s3Store) presign(method, key string, expiry time.Duration) (string, error) {
+	u, err := url.Parse(s.endpoint)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	canonicalPath := "/" + awsEscape(s.bucket, true) + "/" + awsEscape(key, false)
+
+	q := map[string]string{
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    s.accessKey + "/" + scope,
+		"X-Amz-Date":          now.Format("20060102T150405Z"),
+		"X-Amz-Expires":       strconv.Itoa(int(expiry.Seconds())),
+		"X-Amz-SignedHeaders": "host",
+	}
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		parts = append(parts, awsEscape(k, true)+"="+awsEscape(q[k], true))
+	}
+	query := strings.Join(parts, "&")
+
+	canonical := strings.Join([]string{
+		method,
+		canonicalPath,
+		query,
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		q["X-Amz-Date"],
+		scope,
+		hex.EncodeToString(sum[:]),
+	}, "\n")
+
+	k := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	k = hmacSHA256(k, s.region)
+	k = hmacSHA256(k, "s3")
+	k = hmacSHA256(k, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(k, toSign))
+
+	return fmt.Sprintf("%s://%s%s?%s&X-Amz-Signature=%s",
+		u.Scheme, u.Host, canonicalPath, query, sig), nil
+}
+
+func (s *s3Store) do(method, key string, body io.Reader, size int64) error {
+	u, err := s.presign(method, key, 15*time.Minute)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("s3: %s %s: %s: %s", method, key, resp.Status,
+			strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (s *s3Store) Put(key string, r io.Reader, size int64) error {
+	return s.do("PUT", key, r, size)
+}
+
+func (s *s3Store) Delete(key string) error {
+	return s.do("DELETE", key, nil, 0)
+}
+
+func (s *s3Store) URL(key string, expiry time.Duration) (string, error) {
+	return s.presign("GET", key, expiry)
+}
+
+// storeArtifact uploads the file or directory at p under key. Directories
+// such as .xcresult bundles are zipped first and ".zip" is appended to the
+// key, which is returned.
+func storeArtifact(key, p string) (string, error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		f, err := os.Open(p)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		return key, artifacts().Put(key, f, fi.Size())
+	}
+
+	tmp, err := ioutil.TempFile("", "artifact-*.zip")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if err := zipDir(tmp, p); err != nil {
+		return "", err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	key += ".zip"
+	return key, artifacts().Put(key, tmp, size)
+}
+
+func zipDir(w io.Writer, dir string) error {
+	return zipPaths(w, filepath.Dir(dir), dir)
+}
+
+// zipPaths writes a zip of the files and directories at paths, named
+// relative to base. Symlinks are stored as links.
+func zipPaths(w io.Writer, base string, paths ...string) error {
+	zw := zip.NewWriter(w)
+	walk := func(p string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(base, p)
+		if err != nil {
+			return err
+		}
+		h, err := zip.FileInfoHeader(f)
+		if err != nil {
+			return err
+		}
+		h.Name = filepath.ToSlash(rel)
+		if f.IsDir() {
+			h.Name += "/"
+		} else {
+			h.Method = zip.Deflate
+		}
+		hw, err := zw.CreateHeader(h)
+		if err != nil || f.IsDir() {
+			return err
+		}
+		if f.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(hw, target)
+			return err
+		}
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(hw, src)
+		return err
+	}
+	for _, p := range paths {
+		if err := filepath.Walk(p, walk); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// inside reports whether the lexically clean path p is dir or below it.
+func inside(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." &&
+		!strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// unzipTo extracts the zip at path below dir, recreating symlinks. Entries
+// and symlinks that would lead outside dir are refused, as are entries
+// written through a symlink extracted before them to outside it.
+func unzipTo(dir, path string) error {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		name := filepath.Join(dir, filepath.FromSlash(f.Name))
+		if !inside(dir, name) {
+			return fmt.Errorf("zip entry %q is outside the destination", f.Name)
+		}
+		mode := f.Mode()
+		at := name
+		if mode&os.ModeSymlink != 0 {
+			at = filepath.Dir(name)
+		}
+		if err := confined(dir, at); err != nil {
+			return fmt.Errorf("zip entry %q: %v", f.Name, err)
+		}
+		if mode.IsDir() {
+			if err := os.MkdirAll(name, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return err
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		if mode&os.ModeSymlink != 0 {
+			target, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			t := filepath.FromSlash(string(target))
+			if filepath.IsAbs(t) || !inside(dir, filepath.Join(filepath.Dir(name), t)) {
+				return fmt.Errorf("zip entry %q links outside the destination", f.Name)
+			}
+			os.Remove(name)
+			if err := os.Symlink(string(target), name); err != nil {
+				return err
+			}
+			continue
+		}
+		out, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+		if err != nil {
+			rc.Close()
+			return err
+		}
+		_, err = io.Copy(out, rc)
+		rc.Close()
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func uploadArtifact(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	rel := r.URL.Query().Get("path")
+	p, err := repoPath(id, rel)
+	if err != nil {
+		return err
+	}
+	if !fileExists(p) {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			fmt.Errorf("%s does not exist", rel)}
+	}
+
+	key := fmt.Sprintf("%s/%d-%s", id, time.Now().Unix(), path.Base(filepath.ToSlash(p)))
+	if key, err = storeArtifact(key, p); err != nil {
+		return err
+	}
+	u, err := artifacts().URL(key, artifactURLExpiry)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusCreated, map[string]string{
+		"key": key,
+		"url": u,
+	})
+}
+
+func serveArtifact(w http.ResponseWriter, r *http.Request) error {
+	s, ok := artifacts().(*localStore)
+	if !ok {
+		return errNotFound
+	}
+	key := mux.Vars(r)["key"]
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires ||
+		!hmac.Equal([]byte(s.signature(key, expires)),
+			[]byte(r.URL.Query().Get("sig"))) {
+		return &httputil.HTTPError{http.StatusForbidden,
+			errors.New("invalid or expired artifact URL")}
+	}
+	http.ServeFile(w, r, filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+key))))
+	return nil
+}
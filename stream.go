@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// streamHandler is like handler but writes straight to the client instead
+// of buffering the response. Errors returned before anything was written
+// are rendered as usual; later ones can only be logged.
+type streamHandler func(w http.ResponseWriter, r *http.Request) error
+
+type streamWriter struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (w *streamWriter) WriteHeader(status int) {
+	w.wrote = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseWriter.Write(p)
+}
+
+// ReadFrom lets io.Copy use sendfile on the underlying connection.
+func (w *streamWriter) ReadFrom(r io.Reader) (int64, error) {
+	w.wrote = true
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(w.ResponseWriter, r)
+}
+
+func (w *streamWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (h streamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sw := &streamWriter{ResponseWriter: w}
+	defer func() {
+		if rv := recover(); rv != nil {
+			err := errors.New("handler panic")
+			logError(r, err, rv)
+			if !sw.wrote {
+				handleError(w, r, http.StatusInternalServerError, err, false)
+			}
+		}
+	}()
+	err := h(sw, r)
+	if err == nil {
+		return
+	}
+	if sw.wrote {
+		logError(r, err, nil)
+		return
+	}
+	serveError(w, r, err)
+}
+
+// sseWriter writes server-sent events, flushing each one.
+type sseWriter struct {
+	w  http.ResponseWriter
+	mu sync.Mutex
+}
+
+func newSSEWriter(w http.ResponseWriter) *sseWriter {
+	return &sseWriter{w: w}
+}
+
+func (s *sseWriter) send(msg string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := io.WriteString(s.w, msg); err != nil {
+		return err
+	}
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// data sends a line of text as an unnamed event. Writes to a client that
+// has gone away are dropped.
+func (s *sseWriter) data(line string) {
+	s.send("data: " + strings.Replace(line, "\r", "", -1) + "\n\n")
+}
+
+// event sends v as JSON in an event of the given type.
+func (s *sseWriter) event(typ string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.send("event: " + typ + "\ndata: " + string(b) + "\n\n")
+}
+
+// flushJSON sends what has been encoded so far to the client.
+func flushJSON(bw *bufio.Writer, w http.ResponseWriter) error {
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func writeJSONField(bw *bufio.Writer, first bool, name string, v interface{}) error {
+	if !first {
+		bw.WriteByte(',')
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	bw.WriteString(`"` + name + `":`)
+	_, err = bw.Write(b)
+	return err
+}
+
+// writeNodeJSON encodes a file tree the way encoding/json would, without
+// holding the whole document in memory.
+func writeNodeJSON(bw *bufio.Writer, n *FileNode) error {
+	bw.WriteByte('{')
+	if err := writeJSONField(bw, true, "type", n.Type); err != nil {
+		return err
+	}
+	if err := writeJSONField(bw, false, "name", n.Name); err != nil {
+		return err
+	}
+	if err := writeJSONField(bw, false, "size", n.Size); err != nil {
+		return err
+	}
+	if n.URL != "" {
+		if err := writeJSONField(bw, false, "url", n.URL); err != nil {
+			return err
+		}
+	}
+	if len(n.Children) > 0 {
+		names := make([]string, 0, len(n.Children))
+		for name := range n.Children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		bw.WriteString(`,"children":{`)
+		for i, name := range names {
+			if i > 0 {
+				bw.WriteByte(',')
+			}
+			b, err := json.Marshal(name)
+			if err != nil {
+				return err
+			}
+			bw.Write(b)
+			bw.WriteByte(':')
+			if err := writeNodeJSON(bw, n.Children[name]); err != nil {
+				return err
+			}
+		}
+		bw.WriteByte('}')
+	}
+	if n.Truncated {
+		bw.WriteString(`,"truncated":true`)
+	}
+	if n.Collapsed {
+		bw.WriteString(`,"collapsed":true`)
+	}
+	return bw.WriteByte('}')
+}
+
+// writeTreePageJSON encodes a page of the tree endpoint the way
+// encoding/json would, its node with writeNodeJSON.
+func writeTreePageJSON(bw *bufio.Writer, page *TreePage) error {
+	bw.WriteByte('{')
+	if err := writeJSONField(bw, true, "path", page.Path); err != nil {
+		return err
+	}
+	bw.WriteString(`,"node":`)
+	if page.Node == nil {
+		bw.WriteString("null")
+	} else if err := writeNodeJSON(bw, page.Node); err != nil {
+		return err
+	}
+	if page.Next != "" {
+		if err := writeJSONField(bw, false, "next", page.Next); err != nil {
+			return err
+		}
+	}
+	return bw.WriteByte('}')
+}
+
+// writeRepoJSON encodes a repository the way encoding/json would, its file
+// tree with writeNodeJSON.
+func writeRepoJSON(bw *bufio.Writer, repo *Repository) error {
+	bw.WriteByte('{')
+	if err := writeJSONField(bw, true, "id", repo.ID); err != nil {
+		return err
+	}
+	if err := writeJSONField(bw, false, "name", repo.Name); err != nil {
+		return err
+	}
+	if err := writeJSONField(bw, false, "url", repo.URL); err != nil {
+		return err
+	}
+	if repo.Branch != "" {
+		if err := writeJSONField(bw, false, "branch", repo.Branch); err != nil {
+			return err
+		}
+	}
+	if repo.Files != nil {
+		bw.WriteString(`,"files":`)
+		if err := writeNodeJSON(bw, repo.Files); err != nil {
+			return err
+		}
+	}
+	if repo.Error != "" {
+		if err := writeJSONField(bw, false, "error", repo.Error); err != nil {
+			return err
+		}
+	}
+	if repo.Partial {
+		bw.WriteString(`,"partial":true`)
+	}
+	if repo.Credential != "" {
+		if err := writeJSONField(bw, false, "credential", repo.Credential); err != nil {
+			return err
+		}
+	}
+	if repo.Created != nil {
+		if err := writeJSONField(bw, false, "created", repo.Created); err != nil {
+			return err
+		}
+	}
+	if repo.DefaultBranch != "" {
+		if err := writeJSONField(bw, false, "defaultBranch", repo.DefaultBranch); err != nil {
+			return err
+		}
+	}
+	if len(repo.Labels) > 0 {
+		if err := writeJSONField(bw, false, "labels", repo.Labels); err != nil {
+			return err
+		}
+	}
+	if repo.LastBuild != nil {
+		if err := writeJSONField(bw, false, "lastBuild", repo.LastBuild); err != nil {
+			return err
+		}
+	}
+	if repo.Dependencies != nil {
+		if err := writeJSONField(bw, false, "dependencies", repo.Dependencies); err != nil {
+			return err
+		}
+	}
+	if repo.Readiness != nil {
+		if err := writeJSONField(bw, false, "readiness", repo.Readiness); err != nil {
+			return err
+		}
+	}
+	if repo.ResolveDependencies {
+		bw.WriteString(`,"resolveDependencies":true`)
+	}
+	if len(repo.Warm) > 0 {
+		if err := writeJSONField(bw, false, "warm", repo.Warm); err != nil {
+			return err
+		}
+	}
+	return bw.WriteByte('}')
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestWriteRepoJSON(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	files := &FileNode{Type: "directory", Name: "", Children: map[string]*FileNode{
+		"b.swift": {Type: "file", Name: "b.swift", Size: 12, URL: "/b.swift"},
+		"a": {Type: "directory", Name: "a", Truncated: true, Children: map[string]*FileNode{
+			"deep": {Type: "directory", Name: "deep", Collapsed: true},
+		}},
+		"\"quoted\" <name>": {Type: "file", Name: "\"quoted\" <name>"},
+	}}
+	for _, repo := range []*Repository{
+		{},
+		{ID: "01HV3K8Z4Q9X7T2M5N6B0C1D2E", Name: "app", URL: "https://example.com/app.git"},
+		{
+			ID:            "01HV3K8Z4Q9X7T2M5N6B0C1D2E",
+			Name:          "app & <co>",
+			URL:           "https://example.com/app.git",
+			Branch:        "main",
+			Files:         files,
+			Error:         "failed",
+			Partial:       true,
+			Credential:    "cred",
+			Created:       &now,
+			DefaultBranch: "main",
+			Labels:        []string{"ios", "beta"},
+			LastBuild:     &BuildStatus{ID: "b1", State: "succeeded", Finished: &now},
+			Dependencies: &DependencyStatus{Managers: []string{"cocoapods"},
+				State: "failed", Job: "j1", Error: "pod install failed",
+				Started: now, Finished: &now},
+			Readiness: &Readiness{State: readinessPreparing, Started: now,
+				Steps: []*ReadinessStep{
+					{Name: warmDependencies, State: "running", Job: "j1"},
+					{Name: warmIndex, State: "queued"},
+				}},
+			ResolveDependencies: true,
+			Warm:                []string{warmDependencies, warmIndex},
+		},
+	} {
+		want, err := json.Marshal(repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		bw := bufio.NewWriter(&buf)
+		if err := writeRepoJSON(bw, repo); err != nil {
+			t.Fatal(err)
+		}
+		bw.Flush()
+		if got := buf.String(); got != string(want) {
+			t.Errorf("writeRepoJSON wrote\n%s\njson.Marshal gives\n%s", got, want)
+		}
+	}
+}
+
+func TestWriteTreePageJSON(t *testing.T) {
+	node := &FileNode{Type: "directory", Name: "src", Truncated: true, Children: map[string]*FileNode{
+		"main.swift": {Type: "file", Name: "main.swift", Size: 3, URL: "/main.swift"},
+		"lib":        {Type: "directory", Name: "lib", Collapsed: true},
+	}}
+	for _, page := range []*TreePage{
+		{},
+		{Path: "src", Node: node},
+		{Path: "src", Node: node, Next: "main.swift"},
+	} {
+		want, err := json.Marshal(page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		bw := bufio.NewWriter(&buf)
+		if err := writeTreePageJSON(bw, page); err != nil {
+			t.Fatal(err)
+		}
+		bw.Flush()
+		if got := buf.String(); got != string(want) {
+			t.Errorf("writeTreePageJSON wrote\n%s\njson.Marshal gives\n%s", got, want)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+const (
+	sentryCredentialsFile = "sentry.json"
+
+	symbolsSentry      = "sentry"
+	symbolsCrashlytics = "crashlytics"
+)
+
+type SymbolSettings struct {
+	Provider   string `json:"provider"`
+	Org        string `json:"org,omitempty"`
+	Project    string `json:"project,omitempty"`
+	AfterBuild bool   `json:"afterBuild"`
+}
+
+type SentryCredentials struct {
+	Token string `json:"token"`
+	URL   string `json:"url,omitempty"`
+}
+
+type SymbolUpload struct {
+	Provider string   `json:"provider"`
+	DSYMs    []string `json:"dsyms"`
+	Status   string   `json:"status"`
+	Output   string   `json:"output,omitempty"`
+}
+
+func setSentryCredentials(w http.ResponseWriter, r *http.Request) error {
+	var c SentryCredentials
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	if c.Token == "" {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("token is required")}
+	}
+	if err := writeJSON(sentryCredentialsFile, &c); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// findDSYMs returns the .dSYM bundles produced below the repository's
+// build directory since the given time. Those of simulator builds, like
+// Debug-iphonesimulator, are left out: no crash report needs them.
+func findDSYMs(id string, since time.Time) []string {
+	var dsyms []string
+	filepath.Walk(filepath.Join(id, "build"),
+		func(path string, f os.FileInfo, err error) error {
+			if err != nil || !f.IsDir() {
+				return nil
+			}
+			if strings.HasSuffix(f.Name(), "simulator") {
+				return filepath.SkipDir
+			}
+			if strings.HasSuffix(f.Name(), ".dSYM") {
+				if newestModTime(path).After(since) {
+					dsyms = append(dsyms, path)
+				}
+				return filepath.SkipDir
+			}
+			return nil
+		})
+	return dsyms
+}
+
+func findFile(id, name string) string {
+	var found string
+	filepath.Walk(id, func(path string, f os.FileInfo, err error) error {
+		if err != nil || found != "" {
+			return filepath.SkipDir
+		}
+		if f.IsDir() && f.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !f.IsDir() && f.Name() == name {
+			found = path
+		}
+		return nil
+	})
+	return found
+}
+
+func uploadSymbols(id string, s *SymbolSettings, dsyms []string) (*SymbolUpload, error) {
+	upload := &SymbolUpload{Provider: s.Provider}
+	for _, d := range dsyms {
+		upload.DSYMs = append(upload.DSYMs, repoRel(id, d))
+	}
+
+	var out bytes.Buffer
+	var err error
+	switch s.Provider {
+	case symbolsSentry:
+		var c SentryCredentials
+		if err := readJSON(sentryCredentialsFile, &c); err != nil {
+			return nil, err
+		}
+		if c.Token == "" {
+			return nil, &httputil.HTTPError{http.StatusPreconditionFailed,
+				errors.New("Sentry credentials are not configured")}
+		}
+		args := []string{"debug-files", "upload", "--org", s.Org,
+			"--project", s.Project}
+		cmd := exec.Command("sentry-cli", append(args, dsyms...)...)
+		cmd.Env = append(os.Environ(), "SENTRY_AUTH_TOKEN="+c.Token)
+		if c.URL != "" {
+			cmd.Env = append(cmd.Env, "SENTRY_URL="+c.URL)
+		}
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		err = cmd.Run()
+	case symbolsCrashlytics:
+		plist := findFile(id, "GoogleService-Info.plist")
+		if plist == "" {
+			return nil, &httputil.HTTPError{http.StatusBadRequest,
+				errors.New("GoogleService-Info.plist not found")}
+		}
+		tool := filepath.Join(id, "Pods", "FirebaseCrashlytics", "upload-symbols")
+		if !fileExists(tool) {
+			tool = "upload-symbols"
+		}
+		for _, d := range dsyms {
+			cmd := exec.Command(tool, "-gsp", plist, "-p", "ios", d)
+			cmd.Stdout = &out
+			cmd.Stderr = &out
+			if err = cmd.Run(); err != nil {
+				break
+			}
+		}
+	default:
+		return nil, &httputil.HTTPError{http.StatusBadRequest,
+			fmt.Errorf("unknown symbol provider %q", s.Provider)}
+	}
+
+	upload.Output = strings.TrimSpace(out.String())
+	if err != nil {
+		upload.Status = "failed"
+		publish(&Event{Type: eventSymbolsFailed, Repo: id,
+			Data: map[string]interface{}{"error": err.Error()}})
+	} else {
+		upload.Status = "uploaded"
+		publish(&Event{Type: eventSymbolsUploaded, Repo: id,
+			Data: map[string]interface{}{"provider": s.Provider}})
+	}
+	return upload, nil
+}
+
+// uploadSymbolsAfterBuild uploads the dSYMs a successful build produced.
+// Builds that produced none, like Debug and simulator builds, and builds
+// restored from the cache are skipped.
+func uploadSymbolsAfterBuild(e *Event) {
+	if e.Type != eventBuildSucceeded || e.Data["cached"] == true {
+		return
+	}
+	settings, err := loadRepoSettings(e.Repo)
+	if err != nil || settings.Symbols == nil || !settings.Symbols.AfterBuild {
+		return
+	}
+	buildID, _ := e.Data["build"].(string)
+	b, err := repoBuild(e.Repo, buildID)
+	if err != nil || b == nil {
+		return
+	}
+	dsyms := findDSYMs(e.Repo, b.Started)
+	if len(dsyms) == 0 {
+		return
+	}
+	if upload, err := uploadSymbols(e.Repo, settings.Symbols, dsyms); err != nil {
+		log.Printf("symbols: %s: %v", e.Repo, err)
+	} else if upload.Status != "uploaded" {
+		log.Printf("symbols: %s: %s", e.Repo, upload.Output)
+	}
+}
+
+func uploadRepoSymbols(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	settings, err := loadRepoSettings(id)
+	if err != nil {
+		return err
+	}
+	if settings.Symbols == nil {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("symbol upload is not configured for this repository")}
+	}
+	dsyms := findDSYMs(id, time.Time{})
+	if len(dsyms) == 0 {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("no dSYMs found; build the app first")}
+	}
+	upload, err := uploadSymbols(id, settings.Symbols, dsyms)
+	if err != nil {
+		return err
+	}
+	status := http.StatusOK
+	if upload.Status != "uploaded" {
+		status = http.StatusBadGateway
+	}
+	return renderJSON(w, status, upload)
+}
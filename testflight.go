@@ -0,0 +1,308 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+const ascCredentialsFile = "appstoreconnect.json"
+
+var regexpASCKeyID = regexp.MustCompile("^[A-Z0-9]{10}$")
+
+type ASCCredentials struct {
+	KeyID      string `json:"keyID"`
+	IssuerID   string `json:"issuerID"`
+	PrivateKey string `json:"privateKey,omitempty"`
+}
+
+// TestFlightUpload reports an upload of an .ipa to TestFlight. Once it has
+// been uploaded, Status follows the processing state App Store Connect
+// reports for the build: uploaded until it lists the build, then
+// processing, and valid when testers can install it, or failed or invalid.
+type TestFlightUpload struct {
+	IPA          string   `json:"ipa"`
+	BundleID     string   `json:"bundleID,omitempty"`
+	Build        string   `json:"build,omitempty"`
+	Status       string   `json:"status"`
+	BuildID      string   `json:"buildID,omitempty"`
+	DeliveryUUID string   `json:"deliveryUUID,omitempty"`
+	Errors       []string `json:"errors,omitempty"`
+	Output       string   `json:"output,omitempty"`
+}
+
+// ipaBundle reads the bundle ID and build number of the app in an .ipa.
+func ipaBundle(ipa string) (bundleID, build string, err error) {
+	zr, err := zip.OpenReader(ipa)
+	if err != nil {
+		return "", "", err
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		parts := strings.Split(f.Name, "/")
+		if len(parts) != 3 || parts[0] != "Payload" ||
+			!strings.HasSuffix(parts[1], ".app") || parts[2] != "Info.plist" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return "", "", err
+		}
+		defer rc.Close()
+		tmp, err := ioutil.TempFile("", "Info.plist")
+		if err != nil {
+			return "", "", err
+		}
+		defer os.Remove(tmp.Name())
+		_, err = io.Copy(tmp, rc)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return "", "", err
+		}
+		if bundleID, err = plistValue(tmp.Name(), "CFBundleIdentifier"); err != nil {
+			return "", "", err
+		}
+		build, err = plistValue(tmp.Name(), "CFBundleVersion")
+		return bundleID, build, err
+	}
+	return "", "", fmt.Errorf("%s has no app", filepath.Base(ipa))
+}
+
+// refresh sets the upload's status from App Store Connect's processing
+// state for its build.
+func (u *TestFlightUpload) refresh(c *ascClient) error {
+	b, err := c.UploadedBuild(u.BundleID, u.Build)
+	if err != nil {
+		return err
+	}
+	u.Status = "uploaded"
+	if b != nil {
+		u.Status, u.BuildID = strings.ToLower(b.ProcessingState), b.ID
+	}
+	return nil
+}
+
+func loadASCCredentials() (*ASCCredentials, error) {
+	var c ASCCredentials
+	if err := readJSON(ascCredentialsFile, &c); err != nil {
+		return nil, err
+	}
+	if c.KeyID == "" || c.IssuerID == "" || c.PrivateKey == "" {
+		return nil, &httputil.HTTPError{http.StatusPreconditionFailed,
+			errors.New("App Store Connect credentials are not configured")}
+	}
+	return &c, nil
+}
+
+// privateKeysDir writes the API key where altool expects to find it
+// (AuthKey_<keyID>.p8) and returns the directory to pass via
+// API_PRIVATE_KEYS_DIR.
+func (c *ASCCredentials) privateKeysDir() (string, error) {
+	dir, err := filepath.Abs(filepath.Join(dataDir, "private_keys"))
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "AuthKey_"+c.KeyID+".p8")
+	if err := ioutil.WriteFile(path, []byte(c.PrivateKey), 0600); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func getASCCredentials(w http.ResponseWriter, r *http.Request) error {
+	var c ASCCredentials
+	if err := readJSON(ascCredentialsFile, &c); err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, map[string]interface{}{
+		"keyID":      c.KeyID,
+		"issuerID":   c.IssuerID,
+		"configured": c.PrivateKey != "",
+	})
+}
+
+func setASCCredentials(w http.ResponseWriter, r *http.Request) error {
+	var c ASCCredentials
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	if !regexpASCKeyID.MatchString(c.KeyID) {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("keyID must be a 10 character App Store Connect key ID")}
+	}
+	if c.IssuerID == "" {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("issuerID is required")}
+	}
+	if !strings.Contains(c.PrivateKey, "BEGIN PRIVATE KEY") {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("privateKey must be the contents of the .p8 file")}
+	}
+	if err := writeJSON(ascCredentialsFile, &c); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// latestIPA returns the most recently modified .ipa below the repository's
+// build directory.
+func latestIPA(id string) (string, error) {
+	var latest string
+	var latestInfo os.FileInfo
+	filepath.Walk(filepath.Join(id, "build"),
+		func(path string, f os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if !f.IsDir() && strings.HasSuffix(f.Name(), ".ipa") &&
+				(latestInfo == nil || f.ModTime().After(latestInfo.ModTime())) {
+				latest, latestInfo = path, f
+			}
+			return nil
+		})
+	if latest == "" {
+		return "", &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("no .ipa found; archive and export the app first")}
+	}
+	return latest, nil
+}
+
+// resolveIPA returns the repository relative .ipa path rel, or the latest
+// exported .ipa when rel is empty.
+func resolveIPA(id, rel string) (string, error) {
+	if rel == "" {
+		return latestIPA(id)
+	}
+	ipa, err := repoPath(id, rel)
+	if err != nil {
+		return "", err
+	}
+	if !fileExists(ipa) {
+		return "", &httputil.HTTPError{http.StatusBadRequest,
+			fmt.Errorf("%s does not exist", rel)}
+	}
+	return ipa, nil
+}
+
+func distributeTestFlight(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	var req struct {
+		IPA string `json:"ipa"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+
+	creds, err := loadASCCredentials()
+	if err != nil {
+		return err
+	}
+
+	ipa, err := resolveIPA(id, req.IPA)
+	if err != nil {
+		return err
+	}
+
+	keysDir, err := creds.privateKeysDir()
+	if err != nil {
+		return err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("xcrun", "altool", "--upload-app", "--type", "ios",
+		"--file", ipa, "--apiKey", creds.KeyID, "--apiIssuer", creds.IssuerID,
+		"--output-format", "json")
+	cmd.Env = append(os.Environ(), "API_PRIVATE_KEYS_DIR="+keysDir)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	runErr := cmd.Run()
+
+	upload := TestFlightUpload{
+		IPA:    repoRel(id, ipa),
+		Output: strings.TrimSpace(stderr.String()),
+	}
+	var result struct {
+		SuccessMessage string `json:"success-message"`
+		Details        struct {
+			DeliveryUUID string `json:"delivery-uuid"`
+		} `json:"details"`
+		ProductErrors []struct {
+			Message string `json:"message"`
+		} `json:"product-errors"`
+	}
+	json.Unmarshal(stdout.Bytes(), &result)
+	for _, e := range result.ProductErrors {
+		upload.Errors = append(upload.Errors, e.Message)
+	}
+	upload.DeliveryUUID = result.Details.DeliveryUUID
+
+	if runErr != nil || len(upload.Errors) > 0 {
+		upload.Status = "failed"
+		if len(upload.Errors) == 0 {
+			upload.Errors = []string{runErr.Error()}
+		}
+		return renderJSON(w, http.StatusBadGateway, &upload)
+	}
+	// Apple processes the binary after upload; until that finishes the
+	// build is not yet available to testers.
+	upload.Status = "uploaded"
+	if upload.BundleID, upload.Build, err = ipaBundle(ipa); err != nil {
+		log.Printf("testflight: %v", err)
+	} else if c, err := newASCClient(); err != nil {
+		log.Printf("testflight: %v", err)
+	} else if err := upload.refresh(c); err != nil {
+		log.Printf("testflight: %v", err)
+	}
+	return renderJSON(w, http.StatusOK, &upload)
+}
+
+// getTestFlightStatus reports the processing status of the upload of an
+// .ipa, the ?ipa given or the latest exported one.
+func getTestFlightStatus(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	ipa, err := resolveIPA(id, r.URL.Query().Get("ipa"))
+	if err != nil {
+		return err
+	}
+	upload := TestFlightUpload{IPA: repoRel(id, ipa)}
+	if upload.BundleID, upload.Build, err = ipaBundle(ipa); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	c, err := newASCClient()
+	if err != nil {
+		return err
+	}
+	if err := upload.refresh(c); err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, &upload)
+}
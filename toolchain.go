@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const toolCheckTimeout = 10 * time.Second
+
+var regexpVersion = regexp.MustCompile(`\d+(\.\d+)+`)
+
+type ToolStatus struct {
+	Name      string `json:"name"`
+	Available bool   `json:"available"`
+	Version   string `json:"version,omitempty"`
+	Path      string `json:"path,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Hint      string `json:"hint,omitempty"`
+}
+
+type toolCheck struct {
+	name string
+	bin  string
+	args []string
+	hint string
+}
+
+var toolChecks = []toolCheck{
+	{"git", "git", []string{"--version"},
+		"Install git, e.g. with xcode-select --install"},
+	{"xcode", "xcodebuild", []string{"-version"},
+		"Install Xcode and select it with sudo xcode-select -s /Applications/Xcode.app, then accept the license with sudo xcodebuild -license accept"},
+	{"simctl", "xcrun", []string{"simctl", "list", "runtimes"},
+		"Open Xcode once to install its additional components and a simulator runtime"},
+	{"cocoapods", "pod", []string{"--version"},
+		"Install CocoaPods with gem install cocoapods or brew install cocoapods"},
+	{"node", "node", []string{"--version"},
+		"Install Node.js (brew install node) to build React Native projects"},
+	{"go", "go", []string{"version"},
+		"Install Go from https://go.dev/dl/"},
+}
+
+func (c *toolCheck) run() *ToolStatus {
+	st := &ToolStatus{Name: c.name}
+	path, err := exec.LookPath(c.bin)
+	if err != nil {
+		st.Error = c.bin + " not found in PATH"
+		st.Hint = c.hint
+		return st
+	}
+	st.Path = path
+
+	ctx, cancel := context.WithTimeout(context.Background(), toolCheckTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, c.bin, c.args...).CombinedOutput()
+	if err != nil {
+		st.Error = strings.TrimSpace(string(out))
+		if st.Error == "" || ctx.Err() != nil {
+			st.Error = err.Error()
+		}
+		st.Hint = c.hint
+		return st
+	}
+	st.Available = true
+	st.Version = regexpVersion.FindString(string(out))
+	if c.name == "simctl" && !strings.Contains(string(out), "iOS") {
+		st.Error = "no iOS simulator runtime installed"
+		st.Hint = c.hint
+	}
+	return st
+}
+
+func getToolchain(w http.ResponseWriter, r *http.Request) error {
+	tools := make([]*ToolStatus, len(toolChecks))
+	var wg sync.WaitGroup
+	for i := range toolChecks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tools[i] = toolChecks[i].run()
+		}(i)
+	}
+	wg.Wait()
+
+	ok := true
+	for _, t := range tools {
+		ok = ok && t.Available && t.Error == ""
+	}
+	return renderJSON(w, http.StatusOK, map[string]interface{}{
+		"ok":     ok,
+		"tools":  tools,
+		"xcodes": installedXcodes(),
+	})
+}
+
+// BuildEnvironment is the toolchain a build ran with, recorded so that
+// differences between builds can be traced to the machine rather than the
+// code. Env holds the environment variables that steer the tools.
+type BuildEnvironment struct {
+	Xcode      string            `json:"xcode,omitempty"`
+	XcodeBuild string            `json:"xcodeBuild,omitempty"`
+	XcodePath  string            `json:"xcodePath,omitempty"`
+	MacOS      string            `json:"macOS,omitempty"`
+	MacOSBuild string            `json:"macOSBuild,omitempty"`
+	SDKs       []*SDKVersion     `json:"sdks,omitempty"`
+	CocoaPods  string            `json:"cocoapods,omitempty"`
+	Env        map[string]string `json:"env,omitempty"`
+}
+
+type SDKVersion struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Build   string `json:"build,omitempty"`
+}
+
+// buildEnvVars are the environment variables recorded with a build.
+// Secrets and run profile variables aren't among them.
+var buildEnvVars = []string{
+	"PATH", "LANG", "LC_ALL", "DEVELOPER_DIR", "SDKROOT", "TOOLCHAINS",
+	"GEM_HOME", "GEM_PATH", "JAVA_HOME", "NODE_OPTIONS", "CI",
+}
+
+// toolOutput runs a tool with the Xcode chosen for a build, returning its
+// trimmed output, or "" if it fails.
+func toolOutput(xcode *XcodeInstall, name string, args ...string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), toolCheckTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, args...)
+	if xcode != nil {
+		cmd.Env = append(os.Environ(), "DEVELOPER_DIR="+xcode.DeveloperDir())
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// buildEnvironment takes a snapshot of the toolchain a build is about to
+// run with. Tools that aren't installed are left out.
+func buildEnvironment(opts *BuildOptions) *BuildEnvironment {
+	env := &BuildEnvironment{Env: make(map[string]string)}
+	if x := opts.xcode; x != nil {
+		env.Xcode, env.XcodeBuild, env.XcodePath = x.Version, x.Build, x.Path
+		env.Env["DEVELOPER_DIR"] = x.DeveloperDir()
+	}
+	for _, name := range buildEnvVars {
+		if v, ok := os.LookupEnv(name); ok && env.Env[name] == "" {
+			env.Env[name] = v
+		}
+	}
+
+	var wg sync.WaitGroup
+	run := func(fn func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn()
+		}()
+	}
+	run(func() {
+		env.MacOS = toolOutput(nil, "sw_vers", "-productVersion")
+		env.MacOSBuild = toolOutput(nil, "sw_vers", "-buildVersion")
+	})
+	run(func() {
+		if env.Xcode != "" {
+			return
+		}
+		// xcodebuild -version prints "Xcode 15.2" and "Build version 15C500".
+		for _, line := range strings.Split(toolOutput(nil, "xcodebuild", "-version"), "\n") {
+			if v := strings.TrimPrefix(line, "Xcode "); v != line {
+				env.Xcode = v
+			} else if v := strings.TrimPrefix(line, "Build version "); v != line {
+				env.XcodeBuild = v
+			}
+		}
+	})
+	run(func() {
+		var sdks []struct {
+			CanonicalName       string `json:"canonicalName"`
+			SDKVersion          string `json:"sdkVersion"`
+			ProductBuildVersion string `json:"productBuildVersion"`
+		}
+		out := toolOutput(opts.xcode, "xcodebuild", "-showsdks", "-json")
+		if out == "" || json.Unmarshal([]byte(out), &sdks) != nil {
+			return
+		}
+		for _, sdk := range sdks {
+			env.SDKs = append(env.SDKs, &SDKVersion{Name: sdk.CanonicalName,
+				Version: sdk.SDKVersion, Build: sdk.ProductBuildVersion})
+		}
+	})
+	run(func() {
+		env.CocoaPods = toolOutput(nil, "pod", "--version")
+	})
+	wg.Wait()
+	return env
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+const (
+	defaultTrashRetention = 7 * 24 * time.Hour
+	trashPurgeInterval    = time.Hour
+)
+
+// TrashItem is a file or directory deleted through the API. It is moved
+// out of the repository into the trash, where it can be restored until it
+// is purged.
+type TrashItem struct {
+	ID      string    `json:"id"`
+	Repo    string    `json:"repo"`
+	Path    string    `json:"path"`
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+	Deleted time.Time `json:"deleted"`
+}
+
+// trashRetention is how long deleted files are kept, set with
+// TRASH_RETENTION as a duration like "72h".
+func trashRetention() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("TRASH_RETENTION")); err == nil {
+		return d
+	}
+	return defaultTrashRetention
+}
+
+func trashItemName(repo, id string) string {
+	return filepath.Join("trash", repo, id+".json")
+}
+
+func trashDataPath(repo, id string) string {
+	return filepath.Join(dataDir, "trash", repo, id)
+}
+
+func loadTrashItem(repo, id string) (*TrashItem, error) {
+	if strings.ContainsAny(id, `/\.`) || id == "" {
+		return nil, nil
+	}
+	var t TrashItem
+	if err := readJSON(trashItemName(repo, id), &t); err != nil {
+		return nil, err
+	}
+	if t.ID == "" {
+		return nil, nil
+	}
+	return &t, nil
+}
+
+func repoTrash(repo string) ([]*TrashItem, error) {
+	matches, err := filepath.Glob(filepath.Join(dataDir, "trash", repo, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	items := []*TrashItem{}
+	for _, m := range matches {
+		t, err := loadTrashItem(repo, strings.TrimSuffix(filepath.Base(m), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		if t != nil {
+			items = append(items, t)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Deleted.After(items[j].Deleted)
+	})
+	return items, nil
+}
+
+// trashPath moves the file or directory at p in the repository to the
+// trash.
+func trashPath(repo, p string) (*TrashItem, error) {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+	t := &TrashItem{
+		ID:      newID(),
+		Repo:    repo,
+		Path:    repoRel(repo, p),
+		Type:    typeFile,
+		Size:    fi.Size(),
+		Deleted: time.Now(),
+	}
+	if fi.IsDir() {
+		t.Type = typeDir
+		t.Size = dirSize(p)
+	}
+	dst := trashDataPath(repo, t.ID)
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return nil, err
+	}
+	if err := writeJSON(trashItemName(repo, t.ID), t); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(p, dst); err != nil {
+		os.Remove(filepath.Join(dataDir, trashItemName(repo, t.ID)))
+		return nil, err
+	}
+	return t, nil
+}
+
+func removeTrashItem(t *TrashItem) error {
+	if err := os.RemoveAll(trashDataPath(t.Repo, t.ID)); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(dataDir, trashItemName(t.Repo, t.ID)))
+}
+
+// purgeTrash removes trashed files older than the retention period.
+func purgeTrash() {
+	repos, err := filepath.Glob(filepath.Join(dataDir, "trash", "*"))
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-trashRetention())
+	for _, dir := range repos {
+		items, err := repoTrash(filepath.Base(dir))
+		if err != nil {
+			log.Printf("trash: %v", err)
+			continue
+		}
+		for _, t := range items {
+			if t.Deleted.Before(cutoff) {
+				if err := removeTrashItem(t); err != nil {
+					log.Printf("trash: purging %s: %v", t.ID, err)
+				}
+			}
+		}
+	}
+}
+
+func purgeTrashPeriodically() {
+	for {
+		purgeTrash()
+		time.Sleep(trashPurgeInterval)
+	}
+}
+
+func deleteRepoFile(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	p, err := repoPath(id, mux.Vars(r)["path"])
+	if err != nil {
+		return err
+	}
+	if hasGitDir(repoRel(id, p)) {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("can't delete inside .git")}
+	}
+	if err := checkOwners(r, id, repoRel(id, p)); err != nil {
+		return err
+	}
+	defer rlockRepo(id)()
+	t, err := trashPath(id, p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errNotFound
+		}
+		return err
+	}
+	invalidateTreeCache(id)
+	publish(&Event{Type: eventRepoEdited, Repo: id,
+		Data: map[string]interface{}{"action": "delete",
+			"paths": []string{t.Path}}})
+	return renderJSON(w, http.StatusOK, t)
+}
+
+func listTrash(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	items, err := repoTrash(id)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, items)
+}
+
+// restoreTrash moves a trashed item back to where it was deleted from,
+// unless something has been put there since.
+func restoreTrash(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	t, err := loadTrashItem(id, vars["item"])
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return errNotFound
+	}
+	p, err := repoPath(id, t.Path)
+	if err != nil {
+		return err
+	}
+	if err := checkOwners(r, id, treePaths(trashDataPath(id, t.ID), t.Path)...); err != nil {
+		return err
+	}
+	defer rlockRepo(id)()
+	if _, err := os.Lstat(p); err == nil {
+		return &httputil.HTTPError{http.StatusConflict,
+			errors.New(t.Path + " already exists")}
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(trashDataPath(id, t.ID), p); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(dataDir, trashItemName(id, t.ID))); err != nil {
+		return err
+	}
+	invalidateTreeCache(id)
+	publish(&Event{Type: eventRepoEdited, Repo: id,
+		Data: map[string]interface{}{"action": "restore",
+			"paths": []string{t.Path}}})
+	return renderJSON(w, http.StatusOK, t)
+}
+
+func purgeTrashItem(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	t, err := loadTrashItem(vars["id"], vars["item"])
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return errNotFound
+	}
+	if err := removeTrashItem(t); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
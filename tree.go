@@ -0,0 +1,385 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// repoTree caches the file tree of a repository and keeps it current by
+// watching every directory in it. Updates copy the nodes on the path to
+// the change, so a root handed out by snapshot is never modified and can
+// be encoded without holding the lock.
+type repoTree struct {
+	id      string
+	watcher *fsnotify.Watcher
+
+	mu    sync.Mutex
+	root  *FileNode
+	files int   // nodes in the tree
+	size  int64 // total size of the files in the tree
+}
+
+// treeLimits bound how much of a repository is loaded into its tree. They
+// can be set with TREE_MAX_FILES, TREE_MAX_DEPTH and TREE_MAX_SIZE (bytes);
+// zero means no limit.
+var treeLimits = struct {
+	once     sync.Once
+	maxFiles int
+	maxDepth int
+	maxSize  int64
+}{
+	maxFiles: 50000,
+	maxDepth: 32,
+	maxSize:  10 << 30,
+}
+
+func loadTreeLimits() {
+	treeLimits.once.Do(func() {
+		if n, err := strconv.Atoi(os.Getenv("TREE_MAX_FILES")); err == nil {
+			treeLimits.maxFiles = n
+		}
+		if n, err := strconv.Atoi(os.Getenv("TREE_MAX_DEPTH")); err == nil {
+			treeLimits.maxDepth = n
+		}
+		if n, err := strconv.ParseInt(os.Getenv("TREE_MAX_SIZE"), 10, 64); err == nil {
+			treeLimits.maxSize = n
+		}
+	})
+}
+
+var (
+	treesMu sync.Mutex
+	trees   = make(map[string]*repoTree)
+)
+
+const (
+	treeDebounce = 100 * time.Millisecond
+	treeMaxDelay = time.Second
+)
+
+var defaultTreeExcludes = []string{"node_modules", "Pods", "DerivedData", "build"}
+
+var (
+	treeExcludesOnce sync.Once
+	treeExcludes     []string
+)
+
+// loadTreeExcludes returns the patterns of the names left out of
+// repository trees: those of TREE_EXCLUDE, a comma separated list of globs,
+// or the defaults.
+func loadTreeExcludes() []string {
+	treeExcludesOnce.Do(func() {
+		treeExcludes = defaultTreeExcludes
+		if v, ok := os.LookupEnv("TREE_EXCLUDE"); ok {
+			treeExcludes = nil
+			for _, p := range strings.Split(v, ",") {
+				if p = strings.TrimSpace(p); p != "" {
+					treeExcludes = append(treeExcludes, p)
+				}
+			}
+		}
+	})
+	return treeExcludes
+}
+
+// excludedName reports whether a file or directory named name is left out
+// of repository trees. ".git" always is, besides the patterns of
+// loadTreeExcludes.
+func excludedName(name string) bool {
+	loadTreeExcludes()
+	if name == ".git" {
+		return true
+	}
+	for _, p := range treeExcludes {
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// skipTreePath reports whether any segment of the repository relative
+// path rel is excluded.
+func skipTreePath(rel string) bool {
+	for _, seg := range strings.Split(filepath.ToSlash(rel), "/") {
+		if excludedName(seg) {
+			return true
+		}
+	}
+	return false
+}
+
+func newFileNode(id, path string, f os.FileInfo) *FileNode {
+	node := &FileNode{
+		Type:     typeFile,
+		Name:     f.Name(),
+		Size:     f.Size(),
+		Children: make(map[string]*FileNode),
+	}
+	if f.IsDir() {
+		node.Type = typeDir
+	} else {
+		node.URL = fileURL(id, repoRel(id, path))
+	}
+	return node
+}
+
+// fileURL returns the URL of the file at the slash separated path rel,
+// escaping each segment.
+func fileURL(id, rel string) string {
+	segs := strings.Split(rel, "/")
+	for i, s := range segs {
+		segs[i] = url.PathEscape(s)
+	}
+	return "/repositories/" + id + "/files/" + strings.Join(segs, "/")
+}
+
+func (t *repoTree) full() bool {
+	return (treeLimits.maxFiles > 0 && t.files >= treeLimits.maxFiles) ||
+		(treeLimits.maxSize > 0 && t.size >= treeLimits.maxSize)
+}
+
+// scan builds the subtree at path, depth levels below the repository root,
+// watching the directories in it. It stops at the tree limits, marking the
+// directories it couldn't finish as truncated.
+func (t *repoTree) scan(path string, f os.FileInfo, depth int) *FileNode {
+	node := newFileNode(t.id, path, f)
+	t.files++
+	if !f.IsDir() {
+		t.size += f.Size()
+		return node
+	}
+	if treeLimits.maxDepth > 0 && depth >= treeLimits.maxDepth {
+		node.Truncated = true
+		return node
+	}
+	if t.watcher != nil {
+		if err := t.watcher.Add(path); err != nil {
+			log.Printf("tree: watching %s: %v", path, err)
+		}
+	}
+	entries, _ := ioutil.ReadDir(path)
+	for _, e := range entries {
+		if excludedName(e.Name()) {
+			continue
+		}
+		if t.full() {
+			node.Truncated = true
+			break
+		}
+		node.Children[e.Name()] = t.scan(filepath.Join(path, e.Name()), e, depth+1)
+	}
+	return node
+}
+
+// forget removes the counts of the subtree n.
+func (t *repoTree) forget(n *FileNode) {
+	if n == nil {
+		return
+	}
+	t.files--
+	if n.Type == typeFile {
+		t.size -= n.Size
+	}
+	for _, c := range n.Children {
+		t.forget(c)
+	}
+}
+
+func cloneNode(n *FileNode) *FileNode {
+	c := *n
+	c.Children = make(map[string]*FileNode, len(n.Children))
+	for k, v := range n.Children {
+		c.Children[k] = v
+	}
+	return &c
+}
+
+// withNode returns a copy of n with the node at parts replaced by child,
+// or removed when child is nil.
+func withNode(n *FileNode, parts []string, child *FileNode) *FileNode {
+	c := cloneNode(n)
+	if len(parts) == 1 {
+		if child == nil {
+			delete(c.Children, parts[0])
+		} else {
+			c.Children[parts[0]] = child
+		}
+		return c
+	}
+	next, ok := n.Children[parts[0]]
+	if !ok {
+		return n
+	}
+	c.Children[parts[0]] = withNode(next, parts[1:], child)
+	return c
+}
+
+func lookupNode(n *FileNode, parts []string) *FileNode {
+	for _, p := range parts {
+		if n = n.Children[p]; n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// update refreshes the node for path after a change to it.
+func (t *repoTree) update(path string) {
+	rel, err := filepath.Rel(t.id, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") || skipTreePath(rel) {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	// Rescan from the nearest ancestor the tree doesn't know about yet.
+	for i := 1; i < len(parts); i++ {
+		if lookupNode(t.root, parts[:i]) == nil {
+			parts = parts[:i]
+			break
+		}
+	}
+	p := filepath.Join(t.id, filepath.FromSlash(strings.Join(parts, "/")))
+
+	t.forget(lookupNode(t.root, parts))
+	var node *FileNode
+	if f, err := os.Lstat(p); err == nil {
+		if t.full() {
+			// No room; flag the parent so clients know it is incomplete.
+			t.root = withNode(t.root, parts, nil)
+			t.markTruncated(parts[:len(parts)-1])
+			return
+		}
+		node = t.scan(p, f, len(parts))
+	}
+	t.root = withNode(t.root, parts, node)
+}
+
+func (t *repoTree) markTruncated(parts []string) {
+	n := lookupNode(t.root, parts)
+	if n == nil || n.Truncated {
+		return
+	}
+	c := cloneNode(n)
+	c.Truncated = true
+	if len(parts) == 0 {
+		t.root = c
+	} else {
+		t.root = withNode(t.root, parts, c)
+	}
+}
+
+// flush applies the pending changes, skipping paths below another pending
+// path since rescanning that covers them.
+func (t *repoTree) flush(pending map[string]bool) {
+	for p := range pending {
+		covered := false
+		for dir := filepath.Dir(p); dir != t.id && dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+			if pending[dir] {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			t.update(p)
+		}
+	}
+}
+
+// watch applies file system events to the tree. Events are coalesced until
+// none arrive for treeDebounce, or treeMaxDelay after the first, so bursts
+// of saves rebuild the tree once.
+func (t *repoTree) watch() {
+	pending := make(map[string]bool)
+	timer := time.NewTimer(0)
+	<-timer.C
+	var first time.Time
+	for {
+		select {
+		case e, ok := <-t.watcher.Events:
+			if !ok {
+				timer.Stop()
+				return
+			}
+			if e.Op == fsnotify.Chmod {
+				continue
+			}
+			if len(pending) == 0 {
+				first = time.Now()
+			}
+			pending[e.Name] = true
+			wait := treeDebounce
+			if left := treeMaxDelay - time.Since(first); left < wait {
+				wait = left
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(wait)
+		case <-timer.C:
+			t.flush(pending)
+			pending = make(map[string]bool)
+		case err, ok := <-t.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("tree: %s: %v", t.id, err)
+		}
+	}
+}
+
+func (t *repoTree) snapshot() *FileNode {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.root
+}
+
+// cachedTree returns the watched tree of repository id, scanning it on
+// first use. If the repository can't be watched it is scanned every time.
+func cachedTree(id string) *FileNode {
+	loadTreeLimits()
+	treesMu.Lock()
+	t := trees[id]
+	if t == nil {
+		f, err := os.Lstat(id)
+		if err != nil {
+			treesMu.Unlock()
+			return nil
+		}
+		t = &repoTree{id: id}
+		if t.watcher, err = fsnotify.NewWatcher(); err != nil {
+			log.Printf("tree: %s: %v", id, err)
+			treesMu.Unlock()
+			return t.scan(id, f, 0)
+		}
+		t.root = t.scan(id, f, 0)
+		trees[id] = t
+		go t.watch()
+	}
+	treesMu.Unlock()
+	return t.snapshot()
+}
+
+// forgetTree stops watching repository id.
+func forgetTree(id string) {
+	treesMu.Lock()
+	defer treesMu.Unlock()
+	if t := trees[id]; t != nil {
+		t.watcher.Close()
+		delete(trees, id)
+	}
+}
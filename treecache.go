@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const maxTreeCacheEntries = 512
+
+// treeStamp identifies the state of the repository a listing was computed
+// from: the commit checked out, and the modification times of the listed
+// directory and the git index. Edits through the API invalidate listings
+// explicitly, since changes to files below the listed directory don't
+// change its modification time.
+type treeStamp struct {
+	Head  string `json:"head"`
+	Dir   int64  `json:"dir"`
+	Index int64  `json:"index"`
+}
+
+type treeCacheEntry struct {
+	Stamp treeStamp `json:"stamp"`
+	Node  *FileNode `json:"node"`
+}
+
+// TreeCacheStats counts lookups in the listing cache, for debugging.
+type TreeCacheStats struct {
+	Entries       int   `json:"entries"`
+	Hits          int64 `json:"hits"`
+	DiskHits      int64 `json:"diskHits"`
+	Misses        int64 `json:"misses"`
+	Invalidations int64 `json:"invalidations"`
+}
+
+// treeCache holds listings computed by repoTreeAt, in memory and in
+// dataDir/treecache so they survive restarts.
+var treeCache = struct {
+	sync.Mutex
+	entries map[string]*treeCacheEntry
+	stats   TreeCacheStats
+}{entries: make(map[string]*treeCacheEntry)}
+
+// headSHA resolves HEAD by reading git's files, which is much cheaper than
+// running git for every listing.
+func headSHA(id string) string {
+	gitDir := filepath.Join(id, ".git")
+	b, err := ioutil.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return ""
+	}
+	head := strings.TrimSpace(string(b))
+	if !strings.HasPrefix(head, "ref: ") {
+		return head
+	}
+	ref := strings.TrimPrefix(head, "ref: ")
+	if b, err := ioutil.ReadFile(filepath.Join(gitDir, filepath.FromSlash(ref))); err == nil {
+		return strings.TrimSpace(string(b))
+	}
+	f, err := os.Open(filepath.Join(gitDir, "packed-refs"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if fields := strings.Fields(s.Text()); len(fields) == 2 && fields[1] == ref {
+			return fields[0]
+		}
+	}
+	return ""
+}
+
+func currentTreeStamp(id, rel string) treeStamp {
+	st := treeStamp{Head: headSHA(id)}
+	if fi, err := os.Stat(filepath.Join(id, filepath.FromSlash(rel))); err == nil {
+		st.Dir = fi.ModTime().UnixNano()
+	}
+	if fi, err := os.Stat(filepath.Join(id, ".git", "index")); err == nil {
+		st.Index = fi.ModTime().UnixNano()
+	}
+	return st
+}
+
+func treeCacheKey(id, rel string, partial bool, depth int) string {
+	return fmt.Sprintf("%s\x00%s\x00%t\x00%d", id, rel, partial, depth)
+}
+
+func treeCacheName(id, key string) string {
+	sum := sha1.Sum([]byte(key))
+	return filepath.Join("treecache", id, hex.EncodeToString(sum[:])+".json")
+}
+
+// cachedListing returns the listing for key if it was computed at stamp,
+// or else computes it with list and caches the result.
+func cachedListing(id, key string, stamp treeStamp, list func() *FileNode) *FileNode {
+	treeCache.Lock()
+	e := treeCache.entries[key]
+	if e != nil && e.Stamp == stamp {
+		treeCache.stats.Hits++
+		treeCache.Unlock()
+		return e.Node
+	}
+	treeCache.Unlock()
+
+	var disk treeCacheEntry
+	if err := readJSON(treeCacheName(id, key), &disk); err == nil &&
+		disk.Node != nil && disk.Stamp == stamp {
+		storeListing(key, &disk)
+		treeCache.Lock()
+		treeCache.stats.DiskHits++
+		treeCache.Unlock()
+		return disk.Node
+	}
+
+	treeCache.Lock()
+	treeCache.stats.Misses++
+	treeCache.Unlock()
+	n := list()
+	if n == nil {
+		return nil
+	}
+	e = &treeCacheEntry{Stamp: stamp, Node: n}
+	storeListing(key, e)
+	writeJSON(treeCacheName(id, key), e)
+	return n
+}
+
+func storeListing(key string, e *treeCacheEntry) {
+	treeCache.Lock()
+	defer treeCache.Unlock()
+	if _, ok := treeCache.entries[key]; !ok && len(treeCache.entries) >= maxTreeCacheEntries {
+		// Drop an arbitrary entry; it can still be found on disk.
+		for k := range treeCache.entries {
+			delete(treeCache.entries, k)
+			break
+		}
+	}
+	treeCache.entries[key] = e
+}
+
+// invalidateTreeCache drops the cached listings of repository id, after
+// the API changed its files or checkout.
+func invalidateTreeCache(id string) {
+	treeCache.Lock()
+	for k := range treeCache.entries {
+		if strings.HasPrefix(k, id+"\x00") {
+			delete(treeCache.entries, k)
+		}
+	}
+	treeCache.stats.Invalidations++
+	treeCache.Unlock()
+	os.RemoveAll(filepath.Join(dataDir, "treecache", id))
+}
+
+func getTreeCacheStats(w http.ResponseWriter, r *http.Request) error {
+	treeCache.Lock()
+	stats := treeCache.stats
+	stats.Entries = len(treeCache.entries)
+	treeCache.Unlock()
+	return renderJSON(w, http.StatusOK, &stats)
+}
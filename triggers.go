@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/launchmango/backend/httputil"
+)
+
+// A BuildTrigger queues a build of the repository, or of one of its
+// projects, when a pull brings in changes to the paths it watches. Paths
+// and IgnorePaths are globs relative to the repository, where ** matches
+// any number of directories; a pattern without wildcards also matches
+// everything under it. Without Paths every change counts, except those
+// ignored.
+type BuildTrigger struct {
+	Project     string   `json:"project,omitempty"`
+	Paths       []string `json:"paths,omitempty"`
+	IgnorePaths []string `json:"ignorePaths,omitempty"`
+}
+
+// matchPathGlob reports whether p, a slash separated path, matches
+// pattern.
+func matchPathGlob(pattern, p string) bool {
+	pattern = strings.Trim(pattern, "/")
+	if !strings.ContainsAny(pattern, "*?[") {
+		return p == pattern || strings.HasPrefix(p, pattern+"/")
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(p, "/"))
+}
+
+func matchSegments(pattern, p []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(p); i++ {
+				if matchSegments(pattern[1:], p[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(p) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], p[0]); !ok {
+			return false
+		}
+		pattern, p = pattern[1:], p[1:]
+	}
+	return len(p) == 0
+}
+
+func matchAnyGlob(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		if matchPathGlob(pattern, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// fires reports whether any of the changed paths is one the trigger
+// watches.
+func (t *BuildTrigger) fires(changed []string) bool {
+	for _, p := range changed {
+		if matchAnyGlob(t.IgnorePaths, p) {
+			continue
+		}
+		if len(t.Paths) == 0 || matchAnyGlob(t.Paths, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateTriggers checks the build triggers of a repository's settings
+// against its projects.
+func validateTriggers(triggers []*BuildTrigger, projects []*Project) error {
+	for _, t := range triggers {
+		if t == nil {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				errors.New("invalid build trigger")}
+		}
+		for _, pattern := range append(append([]string{}, t.Paths...), t.IgnorePaths...) {
+			if _, err := path.Match(pattern, ""); err != nil || strings.Trim(pattern, "/") == "" {
+				return &httputil.HTTPError{http.StatusBadRequest,
+					fmt.Errorf("invalid path pattern %q", pattern)}
+			}
+		}
+		if t.Project == "" {
+			continue
+		}
+		found := false
+		for _, p := range projects {
+			found = found || p.Name == t.Project
+		}
+		if !found {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				fmt.Errorf("build trigger for unknown project %q", t.Project)}
+		}
+	}
+	return nil
+}
+
+// buildAfterPull queues the builds whose triggers watch the paths a pull
+// changed. A project is built once however many of its triggers fire.
+func buildAfterPull(e *Event) {
+	if e.Type != eventRepoPulled {
+		return
+	}
+	old, _ := e.Data["old"].(string)
+	head, _ := e.Data["new"].(string)
+	if old == "" || head == "" || old == head {
+		return
+	}
+	settings, err := loadRepoSettings(e.Repo)
+	if err != nil || len(settings.BuildTriggers) == 0 {
+		return
+	}
+	unlock := rlockRepo(e.Repo)
+	out, err := gitOutput(e.Repo, nil, "diff", "--name-only", "-z", old, head)
+	unlock()
+	if err != nil {
+		log.Printf("triggers: %s: %v", e.Repo, err)
+		return
+	}
+	changed := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+
+	queued := make(map[string]bool)
+	for _, t := range settings.BuildTriggers {
+		if queued[t.Project] || !t.fires(changed) {
+			continue
+		}
+		queued[t.Project] = true
+		if err := triggerBuild(e.Repo, t.Project); err != nil {
+			log.Printf("triggers: %s: %v", e.Repo, err)
+		}
+	}
+}
+
+func triggerBuild(id, projectName string) error {
+	_, err := queueDefaultBuild(id, projectName)
+	return err
+}
+
+// queueDefaultBuild queues a build of the repository, or of its project
+// named projectName, with the choices its settings default to and its
+// secrets, passing flags on to xcodebuild. It's how builds nobody picked
+// options for are made: triggered, from Slack, and to warm a clone.
+func queueDefaultBuild(id, projectName string, flags ...string) (*Build, error) {
+	project, err := findProject(id, projectName)
+	if err != nil {
+		return nil, err
+	}
+	p, err := repoProvider(id, "", project)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := loadRepoSettings(id)
+	if err != nil {
+		return nil, err
+	}
+	opts := &BuildOptions{project: project}
+	if project != nil {
+		opts.Platform, opts.Xcode = project.Platform, project.Xcode
+	}
+	opts.useDefaults(buildDefaults(settings, project))
+	opts.Flags = append(opts.Flags, flags...)
+	if opts.xcode, err = resolveXcode(id, opts.Xcode); err != nil {
+		return nil, err
+	}
+	if opts.env, err = secretEnv(id); err != nil {
+		return nil, err
+	}
+	b := newBuild(id, p.Name(), project)
+	if err := enqueueBuild(b, p, opts); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
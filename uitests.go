@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+const (
+	testPassed = "passed"
+	testFailed = "failed"
+)
+
+var (
+	regexpTestCase = regexp.MustCompile(
+		`^Test [Cc]ase '([^']+)' (started|passed|failed)(?:.*\((\d+(?:\.\d+)?) seconds\))?`)
+	regexpTestIdentifier = regexp.MustCompile(`^[A-Za-z0-9_]+(/[A-Za-z0-9_]+){0,2}$`)
+)
+
+type TestCase struct {
+	Name       string  `json:"name"`
+	Status     string  `json:"status"`
+	Duration   float64 `json:"duration"`
+	Video      string  `json:"video,omitempty"`
+	Screenshot string  `json:"screenshot,omitempty"`
+}
+
+type TestRun struct {
+	Scheme       string      `json:"scheme"`
+	Device       string      `json:"device"`
+	Passed       int         `json:"passed"`
+	Failed       int         `json:"failed"`
+	Cases        []*TestCase `json:"cases"`
+	ResultBundle string      `json:"resultBundle,omitempty"`
+}
+
+// testName turns "-[Module.Class testFoo]" into "Module.Class/testFoo".
+func testName(s string) string {
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "-["), "]")
+	return strings.Replace(s, " ", "/", 1)
+}
+
+func artifactFileName(name string) string {
+	return strings.NewReplacer("/", "-", ".", "-", "(", "", ")", "").Replace(name)
+}
+
+// testRecorder follows xcodebuild test output, recording the simulator
+// screen while each test case runs and taking a screenshot when one fails.
+type testRecorder struct {
+	repo   string
+	device string
+	dir    string
+	run    *TestRun
+
+	current  *TestCase
+	video    string
+	recorder *exec.Cmd
+}
+
+func (t *testRecorder) startRecording(tc *TestCase) {
+	t.current = tc
+	t.video = filepath.Join(t.dir, artifactFileName(tc.Name)+".mp4")
+	cmd := exec.Command("xcrun", "simctl", "io", t.device, "recordVideo",
+		"--codec=h264", "--force", t.video)
+	if err := cmd.Start(); err != nil {
+		log.Println("tests: recording:", err)
+		return
+	}
+	t.recorder = cmd
+}
+
+func (t *testRecorder) stopRecording() {
+	if t.recorder == nil {
+		return
+	}
+	// recordVideo finalizes the file on SIGINT.
+	t.recorder.Process.Signal(os.Interrupt)
+	t.recorder.Wait()
+	t.recorder = nil
+}
+
+func (t *testRecorder) store(tc *TestCase, p, kind string) string {
+	key := fmt.Sprintf("%s/tests/%s/%s", t.repo, filepath.Base(t.dir),
+		filepath.Base(p))
+	key, err := storeArtifact(key, p)
+	if err != nil {
+		log.Printf("tests: storing %s of %s: %v", kind, tc.Name, err)
+		return ""
+	}
+	os.Remove(p)
+	return key
+}
+
+func (t *testRecorder) line(line string) {
+	m := regexpTestCase.FindStringSubmatch(line)
+	if m == nil {
+		return
+	}
+	name := testName(m[1])
+	switch m[2] {
+	case "started":
+		t.stopRecording()
+		tc := &TestCase{Name: name}
+		t.run.Cases = append(t.run.Cases, tc)
+		t.startRecording(tc)
+	case testPassed, testFailed:
+		tc := t.current
+		if tc == nil || tc.Name != name {
+			tc = &TestCase{Name: name}
+			t.run.Cases = append(t.run.Cases, tc)
+		}
+		tc.Status = m[2]
+		tc.Duration, _ = strconv.ParseFloat(m[3], 64)
+		if tc.Status == testFailed {
+			t.run.Failed++
+			shot := filepath.Join(t.dir, artifactFileName(name)+".png")
+			if _, err := simctl("io", t.device, "screenshot", shot); err == nil {
+				tc.Screenshot = t.store(tc, shot, "screenshot")
+			}
+		} else {
+			t.run.Passed++
+		}
+		if tc == t.current {
+			t.stopRecording()
+			tc.Video = t.store(tc, t.video, "video")
+			t.current = nil
+		}
+	}
+}
+
+func runUITests(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	var req struct {
+		Scheme      string   `json:"scheme"`
+		Device      string   `json:"device"`
+		User        string   `json:"user"`
+		OnlyTesting []string `json:"onlyTesting"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	if req.Device == "" {
+		device, err := preferredSimulator(req.User)
+		if err != nil {
+			return err
+		}
+		req.Device = device
+	}
+	if req.Scheme == "" || strings.HasPrefix(req.Scheme, "-") {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("scheme is required")}
+	}
+	if req.Device != "" && !regexpUDID.MatchString(req.Device) {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("device must be a simulator UDID")}
+	}
+	for _, t := range req.OnlyTesting {
+		if !regexpTestIdentifier.MatchString(t) {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				fmt.Errorf("invalid test identifier %q", t)}
+		}
+	}
+	xcode, err := resolveXcode(id, "")
+	if err != nil {
+		return err
+	}
+
+	j := startResultJob(id, "test", func(out io.Writer) (interface{}, error) {
+		dir, err := filepath.Abs(filepath.Join(dataDir, "tests", newID()))
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+
+		device := req.Device
+		if device == "" {
+			udid, release, err := leaseSimulator(id)
+			if err != nil {
+				return nil, err
+			}
+			defer release()
+			device = udid
+		}
+		run := &TestRun{Scheme: req.Scheme, Device: device,
+			Cases: []*TestCase{}}
+		rec := &testRecorder{repo: id, device: device, dir: dir, run: run}
+		if err := bootSimulator(device); err != nil {
+			return run, err
+		}
+
+		publish(&Event{Type: eventTestStarted, Repo: id,
+			Data: map[string]interface{}{"scheme": req.Scheme}})
+		bundle := filepath.Join(dir, "Test.xcresult")
+		args := []string{"test", "-scheme", req.Scheme,
+			"-destination", "platform=iOS Simulator,id=" + device,
+			"-resultBundlePath", bundle}
+		for _, t := range req.OnlyTesting {
+			args = append(args, "-only-testing:"+t)
+		}
+		lw := newLineWriter(rec.line)
+		err = xcodebuild(id, &BuildOptions{xcode: xcode},
+			io.MultiWriter(out, lw), args...)
+		lw.Flush()
+		rec.stopRecording()
+
+		if fileExists(bundle) {
+			key := fmt.Sprintf("%s/tests/%s/Test.xcresult", id, filepath.Base(dir))
+			if key, serr := storeArtifact(key, bundle); serr == nil {
+				run.ResultBundle = key
+			}
+		}
+
+		e := &Event{Type: eventTestPassed, Repo: id,
+			Data: map[string]interface{}{"passed": run.Passed,
+				"failed": run.Failed}}
+		if err != nil || run.Failed > 0 {
+			e.Type = eventTestFailed
+		}
+		publish(e)
+		return run, err
+	})
+	return renderJSON(w, http.StatusAccepted, j)
+}
+
+// signTestRun replaces artifact keys with download URLs.
+func signTestRun(run *TestRun) *TestRun {
+	sign := func(key string) string {
+		if key == "" {
+			return ""
+		}
+		u, err := artifacts().URL(key, artifactURLExpiry)
+		if err != nil {
+			return ""
+		}
+		return u
+	}
+	signed := *run
+	signed.ResultBundle = sign(run.ResultBundle)
+	signed.Cases = make([]*TestCase, len(run.Cases))
+	for i, tc := range run.Cases {
+		c := *tc
+		c.Video = sign(tc.Video)
+		c.Screenshot = sign(tc.Screenshot)
+		signed.Cases[i] = &c
+	}
+	return &signed
+}
+
+func listTestRuns(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+
+	type summary struct {
+		Job      string    `json:"job"`
+		State    string    `json:"state"`
+		Created  time.Time `json:"created"`
+		Scheme   string    `json:"scheme,omitempty"`
+		Passed   int       `json:"passed"`
+		Failed   int       `json:"failed"`
+		Finished bool      `json:"finished"`
+	}
+	list := []*summary{}
+	for _, j := range repoJobs(id, "test") {
+		j.mu.Lock()
+		s := &summary{Job: j.ID, State: j.State, Created: j.Created,
+			Finished: !j.Finished.IsZero()}
+		if run, ok := j.Result.(*TestRun); ok {
+			s.Scheme, s.Passed, s.Failed = run.Scheme, run.Passed, run.Failed
+		}
+		j.mu.Unlock()
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, k int) bool {
+		return list[i].Created.After(list[k].Created)
+	})
+	return renderJSON(w, http.StatusOK, list)
+}
+
+func getTestRun(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	j := findJob(mux.Vars(r)["jobID"])
+	if j == nil || j.Repo != id || j.Kind != "test" {
+		return errNotFound
+	}
+	j.mu.Lock()
+	run, ok := j.Result.(*TestRun)
+	state := j.State
+	j.mu.Unlock()
+	if !ok {
+		return renderJSON(w, http.StatusOK, map[string]string{"state": state})
+	}
+	return renderJSON(w, http.StatusOK, map[string]interface{}{
+		"state":   state,
+		"results": signTestRun(run),
+	})
+}
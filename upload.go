@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+// maxFileSize bounds the size of a file written through the API, set in
+// bytes with MAX_FILE_SIZE; zero means no limit.
+var maxFileSize = struct {
+	once sync.Once
+	n    int64
+}{n: 100 << 20}
+
+func fileSizeLimit() int64 {
+	maxFileSize.once.Do(func() {
+		if n, err := strconv.ParseInt(os.Getenv("MAX_FILE_SIZE"), 10, 64); err == nil {
+			maxFileSize.n = n
+		}
+	})
+	return maxFileSize.n
+}
+
+var errFileTooLarge = &httputil.HTTPError{http.StatusRequestEntityTooLarge,
+	errors.New("file is too large")}
+
+// sizeReader counts what is read through it, failing with errFileTooLarge
+// once more than max bytes have been read.
+type sizeReader struct {
+	r   io.Reader
+	n   int64
+	max int64
+}
+
+func newSizeReader(r io.Reader) *sizeReader {
+	return &sizeReader{r: r, max: fileSizeLimit()}
+}
+
+func (r *sizeReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if r.max > 0 && r.n > r.max {
+		return n, errFileTooLarge
+	}
+	return n, err
+}
+
+// UploadResult reports what happened to one file of a multipart upload.
+type UploadResult struct {
+	Name  string `json:"name"`
+	Path  string `json:"path,omitempty"`
+	URL   string `json:"url,omitempty"`
+	Size  int64  `json:"size"`
+	Error string `json:"error,omitempty"`
+}
+
+// partFileName returns the file name sent for a part as is. Part.FileName
+// strips directories, but browsers uploading a dropped folder send paths
+// relative to it, which are kept.
+func partFileName(h textproto.MIMEHeader) string {
+	_, params, err := mime.ParseMediaType(h.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+	return params["filename"]
+}
+
+// uploadRepoFiles stores each file of a multipart/form-data request in the
+// directory named by the path, which is the repository root when absent.
+// Files are written independently and the result of each is returned.
+func uploadRepoFiles(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	dir := id
+	if rel := mux.Vars(r)["path"]; rel != "" {
+		var err error
+		if dir, err = repoPath(id, rel); err != nil {
+			return err
+		}
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return errNotFound
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	defer rlockRepo(id)()
+
+	results := []*UploadResult{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return &httputil.HTTPError{http.StatusBadRequest, err}
+		}
+		name := partFileName(part.Header)
+		if name == "" {
+			// Not a file, e.g. another form field.
+			part.Close()
+			continue
+		}
+		res := &UploadResult{Name: name}
+		results = append(results, res)
+		rel, err := cleanRel(name)
+		if err != nil || hasGitDir(rel) {
+			res.Error = "invalid file name"
+			part.Close()
+			continue
+		}
+		p := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := confined(id, p); err != nil {
+			res.Error = "invalid file name"
+			part.Close()
+			continue
+		}
+		if err := checkOwners(r, id, repoRel(id, p)); err != nil {
+			if he, ok := err.(*httputil.HTTPError); ok {
+				err = he.Err
+			}
+			res.Error = err.Error()
+			part.Close()
+			continue
+		}
+		res.Size, err = writeUpload(p, newSizeReader(part), nil)
+		part.Close()
+		if err != nil {
+			if err == errFileTooLarge {
+				err = errFileTooLarge.Err
+			}
+			res.Error = err.Error()
+			continue
+		}
+		res.Path = repoRel(id, p)
+		res.URL = fileURL(id, res.Path)
+	}
+	if len(results) == 0 {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("no files in upload")}
+	}
+	invalidateTreeCache(id)
+	var paths []string
+	for _, res := range results {
+		if res.Error == "" {
+			paths = append(paths, res.Path)
+		}
+	}
+	if len(paths) > 0 {
+		publish(&Event{Type: eventRepoEdited, Repo: id,
+			Data: map[string]interface{}{"action": "upload", "paths": paths}})
+	}
+	return renderJSON(w, http.StatusOK, results)
+}
+
+func hasGitDir(rel string) bool {
+	for _, seg := range strings.Split(rel, "/") {
+		if seg == ".git" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeMu serializes replacing files with their new contents, so a check
+// made by writeUpload's caller still holds when the file is replaced.
+var writeMu sync.Mutex
+
+// writeUpload writes r to p through a temporary file, so a failed upload
+// leaves any existing file as it was. If check is not nil, it is called
+// just before the file is replaced and an error from it abandons the write.
+func writeUpload(p string, r io.Reader, check func() error) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return 0, err
+	}
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(p); err == nil {
+		if fi.IsDir() {
+			return 0, errors.New("is a directory")
+		}
+		mode = fi.Mode()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".upload-")
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), mode)
+	}
+	if err == nil {
+		writeMu.Lock()
+		if check != nil {
+			err = check()
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), p)
+		}
+		writeMu.Unlock()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+var regexpUserName = regexp.MustCompile("^[A-Za-z0-9._-]+$")
+
+type EmailPreferences struct {
+	BuildFailures bool     `json:"buildFailures"`
+	JobResults    bool     `json:"jobResults"`
+	Repos         []string `json:"repos,omitempty"`
+}
+
+// SimulatorPreferences pick the simulator a user's runs and tests use when
+// they don't name one: a device name such as "iPhone 15", and optionally a
+// runtime such as "iOS 17.2".
+type SimulatorPreferences struct {
+	Device  string `json:"device,omitempty"`
+	Runtime string `json:"runtime,omitempty"`
+}
+
+type User struct {
+	Name      string               `json:"name"`
+	Email     string               `json:"email,omitempty"`
+	Notify    EmailPreferences     `json:"notify"`
+	Simulator SimulatorPreferences `json:"simulator"`
+}
+
+// wantsEmail reports whether u has opted into email for events of the
+// given kind ("build" or "job") on repo.
+func (u *User) wantsEmail(kind, repo string) bool {
+	if u.Email == "" {
+		return false
+	}
+	switch kind {
+	case "build":
+		if !u.Notify.BuildFailures {
+			return false
+		}
+	case "job":
+		if !u.Notify.JobResults {
+			return false
+		}
+	default:
+		return false
+	}
+	if len(u.Notify.Repos) == 0 {
+		return true
+	}
+	for _, r := range u.Notify.Repos {
+		if r == repo {
+			return true
+		}
+	}
+	return false
+}
+
+func loadUser(name string) (*User, error) {
+	u := User{Name: name}
+	if err := readJSON(filepath.Join("users", name+".json"), &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func saveUser(u *User) error {
+	return writeJSON(filepath.Join("users", u.Name+".json"), u)
+}
+
+// preferredSimulator returns the UDID of the simulator user prefers, or ""
+// if they haven't set a preference.
+func preferredSimulator(name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	if !regexpUserName.MatchString(name) {
+		return "", &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("invalid user name")}
+	}
+	u, err := loadUser(name)
+	if err != nil {
+		return "", err
+	}
+	if u.Simulator.Device == "" {
+		return "", nil
+	}
+	return findSimulator(u.Simulator.Device, u.Simulator.Runtime)
+}
+
+func loadUsers() ([]*User, error) {
+	fi, err := ioutil.ReadDir(filepath.Join(dataDir, "users"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	users := []*User{}
+	for _, f := range fi {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		u, err := loadUser(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+func listUsers(w http.ResponseWriter, r *http.Request) error {
+	users, err := loadUsers()
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, users)
+}
+
+func getUser(w http.ResponseWriter, r *http.Request) error {
+	name := mux.Vars(r)["name"]
+	if !regexpUserName.MatchString(name) {
+		return errNotFound
+	}
+	u, err := loadUser(name)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, u)
+}
+
+func setUser(w http.ResponseWriter, r *http.Request) error {
+	name := mux.Vars(r)["name"]
+	if !regexpUserName.MatchString(name) {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("invalid user name")}
+	}
+	u, err := loadUser(name)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(u); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	u.Name = name
+	if u.Email != "" && !strings.Contains(u.Email, "@") {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("invalid email address")}
+	}
+	if u.Simulator.Runtime != "" && u.Simulator.Device == "" {
+		return &httputil.HTTPError{http.StatusBadRequest,
+			errors.New("simulator runtime requires a device")}
+	}
+	if err := saveUser(u); err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, u)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/launchmango/backend/httputil"
+)
+
+// Steps of warming up a freshly cloned repository.
+const (
+	warmDependencies = "dependencies" // install pods and resolve packages
+	warmIndex        = "index"        // build with Xcode's index store on
+
+	readinessPreparing = "preparing"
+	readinessReady     = "ready"
+	readinessFailed    = "failed"
+
+	stepSkipped = "skipped"
+)
+
+// Readiness tells whether a repository cloned with warm steps is ready to
+// open and build: preparing while the steps run, then ready, or failed if
+// any of them did.
+type Readiness struct {
+	State    string           `json:"state"`
+	Steps    []*ReadinessStep `json:"steps"`
+	Started  time.Time        `json:"started"`
+	Finished *time.Time       `json:"finished,omitempty"`
+}
+
+// ReadinessStep is one warm step: queued, running, succeeded, failed, or
+// skipped when there is nothing for it to do. Job or Build is what runs
+// it.
+type ReadinessStep struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+	Job   string `json:"job,omitempty"`
+	Build string `json:"build,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func (rd *Readiness) copy() *Readiness {
+	c := *rd
+	c.Steps = make([]*ReadinessStep, len(rd.Steps))
+	for i, s := range rd.Steps {
+		step := *s
+		c.Steps[i] = &step
+	}
+	return &c
+}
+
+func validateWarmSteps(steps []string) error {
+	for _, s := range steps {
+		if s != warmDependencies && s != warmIndex {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				fmt.Errorf("unknown warm step %q (want dependencies or index)", s)}
+		}
+	}
+	return nil
+}
+
+// recordReadiness keeps a copy of rd as the repository's readiness.
+func recordReadiness(id string, rd *Readiness) {
+	c := rd.copy()
+	if _, err := updateRepoMeta(id, func(m *RepoMeta) {
+		m.Readiness = c
+	}); err != nil {
+		log.Printf("repository %s: recording readiness: %v", id, err)
+	}
+}
+
+// startWarmup runs the warm steps for a freshly cloned repository in the
+// background, in order, returning its readiness as they start. The status
+// of resolving its dependencies is returned too, if that is a step.
+func startWarmup(id string, steps []string) (*Readiness, *DependencyStatus) {
+	rd := &Readiness{State: readinessPreparing, Started: time.Now()}
+	for _, name := range steps {
+		rd.Steps = append(rd.Steps, &ReadinessStep{Name: name, State: jobQueued})
+	}
+	var deps *DependencyStatus
+	var depsJob *Job
+	for _, s := range rd.Steps {
+		if s.Name == warmDependencies {
+			if deps, depsJob = startDependencies(id); depsJob != nil {
+				s.Job = depsJob.ID
+			}
+		}
+	}
+	recordReadiness(id, rd)
+	started := rd.copy()
+	go warmUp(id, rd, depsJob)
+	return started, deps
+}
+
+func warmUp(id string, rd *Readiness, depsJob *Job) {
+	failed := false
+	for _, s := range rd.Steps {
+		switch {
+		case s.Name == warmDependencies && depsJob == nil:
+			s.State = stepSkipped
+		case s.Name == warmDependencies:
+			s.State = jobRunning
+			recordReadiness(id, rd)
+			<-depsJob.done
+			depsJob.mu.Lock()
+			s.State, s.Error = depsJob.State, depsJob.Error
+			depsJob.mu.Unlock()
+		case s.Name == warmIndex && failed:
+			s.State, s.Error = stepSkipped, "an earlier step failed"
+		case s.Name == warmIndex:
+			b, err := indexRepo(id)
+			if err != nil {
+				s.State, s.Error = jobFailed, redact(err.Error())
+				break
+			}
+			s.State, s.Build = jobRunning, b.ID
+			recordReadiness(id, rd)
+			activeBuildsMu.Lock()
+			q := activeBuilds[b.ID]
+			activeBuildsMu.Unlock()
+			if q != nil {
+				<-q.done
+			}
+			b.mu.Lock()
+			s.State = jobSucceeded
+			if b.State != buildSucceeded {
+				s.State, s.Error = jobFailed, b.Error
+			}
+			b.mu.Unlock()
+		}
+		failed = failed || s.State == jobFailed
+		recordReadiness(id, rd)
+	}
+	finished := time.Now()
+	rd.Finished = &finished
+	rd.State = readinessReady
+	if failed {
+		rd.State = readinessFailed
+	}
+	recordReadiness(id, rd)
+}
+
+// indexRepo queues a build of the repository with its default choices
+// that also fills Xcode's index store, so the project opens indexed.
+func indexRepo(id string) (*Build, error) {
+	return queueDefaultBuild(id, "", "COMPILER_INDEX_STORE_ENABLE=YES")
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+var (
+	// workspace is the directory repositories are cloned into, set with
+	// --workspace or WORKSPACE. The server runs in it, since repository IDs
+	// are used as paths relative to the working directory throughout, and
+	// keeps its data directory there too.
+	workspace string
+
+	// assetDir is the directory the server was started in, where the app's
+	// pages and scripts are.
+	assetDir string
+)
+
+// initWorkspace creates the workspace if needed and moves into it.
+func initWorkspace(dir string) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	assetDir = wd
+	if dir == "" {
+		dir = wd
+	}
+	if workspace, err = filepath.Abs(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(workspace, 0755); err != nil {
+		return err
+	}
+	return os.Chdir(workspace)
+}
+
+// assetPath returns the path of one of the app's files.
+func assetPath(name string) string {
+	return filepath.Join(assetDir, name)
+}
+
+// repoExists reports whether id names a repository in the workspace. IDs
+// that aren't of the form of a repository ID, like "..", never do.
+func repoExists(id string) bool {
+	if !validRepoID(id) {
+		return false
+	}
+	fi, err := os.Stat(id)
+	return err == nil && fi.IsDir()
+}
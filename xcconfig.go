@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+var (
+	regexpXCConfigSetting = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_]*)((?:\[[^\]]*\])*)\s*=\s*(.*)$`)
+	regexpXCConfigInclude = regexp.MustCompile(`^\s*#include(\?)?\s*"([^"]+)"`)
+	regexpXCConfigKey     = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\[[^\]\n]*\])*$`)
+	regexpInherited       = regexp.MustCompile(`\$[({]inherited[)}]`)
+
+	errNotXCConfig = &httputil.HTTPError{http.StatusBadRequest,
+		errors.New("not an .xcconfig file")}
+)
+
+// maxXCConfigDepth bounds the chain of includes followed.
+const maxXCConfigDepth = 16
+
+// XCConfigSetting is an assignment in an xcconfig file. Condition is the
+// bracketed part of keys like OTHER_LDFLAGS[sdk=iphoneos*].
+type XCConfigSetting struct {
+	Key       string `json:"key"`
+	Condition string `json:"condition,omitempty"`
+	Value     string `json:"value"`
+	Line      int    `json:"line"`
+}
+
+type XCConfigInclude struct {
+	Path     string `json:"path"`
+	Optional bool   `json:"optional,omitempty"`
+	Missing  bool   `json:"missing,omitempty"`
+}
+
+// XCConfig is an xcconfig file's own settings and includes, and Resolved,
+// the settings in effect once includes are followed and $(inherited) is
+// replaced by the value it overrides. Conditional settings are resolved
+// under their full key.
+type XCConfig struct {
+	Path     string             `json:"path"`
+	ETag     string             `json:"etag"`
+	Includes []*XCConfigInclude `json:"includes"`
+	Settings []*XCConfigSetting `json:"settings"`
+	Resolved map[string]string  `json:"resolved"`
+}
+
+// xcconfigLine parses a line of an xcconfig file, returning the setting it
+// makes, if any. Everything after // is a comment, even inside values.
+func xcconfigLine(line string) *XCConfigSetting {
+	if i := strings.Index(line, "//"); i >= 0 {
+		line = line[:i]
+	}
+	m := regexpXCConfigSetting.FindStringSubmatch(line)
+	if m == nil {
+		return nil
+	}
+	value := strings.TrimSuffix(strings.TrimSpace(m[3]), ";")
+	return &XCConfigSetting{Key: m[1], Condition: m[2], Value: strings.TrimSpace(value)}
+}
+
+func parseXCConfig(id, rel string) (*XCConfig, error) {
+	p, err := repoPath(id, rel)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil || fi.IsDir() {
+		return nil, errNotFound
+	}
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &XCConfig{Path: repoRel(id, p), ETag: fileETag(fi),
+		Includes: []*XCConfigInclude{}, Settings: []*XCConfigSetting{},
+		Resolved: make(map[string]string)}
+	for i, line := range strings.Split(string(b), "\n") {
+		if m := regexpXCConfigInclude.FindStringSubmatch(line); m != nil {
+			inc := &XCConfigInclude{Path: m[2], Optional: m[1] == "?"}
+			if p, err := xcconfigInclude(id, cfg.Path, m[2]); err != nil || !fileExists(p) {
+				inc.Missing = true
+			}
+			cfg.Includes = append(cfg.Includes, inc)
+		} else if s := xcconfigLine(line); s != nil {
+			s.Line = i + 1
+			cfg.Settings = append(cfg.Settings, s)
+		}
+	}
+	if err := resolveXCConfig(id, cfg.Path, cfg.Resolved, nil); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// xcconfigInclude returns the path of a file included by the xcconfig at
+// rel. Includes of files outside the repository, like the <...> ones of
+// CocoaPods, fail.
+func xcconfigInclude(id, rel, include string) (string, error) {
+	if strings.HasPrefix(include, "<") || filepath.IsAbs(include) {
+		return "", errPathEscapes
+	}
+	return repoPath(id, path.Join(path.Dir(rel), include))
+}
+
+// resolveXCConfig applies the settings of the xcconfig at rel to resolved,
+// following its includes first where they appear. Missing files are
+// skipped, as Xcode does with a warning.
+func resolveXCConfig(id, rel string, resolved map[string]string, seen []string) error {
+	if len(seen) > maxXCConfigDepth {
+		return &httputil.HTTPError{http.StatusUnprocessableEntity,
+			errors.New("xcconfig includes nest too deeply")}
+	}
+	for _, s := range seen {
+		if s == rel {
+			return &httputil.HTTPError{http.StatusUnprocessableEntity,
+				fmt.Errorf("%s includes itself", rel)}
+		}
+	}
+	seen = append(seen, rel)
+	p, err := repoPath(id, rel)
+	if err != nil {
+		return nil
+	}
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if m := regexpXCConfigInclude.FindStringSubmatch(line); m != nil {
+			inc, err := xcconfigInclude(id, rel, m[2])
+			if err != nil {
+				continue
+			}
+			if err := resolveXCConfig(id, repoRel(id, inc), resolved, seen); err != nil {
+				return err
+			}
+		} else if s := xcconfigLine(line); s != nil {
+			key := s.Key + s.Condition
+			resolved[key] = strings.TrimSpace(regexpInherited.ReplaceAllLiteralString(s.Value, resolved[key]))
+		}
+	}
+	return nil
+}
+
+// listXCConfigs lists the xcconfig files in the repository, leaving out
+// the directories excluded from the tree, like Pods.
+func listXCConfigs(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	defer rlockRepo(id)()
+	paths := []string{}
+	err := filepath.Walk(id, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel := repoRel(id, p)
+		if rel == "." {
+			return nil
+		}
+		if hasGitDir(rel) || skipTreePath(rel) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.IsDir() && filepath.Ext(p) == ".xcconfig" {
+			paths = append(paths, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+	return renderJSON(w, http.StatusOK, paths)
+}
+
+func getXCConfig(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	rel := mux.Vars(r)["path"]
+	if path.Ext(rel) != ".xcconfig" {
+		return errNotXCConfig
+	}
+	defer rlockRepo(id)()
+	cfg, err := parseXCConfig(id, rel)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, cfg)
+}
+
+// updateXCConfig sets and removes settings of an xcconfig file. Keys may
+// carry a condition, like KEY[config=Debug]. A setting already in the file
+// is changed where it is, keeping comments and order, and new ones are
+// appended. With If-Match, the file must not have changed since it was
+// read.
+func updateXCConfig(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	rel := mux.Vars(r)["path"]
+	if path.Ext(rel) != ".xcconfig" {
+		return errNotXCConfig
+	}
+	var req struct {
+		Set   map[string]string `json:"set"`
+		Unset []string          `json:"unset"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return &httputil.HTTPError{http.StatusBadRequest, err}
+	}
+	for key, value := range req.Set {
+		if !regexpXCConfigKey.MatchString(key) {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				fmt.Errorf("invalid setting %q", key)}
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				fmt.Errorf("%s: values must be on one line", key)}
+		}
+		if strings.Contains(value, "//") {
+			return &httputil.HTTPError{http.StatusBadRequest,
+				fmt.Errorf("%s: // starts a comment in xcconfig files; write /$()/ instead", key)}
+		}
+	}
+	unset := make(map[string]bool)
+	for _, key := range req.Unset {
+		unset[key] = true
+	}
+
+	defer rlockRepo(id)()
+	p, err := repoPath(id, rel)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(p)
+	if err != nil || fi.IsDir() {
+		return errNotFound
+	}
+	if err := checkOwners(r, id, repoRel(id, p)); err != nil {
+		return err
+	}
+	etag := fileETag(fi)
+	if h := r.Header.Get("If-Match"); h != "" && h != "*" && h != etag {
+		return errPreconditionFailed
+	}
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	done := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		s := xcconfigLine(line)
+		if s == nil {
+			lines = append(lines, line)
+			continue
+		}
+		key := s.Key + s.Condition
+		value, set := req.Set[key]
+		switch {
+		case unset[key]:
+		case set:
+			lines = append(lines, key+" = "+value)
+			done[key] = true
+		default:
+			lines = append(lines, line)
+		}
+	}
+	var added []string
+	for key := range req.Set {
+		if !done[key] {
+			added = append(added, key)
+		}
+	}
+	sort.Strings(added)
+	for _, key := range added {
+		lines = append(lines, key+" = "+req.Set[key])
+	}
+
+	src, err := textReader(id, repoRel(id, p), p,
+		strings.NewReader(strings.Join(lines, "\n")+"\n"))
+	if err != nil {
+		return err
+	}
+	_, err = writeUpload(p, src, func() error {
+		fi, err := os.Stat(p)
+		if err != nil || fileETag(fi) != etag {
+			return errPreconditionFailed
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	invalidateTreeCache(id)
+	cfg, err := parseXCConfig(id, rel)
+	if err != nil {
+		return err
+	}
+	publish(&Event{Type: eventRepoEdited, Repo: id,
+		Data: map[string]interface{}{"action": "xcconfig", "paths": []string{cfg.Path}}})
+	return renderJSON(w, http.StatusOK, cfg)
+}
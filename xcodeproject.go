@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/launchmango/backend/httputil"
+)
+
+// xcodeListTimeout bounds xcodebuild -list, which resolves Swift packages
+// first and can stall on the network.
+const xcodeListTimeout = 2 * time.Minute
+
+// XcodeProject describes what can be built in a directory: its workspace,
+// if any, and project, with their schemes, and the project's targets and
+// build configurations. Paths are relative to the directory.
+type XcodeProject struct {
+	Workspace      string   `json:"workspace,omitempty"`
+	Project        string   `json:"project,omitempty"`
+	Schemes        []string `json:"schemes"`
+	Targets        []string `json:"targets"`
+	Configurations []string `json:"configurations"`
+}
+
+// xcodeContainers returns the workspace and project in dir. A workspace
+// is preferred by xcodebuild since it brings in CocoaPods and the like;
+// those inside projects are implicit and left out.
+func xcodeContainers(dir string) (workspace, project string) {
+	if m, _ := filepath.Glob(filepath.Join(dir, "*.xcworkspace")); len(m) > 0 {
+		workspace = filepath.Base(m[0])
+	}
+	if m, _ := filepath.Glob(filepath.Join(dir, "*.xcodeproj")); len(m) > 0 {
+		project = filepath.Base(m[0])
+	}
+	return workspace, project
+}
+
+// containerArgs returns the xcodebuild arguments choosing what to build in
+// dir, which are needed alongside -scheme when there are several.
+func containerArgs(dir string) []string {
+	workspace, project := xcodeContainers(dir)
+	switch {
+	case workspace != "":
+		return []string{"-workspace", workspace}
+	case project != "":
+		return []string{"-project", project}
+	}
+	return nil
+}
+
+// xcodeList runs xcodebuild -list on a workspace or project in dir.
+func xcodeList(dir string, xcode *XcodeInstall, flag, name string, v interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), xcodeListTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "xcodebuild", "-list", "-json", flag, name)
+	cmd.Dir = dir
+	cmd.Stderr = &stderr
+	if xcode != nil {
+		cmd.Env = append(os.Environ(), "DEVELOPER_DIR="+xcode.DeveloperDir())
+	}
+	out, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return &httputil.HTTPError{http.StatusGatewayTimeout,
+			errors.New("xcodebuild -list took too long")}
+	}
+	if err != nil {
+		return &httputil.HTTPError{http.StatusUnprocessableEntity,
+			fmt.Errorf("xcodebuild -list: %s", strings.TrimSpace(stderr.String()))}
+	}
+	return json.Unmarshal(out, v)
+}
+
+func readXcodeProject(dir string, xcode *XcodeInstall) (*XcodeProject, error) {
+	workspace, project := xcodeContainers(dir)
+	if workspace == "" && project == "" {
+		return nil, errNoXcodeProject
+	}
+	info := &XcodeProject{Workspace: workspace, Project: project,
+		Schemes: []string{}, Targets: []string{}, Configurations: []string{}}
+	if project != "" {
+		var list struct {
+			Project struct {
+				Schemes        []string `json:"schemes"`
+				Targets        []string `json:"targets"`
+				Configurations []string `json:"configurations"`
+			} `json:"project"`
+		}
+		if err := xcodeList(dir, xcode, "-project", project, &list); err != nil {
+			return nil, err
+		}
+		if list.Project.Schemes != nil {
+			info.Schemes = list.Project.Schemes
+		}
+		if list.Project.Targets != nil {
+			info.Targets = list.Project.Targets
+		}
+		if list.Project.Configurations != nil {
+			info.Configurations = list.Project.Configurations
+		}
+	}
+	if workspace != "" {
+		// A workspace's schemes include those of every project in it.
+		var list struct {
+			Workspace struct {
+				Schemes []string `json:"schemes"`
+			} `json:"workspace"`
+		}
+		if err := xcodeList(dir, xcode, "-workspace", workspace, &list); err != nil {
+			return nil, err
+		}
+		if list.Workspace.Schemes != nil {
+			info.Schemes = list.Workspace.Schemes
+		}
+	}
+	return info, nil
+}
+
+// getXcodeProject lists the schemes, targets and configurations that can
+// be passed to the build endpoint, for the repository or with project one
+// of its projects.
+func getXcodeProject(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !repoExists(id) {
+		return errNotFound
+	}
+	project, err := findProject(id, r.URL.Query().Get("project"))
+	if err != nil {
+		return err
+	}
+	xcode, err := resolveXcode(id, r.URL.Query().Get("xcode"))
+	if err != nil {
+		return err
+	}
+	defer rlockRepo(id)()
+	info, err := readXcodeProject(projectDir(id, project), xcode)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, http.StatusOK, info)
+}
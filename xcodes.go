@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/launchmango/backend/httputil"
+)
+
+type XcodeInstall struct {
+	Path     string `json:"path"`
+	Version  string `json:"version"`
+	Build    string `json:"build"`
+	Selected bool   `json:"selected"`
+}
+
+// DeveloperDir is the value for DEVELOPER_DIR that selects this Xcode.
+func (x *XcodeInstall) DeveloperDir() string {
+	return filepath.Join(x.Path, "Contents", "Developer")
+}
+
+func selectedXcodePath() string {
+	out, err := exec.Command("xcode-select", "-p").Output()
+	if err != nil {
+		return ""
+	}
+	// xcode-select prints the Contents/Developer directory of the app.
+	return filepath.Dir(filepath.Dir(strings.TrimSpace(string(out))))
+}
+
+// installedXcodes returns the Xcode apps in /Applications plus the one
+// selected with xcode-select, which may live elsewhere.
+func installedXcodes() []*XcodeInstall {
+	paths, _ := filepath.Glob("/Applications/Xcode*.app")
+	selected := selectedXcodePath()
+	if selected != "" && strings.HasSuffix(selected, ".app") {
+		found := false
+		for _, p := range paths {
+			found = found || p == selected
+		}
+		if !found {
+			paths = append(paths, selected)
+		}
+	}
+
+	xcodes := []*XcodeInstall{}
+	for _, p := range paths {
+		plist := filepath.Join(p, "Contents", "version.plist")
+		version, err := plistValue(plist, "CFBundleShortVersionString")
+		if err != nil {
+			continue
+		}
+		build, _ := plistValue(plist, "ProductBuildVersion")
+		xcodes = append(xcodes, &XcodeInstall{
+			Path:     p,
+			Version:  version,
+			Build:    build,
+			Selected: p == selected,
+		})
+	}
+	sort.Slice(xcodes, func(i, j int) bool {
+		return versionLess(xcodes[j].Version, xcodes[i].Version)
+	})
+	return xcodes
+}
+
+// versionLess compares dotted numeric versions such as "9.4" < "15.2".
+func versionLess(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, _ := strconv.Atoi(as[i])
+		y, _ := strconv.Atoi(bs[i])
+		if x != y {
+			return x < y
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// resolveXcode finds the Xcode for a build: want (a version such as
+// "15.2", a build number or an app path) if given, else the version pinned
+// in the repository settings, else the selected one.
+func resolveXcode(id, want string) (*XcodeInstall, error) {
+	if want == "" {
+		settings, err := loadRepoSettings(id)
+		if err != nil {
+			return nil, err
+		}
+		want = settings.Xcode
+	}
+	xcodes := installedXcodes()
+	for _, x := range xcodes {
+		if want == "" && x.Selected ||
+			want != "" && (x.Version == want || x.Build == want || x.Path == want) {
+			return x, nil
+		}
+	}
+	if want == "" {
+		return nil, nil
+	}
+	return nil, &httputil.HTTPError{http.StatusBadRequest,
+		fmt.Errorf("Xcode %s is not installed", want)}
+}
+
+// xcodebuild runs xcodebuild in the repository with the Xcode chosen for
+// the build.
+func xcodebuild(id string, opts *BuildOptions, out io.Writer, arg ...string) error {
+	if opts.xcconfig != "" {
+		arg = append([]string{"-xcconfig", opts.xcconfig}, arg...)
+	}
+	arg = append(arg, opts.Flags...)
+	cmd := exec.Command("xcodebuild", arg...)
+	cmd.Dir = id
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.Env = append(os.Environ(), opts.env...)
+	if opts.xcode != nil {
+		cmd.Env = append(cmd.Env, "DEVELOPER_DIR="+opts.xcode.DeveloperDir())
+	}
+	return runGroup(opts.context(), cmd)
+}
+
+func listXcodes(w http.ResponseWriter, r *http.Request) error {
+	return renderJSON(w, http.StatusOK, installedXcodes())
+}